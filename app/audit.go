@@ -0,0 +1,104 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditBodyLimit is how much of a request body is kept in the audit log
+const auditBodyLimit = 4096
+
+// AuditEntry records a change made through the API
+type AuditEntry struct {
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request-id"`
+	Site      string          `json:"site,omitempty"`
+	Principal string          `json:"principal"`
+	Auth      string          `json:"auth"`
+	Remote    string          `json:"remote"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Query     string          `json:"query,omitempty"`
+	Status    int             `json:"status"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+// auditLog appends entries to a file as JSON lines
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+func (al *auditLog) write(e *AuditEntry) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	_, err = al.file.Write(append(d, '\n'))
+	return err
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := lb.limit - lb.Len(); room < len(p) {
+		p = p[:room]
+		lb.truncated = true
+	}
+	lb.Buffer.Write(p)
+	return n, nil
+}
+
+// auditBody is the request body if it was small JSON
+func auditBody(lb *limitedBuffer) json.RawMessage {
+	if lb.truncated || lb.Len() == 0 || !json.Valid(lb.Bytes()) {
+		return nil
+	}
+	return json.RawMessage(lb.Bytes())
+}
+
+// audit logs a change, and appends it to the audit log if there is one
+func (a *App) audit(e *AuditEntry) {
+	log.WithFields(log.Fields{
+		"request-id": e.RequestID,
+		"site":       e.Site,
+		"principal":  e.Principal,
+		"auth":       e.Auth,
+		"remote":     e.Remote,
+		"method":     e.Method,
+		"path":       e.Path,
+		"query":      e.Query,
+		"status":     e.Status,
+		"body":       string(e.Body),
+	}).Info("audit")
+
+	if a.auditLog == nil {
+		return
+	}
+	err := a.auditLog.write(e)
+	if err != nil {
+		log.WithError(err).Error("unable to write audit log")
+	}
+}
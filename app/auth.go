@@ -0,0 +1,303 @@
+package app
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scope is what a principal is allowed to do, each includes the ones before
+const (
+	// ScopeRead can look at bulbs, curves, scenes and events
+	ScopeRead = "read"
+	// ScopeControl can also set and release overrides, activate scenes and
+	// trigger occupancy
+	ScopeControl = "control"
+	// ScopeAdmin can also edit curves and delete scenes
+	ScopeAdmin = "admin"
+)
+
+var scopeLevels = map[string]int{
+	ScopeRead:    1,
+	ScopeControl: 2,
+	ScopeAdmin:   3,
+}
+
+// Grant is the scope and groups a credential is allowed, no groups means
+// every group
+type Grant struct {
+	Scope  string   `json:"scope"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// AuthToken is a static bearer token, read from TokenFile if Token is empty
+// so it can live in a mounted secret
+type AuthToken struct {
+	Name      string `json:"name"`
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token-file,omitempty"`
+	Grant
+}
+
+// unknownUserHash is checked against for users who don't exist, it's at the
+// cost lifx passwd uses
+const unknownUserHash = "$2a$10$XumIdrfvyxKatl0vuSZ7seF1TvseJCVXoefCS17ngsd67kF5BTA0m"
+
+// AuthUser is an HTTP basic user with a bcrypt password hash, see lifx passwd
+type AuthUser struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password-hash"`
+	Grant
+}
+
+// AuthCertificate grants a TLS client certificate by its subject common name
+type AuthCertificate struct {
+	CommonName string `json:"common-name"`
+	Grant
+}
+
+// AuthTLS serves the API over TLS, asking for client certificates signed by
+// ClientCA if it is set
+type AuthTLS struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client-ca,omitempty"`
+}
+
+// AuthConfig is the auth.json file, without it the API is open
+type AuthConfig struct {
+	Tokens       []*AuthToken       `json:"tokens,omitempty"`
+	Users        []*AuthUser        `json:"users,omitempty"`
+	Certificates []*AuthCertificate `json:"certificates,omitempty"`
+	TLS          *AuthTLS           `json:"tls,omitempty"`
+
+	// AuditLog is a file to append changes to as JSON lines, they are
+	// logged either way
+	AuditLog string `json:"audit-log,omitempty"`
+}
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	Name   string   `json:"name"`
+	Method string   `json:"method"`
+	Scope  string   `json:"scope"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// anonymous is the principal for every request when auth is off
+var anonymous = &Principal{Name: "anonymous", Method: "none", Scope: ScopeAdmin}
+
+func (g *Grant) validate() error {
+	if _, ok := scopeLevels[g.Scope]; !ok {
+		return fmt.Errorf("scope must be %s, %s or %s", ScopeRead, ScopeControl, ScopeAdmin)
+	}
+	return nil
+}
+
+func (ac *AuthConfig) validate() error {
+	for _, t := range ac.Tokens {
+		if t.Name == "" {
+			return errors.New("tokens need a name")
+		}
+		if t.Token == "" && t.TokenFile != "" {
+			data, err := ioutil.ReadFile(t.TokenFile)
+			if err != nil {
+				return fmt.Errorf("token %s: %s", t.Name, err)
+			}
+			t.Token = strings.TrimSpace(string(data))
+		}
+		if t.Token == "" {
+			return fmt.Errorf("token %s: token or token-file is required", t.Name)
+		}
+		err := t.validate()
+		if err != nil {
+			return fmt.Errorf("token %s: %s", t.Name, err)
+		}
+	}
+	for _, u := range ac.Users {
+		if u.Name == "" {
+			return errors.New("users need a name")
+		}
+		_, err := bcrypt.Cost([]byte(u.PasswordHash))
+		if err != nil {
+			return fmt.Errorf("user %s: password-hash: %s", u.Name, err)
+		}
+		err = u.validate()
+		if err != nil {
+			return fmt.Errorf("user %s: %s", u.Name, err)
+		}
+	}
+	for _, c := range ac.Certificates {
+		if c.CommonName == "" {
+			return errors.New("certificates need a common-name")
+		}
+		err := c.validate()
+		if err != nil {
+			return fmt.Errorf("certificate %s: %s", c.CommonName, err)
+		}
+	}
+	if len(ac.Certificates) > 0 && (ac.TLS == nil || ac.TLS.ClientCA == "") {
+		return errors.New("certificates need tls with a client-ca")
+	}
+	return nil
+}
+
+// loadAuth reads the optional auth file
+func (a *App) loadAuth() error {
+	data, err := ioutil.ReadFile(a.authPath)
+	if os.IsNotExist(err) {
+		log.Warn("no auth configured, the API is open to anybody who can reach it")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ac := &AuthConfig{}
+	err = json.Unmarshal(data, ac)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.authPath, err)
+	}
+	err = ac.validate()
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.authPath, err)
+	}
+
+	if ac.AuditLog != "" {
+		a.auditLog, err = openAuditLog(ac.AuditLog)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.auth = ac
+	log.WithFields(log.Fields{
+		"path":         a.authPath,
+		"tokens":       len(ac.Tokens),
+		"users":        len(ac.Users),
+		"certificates": len(ac.Certificates),
+	}).Info("loaded auth")
+
+	return nil
+}
+
+func newPrincipal(name string, method string, g Grant) *Principal {
+	return &Principal{Name: name, Method: method, Scope: g.Scope, Groups: g.Groups}
+}
+
+// authenticate works out who made req, nil if they couldn't be identified
+func (ac *AuthConfig) authenticate(req *http.Request) *Principal {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range ac.Certificates {
+			if c.CommonName == cn {
+				return newPrincipal(cn, "certificate", c.Grant)
+			}
+		}
+	}
+
+	authorization := req.Header.Get("authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+		for _, t := range ac.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				return newPrincipal(t.Name, "token", t.Grant)
+			}
+		}
+		return nil
+	}
+
+	if name, password, ok := req.BasicAuth(); ok {
+		for _, u := range ac.Users {
+			if u.Name != name {
+				continue
+			}
+			if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
+				return newPrincipal(u.Name, "basic", u.Grant)
+			}
+			return nil
+		}
+		// take as long as a wrong password would, so response times don't
+		// give away which users exist
+		bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte(password))
+	}
+
+	return nil
+}
+
+// tlsConfig builds the server's TLS config, requesting client certificates
+// when there's a CA to check them against
+func (ac *AuthConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(ac.TLS.Cert, ac.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if ac.TLS.ClientCA != "" {
+		data, err := ioutil.ReadFile(ac.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", ac.TLS.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Allows reports whether the principal has at least scope
+func (p *Principal) Allows(scope string) bool {
+	return scopeLevels[p.Scope] >= scopeLevels[scope]
+}
+
+// Permits reports whether the principal may control bulbs in group
+func (p *Principal) Permits(group string) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, g := range p.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// publicPaths are left open so probes and scrapes don't need credentials
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// requiredScope is the scope needed for a request, by method and path as
+// the route isn't known until after the root middleware
+func requiredScope(method string, path string) string {
+	if publicPaths[path] {
+		return ""
+	}
+	if method == "GET" || method == "HEAD" || method == "OPTIONS" {
+		return ScopeRead
+	}
+	path = strings.TrimPrefix(path, "/api/v2")
+	if strings.HasPrefix(path, "/curves") {
+		return ScopeAdmin
+	}
+	if strings.HasPrefix(path, "/scenes/") && method == "DELETE" {
+		return ScopeAdmin
+	}
+	return ScopeControl
+}
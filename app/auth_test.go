@@ -0,0 +1,195 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func authApp(t *testing.T) *App {
+	a, _ := testApp()
+	report(a, 32768, 5000)
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "tablet")
+	err = ioutil.WriteFile(tokenFile, []byte("tablet-secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac := &AuthConfig{
+		Tokens: []*AuthToken{
+			{Name: "dashboard", Token: "dashboard-secret", Grant: Grant{Scope: ScopeRead}},
+			{Name: "tablet", TokenFile: tokenFile, Grant: Grant{Scope: ScopeControl, Groups: []string{"Bedroom"}}},
+			{Name: "kitchen-admin", Token: "kitchen-secret", Grant: Grant{Scope: ScopeAdmin, Groups: []string{"Kitchen"}}},
+		},
+		Users: []*AuthUser{
+			{Name: "adam", PasswordHash: string(hash), Grant: Grant{Scope: ScopeAdmin}},
+		},
+		Certificates: []*AuthCertificate{
+			{CommonName: "homeassistant", Grant: Grant{Scope: ScopeControl}},
+		},
+		TLS:      &AuthTLS{ClientCA: "ca.pem"},
+		AuditLog: filepath.Join(dir, "audit.log"),
+	}
+	err = ac.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.auth = ac
+	a.auditLog, err = openAuditLog(ac.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func request(a *App, method string, path string, body string, authorization string, cn string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		req.Header.Set("authorization", authorization)
+	}
+	if cn != "" {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: cn}},
+		}}}
+	}
+	rw := httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestAuthScopes(t *testing.T) {
+	a := authApp(t)
+	defer os.RemoveAll(filepath.Dir(a.auth.AuditLog))
+	override := `{"brightness": 1000, "duration": "1h"}`
+
+	rw := request(a, "GET", "/api/v2/bulbs", "", "", "")
+	expectAPIError(t, rw, 401)
+	if len(rw.Header()["Www-Authenticate"]) != 2 {
+		t.Fatalf("expected bearer and basic challenges, got: %v", rw.Header()["Www-Authenticate"])
+	}
+	expectAPIError(t, request(a, "GET", "/api/v2/bulbs", "", "Bearer wrong", ""), 401)
+	if rw := request(a, "GET", "/bulbs", "", "Basic YWRhbTpudW1iZXJz", ""); rw.Code != 401 {
+		t.Fatalf("expected %d, got: %d", 401, rw.Code)
+	}
+
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		if rw := request(a, "GET", path, "", "", ""); rw.Code == 401 {
+			t.Fatalf("expected %s to be public", path)
+		}
+	}
+
+	rw = request(a, "GET", "/api/v2/bulbs", "", "Bearer dashboard-secret", "")
+	if rw.Code != 200 {
+		t.Fatalf("expected %d, got: %d", 200, rw.Code)
+	}
+	expectAPIError(t, request(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", override, "Bearer dashboard-secret", ""), 403)
+
+	rw = request(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", override, "", "homeassistant")
+	if rw.Code != 201 {
+		t.Fatalf("expected %d, got: %d %s", 201, rw.Code, rw.Body.String())
+	}
+	expectAPIError(t, request(a, "PUT", "/api/v2/curves/default", "{}", "", "homeassistant"), 403)
+
+	req := httptest.NewRequest("DELETE", "/api/v2/bulbs/d073d50035f7/override", nil)
+	req.SetBasicAuth("adam", "hunter2")
+	rw = httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	if rw.Code != 204 {
+		t.Fatalf("expected %d, got: %d %s", 204, rw.Code, rw.Body.String())
+	}
+}
+
+func TestAuthGroups(t *testing.T) {
+	a := authApp(t)
+	defer os.RemoveAll(filepath.Dir(a.auth.AuditLog))
+	b := a.GetBulb("d073d50035f7")
+	override := `{"brightness": 1000, "duration": "1h"}`
+
+	expectAPIError(t, request(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", override, "Bearer tablet-secret", ""), 403)
+	expectAPIError(t, request(a, "POST", "/api/v2/groups/Kitchen/occupancy", "", "Bearer tablet-secret", ""), 403)
+
+	// bulk changes skip the groups the tablet can't control
+	rw := request(a, "POST", "/api/v2/overrides?filter=all", override, "Bearer tablet-secret", "")
+	if rw.Code != 201 || b.ManualStateBrightness != nil {
+		t.Fatalf("expected the kitchen to be left alone, got: %d %s", rw.Code, rw.Body.String())
+	}
+
+	// but it can still see them
+	rw = request(a, "GET", "/api/v2/bulbs/d073d50035f7", "", "Bearer tablet-secret", "")
+	if rw.Code != 200 {
+		t.Fatalf("expected %d, got: %d", 200, rw.Code)
+	}
+
+	expectAPIError(t, request(a, "PUT", "/api/v2/curves/default", "{}", "Bearer kitchen-secret", ""), 403)
+	rw = request(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", override, "Bearer kitchen-secret", "")
+	if rw.Code != 201 {
+		t.Fatalf("expected %d, got: %d %s", 201, rw.Code, rw.Body.String())
+	}
+}
+
+func TestAudit(t *testing.T) {
+	a := authApp(t)
+	defer os.RemoveAll(filepath.Dir(a.auth.AuditLog))
+
+	request(a, "GET", "/api/v2/bulbs", "", "Bearer dashboard-secret", "")
+	request(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", `{"brightness": 1000, "duration": "1h"}`, "", "homeassistant")
+
+	data, err := ioutil.ReadFile(a.auth.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected %d, got: %d", 1, len(lines))
+	}
+	e := &AuditEntry{}
+	err = json.Unmarshal([]byte(lines[0]), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Principal != "homeassistant" || e.Auth != "certificate" || e.Status != 201 || string(e.Body) != `{"brightness":1000,"duration":"1h"}` {
+		t.Fatalf("unexpected audit entry: %s", lines[0])
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	for _, ac := range []*AuthConfig{
+		{Tokens: []*AuthToken{{Name: "x", Token: "y", Grant: Grant{Scope: "root"}}}},
+		{Tokens: []*AuthToken{{Name: "x", Grant: Grant{Scope: ScopeRead}}}},
+		{Users: []*AuthUser{{Name: "x", PasswordHash: "hunter2", Grant: Grant{Scope: ScopeRead}}}},
+		{Certificates: []*AuthCertificate{{CommonName: "x", Grant: Grant{Scope: ScopeRead}}}},
+	} {
+		if ac.validate() == nil {
+			t.Fatalf("expected %+v to be invalid", ac)
+		}
+	}
+}
+
+func TestUnknownUserHash(t *testing.T) {
+	// unknown users cost the same as users made with lifx passwd
+	cost, err := bcrypt.Cost([]byte(unknownUserHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Fatalf("expected %d, got: %d", bcrypt.DefaultCost, cost)
+	}
+}
@@ -20,6 +20,8 @@ type Bulb struct {
 	LastState       lifx.BulbState
 	Controlled      bool
 	ControlAfter    time.Time
+	suspendReason   string
+	gestures        gestureDetector
 	TargetState     lifx.BulbState
 	Lux             float32
 	Location        string
@@ -27,9 +29,20 @@ type Bulb struct {
 
 	ManualStateKelvin     *uint16
 	ManualStateBrightness *uint16
+	ManualStateHue        *uint16
+	ManualStateSaturation *uint16
+	ManualStatePower      *bool
+	ManualStateTransition *time.Duration
 	ManualStateUntil      time.Time
+	ManualStateSource     string
 }
 
+const (
+	defaultTransition = time.Second * 10
+	powerOn           = 65535
+	powerOff          = 0
+)
+
 func bulbDiff(left lifx.BulbState, right lifx.BulbState) ([]string, bool) {
 	var changed bool = false
 	var differences []string
@@ -60,51 +73,78 @@ func bulbDiff(left lifx.BulbState, right lifx.BulbState) ([]string, bool) {
 	return differences, changed
 }
 
+// colourChange is a colour a bulb has been found to need
+type colourChange struct {
+	bulb       *Bulb
+	hue        uint16
+	saturation uint16
+	brightness uint16
+	kelvin     uint16
+	transition time.Duration
+	priority   lifx.Priority
+}
+
+// adjustState sends the bulb whatever it needs to match its target
 func (b *Bulb) adjustState() {
+	if change := b.planState(); change != nil {
+		b.app.sendColourChanges([]*colourChange{change})
+	}
+}
+
+// planState works out what the bulb needs to match its target, sending any
+// power change itself but leaving the colour change it returns for the
+// caller to send, nil when the colour is close enough
+func (b *Bulb) planState() *colourChange {
 	var hue uint16
 	var sat uint16
 	var brightness uint16
 	var kelvin uint16
-	var timing uint32
-	timing = 10000
-	brightness = 65535
-	kelvin = 4000
+	var power *bool
+	transition := time.Duration(b.app.config.Transition)
+	priority := lifx.PriorityNormal
 
-	defaultCurveBrightness, defaultCurveKelvin := b.app.GetDefaultCurve()
-	if defaultCurveBrightness != nil {
-		brightness = *defaultCurveBrightness
-	}
+	now := b.app.clock.Now()
+	brightness, kelvin, _ = b.app.bulbTarget(b, now)
 
-	if defaultCurveKelvin != nil {
-		kelvin = *defaultCurveKelvin
-	}
-
-	groupCurveBrightness, groupCurveKelvin := b.app.GetGroupCurve(b.Group)
-	if groupCurveBrightness != nil {
-		brightness = *groupCurveBrightness
-	}
-
-	if groupCurveKelvin != nil {
-		kelvin = *groupCurveKelvin
-	}
-
-	if b.ManualStateUntil.After(time.Now()) {
+	if b.ManualStateUntil.After(now) {
 		le := log.WithFields(log.Fields{
 			"name":    b.Name,
 			"address": b.Address,
 			"until":   b.ManualStateUntil,
-			"for":     b.ManualStateUntil.Sub(time.Now()),
+			"for":     b.ManualStateUntil.Sub(now),
 		})
 		if b.ManualStateKelvin != nil {
 			kelvin = *b.ManualStateKelvin
-			le.WithField("kelvin", kelvin)
+			le = le.WithField("kelvin", kelvin)
 		}
 		if b.ManualStateBrightness != nil {
 			brightness = *b.ManualStateBrightness
-			le.WithField("brightness", brightness)
+			le = le.WithField("brightness", brightness)
+		}
+		if b.ManualStateHue != nil {
+			hue = *b.ManualStateHue
+			le = le.WithField("hue", hue)
+		}
+		if b.ManualStateSaturation != nil {
+			sat = *b.ManualStateSaturation
+			le = le.WithField("saturation", sat)
+		}
+		if b.ManualStatePower != nil {
+			power = b.ManualStatePower
+			le = le.WithField("power", *power)
+		}
+		if b.ManualStateTransition != nil {
+			transition = *b.ManualStateTransition
+		}
+		// somebody asked for this rather than occupancy
+		if b.ManualStateSource == "" {
+			priority = lifx.PriorityUser
 		}
 		le.Debug("manually controlling state")
 	} else {
+		if b.hasManualState() {
+			b.expireManualState()
+		}
 		log.WithFields(log.Fields{
 			"name":             b.Name,
 			"address":          b.Address,
@@ -113,20 +153,63 @@ func (b *Bulb) adjustState() {
 	}
 
 	state := b.bulb.GetState()
+	policy := b.app.policyFor(b)
+
+	// give the bulb time to finish transitioning before expecting it to match
+	grace := policy.Grace
+	if transition+time.Second*5 > grace {
+		grace = transition + time.Second*5
+	}
+	controlAfter := now.Add(grace)
+
+	if power != nil && *power != (state.Power != powerOff) {
+		log.WithFields(log.Fields{
+			"current-power": state.Power != powerOff,
+			"target-power":  *power,
+			"name":          b.Name,
+			"group":         b.Group,
+			"address":       b.Address,
+			"control-after": controlAfter,
+		}).Info("initiating power change")
+		b.Controlled = false
+		b.ControlAfter = controlAfter
+		b.suspendReason = "adjusting"
+		if *power {
+			b.TargetState.Power = powerOn
+		} else {
+			b.TargetState.Power = powerOff
+		}
+		b.client.SetPower(b.bulb, priority, *power)
+	}
+
+	if power != nil && !*power {
+		// nothing to see while it's held off
+		return nil
+	}
+
 	var update bool = false
-	if state.Brightness != brightness {
+	if !withinTolerance(state.Brightness, brightness, policy.BrightnessTolerance) {
+		update = true
+	}
+	if !withinTolerance(state.Kelvin, kelvin, policy.KelvinTolerance) {
+		update = true
+	}
+	if state.Saturation != sat {
 		update = true
 	}
-	if state.Kelvin != kelvin {
+	if sat != 0 && state.Hue != hue {
 		update = true
 	}
 	if update {
-		controlAfter := time.Now().Add(time.Second * 15)
 		log.WithFields(log.Fields{
 			"current-brightness": state.Brightness,
 			"target-brightness":  brightness,
 			"current-kelvin":     state.Kelvin,
 			"target-kelvin":      kelvin,
+			"current-hue":        state.Hue,
+			"target-hue":         hue,
+			"current-saturation": state.Saturation,
+			"target-saturation":  sat,
 			"name":               b.Name,
 			"group":              b.Group,
 			"address":            b.Address,
@@ -134,27 +217,153 @@ func (b *Bulb) adjustState() {
 		}).Info("initiating LightColor change")
 		b.Controlled = false
 		b.ControlAfter = controlAfter
+		b.suspendReason = "adjusting"
 		b.TargetState.Kelvin = kelvin
 		b.TargetState.Brightness = brightness
-		b.client.LightColour(b.bulb, hue, sat, brightness, kelvin, timing)
+		b.TargetState.Hue = hue
+		b.TargetState.Saturation = sat
+		return &colourChange{
+			bulb:       b,
+			hue:        hue,
+			saturation: sat,
+			brightness: brightness,
+			kelvin:     kelvin,
+			transition: transition,
+			priority:   priority,
+		}
 	}
+	return nil
+}
+
+// setManualState holds the bulb at ms until ms.Until, replacing any previous manual state
+func (b *Bulb) setManualState(ms *ManualState) {
+	b.ManualStateUntil = ms.Until
+	b.ManualStateBrightness = ms.Brightness
+	b.ManualStateKelvin = ms.Kelvin
+	b.ManualStateHue = ms.Hue
+	b.ManualStateSaturation = ms.Saturation
+	b.ManualStatePower = ms.Power
+	b.ManualStateTransition = ms.Transition
+	b.ManualStateSource = ms.Source
+	b.app.publish(EventOverrideSet, b, b.override(b.app.clock.Now()))
+}
+
+func (b *Bulb) hasManualState() bool {
+	return b.ManualStateBrightness != nil || b.ManualStateKelvin != nil ||
+		b.ManualStateHue != nil || b.ManualStateSaturation != nil ||
+		b.ManualStatePower != nil || b.ManualStateTransition != nil
+}
+
+// releaseManualState ends any manual state immediately
+func (b *Bulb) releaseManualState() {
+	b.ManualStateUntil = b.app.clock.Now()
+	b.expireManualState()
+}
+
+// expireManualState clears an expired manual state. A bulb which was held off
+// is turned back on, curves don't manage power so nothing else would.
+func (b *Bulb) expireManualState() {
+	le := log.WithFields(log.Fields{
+		"name":    b.Name,
+		"address": b.Address,
+		"until":   b.ManualStateUntil,
+	})
+	if b.ManualStatePower != nil && !*b.ManualStatePower {
+		le.Info("manual state expired, turning bulb back on")
+		b.TargetState.Power = powerOn
+		b.client.LightOn(b.bulb)
+	} else {
+		le.Info("manual state expired")
+	}
+	b.ManualStateBrightness = nil
+	b.ManualStateKelvin = nil
+	b.ManualStateHue = nil
+	b.ManualStateSaturation = nil
+	b.ManualStatePower = nil
+	b.ManualStateTransition = nil
+	b.ManualStateSource = ""
+	b.app.publish(EventOverrideExpired, b, nil)
 }
 
 func (b *Bulb) setState(bulb *lifx.Bulb) {
 	state := bulb.GetState()
-	b.LastStateUpdate = time.Now()
+	b.LastStateUpdate = b.app.clock.Now()
 	b.LastState = state
 	b.Lux = bulb.GetLux()
 	b.Location = bulb.GetLocation()
 	b.Group = bulb.GetGroup()
 }
 
-func (b *Bulb) targetedChange(bulb *lifx.Bulb) ([]string, bool) {
+func (b *Bulb) targetedChange(bulb *lifx.Bulb, p policy) ([]string, bool) {
 	state := bulb.GetState()
-	differences, changed := bulbDiff(b.TargetState, state)
+	differences, changed := targetMismatch(b.TargetState, state, p)
 	return differences, !changed
 }
 
+// relinquishControl handles a change to the bulb which wasn't ours
+func (b *Bulb) relinquishControl(p policy, targetMismatch []string) {
+	now := b.app.clock.Now()
+	le := log.WithFields(log.Fields{
+		"address":        b.Address,
+		"name":           b.Name,
+		"targetMismatch": targetMismatch,
+		"policy":         p.Relinquish,
+	})
+
+	switch p.Relinquish {
+	case RelinquishNever:
+		le.Info("target mismatched, re-asserting control")
+		return
+	case RelinquishNextCurvePoint:
+		b.ControlAfter = b.app.nextCurvePoint(b, now)
+	case RelinquishPowerCycle:
+		b.ControlAfter = manualStateForever
+	default:
+		b.ControlAfter = now.Add(p.RelinquishFor)
+	}
+	b.Controlled = false
+	b.suspendReason = p.Relinquish
+	le.WithField("control-after", b.ControlAfter).Info("target mismatched, relinquishing control")
+	b.app.metrics.relinquished(p.Relinquish)
+	b.app.publish(EventControlRelinquished, b, map[string]interface{}{
+		"policy":   p.Relinquish,
+		"mismatch": targetMismatch,
+	})
+}
+
+// regainControl hands the bulb back to the curve. Finishing one of our own
+// adjustments isn't news, so only regaining from somebody else is published.
+func (b *Bulb) regainControl(reason string) {
+	adjusting := b.suspendReason == "adjusting"
+	b.Controlled = true
+	if !adjusting {
+		b.app.metrics.regained(reason)
+		b.app.publish(EventControlRegained, b, map[string]interface{}{
+			"reason": reason,
+		})
+	}
+}
+
+// ControlReason explains who is deciding the bulb's state right now
+func (b *Bulb) ControlReason() string {
+	if b.Controlled {
+		if b.ManualStateUntil.After(b.app.clock.Now()) {
+			if b.ManualStateSource == occupancySource {
+				return occupancySource
+			}
+			return "manual-state"
+		}
+		return "curve"
+	}
+	switch b.suspendReason {
+	case "adjusting":
+		return "adjusting"
+	case "":
+		return "relinquished"
+	}
+	return "relinquished:" + b.suspendReason
+}
+
 func (b *Bulb) changed(bulb *lifx.Bulb) ([]string, bool) {
 	state := bulb.GetState()
 	return bulbDiff(b.LastState, state)
@@ -0,0 +1,354 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigPath is read if it exists when no config file is given
+const defaultConfigPath = "lifx.yaml"
+
+// Config is the daemon's settings. Each comes from, in increasing
+// precedence, its default, the config file, a LIFX_ environment variable
+// and a flag of the same name.
+type Config struct {
+	Listen    string `yaml:"listen"`
+	CurvesDir string `yaml:"curves-dir"`
+	StateDir  string `yaml:"state-dir"`
+
+	// ControlInterval is how often controlled bulbs are moved along their
+	// curves and relinquished bulbs are checked for regaining control
+	ControlInterval Duration `yaml:"control-interval"`
+	// Grace and RelinquishFor are the defaults for the control policy,
+	// policies.json can override them
+	Grace         Duration `yaml:"grace"`
+	RelinquishFor Duration `yaml:"relinquish-for"`
+	// Transition is how long curve changes take
+	Transition Duration `yaml:"transition"`
+	// OfflineAfter is how long a bulb can go unseen before it's offline
+	OfflineAfter Duration `yaml:"offline-after"`
+	// DiscoveryInterval is how often bulbs are looked for and asked for
+	// their state, and VisibilityTimeout how long one can go unseen before
+	// it's taken to be switched off. Gestures at the wall switch are only
+	// seen when the bulb is off for longer than the visibility timeout.
+	DiscoveryInterval Duration `yaml:"discovery-interval"`
+	VisibilityTimeout Duration `yaml:"visibility-timeout"`
+	// Rate and DeviceRate limit the packets a second sent in all and the
+	// commands a second sent to each bulb
+	Rate       float64 `yaml:"rate"`
+	DeviceRate float64 `yaml:"device-rate"`
+
+	LogLevel  string `yaml:"log-level"`
+	LogFormat string `yaml:"log-format"`
+
+	// Sites runs several homes in one process, they can only be set in the
+	// config file
+	Sites []*SiteConfig `yaml:"sites,omitempty"`
+
+	// site is set on the config each site's App is built with
+	site *SiteConfig
+}
+
+// DefaultConfig is the config used when nothing else is set
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:            ":8089",
+		CurvesDir:         "curves",
+		StateDir:          "state",
+		ControlInterval:   Duration(time.Second),
+		Grace:             Duration(defaultPolicy.Grace),
+		RelinquishFor:     Duration(defaultPolicy.RelinquishFor),
+		Transition:        Duration(defaultTransition),
+		OfflineAfter:      Duration(time.Hour),
+		DiscoveryInterval: Duration(time.Second),
+		VisibilityTimeout: Duration(3 * time.Second),
+		Rate:              lifx.DefaultRate,
+		DeviceRate:        lifx.DefaultDeviceRate,
+		LogLevel:          "info",
+		LogFormat:         "text",
+	}
+}
+
+// configField is a setting, which can be set from a string for the
+// environment and flags
+type configField struct {
+	name  string
+	usage string
+	value flag.Value
+}
+
+type stringValue string
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+type floatValue float64
+
+func (f *floatValue) Set(v string) error {
+	fv, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*f = floatValue(fv)
+	return nil
+}
+
+func (f *floatValue) String() string {
+	return strconv.FormatFloat(float64(*f), 'g', -1, 64)
+}
+
+func (d *Duration) Set(v string) error {
+	dv, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dv)
+	return nil
+}
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (c *Config) fields() []configField {
+	return []configField{
+		{"listen", "address to serve the HTTP API on", (*stringValue)(&c.Listen)},
+		{"curves-dir", "directory of curves", (*stringValue)(&c.CurvesDir)},
+		{"state-dir", "directory for control state and scenes", (*stringValue)(&c.StateDir)},
+		{"control-interval", "how often bulbs are moved along their curves", &c.ControlInterval},
+		{"grace", "default time allowed for a bulb to reach its target", &c.Grace},
+		{"relinquish-for", "default time control is given up for after a manual change", &c.RelinquishFor},
+		{"transition", "how long curve changes take", &c.Transition},
+		{"offline-after", "how long a bulb can go unseen before it's offline", &c.OfflineAfter},
+		{"discovery-interval", "how often bulbs are looked for and asked for their state", &c.DiscoveryInterval},
+		{"visibility-timeout", "how long a bulb can go unseen before it's taken to be switched off", &c.VisibilityTimeout},
+		{"rate", "most packets a second sent to bulbs, 0 for no limit", (*floatValue)(&c.Rate)},
+		{"device-rate", "most commands a second sent to each bulb, 0 for no limit", (*floatValue)(&c.DeviceRate)},
+		{"log-level", "trace, debug, info, warning or error, trace logs every packet", (*stringValue)(&c.LogLevel)},
+		{"log-format", "text or json", (*stringValue)(&c.LogFormat)},
+	}
+}
+
+// envName is the environment variable for a setting, LIFX_LOG_LEVEL for
+// log-level
+func envName(name string) string {
+	return "LIFX_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// ParseConfig builds the config from the config file, environment and the
+// flags in args, registering the flags on fs
+func ParseConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	// flags are parsed into a scratch config, only the ones given are copied
+	// over once the file and environment have been applied
+	flags := DefaultConfig()
+	for _, f := range flags.fields() {
+		fs.Var(f.value, f.name, f.usage)
+	}
+	path := fs.String("config", "", "config file (default "+defaultConfigPath+" if it exists, or $LIFX_CONFIG)")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := DefaultConfig()
+
+	if *path == "" {
+		*path = getenv("LIFX_CONFIG")
+	}
+	required := *path != ""
+	if !required {
+		*path = defaultConfigPath
+	}
+	err = c.load(*path, required)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range c.fields() {
+		if v := getenv(envName(f.name)); v != "" {
+			err := f.value.Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", envName(f.name), err)
+			}
+		}
+	}
+
+	fields := make(map[string]configField)
+	for _, f := range c.fields() {
+		fields[f.name] = f
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		if f, ok := fields[fl.Name]; ok && err == nil {
+			err = f.value.Set(fl.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the YAML config file, a missing file is only an error if it
+// was asked for
+func (c *Config) load(path string, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return errors.New("listen is required")
+	}
+	if c.CurvesDir == "" {
+		return errors.New("curves-dir is required")
+	}
+	if c.StateDir == "" {
+		return errors.New("state-dir is required")
+	}
+	// the limits catch units mixed up, 10h for 10s, rather than anything
+	// the daemon couldn't do
+	day := 24 * time.Hour
+	for _, d := range []struct {
+		name  string
+		value Duration
+		max   time.Duration
+	}{
+		{"control-interval", c.ControlInterval, time.Hour},
+		{"grace", c.Grace, time.Hour},
+		{"relinquish-for", c.RelinquishFor, 7 * day},
+		{"offline-after", c.OfflineAfter, 7 * day},
+		{"discovery-interval", c.DiscoveryInterval, time.Minute},
+		{"visibility-timeout", c.VisibilityTimeout, 10 * time.Minute},
+	} {
+		if d.value <= 0 {
+			return fmt.Errorf("%s must be positive", d.name)
+		}
+		if time.Duration(d.value) > d.max {
+			return fmt.Errorf("%s can't be more than %s", d.name, d.max)
+		}
+	}
+	if c.Transition < 0 {
+		return errors.New("transition can't be negative")
+	}
+	if time.Duration(c.Transition) > time.Hour {
+		return fmt.Errorf("transition can't be more than %s", time.Hour)
+	}
+	if c.VisibilityTimeout <= c.DiscoveryInterval {
+		return errors.New("visibility-timeout must be longer than discovery-interval, or bulbs are lost between discoveries")
+	}
+	if c.OfflineAfter < c.VisibilityTimeout {
+		return errors.New("offline-after can't be shorter than visibility-timeout, a bulb isn't known to be gone until then")
+	}
+	if c.Rate < 0 || c.DeviceRate < 0 {
+		return errors.New("rate and device-rate can't be negative")
+	}
+	if c.Rate > 0 && c.DeviceRate > c.Rate {
+		return errors.New("device-rate can't be more than rate, every command to a bulb counts towards both")
+	}
+	_, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log-level: %s", err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log-format must be text or json")
+	}
+	// every site's discovery listens on the LIFX port, so when there are
+	// several each needs an address of its own
+	names := make(map[string]bool)
+	discovery := make(map[string]string)
+	for i, s := range c.Sites {
+		err := s.validate()
+		if err != nil {
+			return fmt.Errorf("sites[%d]: %s", i, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("sites[%d]: site %q is defined twice", i, s.Name)
+		}
+		names[s.Name] = true
+
+		if len(c.Sites) == 1 {
+			continue
+		}
+		address := s.discoveryAddress()
+		if address == "" {
+			return fmt.Errorf("sites[%d]: site %q needs an interface or bind address, with several sites they can't all discover on every interface", i, s.Name)
+		}
+		if other, ok := discovery[address]; ok {
+			return fmt.Errorf("sites[%d]: site %q discovers on %s like site %q, each site needs its own", i, s.Name, address, other)
+		}
+		discovery[address] = s.Name
+	}
+	return nil
+}
+
+// SetupLogging applies the log level and format
+func (c *Config) SetupLogging() {
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+	if c.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	}
+}
+
+// YAML returns the config as a config file
+func (c *Config) YAML() []byte {
+	d, err := yaml.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// configure points the app at the config's paths
+func (a *App) configure(c *Config) {
+	a.config = c
+	a.curvesDir = c.CurvesDir
+	a.scenesDir = filepath.Join(c.StateDir, "scenes")
+	a.statePath = filepath.Join(c.StateDir, "control.json")
+	a.offsetsPath = filepath.Join(c.StateDir, "offsets.json")
+
+	if s := c.site; s != nil {
+		a.site = s.Name
+		a.policiesPath = filepath.Join(s.dir(), "policies.json")
+		a.gesturesPath = filepath.Join(s.dir(), "gestures.json")
+		a.occupancyPath = filepath.Join(s.dir(), "occupancy.json")
+		a.mqttPath = filepath.Join(s.dir(), "mqtt.json")
+		if s.timezone != nil {
+			a.clock = timezoneClock{a.client.Clock(), s.timezone}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func parseTestConfig(args []string, env map[string]string) (*Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return ParseConfig(fs, args, func(name string) string {
+		return env[name]
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lifx.yaml")
+	err = ioutil.WriteFile(path, []byte("listen: :9000\ngrace: 30s\ntransition: 5s\nlog-level: debug\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := parseTestConfig([]string{"-transition", "2s"}, map[string]string{
+		"LIFX_CONFIG":     path,
+		"LIFX_GRACE":      "20s",
+		"LIFX_TRANSITION": "3s",
+		"LIFX_RATE":       "50",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != ":9000" || c.LogLevel != "debug" {
+		t.Fatalf("expected settings from the file, got: %s %s", c.Listen, c.LogLevel)
+	}
+	if time.Duration(c.Grace) != 20*time.Second {
+		t.Fatalf("expected the environment over the file, got: %s", time.Duration(c.Grace))
+	}
+	if time.Duration(c.Transition) != 2*time.Second {
+		t.Fatalf("expected the flag over the environment, got: %s", time.Duration(c.Transition))
+	}
+	if time.Duration(c.OfflineAfter) != time.Hour {
+		t.Fatalf("expected the default, got: %s", time.Duration(c.OfflineAfter))
+	}
+	if c.Rate != 50 || c.DeviceRate != 20 {
+		t.Fatalf("expected 50 and 20, got: %g and %g", c.Rate, c.DeviceRate)
+	}
+
+	// the YAML it prints reads back the same
+	again, err := parseTestConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, c.YAML(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = again.load(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, c) {
+		t.Fatalf("expected %+v, got: %+v", c, again)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lifx.yaml")
+	err = ioutil.WriteFile(path, []byte("grace: 30s\ngrase: 1m\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		args []string
+		env  map[string]string
+	}{
+		{args: []string{"-config", path}},
+		{args: []string{"-config", filepath.Join(dir, "missing.yaml")}},
+		{args: []string{"-grace", "soon"}},
+		{args: []string{"-control-interval", "0s"}},
+		{args: []string{"-log-level", "loud"}},
+		{args: []string{"-log-format", "xml"}},
+		{args: []string{"-device-rate", "-1"}},
+		{args: []string{"-rate", "fast"}},
+		{args: []string{"-discovery-interval", "5s"}},
+		{args: []string{"-visibility-timeout", "1s"}},
+		{args: []string{"-relinquish-for", "720h"}},
+		{args: []string{"-grace", "15h"}},
+		{args: []string{"-transition", "2h"}},
+		{args: []string{"-discovery-interval", "2m"}},
+		{args: []string{"-offline-after", "2s"}},
+		{args: []string{"-rate", "10"}},
+		{env: map[string]string{"LIFX_CONTROL_INTERVAL": "2h"}},
+		{env: map[string]string{"LIFX_OFFLINE_AFTER": "-1m"}},
+		{env: map[string]string{"LIFX_RELINQUISH_FOR": "forever"}},
+	} {
+		_, err := parseTestConfig(test.args, test.env)
+		if err == nil {
+			t.Fatalf("expected an error for %v %v", test.args, test.env)
+		}
+	}
+
+	// without -config or LIFX_CONFIG lifx.yaml is optional
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+	os.Remove(path)
+
+	c, err := parseTestConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, DefaultConfig()) {
+		t.Fatalf("expected the defaults, got: %+v", c)
+	}
+}
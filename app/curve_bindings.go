@@ -0,0 +1,294 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where a curve value came from, least specific first
+const (
+	sourceBuiltin  = "builtin"
+	sourceDefault  = "default"
+	sourceLocation = "location"
+	sourceGroup    = "group"
+	sourceLabel    = "label"
+	sourceBulb     = "bulb"
+)
+
+var sourceRank = map[string]int{
+	sourceBuiltin:  0,
+	sourceDefault:  1,
+	sourceLocation: 2,
+	sourceGroup:    3,
+	sourceLabel:    4,
+	sourceBulb:     5,
+}
+
+var addressRegexp = regexp.MustCompile("^[0-9a-f]{12}$")
+
+// validateBindings checks what the curve is bound to besides groups
+func (c *Curve) validateBindings() error {
+	for _, address := range c.Bulbs {
+		if !addressRegexp.MatchString(address) {
+			return fmt.Errorf("invalid bulb address %q (must be 12 lowercase hex digits)", address)
+		}
+	}
+	for _, pattern := range c.Labels {
+		if strings.TrimSpace(pattern) == "" {
+			return errors.New("label patterns must not be empty")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid label pattern %q", pattern)
+		}
+	}
+	for _, location := range c.Locations {
+		if strings.TrimSpace(location) == "" {
+			return errors.New("location names must not be empty")
+		}
+	}
+	return nil
+}
+
+func (c *Curve) bound() bool {
+	return len(c.Groups) > 0 || len(c.Bulbs) > 0 || len(c.Labels) > 0 || len(c.Locations) > 0
+}
+
+// labelBinding is a named curve bound to the bulbs whose labels match
+// pattern
+type labelBinding struct {
+	pattern string
+	name    string
+}
+
+// rebuildBindings recomputes the indexes from what the named curves are
+// bound to to the curves
+func (c *Curves) rebuildBindings() {
+	c.Groups = make(map[string]*Curve)
+	c.bulbs = make(map[string]string)
+	c.groups = make(map[string]string)
+	c.locations = make(map[string]string)
+	c.labels = nil
+
+	// label patterns are tried in curve name order
+	names := make([]string, 0, len(c.Named))
+	for name := range c.Named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		curve := c.Named[name]
+		for _, group := range curve.Groups {
+			c.Groups[group] = curve
+			c.groups[group] = name
+		}
+		for _, address := range curve.Bulbs {
+			c.bulbs[address] = name
+		}
+		for _, pattern := range curve.Labels {
+			c.labels = append(c.labels, labelBinding{pattern, name})
+		}
+		for _, location := range curve.Locations {
+			c.locations[location] = name
+		}
+	}
+}
+
+// checkBindings returns an error if curve would take a bulb, group or
+// location already bound to a curve other than name
+func (c *Curves) checkBindings(name string, curve *Curve) error {
+	for _, check := range []struct {
+		kind   string
+		keys   []string
+		active map[string]string
+	}{
+		{"bulb", curve.Bulbs, c.bulbs},
+		{"group", curve.Groups, c.groups},
+		{"location", curve.Locations, c.locations},
+	} {
+		for _, key := range check.keys {
+			if other, ok := check.active[key]; ok && other != name {
+				return fmt.Errorf("%s %q is already assigned to another curve", check.kind, key)
+			}
+		}
+	}
+	return nil
+}
+
+// curveSubject is what a bulb is matched against curve bindings by
+type curveSubject struct {
+	address  string
+	label    string
+	group    string
+	location string
+}
+
+func (b *Bulb) curveSubject() curveSubject {
+	return curveSubject{
+		address:  b.Address,
+		label:    b.Name,
+		group:    b.Group,
+		location: b.Location,
+	}
+}
+
+// curveLayer is a curve which applies to a bulb and what matched it
+type curveLayer struct {
+	source string
+	match  string
+	name   string
+	curve  *Curve
+}
+
+// layers returns the curves which apply to s, most specific first: bound
+// to its address, to a pattern matching its label, to its group, to its
+// location, then the default
+func (c *Curves) layers(s curveSubject) []curveLayer {
+	if c == nil {
+		return nil
+	}
+
+	var l []curveLayer
+	add := func(source string, match string, name string) {
+		if curve, ok := c.Named[name]; ok {
+			l = append(l, curveLayer{source, match, name, curve})
+		}
+	}
+	if name, ok := c.bulbs[s.address]; ok && s.address != "" {
+		add(sourceBulb, s.address, name)
+	}
+	if s.label != "" {
+		for _, lb := range c.labels {
+			if ok, _ := path.Match(lb.pattern, s.label); ok {
+				add(sourceLabel, lb.pattern, lb.name)
+				break
+			}
+		}
+	}
+	if name, ok := c.groups[s.group]; ok && s.group != "" {
+		add(sourceGroup, s.group, name)
+	}
+	if name, ok := c.locations[s.location]; ok && s.location != "" {
+		add(sourceLocation, s.location, name)
+	}
+	if c.Default != nil {
+		l = append(l, curveLayer{sourceDefault, "", "default", c.Default})
+	}
+	return l
+}
+
+// CurveValue is a brightness or kelvin from the curves and where it came
+// from
+type CurveValue struct {
+	Value uint16 `json:"value"`
+	// Source is bulb, label, group, location, default or builtin
+	Source string `json:"source"`
+	// Curve is the name of the curve the value is from
+	Curve string `json:"curve,omitempty"`
+	// Match is the address, label pattern, group or location the curve
+	// is bound to
+	Match string `json:"match,omitempty"`
+}
+
+// effective merges the curves which apply to s for the hour containing t,
+// taking brightness and kelvin each from the most specific curve which
+// sets it that hour
+func (c *Curves) effective(s curveSubject, t time.Time) (brightness CurveValue, kelvin CurveValue) {
+	brightness = CurveValue{Value: 65535, Source: sourceBuiltin}
+	kelvin = CurveValue{Value: 4000, Source: sourceBuiltin}
+
+	hour := strconv.Itoa(t.Hour())
+	haveBrightness, haveKelvin := false, false
+	for _, layer := range c.layers(s) {
+		point, ok := layer.curve.Hours[hour]
+		if !ok {
+			continue
+		}
+		if point.Brightness != nil && !haveBrightness {
+			brightness = CurveValue{*point.Brightness, layer.source, layer.name, layer.match}
+			haveBrightness = true
+		}
+		if point.Kelvin != nil && !haveKelvin {
+			kelvin = CurveValue{*point.Kelvin, layer.source, layer.name, layer.match}
+			haveKelvin = true
+		}
+	}
+	return brightness, kelvin
+}
+
+// targetFor is the brightness and kelvin for s at t, and the most specific
+// source either came from
+func (c *Curves) targetFor(s curveSubject, t time.Time) (uint16, uint16, string) {
+	brightness, kelvin := c.effective(s, t)
+	source := brightness.Source
+	if sourceRank[kelvin.Source] > sourceRank[source] {
+		source = kelvin.Source
+	}
+	return brightness.Value, kelvin.Value, source
+}
+
+// bulbCurveTarget is the curve target for a bulb against the app's active
+// curve set
+func (a *App) bulbCurveTarget(b *Bulb, t time.Time) (uint16, uint16, string) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	return a.curves.targetFor(b.curveSubject(), t)
+}
+
+// CurveLayerJSON is a curve which applies to a bulb
+type CurveLayerJSON struct {
+	Source string `json:"source"`
+	Curve  string `json:"curve"`
+	Match  string `json:"match,omitempty"`
+}
+
+// EffectiveJSON explains where a bulb's target brightness and kelvin come
+// from
+type EffectiveJSON struct {
+	Address    string     `json:"address"`
+	Name       string     `json:"name"`
+	Time       time.Time  `json:"time"`
+	Brightness CurveValue `json:"brightness"`
+	Kelvin     CurveValue `json:"kelvin"`
+
+	// Curves are the curves which apply to the bulb, most specific first
+	Curves []*CurveLayerJSON `json:"curves"`
+
+	// Offset is the bulb's offset merged over its group's, which adjusts
+	// the curve values to give the target
+	Offset           *Offset `json:"offset,omitempty"`
+	TargetBrightness uint16  `json:"target-brightness"`
+	TargetKelvin     uint16  `json:"target-kelvin"`
+
+	// Override replaces the curve values while it lasts
+	Override *OverrideJSON `json:"override,omitempty"`
+}
+
+// effective explains a bulb's curve target at t
+func (a *App) effective(b *Bulb, t time.Time) *EffectiveJSON {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	s := b.curveSubject()
+	e := &EffectiveJSON{
+		Address:  b.Address,
+		Name:     b.Name,
+		Time:     t,
+		Curves:   []*CurveLayerJSON{},
+		Override: b.override(t),
+	}
+	e.Brightness, e.Kelvin = a.curves.effective(s, t)
+	for _, layer := range a.curves.layers(s) {
+		e.Curves = append(e.Curves, &CurveLayerJSON{layer.source, layer.name, layer.match})
+	}
+	e.Offset = a.bulbOffset(b)
+	e.TargetBrightness, e.TargetKelvin = e.Offset.apply(e.Brightness.Value, e.Kelvin.Value)
+	return e
+}
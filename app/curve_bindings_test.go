@@ -0,0 +1,137 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func bindingCurves() *Curves {
+	c := testCurves()
+	c.Named["home"] = &Curve{
+		Locations: []string{"Home"},
+		Hours:     map[string]CurveHour{"6": {Kelvin: uint16p(3000)}},
+	}
+	c.Named["desks"] = &Curve{
+		Labels: []string{"Desk*"},
+		Hours:  map[string]CurveHour{"6": {Brightness: uint16p(20000)}},
+	}
+	c.Named["reading"] = &Curve{
+		Bulbs: []string{"d073d5000002"},
+		Hours: map[string]CurveHour{"6": {Kelvin: uint16p(2200)}},
+	}
+	c.rebuildBindings()
+	return c
+}
+
+func TestCurveBindings(t *testing.T) {
+	c := bindingCurves()
+	at := time.Date(2020, 1, 1, 6, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		subject          curveSubject
+		brightness       uint16
+		brightnessSource string
+		kelvin           uint16
+		kelvinSource     string
+		source           string
+	}{
+		// brightness from the group, kelvin from the location
+		{curveSubject{"d073d5000001", "Lamp", "Kitchen", "Home"}, 32768, "group", 3000, "location", "group"},
+		// the bulb's own curve only sets kelvin
+		{curveSubject{"d073d5000002", "Lamp", "Kitchen", "Home"}, 32768, "group", 2200, "bulb", "bulb"},
+		{curveSubject{"d073d5000003", "Desk Lamp", "Kitchen", "Home"}, 20000, "label", 3000, "location", "label"},
+		{curveSubject{"d073d5000004", "Lamp", "Office", "Cabin"}, 16384, "default", 5000, "default", "default"},
+	} {
+		brightness, kelvin := c.effective(test.subject, at)
+		if brightness.Value != test.brightness || brightness.Source != test.brightnessSource {
+			t.Fatalf("%+v: expected brightness %d from %s, got: %+v", test.subject, test.brightness, test.brightnessSource, brightness)
+		}
+		if kelvin.Value != test.kelvin || kelvin.Source != test.kelvinSource {
+			t.Fatalf("%+v: expected kelvin %d from %s, got: %+v", test.subject, test.kelvin, test.kelvinSource, kelvin)
+		}
+		_, _, source := c.targetFor(test.subject, at)
+		if source != test.source {
+			t.Fatalf("%+v: expected %s, got: %s", test.subject, test.source, source)
+		}
+	}
+
+	layers := c.layers(curveSubject{"d073d5000002", "Desk", "Kitchen", "Home"})
+	var sources []string
+	for _, l := range layers {
+		sources = append(sources, l.source+":"+l.name)
+	}
+	if len(sources) != 5 || sources[0] != "bulb:reading" || sources[1] != "label:desks" || sources[4] != "default:default" {
+		t.Fatalf("unexpected layers: %v", sources)
+	}
+}
+
+func TestPutCurveBindings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "curves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, _ := testApp()
+	a.curvesDir = dir
+	a.curves = bindingCurves()
+
+	for _, bad := range []*Curve{
+		{Bulbs: []string{"d073d5000002"}},
+		{Locations: []string{"Home"}},
+		{Bulbs: []string{"D0:73:D5:00:00:05"}},
+		{Labels: []string{"[Desk"}},
+	} {
+		_, err := a.putCurve("other", bad, "", "")
+		if err == nil {
+			t.Fatalf("expected an error for %+v", bad)
+		}
+	}
+	_, err = a.putCurve("default", &Curve{Locations: []string{"Cabin"}}, "", "")
+	if err == nil {
+		t.Fatal("expected the default curve not to be bindable")
+	}
+
+	// a curve can keep what it's already bound to
+	_, err = a.putCurve("home", &Curve{Locations: []string{"Home", "Cabin"}}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.curves.locations["Cabin"] != "home" {
+		t.Fatalf("expected %q, got: %q", "home", a.curves.locations["Cabin"])
+	}
+}
+
+func TestEffectiveEndpoint(t *testing.T) {
+	a, _ := testApp()
+	a.curves = bindingCurves()
+	report(a, 32768, 5000)
+
+	rw := serve(a, "GET", "/api/v2/bulbs/d073d50035f7/effective", "")
+	e := &EffectiveJSON{}
+	err := json.Unmarshal(rw.Body.Bytes(), e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Brightness.Value != 32768 || e.Brightness.Curve != "kitchen" || e.Brightness.Match != "Kitchen" {
+		t.Fatalf("unexpected brightness: %+v", e.Brightness)
+	}
+	if e.Kelvin.Value != 3000 || e.Kelvin.Source != "location" {
+		t.Fatalf("unexpected kelvin: %+v", e.Kelvin)
+	}
+	if len(e.Curves) != 3 || e.Curves[0].Curve != "kitchen" || e.Curves[1].Curve != "home" {
+		t.Fatalf("unexpected curves: %s", rw.Body.String())
+	}
+
+	rw = serve(a, "GET", "/api/v2/bulbs/d073d50035f7/effective?at=2020-01-01T20:15:00Z", "")
+	json.Unmarshal(rw.Body.Bytes(), e)
+	if e.Brightness.Value != 4096 || e.Brightness.Source != "default" || e.Kelvin.Value != 2500 {
+		t.Fatalf("unexpected values at 8pm: %+v %+v", e.Brightness, e.Kelvin)
+	}
+
+	expectAPIError(t, serve(a, "GET", "/api/v2/bulbs/nope/effective", ""), 404)
+	expectAPIError(t, serve(a, "GET", "/api/v2/bulbs/d073d50035f7/effective?at=8pm", ""), 400)
+}
@@ -1,39 +1,159 @@
 package app
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	errCurveNotFound      = errors.New("no such curve")
+	errPreconditionFailed = errors.New("curve has been modified (etag mismatch)")
+	errCurveExists        = errors.New("curve already exists")
+	errCurveHourNotFound  = errors.New("no such hour in curve")
+
+	nameRegexp = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+)
+
 type Curves struct {
 	Default *Curve            `json:"default"`
 	Groups  map[string]*Curve `json:"groups"`
+	Named   map[string]*Curve `json:"curves"`
+
+	// the names of the curves bound to bulbs, groups, locations and label
+	// patterns, see rebuildBindings
+	bulbs     map[string]string
+	groups    map[string]string
+	locations map[string]string
+	labels    []labelBinding
 }
 
 type Curve struct {
-	Groups []string             `json:"groups"`
-	Hours  map[string]CurveHour `json:"hours"`
+	Groups []string `json:"groups"`
+	// Bulbs, Labels and Locations bind the curve to bulbs by address, by
+	// label pattern (such as "Desk*") and by location. A bulb follows the
+	// curves bound to it in the order bulb, label, group, location and
+	// default, each value from the first which sets it.
+	Bulbs     []string             `json:"bulbs,omitempty"`
+	Labels    []string             `json:"labels,omitempty"`
+	Locations []string             `json:"locations,omitempty"`
+	Hours     map[string]CurveHour `json:"hours"`
 }
 type CurveHour struct {
 	Brightness *uint16 `json:"brightness,omitempty"`
 	Kelvin     *uint16 `json:"kelvin,omitempty"`
 }
 
+// ETag returns a strong entity tag for the curve's current content
+func (c *Curve) ETag() string {
+	d, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(d)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func (c *Curve) validate() error {
+	for hour, point := range c.Hours {
+		h, err := strconv.Atoi(hour)
+		if err != nil || h < 0 || h > 23 || hour != strconv.Itoa(h) {
+			return fmt.Errorf("invalid hour %q (must be 0-23)", hour)
+		}
+		if err := point.validate(); err != nil {
+			return fmt.Errorf("hour %s: %s", hour, err)
+		}
+	}
+	for _, group := range c.Groups {
+		if strings.TrimSpace(group) == "" {
+			return errors.New("group names must not be empty")
+		}
+	}
+	return c.validateBindings()
+}
+
+// the range of colour temperatures bulbs support
+const (
+	minKelvin = 1500
+	maxKelvin = 9000
+)
+
+func (ch CurveHour) validate() error {
+	if ch.Kelvin != nil && (*ch.Kelvin < minKelvin || *ch.Kelvin > maxKelvin) {
+		return fmt.Errorf("kelvin %d out of range (%d-%d)", *ch.Kelvin, minKelvin, maxKelvin)
+	}
+	return nil
+}
+
+func (c *Curve) copy() *Curve {
+	n := &Curve{
+		Groups:    append([]string(nil), c.Groups...),
+		Bulbs:     append([]string(nil), c.Bulbs...),
+		Labels:    append([]string(nil), c.Labels...),
+		Locations: append([]string(nil), c.Locations...),
+		Hours:     make(map[string]CurveHour, len(c.Hours)),
+	}
+	for hour, point := range c.Hours {
+		n.Hours[hour] = point
+	}
+	return n
+}
+
+// ETag returns an entity tag covering every curve
+func (c *Curves) ETag() string {
+	d, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(d)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
 func (a *App) GetDefaultCurve() (*uint16, *uint16) {
-	if a.curves == nil {
+	return a.GetDefaultCurveAt(a.clock.Now())
+}
+
+func (a *App) GetGroupCurve(group string) (*uint16, *uint16) {
+	return a.GetGroupCurveAt(group, a.clock.Now())
+}
+
+// GetDefaultCurveAt returns the default curve's values for the hour containing t
+func (a *App) GetDefaultCurveAt(t time.Time) (*uint16, *uint16) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	return a.curves.defaultAt(t)
+}
+
+// GetGroupCurveAt returns the group curve's values for the hour containing t
+func (a *App) GetGroupCurveAt(group string, t time.Time) (*uint16, *uint16) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	return a.curves.groupAt(group, t)
+}
+
+func (c *Curves) defaultAt(t time.Time) (*uint16, *uint16) {
+	if c == nil {
 		return nil, nil
 	}
 
-	if a.curves.Default == nil {
+	if c.Default == nil {
 		return nil, nil
 	}
 
-	hour := fmt.Sprintf("%d", time.Now().Hour())
+	hour := fmt.Sprintf("%d", t.Hour())
 
-	curve, ok := a.curves.Default.Hours[hour]
+	curve, ok := c.Default.Hours[hour]
 	if !ok {
 		return nil, nil
 	}
@@ -41,21 +161,21 @@ func (a *App) GetDefaultCurve() (*uint16, *uint16) {
 	return curve.Brightness, curve.Kelvin
 }
 
-func (a *App) GetGroupCurve(group string) (*uint16, *uint16) {
-	if a.curves == nil {
+func (c *Curves) groupAt(group string, t time.Time) (*uint16, *uint16) {
+	if c == nil {
 		return nil, nil
 	}
 
-	if a.curves.Groups == nil {
+	if c.Groups == nil {
 		return nil, nil
 	}
 
-	groupCurves, ok := a.curves.Groups[group]
+	groupCurves, ok := c.Groups[group]
 	if !ok {
 		return nil, nil
 	}
 
-	hour := fmt.Sprintf("%d", time.Now().Hour())
+	hour := fmt.Sprintf("%d", t.Hour())
 
 	curve, ok := groupCurves.Hours[hour]
 	if !ok {
@@ -65,36 +185,70 @@ func (a *App) GetGroupCurve(group string) (*uint16, *uint16) {
 	return curve.Brightness, curve.Kelvin
 }
 
+// Target composes the built-in defaults, the default curve and the group's
+// curve into the brightness and kelvin a bulb in group should have at t,
+// ignoring curves bound to bulbs, labels and locations. source names the
+// most specific layer which contributed a value.
+func (c *Curves) Target(group string, t time.Time) (brightness uint16, kelvin uint16, source string) {
+	return c.targetFor(curveSubject{group: group}, t)
+}
+
+// curveTarget is Curves.Target against the app's active curve set
+func (a *App) curveTarget(group string, t time.Time) (uint16, uint16, string) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	return a.curves.Target(group, t)
+}
+
 func (a *App) loadCurves() error {
+	curves, err := LoadCurves(a.curvesDir)
+	if err != nil {
+		a.curvesMutex.Lock()
+		a.curvesError = err
+		a.curvesMutex.Unlock()
+		return err
+	}
+
+	a.curvesMutex.Lock()
+	a.curves = curves
+	a.curvesError = nil
+	a.curvesMutex.Unlock()
+
+	a.publishCurve(EventCurvesReloaded, "")
+
+	return nil
+}
+
+// LoadCurves reads default.json and groups/*.json from dir
+func LoadCurves(dir string) (*Curves, error) {
 	curves := &Curves{}
-	curves.Groups = make(map[string]*Curve)
+	curves.Named = make(map[string]*Curve)
 
-	defaultCurve, err := loadCurve("curves/default.json")
+	defaultCurve, err := loadCurve(filepath.Join(dir, "default.json"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	curves.Default = defaultCurve
 
-	groupCurveFiles, err := filepath.Glob("curves/groups/*.json")
+	groupCurveFiles, err := filepath.Glob(filepath.Join(dir, "groups", "*.json"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, groupCurveFile := range groupCurveFiles {
 		groupCurve, err := loadCurve(groupCurveFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		for _, groupCurveName := range groupCurve.Groups {
-			curves.Groups[groupCurveName] = groupCurve
-		}
+		name := strings.TrimSuffix(filepath.Base(groupCurveFile), ".json")
+		curves.Named[name] = groupCurve
 	}
+	curves.rebuildBindings()
 
-	a.curves = curves
-
-	return nil
+	return curves, nil
 }
 
 func loadCurve(filename string) (*Curve, error) {
@@ -112,3 +266,226 @@ func loadCurve(filename string) (*Curve, error) {
 
 	return curve, nil
 }
+
+// getCurve returns a copy of the named curve, "default" refers to the default curve
+func (a *App) getCurve(name string) (*Curve, error) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	curve := a.lookupCurve(name)
+	if curve == nil {
+		return nil, errCurveNotFound
+	}
+	return curve.copy(), nil
+}
+
+// lookupCurve must be called with curvesMutex held
+func (a *App) lookupCurve(name string) *Curve {
+	if a.curves == nil {
+		return nil
+	}
+	if name == "default" {
+		return a.curves.Default
+	}
+	return a.curves.Named[name]
+}
+
+// curveFile returns the on-disk location of a curve
+func (a *App) curveFile(name string) string {
+	if name == "default" {
+		return filepath.Join(a.curvesDir, "default.json")
+	}
+	return filepath.Join(a.curvesDir, "groups", name+".json")
+}
+
+// checkETag compares an If-Match header value against the current curve
+func checkETag(curve *Curve, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	if ifMatch == "*" {
+		if curve == nil {
+			return errPreconditionFailed
+		}
+		return nil
+	}
+	if curve == nil || curve.ETag() != ifMatch {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// putCurve creates or replaces a curve, persisting it before it becomes
+// active. It returns whether the curve was newly created.
+func (a *App) putCurve(name string, curve *Curve, ifMatch string, ifNoneMatch string) (bool, error) {
+	if !nameRegexp.MatchString(name) {
+		return false, fmt.Errorf("invalid curve name %q", name)
+	}
+	if err := curve.validate(); err != nil {
+		return false, err
+	}
+	if name == "default" && curve.bound() {
+		return false, errors.New("the default curve can't be assigned to bulbs, groups or locations")
+	}
+
+	a.curvesMutex.Lock()
+	defer a.curvesMutex.Unlock()
+
+	if a.curves == nil {
+		a.curves = &Curves{Named: make(map[string]*Curve), Groups: make(map[string]*Curve)}
+	}
+
+	existing := a.lookupCurve(name)
+	if ifNoneMatch == "*" && existing != nil {
+		return false, errCurveExists
+	}
+	if err := checkETag(existing, ifMatch); err != nil {
+		return false, err
+	}
+
+	if err := a.curves.checkBindings(name, curve); err != nil {
+		return false, err
+	}
+
+	if err := a.writeCurve(name, curve); err != nil {
+		return false, err
+	}
+
+	if name == "default" {
+		a.curves.Default = curve
+	} else {
+		a.curves.Named[name] = curve
+		a.curves.rebuildBindings()
+	}
+	a.publishCurve(EventCurveUpdated, name)
+
+	return existing == nil, nil
+}
+
+// patchCurveHour sets (or with a nil point, removes) a single hour of a curve
+func (a *App) patchCurveHour(name string, hour string, point *CurveHour, ifMatch string) (*Curve, error) {
+	a.curvesMutex.Lock()
+	defer a.curvesMutex.Unlock()
+
+	existing := a.lookupCurve(name)
+	if existing == nil {
+		return nil, errCurveNotFound
+	}
+	if err := checkETag(existing, ifMatch); err != nil {
+		return nil, err
+	}
+
+	curve := existing.copy()
+	if curve.Hours == nil {
+		curve.Hours = make(map[string]CurveHour)
+	}
+	if point == nil {
+		if _, ok := curve.Hours[hour]; !ok {
+			return nil, errCurveHourNotFound
+		}
+		delete(curve.Hours, hour)
+	} else {
+		curve.Hours[hour] = *point
+	}
+	if err := curve.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := a.writeCurve(name, curve); err != nil {
+		return nil, err
+	}
+
+	if name == "default" {
+		a.curves.Default = curve
+	} else {
+		a.curves.Named[name] = curve
+		a.curves.rebuildBindings()
+	}
+	a.publishCurve(EventCurveUpdated, name)
+
+	return curve.copy(), nil
+}
+
+// deleteCurve removes a group curve from disk and from the active set
+func (a *App) deleteCurve(name string, ifMatch string) error {
+	if name == "default" {
+		return errors.New("the default curve can't be deleted")
+	}
+
+	a.curvesMutex.Lock()
+	defer a.curvesMutex.Unlock()
+
+	existing := a.lookupCurve(name)
+	if existing == nil {
+		return errCurveNotFound
+	}
+	if err := checkETag(existing, ifMatch); err != nil {
+		return err
+	}
+
+	err := os.Remove(a.curveFile(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(a.curves.Named, name)
+	a.curves.rebuildBindings()
+	a.publishCurve(EventCurveDeleted, name)
+
+	return nil
+}
+
+func (a *App) writeCurve(name string, curve *Curve) error {
+	d, err := json.MarshalIndent(curve, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(a.curveFile(name), append(d, '\n'))
+}
+
+// writeFileSync atomically replaces filename with data, making sure both the
+// file and the directory entry have hit the disk before returning
+func writeFileSync(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filename)
+	if err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.adam.gs/home/lifx/filter"
+)
+
+// Event types
+const (
+	EventBulbDiscovered      = "bulb-discovered"
+	EventBulbChanged         = "bulb-changed"
+	EventBulbOffline         = "bulb-offline"
+	EventBulbOnline          = "bulb-online"
+	EventControlRelinquished = "control-relinquished"
+	EventControlRegained     = "control-regained"
+	EventOverrideSet         = "override-set"
+	EventOverrideExpired     = "override-expired"
+	EventOffsetSet           = "offset-set"
+	EventOffsetRemoved       = "offset-removed"
+	EventCurvesReloaded      = "curves-reloaded"
+	EventCurveUpdated        = "curve-updated"
+	EventCurveDeleted        = "curve-deleted"
+	EventOccupancyChanged    = "occupancy-changed"
+	EventGroupChanged        = "group-changed"
+
+	// EventReset tells a resuming client events were missed and it should
+	// refetch whatever it's showing
+	EventReset = "reset"
+)
+
+// eventBacklog is how many events are kept for clients resuming with Last-Event-ID
+const eventBacklog = 1024
+
+// Event is something which happened to a bulb or the daemon
+type Event struct {
+	// ID is <epoch>-<sequence>, the epoch is when the daemon started so IDs
+	// from before a restart are never mistaken for new ones
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Time  time.Time   `json:"time"`
+	Bulb  *BulbJSON   `json:"bulb,omitempty"`
+	Curve string      `json:"curve,omitempty"`
+	Group string      `json:"group,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+
+	bulb *Bulb
+	seq  uint64
+}
+
+// eventID is where a subscriber got to, a zero seq is the start
+type eventID struct {
+	epoch int64
+	seq   uint64
+}
+
+func (id eventID) String() string {
+	return fmt.Sprintf("%d-%d", id.epoch, id.seq)
+}
+
+// parseEventID reads a Last-Event-ID. A bare sequence number was issued
+// before IDs had epochs, so it can't be resumed from this process.
+func parseEventID(s string) (id eventID, err error) {
+	seq := s
+	if i := strings.LastIndex(s, "-"); i >= 0 {
+		id.epoch, err = strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return id, err
+		}
+		seq = s[i+1:]
+	}
+	id.seq, err = strconv.ParseUint(seq, 10, 64)
+	return id, err
+}
+
+type eventBus struct {
+	mutex   sync.Mutex
+	epoch   int64
+	nextID  uint64
+	backlog []*Event
+	subs    map[*eventSub]bool
+}
+
+type eventSub struct {
+	events chan *Event
+	filter filter.Node
+	types  map[string]bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		epoch:  time.Now().UnixNano(),
+		nextID: 1,
+		subs:   make(map[*eventSub]bool),
+	}
+}
+
+// wants reports whether the subscriber asked for e, events which aren't
+// about a bulb pass any filter
+func (s *eventSub) wants(e *Event) bool {
+	if len(s.types) > 0 && !s.types[e.Type] {
+		return false
+	}
+	if e.bulb != nil && !s.filter.Match(e.bulb) {
+		return false
+	}
+	return true
+}
+
+func (eb *eventBus) publish(e *Event) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	e.seq = eb.nextID
+	e.ID = eventID{eb.epoch, e.seq}.String()
+	eb.nextID++
+	eb.backlog = append(eb.backlog, e)
+	if len(eb.backlog) > eventBacklog {
+		eb.backlog = eb.backlog[len(eb.backlog)-eventBacklog:]
+	}
+
+	for sub := range eb.subs {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// too slow, it can resume from the backlog
+			close(sub.events)
+			delete(eb.subs, sub)
+		}
+	}
+}
+
+// subscribe returns a subscription and whatever it missed after lastID, with
+// gap set when events it wanted have already left the backlog. An ID from
+// another epoch was issued before a restart, so that's a gap too and the
+// subscriber gets the whole backlog.
+func (eb *eventBus) subscribe(lastID eventID, node filter.Node, types map[string]bool) (sub *eventSub, missed []*Event, gap bool) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	sub = &eventSub{
+		events: make(chan *Event, 64),
+		filter: node,
+		types:  types,
+	}
+	eb.subs[sub] = true
+
+	if lastID.seq == 0 {
+		return sub, nil, false
+	}
+	after := lastID.seq
+	if lastID.epoch != eb.epoch || after >= eb.nextID {
+		gap = true
+		after = 0
+	} else if len(eb.backlog) > 0 && eb.backlog[0].seq > after+1 {
+		gap = true
+	}
+	for _, e := range eb.backlog {
+		if e.seq > after && sub.wants(e) {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, gap
+}
+
+func (eb *eventBus) unsubscribe(sub *eventSub) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	if eb.subs[sub] {
+		close(sub.events)
+		delete(eb.subs, sub)
+	}
+}
+
+// publish records an event, b may be nil for events which aren't about a bulb
+func (a *App) publish(eventType string, b *Bulb, data interface{}) *Event {
+	e := &Event{
+		Type: eventType,
+		Time: a.clock.Now(),
+		Data: data,
+		bulb: b,
+	}
+	if b != nil {
+		e.Bulb = a.bulbJSON(b)
+	}
+	a.events.publish(e)
+	return e
+}
+
+// publishOccupancy records a group's occupancy changing state, it is called
+// with occupancyMutex held
+func (a *App) publishOccupancy(o *Occupancy) {
+	v := *o
+	e := &Event{
+		Type:  EventOccupancyChanged,
+		Time:  a.clock.Now(),
+		Group: o.Group,
+		Data:  &v,
+	}
+	a.events.publish(e)
+}
+
+// publishGroupChange records how a group change went for each of its bulbs
+func (a *App) publishGroupChange(group string, gc *GroupChange) {
+	e := &Event{
+		Type:  EventGroupChanged,
+		Time:  a.clock.Now(),
+		Group: group,
+		Data:  gc,
+	}
+	a.events.publish(e)
+}
+
+func (a *App) publishCurve(eventType string, name string) {
+	e := &Event{
+		Type:  eventType,
+		Time:  a.clock.Now(),
+		Curve: name,
+	}
+	a.events.publish(e)
+}
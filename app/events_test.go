@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.adam.gs/home/lifx/filter"
+)
+
+func TestEventBusResume(t *testing.T) {
+	eb := newEventBus()
+	for i := 0; i < 3; i++ {
+		eb.publish(&Event{Type: EventCurvesReloaded})
+	}
+
+	last, err := parseEventID(eb.backlog[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, missed, gap := eb.subscribe(last, filter.All{}, nil)
+	defer eb.unsubscribe(sub)
+	if gap {
+		t.Fatal("expected no gap")
+	}
+	if len(missed) != 2 || missed[0].seq != 2 || missed[1].seq != 3 {
+		t.Fatalf("expected events 2 and 3, got: %d", len(missed))
+	}
+
+	eb.publish(&Event{Type: EventCurveUpdated})
+	e := <-sub.events
+	if expected := (eventID{eb.epoch, 4}).String(); e.ID != expected {
+		t.Fatalf("expected %s, got: %s", expected, e.ID)
+	}
+}
+
+func TestEventBusGap(t *testing.T) {
+	eb := newEventBus()
+	for i := 0; i < eventBacklog+10; i++ {
+		eb.publish(&Event{Type: EventCurvesReloaded})
+	}
+
+	sub, missed, gap := eb.subscribe(eventID{eb.epoch, 5}, filter.All{}, nil)
+	defer eb.unsubscribe(sub)
+	if !gap {
+		t.Fatal("expected a gap")
+	}
+	if len(missed) != eventBacklog {
+		t.Fatalf("expected %d, got: %d", eventBacklog, len(missed))
+	}
+}
+
+func TestEventBusRestarted(t *testing.T) {
+	eb := newEventBus()
+	for i := 0; i < 3; i++ {
+		eb.publish(&Event{Type: EventCurvesReloaded})
+	}
+
+	// the subscriber saw event 10 before the daemon restarted
+	sub, missed, gap := eb.subscribe(eventID{eb.epoch - 1, 10}, filter.All{}, nil)
+	defer eb.unsubscribe(sub)
+	if !gap {
+		t.Fatal("expected a gap")
+	}
+	if len(missed) != 3 || missed[0].seq != 1 {
+		t.Fatalf("expected every event since the restart, got: %d", len(missed))
+	}
+
+	// the newest event isn't a gap
+	sub2, missed, gap := eb.subscribe(eventID{eb.epoch, 3}, filter.All{}, nil)
+	defer eb.unsubscribe(sub2)
+	if gap || len(missed) != 0 {
+		t.Fatalf("expected nothing missed, got: %v %d", gap, len(missed))
+	}
+}
+
+func TestEventBusOldEpoch(t *testing.T) {
+	eb := newEventBus()
+	for i := 0; i < 20; i++ {
+		eb.publish(&Event{Type: EventCurvesReloaded})
+	}
+
+	// the subscriber saw event 5 before the restart, and the restarted
+	// daemon has since gone well past 5
+	sub, missed, gap := eb.subscribe(eventID{eb.epoch - 1, 5}, filter.All{}, nil)
+	defer eb.unsubscribe(sub)
+	if !gap {
+		t.Fatal("expected a gap")
+	}
+	if len(missed) != 20 {
+		t.Fatalf("expected %d, got: %d", 20, len(missed))
+	}
+
+	// IDs from before epochs can't be resumed either
+	old, err := parseEventID("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub2, missed, gap := eb.subscribe(old, filter.All{}, nil)
+	defer eb.unsubscribe(sub2)
+	if !gap || len(missed) != 20 {
+		t.Fatalf("expected a gap and every event, got: %v %d", gap, len(missed))
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	eb := newEventBus()
+	sub, _, _ := eb.subscribe(eventID{}, filter.All{}, nil)
+	for i := 0; i < cap(sub.events)+1; i++ {
+		eb.publish(&Event{Type: EventCurvesReloaded})
+	}
+
+	n := 0
+	for range sub.events {
+		n++
+	}
+	if n != cap(sub.events) {
+		t.Fatalf("expected %d, got: %d", cap(sub.events), n)
+	}
+	eb.unsubscribe(sub)
+}
+
+func TestEventFilter(t *testing.T) {
+	a, _ := testApp()
+	node, err := filter.Parse("group=Bedroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _, _ := a.events.subscribe(eventID{}, node, map[string]bool{EventBulbDiscovered: true, EventCurvesReloaded: true})
+	defer a.events.unsubscribe(sub)
+
+	report(a, 32768, 5000)
+	a.publishCurve(EventCurvesReloaded, "")
+	e := <-sub.events
+	if e.Type != EventCurvesReloaded {
+		t.Fatalf("expected %s, got: %s", EventCurvesReloaded, e.Type)
+	}
+}
+
+func TestEventsFromState(t *testing.T) {
+	a, _ := testApp()
+	sub, _, _ := a.events.subscribe(eventID{}, filter.All{}, nil)
+	defer a.events.unsubscribe(sub)
+
+	report(a, 32768, 5000)
+	a.adjustControlled()
+	report(a, 10000, 5000)
+
+	var types []string
+	for len(sub.events) > 0 {
+		types = append(types, (<-sub.events).Type)
+	}
+	found := map[string]bool{}
+	for _, eventType := range types {
+		found[eventType] = true
+	}
+	for _, eventType := range []string{EventBulbDiscovered, EventBulbChanged, EventControlRelinquished} {
+		if !found[eventType] {
+			t.Fatalf("expected a %s event, got: %v", eventType, types)
+		}
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	a, _ := testApp()
+	report(a, 32768, 5000)
+
+	// the stream replays what was missed then ends with the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/events?last-event-id=0&types=bulb-discovered", nil).WithContext(ctx)
+	req.Header.Set("last-event-id", "0")
+	rw := httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	if rw.Code != 200 || rw.Header().Get("content-type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got: %d %s", rw.Code, rw.Header().Get("content-type"))
+	}
+
+	rw = serve(a, "GET", "/api/v2/events?last-event-id=x", "")
+	expectAPIError(t, rw, 400)
+
+	first := a.events.backlog[0].ID
+	req = httptest.NewRequest("GET", "/events?types=bulb-discovered", nil).WithContext(ctx)
+	req.Header.Set("last-event-id", first)
+	rw = httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	if strings.Contains(rw.Body.String(), "bulb-discovered") {
+		t.Fatalf("expected nothing after event %s, got: %s", first, rw.Body.String())
+	}
+
+	// an event ID from before a restart is a reset and a replay
+	req = httptest.NewRequest("GET", "/events?types=bulb-discovered", nil).WithContext(ctx)
+	req.Header.Set("last-event-id", "1-1")
+	rw = httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	body := rw.Body.String()
+	if !strings.Contains(body, "event: reset") || !strings.Contains(body, "id: "+first) {
+		t.Fatalf("expected a reset and event %s, got: %s", first, body)
+	}
+}
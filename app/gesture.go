@@ -0,0 +1,323 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+// Gesture actions
+const (
+	// GestureReset releases any manual state and puts the bulbs back on their curve
+	GestureReset = "reset"
+	// GestureScene activates a scene
+	GestureScene = "scene"
+	// GestureOverride sets a manual state
+	GestureOverride = "override"
+)
+
+// GestureAction is what to do when a gesture is recognised
+type GestureAction struct {
+	Action     string    `json:"action"`
+	Scene      string    `json:"scene,omitempty"`
+	For        *Duration `json:"for,omitempty"`
+	Transition *Duration `json:"transition,omitempty"`
+	Brightness *uint16   `json:"brightness,omitempty"`
+	Kelvin     *uint16   `json:"kelvin,omitempty"`
+}
+
+// GestureConfig maps quick power cycles of a bulb (typically at the wall
+// switch) to actions. Actions are keyed by the number of cycles, "1", "2"...
+type GestureConfig struct {
+	// MaxOff is the longest a bulb can be off and still count as a cycle. A
+	// bulb switched off at the wall isn't noticed until it has been unseen
+	// for the visibility-timeout, so MaxOff has to be longer.
+	MaxOff *Duration `json:"max-off,omitempty"`
+	// Between is how long to wait for a further cycle before acting
+	Between *Duration                 `json:"between,omitempty"`
+	Actions map[string]*GestureAction `json:"actions,omitempty"`
+}
+
+// Gestures is the gestures.json file, groups override default
+type Gestures struct {
+	Default *GestureConfig            `json:"default,omitempty"`
+	Groups  map[string]*GestureConfig `json:"groups,omitempty"`
+}
+
+type gestureConfig struct {
+	MaxOff  time.Duration
+	Between time.Duration
+	Actions map[string]*GestureAction
+}
+
+var defaultGestureConfig = gestureConfig{
+	MaxOff:  8 * time.Second,
+	Between: 5 * time.Second,
+}
+
+func (gc *gestureConfig) apply(c *GestureConfig) {
+	if c == nil {
+		return
+	}
+	if c.MaxOff != nil {
+		gc.MaxOff = time.Duration(*c.MaxOff)
+	}
+	if c.Between != nil {
+		gc.Between = time.Duration(*c.Between)
+	}
+	if c.Actions != nil {
+		gc.Actions = c.Actions
+	}
+}
+
+func (c *GestureConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	for cycles, action := range c.Actions {
+		if n, err := strconv.Atoi(cycles); err != nil || n < 1 {
+			return fmt.Errorf("actions are keyed by number of cycles, not %q", cycles)
+		}
+		switch action.Action {
+		case GestureReset, GestureOverride:
+		case GestureScene:
+			if action.Scene == "" {
+				return fmt.Errorf("%s: scene action needs a scene", cycles)
+			}
+		default:
+			return fmt.Errorf("%s: unknown action %q", cycles, action.Action)
+		}
+	}
+	return nil
+}
+
+func (a *App) loadGestures() error {
+	data, err := ioutil.ReadFile(a.gesturesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	gestures := &Gestures{}
+	err = json.Unmarshal(data, gestures)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.gesturesPath, err)
+	}
+	err = gestures.Default.validate()
+	if err != nil {
+		return fmt.Errorf("%s: default: %s", a.gesturesPath, err)
+	}
+	for group, gc := range gestures.Groups {
+		if err := gc.validate(); err != nil {
+			return fmt.Errorf("%s: group %s: %s", a.gesturesPath, group, err)
+		}
+	}
+
+	// a cycle at the wall switch is only seen once the bulb has been gone
+	// for the visibility timeout
+	visibility := time.Duration(a.config.VisibilityTimeout)
+	gc := defaultGestureConfig
+	gc.apply(gestures.Default)
+	if gc.MaxOff <= visibility {
+		return fmt.Errorf("%s: default: max-off %s must be longer than the visibility-timeout %s", a.gesturesPath, gc.MaxOff, visibility)
+	}
+	for group, c := range gestures.Groups {
+		gc := gc
+		gc.apply(c)
+		if gc.MaxOff <= visibility {
+			return fmt.Errorf("%s: group %s: max-off %s must be longer than the visibility-timeout %s", a.gesturesPath, group, gc.MaxOff, visibility)
+		}
+	}
+
+	a.gestures = gestures
+	log.WithField("path", a.gesturesPath).Info("loaded gestures")
+
+	return nil
+}
+
+func (a *App) gestureConfigFor(b *Bulb) gestureConfig {
+	gc := defaultGestureConfig
+	if a.gestures == nil {
+		return gc
+	}
+	gc.apply(a.gestures.Default)
+	gc.apply(a.gestures.Groups[b.Group])
+	return gc
+}
+
+// gestureDetector counts off/on cycles of a single bulb
+type gestureDetector struct {
+	off      bool
+	offAt    time.Time
+	cycles   int
+	lastOnAt time.Time
+}
+
+// observe records the bulb going dark (on is false) or coming back at time at
+func (d *gestureDetector) observe(on bool, at time.Time, maxOff time.Duration) {
+	if !on {
+		if !d.off {
+			d.off = true
+			d.offAt = at
+		}
+		return
+	}
+	if !d.off {
+		return
+	}
+	d.off = false
+	if at.Sub(d.offAt) > maxOff {
+		d.cycles = 0
+		return
+	}
+	d.cycles++
+	d.lastOnAt = at
+}
+
+// poll returns the number of cycles in a completed gesture, or zero
+func (d *gestureDetector) poll(now time.Time, gc gestureConfig) int {
+	if d.cycles == 0 {
+		return 0
+	}
+	if d.off {
+		if now.Sub(d.offAt) > gc.MaxOff {
+			// turned off for real
+			d.cycles = 0
+		}
+		return 0
+	}
+	if now.Sub(d.lastOnAt) < gc.Between {
+		return 0
+	}
+	n := d.cycles
+	d.cycles = 0
+	return n
+}
+
+// observeGesture feeds power and visibility changes to the bulb's detector,
+// a bulb which drops off the network went dark when it was last seen
+func (a *App) observeGesture(b *Bulb, bulb *lifx.Bulb) {
+	prev := b.LastState
+	state := bulb.GetState()
+	wasOn := prev.Visible && prev.Power != powerOff
+	isOn := state.Visible && state.Power != powerOff
+	if wasOn == isOn {
+		return
+	}
+
+	at := a.clock.Now()
+	if !isOn && !state.Visible && !bulb.LastSeen().IsZero() {
+		at = bulb.LastSeen()
+	}
+	b.gestures.observe(isOn, at, a.gestureConfigFor(b).MaxOff)
+}
+
+func (a *App) watchGestures() {
+	a.heartbeat("gestures", time.Second/4)
+	ticker := a.clock.NewTicker(time.Second / 4)
+	for range ticker.C() {
+		a.checkGestures()
+		a.heartbeat("gestures", time.Second/4)
+	}
+}
+
+// checkGestures acts on completed gestures. Every bulb on a switch sees the
+// same gesture, so it is acted on once for the whole group.
+func (a *App) checkGestures() {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
+	now := a.clock.Now()
+	for _, bulb := range a.BulbList() {
+		gc := a.gestureConfigFor(bulb)
+		cycles := bulb.gestures.poll(now, gc)
+		if cycles == 0 {
+			continue
+		}
+
+		le := log.WithFields(log.Fields{
+			"address": bulb.Address,
+			"name":    bulb.Name,
+			"group":   bulb.Group,
+			"cycles":  cycles,
+		})
+
+		action, ok := gc.Actions[strconv.Itoa(cycles)]
+		if !ok {
+			le.Debug("no action for gesture")
+			continue
+		}
+
+		key := bulb.Group + "/" + strconv.Itoa(cycles)
+		if bulb.Group == "" {
+			key = bulb.Address + "/" + strconv.Itoa(cycles)
+		}
+		if last, ok := a.gesturesFired[key]; ok && now.Sub(last) < gc.Between+gc.MaxOff {
+			continue
+		}
+		a.gesturesFired[key] = now
+
+		le.WithField("action", action.Action).Info("gesture recognised")
+		err := a.runGestureAction(bulb, action)
+		if err != nil {
+			le.WithError(err).Error("gesture action failed")
+		}
+	}
+}
+
+func (a *App) runGestureAction(b *Bulb, action *GestureAction) error {
+	now := a.clock.Now()
+	bulbs := []*Bulb{b}
+	if b.Group != "" {
+		bulbs = a.GetGroupBulbs(b.Group)
+	}
+
+	var until *time.Time
+	if action.For != nil {
+		uv := now.Add(time.Duration(*action.For))
+		until = &uv
+	}
+	var transition time.Duration
+	if action.Transition != nil {
+		transition = time.Duration(*action.Transition)
+	}
+
+	switch action.Action {
+	case GestureReset:
+		for _, bulb := range bulbs {
+			bulb.releaseManualState()
+			// take over from wherever the bulb is now
+			bulb.TargetState = bulb.bulb.GetState()
+			bulb.Controlled = true
+		}
+		a.adjustTogether(bulbs)
+	case GestureScene:
+		_, err := a.ActivateScene(action.Scene, transition, until)
+		return err
+	case GestureOverride:
+		ms := &ManualState{
+			Until:      now.Add(time.Hour),
+			Brightness: action.Brightness,
+			Kelvin:     action.Kelvin,
+		}
+		if until != nil {
+			ms.Until = *until
+		}
+		if action.Transition != nil {
+			ms.Transition = &transition
+		}
+		for _, bulb := range bulbs {
+			bulb.setManualState(ms)
+			bulb.Controlled = true
+		}
+		a.adjustTogether(bulbs)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func TestGestureDetector(t *testing.T) {
+	gc := defaultGestureConfig
+	start := time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC)
+	d := &gestureDetector{}
+
+	// two quick cycles
+	d.observe(false, start, gc.MaxOff)
+	d.observe(true, start.Add(time.Second), gc.MaxOff)
+	d.observe(false, start.Add(2*time.Second), gc.MaxOff)
+	d.observe(true, start.Add(3*time.Second), gc.MaxOff)
+	if n := d.poll(start.Add(4*time.Second), gc); n != 0 {
+		t.Fatalf("expected no gesture while waiting for more cycles, got: %d", n)
+	}
+	if n := d.poll(start.Add(8*time.Second), gc); n != 2 {
+		t.Fatalf("expected %d cycles, got: %d", 2, n)
+	}
+	if n := d.poll(start.Add(9*time.Second), gc); n != 0 {
+		t.Fatalf("expected gesture to fire once, got: %d", n)
+	}
+
+	// off for longer than max-off isn't a gesture
+	d.observe(false, start.Add(10*time.Second), gc.MaxOff)
+	d.observe(true, start.Add(20*time.Second), gc.MaxOff)
+	if n := d.poll(start.Add(30*time.Second), gc); n != 0 {
+		t.Fatalf("expected no gesture after a long off, got: %d", n)
+	}
+
+	// a cycle followed by turning off for real
+	d.observe(false, start.Add(40*time.Second), gc.MaxOff)
+	d.observe(true, start.Add(41*time.Second), gc.MaxOff)
+	d.observe(false, start.Add(42*time.Second), gc.MaxOff)
+	if n := d.poll(start.Add(50*time.Second), gc); n != 0 {
+		t.Fatalf("expected no gesture once the bulb stayed off, got: %d", n)
+	}
+	d.observe(true, start.Add(60*time.Second), gc.MaxOff)
+	if n := d.poll(start.Add(70*time.Second), gc); n != 0 {
+		t.Fatalf("expected no gesture, got: %d", n)
+	}
+}
+
+func TestGestureActions(t *testing.T) {
+	a, clock := testApp()
+	a.gestures = &Gestures{
+		Groups: map[string]*GestureConfig{
+			"Kitchen": {
+				Actions: map[string]*GestureAction{
+					"1": {Action: GestureReset},
+					"2": {Action: GestureOverride, Brightness: uint16p(65535), For: durationp(time.Hour)},
+				},
+			},
+		},
+	}
+	b := report(a, 32768, 5000)
+
+	cycle := func() {
+		reportPower(a, 32768, powerOff)
+		clock.Advance(time.Second)
+		reportPower(a, 32768, powerOn)
+		clock.Advance(time.Second)
+	}
+
+	cycle()
+	cycle()
+	a.checkGestures()
+	if b.ManualStateBrightness != nil {
+		t.Fatal("expected no action before the gesture completes")
+	}
+	clock.Advance(5 * time.Second)
+	a.checkGestures()
+	if b.ManualStateBrightness == nil || *b.ManualStateBrightness != 65535 {
+		t.Fatal("expected two cycles to set a bright override")
+	}
+	if !b.ManualStateUntil.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("expected override until %s, got: %s", clock.Now().Add(time.Hour), b.ManualStateUntil)
+	}
+
+	clock.Advance(time.Minute)
+	cycle()
+	clock.Advance(5 * time.Second)
+	a.checkGestures()
+	if b.hasManualState() {
+		t.Fatal("expected one cycle to reset the bulb to its curve")
+	}
+	if b.TargetState.Brightness != 32768 || b.ControlReason() != "curve" {
+		t.Fatalf("expected curve control at %d, got: %s at %d", 32768, b.ControlReason(), b.TargetState.Brightness)
+	}
+}
+
+func TestGestureAtWallSwitch(t *testing.T) {
+	a, clock := testApp()
+	a.gestures = &Gestures{
+		Groups: map[string]*GestureConfig{
+			"Kitchen": {
+				Actions: map[string]*GestureAction{
+					"2": {Action: GestureOverride, Brightness: uint16p(65535), For: durationp(time.Hour)},
+				},
+			},
+		},
+	}
+	b := report(a, 32768, 5000)
+
+	// the bulb keeps reporting itself on, it just stops answering until
+	// the client gives up on it, then comes back when switched on again
+	visibility := time.Duration(a.config.VisibilityTimeout)
+	cycle := func() {
+		lastSeen := clock.Now()
+		clock.Advance(visibility + time.Second)
+		gone := lifx.NewBulbWithState(testAddr, "Lamp", "Kitchen", "Home", lifx.BulbState{
+			Brightness: 32768,
+			Kelvin:     5000,
+			Power:      powerOn,
+			Visible:    false,
+		})
+		gone.SetLastSeen(lastSeen)
+		a.SetState(gone)
+		clock.Advance(time.Second)
+		report(a, 32768, 5000)
+		clock.Advance(time.Second)
+	}
+
+	cycle()
+	cycle()
+	a.checkGestures()
+	if b.ManualStateBrightness != nil {
+		t.Fatal("expected no action before the gesture completes")
+	}
+	clock.Advance(5 * time.Second)
+	a.checkGestures()
+	if b.ManualStateBrightness == nil || *b.ManualStateBrightness != 65535 {
+		t.Fatal("expected two cycles at the wall switch to set a bright override")
+	}
+}
+
+func TestGestureMaxOffVisibility(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gestures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, _ := testApp()
+	a.gesturesPath = filepath.Join(dir, "gestures.json")
+	err = ioutil.WriteFile(a.gesturesPath, []byte(`{"groups": {"Kitchen": {"max-off": "2s"}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.loadGestures()
+	if err == nil || !strings.Contains(err.Error(), "visibility-timeout") {
+		t.Fatalf("expected max-off within the visibility timeout to be rejected, got: %v", err)
+	}
+}
+
+func durationp(d time.Duration) *Duration {
+	v := Duration(d)
+	return &v
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/lib"
+)
+
+// Group change results
+const (
+	GroupResultSent       = "sent"
+	GroupResultFailed     = "failed"
+	GroupResultSuperseded = "superseded"
+)
+
+// GroupChange is how a group change went, the data of a group-changed event
+type GroupChange struct {
+	Bulbs []*GroupChangeBulb `json:"bulbs"`
+	// Broadcast is set when the change went out as one broadcast packet
+	Broadcast bool `json:"broadcast,omitempty"`
+}
+
+// GroupChangeBulb is how sending one bulb its part of a group change went
+type GroupChangeBulb struct {
+	Address string     `json:"address"`
+	Name    string     `json:"name"`
+	Result  string     `json:"result"`
+	Sent    *time.Time `json:"sent,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// groupResultName is sent, failed or superseded
+func groupResultName(result lifx.GroupResult) string {
+	switch {
+	case result.Superseded:
+		return GroupResultSuperseded
+	case result.Err != nil:
+		return GroupResultFailed
+	}
+	return GroupResultSent
+}
+
+// groupChangeKey is what bulbs' colour changes must share to be sent
+// together
+type groupChangeKey struct {
+	group      string
+	transition time.Duration
+	priority   lifx.Priority
+}
+
+// adjustTogether sends each bulb whatever it needs to match its target,
+// the bulbs in a group changing together
+func (a *App) adjustTogether(bulbs []*Bulb) {
+	var changes []*colourChange
+	for _, bulb := range bulbs {
+		if change := bulb.planState(); change != nil {
+			changes = append(changes, change)
+		}
+	}
+	a.sendColourChanges(changes)
+}
+
+// sendColourChanges sends colour changes, those for bulbs in the same group
+// over the same transition as one group change so their transitions start
+// together rather than one after another
+func (a *App) sendColourChanges(changes []*colourChange) {
+	var keys []groupChangeKey
+	groups := make(map[groupChangeKey][]*colourChange)
+	for _, change := range changes {
+		key := groupChangeKey{change.bulb.Group, change.transition, change.priority}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], change)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		timing := uint32(key.transition / time.Millisecond)
+		if key.group == "" || len(group) == 1 {
+			for _, change := range group {
+				a.client.SetColour(change.bulb.bulb, change.priority, change.hue, change.saturation, change.brightness, change.kelvin, timing)
+			}
+			continue
+		}
+
+		colours := make([]lifx.GroupColour, len(group))
+		for i, change := range group {
+			colours[i] = lifx.GroupColour{
+				Bulb:       change.bulb.bulb,
+				Hue:        change.hue,
+				Saturation: change.saturation,
+				Brightness: change.brightness,
+				Kelvin:     change.kelvin,
+			}
+		}
+		go a.groupChanged(key.group, group, a.client.SetGroupColour(key.priority, timing, colours))
+	}
+}
+
+// groupChanged records and publishes how sending a group change went once
+// it has been sent, the results are in the same order as the changes. Bulbs
+// given a newer colour before the change went out weren't sent theirs.
+func (a *App) groupChanged(group string, changes []*colourChange, results <-chan []lifx.GroupResult) {
+	var first, last time.Time
+	failed, superseded := 0, 0
+	r := <-results
+
+	a.controlMutex.Lock()
+	gc := &GroupChange{Bulbs: make([]*GroupChangeBulb, len(r))}
+	for i, result := range r {
+		gb := &GroupChangeBulb{
+			Address: changes[i].bulb.Address,
+			Name:    changes[i].bulb.Name,
+			Result:  groupResultName(result),
+		}
+		if result.Err != nil {
+			gb.Error = result.Err.Error()
+		} else if !result.Superseded {
+			sent := result.Sent
+			gb.Sent = &sent
+		}
+		gc.Bulbs[i] = gb
+		gc.Broadcast = gc.Broadcast || result.Broadcast
+	}
+	a.publishGroupChange(group, gc)
+	a.controlMutex.Unlock()
+
+	for i, result := range r {
+		a.metrics.groupChangeSent(result)
+		if result.Superseded {
+			superseded++
+			continue
+		}
+		if result.Err != nil {
+			failed++
+			log.WithFields(log.Fields{
+				"group":   group,
+				"name":    changes[i].bulb.Name,
+				"address": changes[i].bulb.Address,
+				"error":   result.Err,
+			}).Warn("failed to send group change to bulb")
+			continue
+		}
+		if first.IsZero() || result.Sent.Before(first) {
+			first = result.Sent
+		}
+		if result.Sent.After(last) {
+			last = result.Sent
+		}
+	}
+	if failed+superseded < len(r) {
+		a.metrics.groupChangeSpread(last.Sub(first))
+	}
+
+	log.WithFields(log.Fields{
+		"group":      group,
+		"bulbs":      len(r),
+		"failed":     failed,
+		"superseded": superseded,
+		"spread":     last.Sub(first),
+		"broadcast":  gc.Broadcast,
+	}).Info("sent group change")
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.adam.gs/home/lifx/filter"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func TestAdjustTogether(t *testing.T) {
+	a, _ := testApp()
+	defer withGateway(t, a)()
+	a.client.Rate = 0
+	lamp := report(a, 1000, 2700)
+	for _, bulb := range []*lifx.Bulb{
+		lifx.NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Spot", "Kitchen", "Home", lifx.BulbState{Power: 65535, Visible: true}),
+		lifx.NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Porch", "Outside", "Home", lifx.BulbState{Power: 65535, Visible: true}),
+	} {
+		a.SetState(bulb)
+	}
+
+	a.adjustControlled()
+	for _, bulb := range a.BulbList() {
+		if bulb.Controlled {
+			t.Fatalf("expected control of %s to be suspended while the change is in flight", bulb.Name)
+		}
+	}
+	if lamp.TargetState.Brightness != 32768 {
+		t.Fatalf("expected %d, got: %d", 32768, lamp.TargetState.Brightness)
+	}
+
+	// the kitchen's two bulbs went as one command, the porch on its own
+	body := serve(a, "GET", "/metrics", "").Body.String()
+	expected := `lifx_command_queue_delay_seconds_count{type="SetLightColour"} 2`
+	if !strings.Contains(body, expected) {
+		t.Fatalf("expected %q in:\n%s", expected, body)
+	}
+}
+
+func TestGroupChanged(t *testing.T) {
+	a, clock := testApp()
+	lamp := report(a, 1000, 2700)
+	changes := []*colourChange{{bulb: lamp}, {bulb: lamp}, {bulb: lamp}, {bulb: lamp}}
+
+	results := make(chan []lifx.GroupResult, 1)
+	results <- []lifx.GroupResult{
+		{Bulb: lamp.bulb, Sent: clock.Now()},
+		{Bulb: lamp.bulb, Sent: clock.Now().Add(2 * time.Millisecond)},
+		{Bulb: lamp.bulb, Err: errors.New("gone")},
+		{Bulb: lamp.bulb, Superseded: true},
+	}
+	sub, _, _ := a.events.subscribe(eventID{}, filter.All{}, map[string]bool{EventGroupChanged: true})
+	defer a.events.unsubscribe(sub)
+	a.groupChanged("Kitchen", changes, results)
+
+	e := <-sub.events
+	gc, ok := e.Data.(*GroupChange)
+	if !ok || e.Group != "Kitchen" || len(gc.Bulbs) != 4 {
+		t.Fatalf("expected a group change for the kitchen's 4 parts, got: %+v", e)
+	}
+	for i, expected := range []string{GroupResultSent, GroupResultSent, GroupResultFailed, GroupResultSuperseded} {
+		if gc.Bulbs[i].Result != expected || gc.Bulbs[i].Address != "d073d50035f7" {
+			t.Fatalf("expected %s for part %d, got: %+v", expected, i, gc.Bulbs[i])
+		}
+	}
+	if gc.Bulbs[1].Sent == nil || !gc.Bulbs[1].Sent.Equal(clock.Now().Add(2*time.Millisecond)) || gc.Bulbs[2].Error != "gone" || gc.Bulbs[3].Sent != nil {
+		t.Fatalf("unexpected parts: %+v %+v %+v", gc.Bulbs[1], gc.Bulbs[2], gc.Bulbs[3])
+	}
+
+	body := serve(a, "GET", "/metrics", "").Body.String()
+	for _, expected := range []string{
+		`lifx_group_change_bulbs_total{result="sent"} 2`,
+		`lifx_group_change_bulbs_total{result="failed"} 1`,
+		`lifx_group_change_bulbs_total{result="superseded"} 1`,
+		`lifx_group_change_spread_seconds_sum 0.002`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, body)
+		}
+	}
+}
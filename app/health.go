@@ -0,0 +1,150 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gocraft/web"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+// healthStale is how long a loop can go without ticking before it is
+// considered stuck, loops which tick less often get three of their intervals
+const healthStale = 30 * time.Second
+
+// heartbeat is when a background loop last ticked and how often it ticks
+type heartbeat struct {
+	at       time.Time
+	interval time.Duration
+}
+
+// staleAfter is how long a loop ticking every interval can go quiet
+func staleAfter(interval time.Duration) time.Duration {
+	if 3*interval > healthStale {
+		return 3 * interval
+	}
+	return healthStale
+}
+
+// HealthCheck is the outcome of one health or readiness check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthJSON is the body of /healthz and /readyz
+type HealthJSON struct {
+	Status string         `json:"status"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+func (h *HealthJSON) add(name string, ok bool, detail string) {
+	h.Checks = append(h.Checks, &HealthCheck{Name: name, OK: ok, Detail: detail})
+	if !ok {
+		h.Status = "failing"
+	}
+}
+
+func newHealthJSON() *HealthJSON {
+	return &HealthJSON{Status: "ok", Checks: []*HealthCheck{}}
+}
+
+// heartbeat records that a background loop ticking every interval is still
+// running
+func (a *App) heartbeat(loop string, interval time.Duration) {
+	now := a.clock.Now()
+
+	a.heartbeatsMutex.Lock()
+	defer a.heartbeatsMutex.Unlock()
+	a.heartbeats[loop] = heartbeat{now, interval}
+}
+
+// since describes how long ago t was, checking it is recent enough for
+// something which happens every interval
+func since(now time.Time, t time.Time, interval time.Duration) (bool, string) {
+	if t.IsZero() {
+		return false, "never"
+	}
+	ago := now.Sub(t)
+	return ago < staleAfter(interval), fmt.Sprintf("%s ago", ago.Truncate(time.Millisecond))
+}
+
+// checkHealth reports whether the client's socket and loops and our own
+// background loops are alive
+func (a *App) checkHealth(ch lifx.Health) *HealthJSON {
+	now := a.clock.Now()
+	h := newHealthJSON()
+
+	if ch.Listening {
+		h.add("broadcast-socket", true, "open")
+	} else {
+		h.add("broadcast-socket", false, "not listening")
+	}
+	// the event loop ticks at least every visibility timeout
+	ok, detail := since(now, ch.LastTick, a.client.VisibilityTimeout)
+	h.add("event-loop", ok, detail)
+	ok, detail = since(now, ch.LastDiscovery, a.client.DiscoveryInterval)
+	h.add("discovery", ok, detail)
+
+	a.heartbeatsMutex.Lock()
+	loops := make([]string, 0, len(a.heartbeats))
+	for loop := range a.heartbeats {
+		loops = append(loops, loop)
+	}
+	sort.Strings(loops)
+	for _, loop := range loops {
+		hb := a.heartbeats[loop]
+		ok, detail := since(now, hb.at, hb.interval)
+		h.add("loop:"+loop, ok, detail)
+	}
+	a.heartbeatsMutex.Unlock()
+
+	return h
+}
+
+// checkReady reports whether we have found something to control and know
+// how to control it
+func (a *App) checkReady(ch lifx.Health) *HealthJSON {
+	h := newHealthJSON()
+
+	bulbs := a.bulbCount()
+	h.add("discovered", ch.Gateways > 0 || bulbs > 0,
+		fmt.Sprintf("%d gateways, %d bulbs", ch.Gateways, bulbs))
+
+	a.curvesMutex.RLock()
+	switch {
+	case a.curves == nil && a.curvesError != nil:
+		h.add("curves", false, a.curvesError.Error())
+	case a.curves == nil:
+		h.add("curves", false, "not loaded yet")
+	case a.curvesError != nil:
+		// the last good curves are still in use
+		h.add("curves", true, "reload failed: "+a.curvesError.Error())
+	default:
+		h.add("curves", true, fmt.Sprintf("%d named curves", len(a.curves.Named)))
+	}
+	a.curvesMutex.RUnlock()
+
+	return h
+}
+
+func (c *Context) writeHealth(rw web.ResponseWriter, h *HealthJSON) {
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	c.writeJSONStatus(rw, status, h)
+}
+
+// Healthz is the liveness probe
+func (c *Context) Healthz(rw web.ResponseWriter, req *web.Request) {
+	c.writeHealth(rw, c.App.checkHealth(c.App.client.Health()))
+}
+
+// Readyz is the readiness probe
+func (c *Context) Readyz(rw web.ResponseWriter, req *web.Request) {
+	c.writeHealth(rw, c.App.checkReady(c.App.client.Health()))
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func healthCheck(t *testing.T, h *HealthJSON, name string) *HealthCheck {
+	for _, check := range h.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("expected a %s check, got: %v", name, h.Checks)
+	return nil
+}
+
+func TestHealth(t *testing.T) {
+	a, clock := testApp()
+	a.heartbeat("control", time.Second)
+
+	ch := lifx.Health{
+		Listening:     true,
+		LastTick:      clock.Now(),
+		LastDiscovery: clock.Now(),
+	}
+	h := a.checkHealth(ch)
+	if h.Status != "ok" {
+		t.Fatalf("expected ok, got: %s %v", h.Status, h.Checks)
+	}
+
+	clock.Advance(time.Minute)
+	ch.LastTick = clock.Now()
+	ch.LastDiscovery = clock.Now()
+	h = a.checkHealth(ch)
+	if h.Status != "failing" || healthCheck(t, h, "loop:control").OK {
+		t.Fatal("expected a stuck loop to fail the health check")
+	}
+
+	// the client in tests never starts listening
+	rw := serve(a, "GET", "/healthz", "")
+	if rw.Code != 503 {
+		t.Fatalf("expected %d, got: %d", 503, rw.Code)
+	}
+	h = &HealthJSON{}
+	err := json.Unmarshal(rw.Body.Bytes(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if healthCheck(t, h, "broadcast-socket").OK {
+		t.Fatal("expected the broadcast socket check to fail")
+	}
+}
+
+func TestHealthLongInterval(t *testing.T) {
+	a, clock := testApp()
+	a.heartbeat("control", time.Minute)
+
+	ch := lifx.Health{
+		Listening:     true,
+		LastTick:      clock.Now(),
+		LastDiscovery: clock.Now(),
+	}
+
+	// a loop ticking every minute isn't stuck between ticks
+	clock.Advance(time.Minute + 10*time.Second)
+	ch.LastTick = clock.Now()
+	ch.LastDiscovery = clock.Now()
+	h := a.checkHealth(ch)
+	if !healthCheck(t, h, "loop:control").OK {
+		t.Fatalf("expected a slow loop between ticks to be healthy, got: %v", healthCheck(t, h, "loop:control").Detail)
+	}
+
+	clock.Advance(2 * time.Minute)
+	ch.LastTick = clock.Now()
+	ch.LastDiscovery = clock.Now()
+	h = a.checkHealth(ch)
+	if healthCheck(t, h, "loop:control").OK {
+		t.Fatal("expected a slow loop which missed three ticks to fail")
+	}
+}
+
+func TestReady(t *testing.T) {
+	a, _ := testApp()
+	curves := a.curves
+	a.curves = nil
+
+	h := a.checkReady(lifx.Health{})
+	if healthCheck(t, h, "discovered").OK || healthCheck(t, h, "curves").OK {
+		t.Fatalf("expected not ready, got: %v", h.Checks)
+	}
+
+	report(a, 32768, 5000)
+	a.curves = curves
+	rw := serve(a, "GET", "/readyz", "")
+	if rw.Code != 200 {
+		t.Fatalf("expected %d, got: %d %s", 200, rw.Code, rw.Body.String())
+	}
+
+	// a failed reload leaves the old curves in use
+	a.curvesError = errors.New("bad curve")
+	h = a.checkReady(lifx.Health{})
+	if h.Status != "ok" || healthCheck(t, h, "curves").Detail != "reload failed: bad curve" {
+		t.Fatalf("expected ready with the reload error, got: %v", h.Checks)
+	}
+}
@@ -1,45 +1,219 @@
 package app
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gocraft/web"
 	log "github.com/sirupsen/logrus"
+	lifx "gitlab.adam.gs/home/lifx/lib"
 )
 
 type BulbJSON struct {
-	Name          string    `json:"name"`
-	Address       string    `json:"address"`
-	Lux           float32   `json:"lux,omitempty"`
-	Location      string    `json:"location,omitempty"`
-	Group         string    `json:"group,omitempty"`
-	LastSeen      time.Time `json:"last-seen"`
-	LastSeenSince string    `json:"last-seen-since"`
-	Hue           int       `json:"hue"`
-	Saturation    int       `json:"saturation"`
-	Brightness    int       `json:"brightness"`
-	Kelvin        int       `json:"kelvin"`
-	Dim           int       `json:"dim"`
-	Power         int       `json:"power"`
+	Name          string     `json:"name"`
+	Address       string     `json:"address"`
+	Lux           float32    `json:"lux,omitempty"`
+	Location      string     `json:"location,omitempty"`
+	Group         string     `json:"group,omitempty"`
+	LastSeen      time.Time  `json:"last-seen"`
+	LastSeenSince string     `json:"last-seen-since"`
+	Hue           int        `json:"hue"`
+	Saturation    int        `json:"saturation"`
+	Brightness    int        `json:"brightness"`
+	Kelvin        int        `json:"kelvin"`
+	Dim           int        `json:"dim"`
+	Power         int        `json:"power"`
+	Controlled    bool       `json:"controlled"`
+	ControlAfter  *time.Time `json:"control-after,omitempty"`
+	ControlReason string     `json:"control-reason"`
+
+	Product  *lifx.Product `json:"product,omitempty"`
+	Override *OverrideJSON `json:"override,omitempty"`
+	Offset   *Offset       `json:"offset,omitempty"`
+}
+
+func (a *App) bulbJSON(bulb *Bulb) *BulbJSON {
+	state := bulb.bulb.GetState()
+	v := &BulbJSON{
+		Name:          bulb.Name,
+		Address:       bulb.Address,
+		Location:      bulb.Location,
+		Group:         bulb.Group,
+		Lux:           bulb.Lux,
+		LastSeen:      bulb.bulb.LastSeen(),
+		LastSeenSince: a.clock.Since(bulb.bulb.LastSeen()).String(),
+		Hue:           int(state.Hue),
+		Saturation:    int(state.Saturation),
+		Brightness:    int(state.Brightness),
+		Kelvin:        int(state.Kelvin),
+		Dim:           int(state.Dim),
+		Power:         int(state.Power),
+		Controlled:    bulb.Controlled,
+		ControlReason: bulb.ControlReason(),
+		Product:       bulb.bulb.GetProduct(),
+		Override:      bulb.override(a.clock.Now()),
+		Offset:        a.bulbOffset(bulb),
+	}
+	if !bulb.Controlled {
+		controlAfter := bulb.ControlAfter
+		v.ControlAfter = &controlAfter
+	}
+	return v
+}
+
+func (c *Context) bulbJSON(bulb *Bulb) *BulbJSON {
+	return c.App.bulbJSON(bulb)
 }
 
 type Context struct {
-	App *App
+	App       *App
+	RequestID string
+	Principal *Principal
+
+	// v2 requests get JSON error envelopes
+	v2 bool
+
+	// control is set for requests which change things, which are limited
+	// to the principal's groups
+	control bool
+}
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRequestID returns the caller's X-Request-ID if it's sensible, or a new one
+func newRequestID(req *web.Request) string {
+	if id := req.Header.Get("x-request-id"); requestIDRegexp.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// error writes an error response, a JSON envelope for v2 and plain text otherwise
+func (c *Context) error(rw web.ResponseWriter, status int, message string) {
+	if !c.v2 {
+		http.Error(rw, message, status)
+		return
+	}
+	d, err := json.Marshal(&ErrorEnvelope{Error: &APIError{
+		Status:    status,
+		Code:      strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1)),
+		Message:   message,
+		RequestID: c.RequestID,
+	}})
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(d)
+}
+
+func (c *Context) panicked(rw web.ResponseWriter, req *web.Request, err interface{}) {
+	log.WithFields(log.Fields{
+		"request-id": c.RequestID,
+		"method":     req.Method,
+		"path":       req.URL.Path,
+		"error":      err,
+	}).Error("panic handling request")
+	c.error(rw, http.StatusInternalServerError, "internal error")
 }
 
-func RunWebServer(a *App) {
+// isV2 reports whether path is in the v2 API, including under a site which
+// doesn't exist
+func isV2(path string) bool {
+	if strings.HasPrefix(path, "/sites/") {
+		rest := strings.TrimPrefix(path, "/sites/")
+		if i := strings.Index(rest, "/"); i >= 0 {
+			path = rest[i:]
+		}
+	}
+	return strings.HasPrefix(path, "/api/v2/")
+}
+
+func (c *Context) notFound(rw web.ResponseWriter, req *web.Request) {
+	if c.RequestID == "" {
+		c.RequestID = newRequestID(req)
+		rw.Header().Set("x-request-id", c.RequestID)
+	}
+	c.v2 = isV2(req.URL.Path)
+	c.error(rw, http.StatusNotFound, "not found")
+}
+
+// unlockedPaths take controlMutex themselves for only as long as they need
+// it, the event streams because they last as long as the client stays
+// connected and metrics because they're gathered across sites
+var unlockedPaths = map[string]bool{
+	"/events":           true,
+	"/events/ws":        true,
+	"/api/v2/events":    true,
+	"/api/v2/events/ws": true,
+	"/metrics":          true,
+}
+
+// lockControl holds controlMutex while the request is handled, so handlers
+// see and change the bulbs one at a time with the control loops
+func (c *Context) lockControl(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if !unlockedPaths[req.URL.Path] {
+		c.App.controlMutex.Lock()
+		defer c.App.controlMutex.Unlock()
+	}
+	next(rw, req)
+}
+
+func newRouter(a *App) *web.Router {
 	router := web.New(Context{})
 
 	router.Middleware(func(ctx *Context, rw web.ResponseWriter,
 		req *web.Request, next web.NextMiddlewareFunc) {
 		ctx.App = a
+		ctx.RequestID = newRequestID(req)
+		rw.Header().Set("x-request-id", ctx.RequestID)
 		next(rw, req)
 	})
+	router.Middleware((*Context).authorize)
+	router.Middleware((*Context).lockControl)
+	router.Error((*Context).panicked)
+	router.NotFound((*Context).notFound)
 
 	router.Get("/curves", (*Context).ListCurves)
+	router.Get("/curves/default", (*Context).GetCurve)
+	router.Put("/curves/default", (*Context).PutCurve)
+	router.Patch("/curves/default/hours/:hour", (*Context).PatchCurveHour)
+	router.Delete("/curves/default/hours/:hour", (*Context).DeleteCurveHour)
+	router.Get("/curves/groups/:name", (*Context).GetCurve)
+	router.Put("/curves/groups/:name", (*Context).PutCurve)
+	router.Delete("/curves/groups/:name", (*Context).DeleteCurve)
+	router.Patch("/curves/groups/:name/hours/:hour", (*Context).PatchCurveHour)
+	router.Delete("/curves/groups/:name/hours/:hour", (*Context).DeleteCurveHour)
+	router.Get("/scenes", (*Context).ListScenes)
+	router.Get("/scenes/:name", (*Context).GetScene)
+	router.Delete("/scenes/:name", (*Context).DeleteScene)
+	router.Post("/scenes/:name/capture", (*Context).CaptureScene)
+	router.Post("/scenes/:name/activate", (*Context).ActivateScene)
+	router.Get("/simulate/group/:group", (*Context).SimulateGroup)
+	router.Get("/simulate/bulb/:bulb_id", (*Context).SimulateBulb)
+	router.Get("/groups", (*Context).ListGroups)
+	router.Get("/groups/:name", (*Context).GetGroup)
+	router.Post("/groups/:name/occupancy", (*Context).GroupOccupancy)
+	router.Post("/occupancy/:*", (*Context).FilterOccupancy)
+	router.Get("/sites", (*Context).ListSites)
+	router.Get("/healthz", (*Context).Healthz)
+	router.Get("/readyz", (*Context).Readyz)
+	router.Get("/metrics", (*Context).Metrics)
+	router.Get("/events", (*Context).Events)
+	router.Get("/events/ws", (*Context).EventsWebSocket)
 	router.Get("/bulbs", (*Context).ListBulbs)
 	router.Get("/bulbs/:*", (*Context).ListBulbs)
 	router.Post("/bulbs/:*", (*Context).UpdateBulbs)
@@ -47,8 +221,42 @@ func RunWebServer(a *App) {
 	router.Get("/bulb/:bulb_id", (*Context).GetBulb)
 	router.Post("/bulb/:bulb_id", (*Context).UpdateBulb)
 
-	go http.ListenAndServe(":8089", router)
-	log.Info("listening")
+	v2 := router.Subrouter(Context{}, "/api/v2")
+	v2.Middleware(func(ctx *Context, rw web.ResponseWriter,
+		req *web.Request, next web.NextMiddlewareFunc) {
+		ctx.v2 = true
+		next(rw, req)
+	})
+	for _, route := range apiRoutes() {
+		route.register(v2)
+	}
+
+	return router
+}
+
+func RunWebServer(a *App) error {
+	return listen(a.config.Listen, a.auth, newRouter(a))
+}
+
+// listen serves handler on address, with TLS if auth has it
+func listen(address string, auth *AuthConfig, handler http.Handler) error {
+	if auth == nil || auth.TLS == nil {
+		go http.ListenAndServe(address, handler)
+		log.WithField("address", address).Info("listening")
+		return nil
+	}
+
+	config, err := auth.tlsConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: address, Handler: handler, TLSConfig: config}
+	go server.ListenAndServeTLS("", "")
+	log.WithFields(log.Fields{
+		"address":             address,
+		"client-certificates": config.ClientCAs != nil,
+	}).Info("listening with tls")
+	return nil
 }
 
 type UpdateBulbRequest struct {
@@ -56,51 +264,126 @@ type UpdateBulbRequest struct {
 	Duration   *string    `json:"duration,omitempty"`
 	Brightness *int       `json:"brightness,omitempty"`
 	Kelvin     *int       `json:"kelvin,omitempty"`
+	Hue        *int       `json:"hue,omitempty"`
+	Saturation *int       `json:"saturation,omitempty"`
+	Power      *bool      `json:"power,omitempty"`
+	Transition *string    `json:"transition,omitempty"`
 }
 
-func ParseUpdateBulbRequest(ur *UpdateBulbRequest) (*time.Time, *time.Duration, *uint16, *uint16, error) {
+// ManualState is a parsed UpdateBulbRequest, ready to apply to a bulb
+type ManualState struct {
+	Until      time.Time
+	Duration   *time.Duration
+	Brightness *uint16
+	Kelvin     *uint16
+	Hue        *uint16
+	Saturation *uint16
+	Power      *bool
+	Transition *time.Duration
+
+	// Source names whatever set the state when it wasn't a person, such as occupancy
+	Source string
+}
+
+func ParseUpdateBulbRequest(ur *UpdateBulbRequest, now time.Time) (*ManualState, error) {
 	if ur.Until != nil && ur.Duration != nil {
-		return nil, nil, nil, nil, errors.New("don't set both until and duration")
+		return nil, errors.New("don't set both until and duration")
 	}
-	var until *time.Time
-	var duration *time.Duration
-	var brightness *uint16
-	var kelvin *uint16
+	ms := &ManualState{}
 
 	if ur.Until != nil {
-		until = ur.Until
+		ms.Until = *ur.Until
 	} else if ur.Duration != nil {
 		dv, err := time.ParseDuration(*ur.Duration)
 		if err != nil {
-			return nil, nil, nil, nil, errors.New("can't parse duration")
+			return nil, errors.New("can't parse duration")
 		}
-		duration = &dv
-		uv := time.Now().Add(dv)
-		until = &uv
+		ms.Duration = &dv
+		ms.Until = now.Add(dv)
 	} else {
-		return nil, nil, nil, nil, errors.New("must set until or duration")
+		return nil, errors.New("must set until or duration")
 	}
-	if ur.Brightness == nil && ur.Kelvin == nil {
-		return nil, nil, nil, nil, errors.New("must set one of brightness or kelvin")
+	if ur.Brightness == nil && ur.Kelvin == nil && ur.Hue == nil && ur.Saturation == nil && ur.Power == nil {
+		return nil, errors.New("must set one of brightness, kelvin, hue, saturation or power")
+	}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{{"brightness", ur.Brightness}, {"hue", ur.Hue}, {"saturation", ur.Saturation}} {
+		if field.value != nil && (*field.value < 0 || *field.value > 65535) {
+			return nil, fmt.Errorf("%s %d out of range (0-65535)", field.name, *field.value)
+		}
+	}
+	if ur.Kelvin != nil && (*ur.Kelvin < minKelvin || *ur.Kelvin > maxKelvin) {
+		return nil, fmt.Errorf("kelvin %d out of range (%d-%d)", *ur.Kelvin, minKelvin, maxKelvin)
 	}
 
 	if ur.Brightness != nil {
 		bv := uint16(*ur.Brightness)
-		brightness = &bv
+		ms.Brightness = &bv
 	}
 
 	if ur.Kelvin != nil {
 		kv := uint16(*ur.Kelvin)
-		kelvin = &kv
+		ms.Kelvin = &kv
 	}
 
-	return until, duration, brightness, kelvin, nil
+	if ur.Hue != nil {
+		hv := uint16(*ur.Hue)
+		ms.Hue = &hv
+	}
+
+	if ur.Saturation != nil {
+		sv := uint16(*ur.Saturation)
+		ms.Saturation = &sv
+	}
+
+	ms.Power = ur.Power
+
+	if ur.Transition != nil {
+		tv, err := time.ParseDuration(*ur.Transition)
+		if err != nil || tv < 0 {
+			return nil, errors.New("can't parse transition")
+		}
+		ms.Transition = &tv
+	}
+
+	return ms, nil
+}
+
+func (ms *ManualState) logFields() log.Fields {
+	fields := log.Fields{
+		"until": ms.Until,
+	}
+	if ms.Duration != nil {
+		fields["duration"] = *ms.Duration
+	}
+	if ms.Brightness != nil {
+		fields["brightness"] = *ms.Brightness
+	}
+	if ms.Kelvin != nil {
+		fields["kelvin"] = *ms.Kelvin
+	}
+	if ms.Hue != nil {
+		fields["hue"] = *ms.Hue
+	}
+	if ms.Saturation != nil {
+		fields["saturation"] = *ms.Saturation
+	}
+	if ms.Power != nil {
+		fields["power"] = *ms.Power
+	}
+	if ms.Transition != nil {
+		fields["transition"] = *ms.Transition
+	}
+	return fields
 }
 
 func (c *Context) ReleaseBulbs(rw web.ResponseWriter, req *web.Request) {
 	bulbs, err := c.filter(req.PathParams["*"])
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
 	for _, bulb := range bulbs {
@@ -108,9 +391,7 @@ func (c *Context) ReleaseBulbs(rw web.ResponseWriter, req *web.Request) {
 			"address": bulb.Address,
 			"name":    bulb.Name,
 		})
-		bulb.ManualStateUntil = time.Now()
-		bulb.ManualStateBrightness = nil
-		bulb.ManualStateKelvin = nil
+		bulb.releaseManualState()
 		bulb.Controlled = true
 		le.Info("releasing bulb from manual control")
 	}
@@ -119,41 +400,29 @@ func (c *Context) ReleaseBulbs(rw web.ResponseWriter, req *web.Request) {
 func (c *Context) UpdateBulbs(rw web.ResponseWriter, req *web.Request) {
 	bulbs, err := c.filter(req.PathParams["*"])
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
 	ur := &UpdateBulbRequest{}
 	err = unmarshal_json_request(rw, req, ur)
 	if err != nil {
-		panic(err)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
-	until, duration, brightness, kelvin, err := ParseUpdateBulbRequest(ur)
+	ms, err := ParseUpdateBulbRequest(ur, c.App.clock.Now())
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
 	for _, bulb := range bulbs {
-		le := log.WithFields(log.Fields{
+		bulb.setManualState(ms)
+		log.WithFields(log.Fields{
 			"address": bulb.Address,
 			"name":    bulb.Name,
-		})
-		bulb.ManualStateUntil = *until
-		le = le.WithField("until", *until)
-		if duration != nil {
-			le = le.WithField("duration", *duration)
-		}
-		bulb.ManualStateBrightness = nil
-		bulb.ManualStateKelvin = nil
-		if brightness != nil {
-			bulb.ManualStateBrightness = brightness
-			le = le.WithField("brightness", *brightness)
-		}
-		if kelvin != nil {
-			bulb.ManualStateKelvin = kelvin
-			le = le.WithField("kelvin", *kelvin)
-		}
-		le.Info("setting bulb to manual control")
+		}).WithFields(ms.logFields()).Info("setting bulb to manual control")
 	}
 }
 
@@ -161,60 +430,35 @@ func (c *Context) UpdateBulb(rw web.ResponseWriter, req *web.Request) {
 	ur := &UpdateBulbRequest{}
 	err := unmarshal_json_request(rw, req, ur)
 	if err != nil {
-		panic(err)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
-	until, duration, brightness, kelvin, err := ParseUpdateBulbRequest(ur)
+	ms, err := ParseUpdateBulbRequest(ur, c.App.clock.Now())
 	if err != nil {
-		http.Error(rw, err.Error(), 400)
+		c.error(rw, 400, err.Error())
+		return
 	}
 
 	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
 	if bulb == nil {
-		http.Error(rw, "no such bulb", 404)
+		c.error(rw, 404, "no such bulb")
 		return
 	}
-	le := log.WithFields(log.Fields{
+	if !c.mayControl(rw, bulb.Group) {
+		return
+	}
+	bulb.setManualState(ms)
+	log.WithFields(log.Fields{
 		"address": bulb.Address,
 		"name":    bulb.Name,
-	})
-	bulb.ManualStateUntil = *until
-	le = le.WithField("until", ur.Until)
-	if duration != nil {
-		le = le.WithField("duration", duration)
-	}
-	bulb.ManualStateBrightness = nil
-	bulb.ManualStateKelvin = nil
-	if brightness != nil {
-		bulb.ManualStateBrightness = brightness
-		le = le.WithField("brightness", brightness)
-	}
-	if kelvin != nil {
-		bulb.ManualStateKelvin = kelvin
-		le = le.WithField("kelvin", kelvin)
-	}
-	le.Info("setting bulb to manual control")
+	}).WithFields(ms.logFields()).Info("setting bulb to manual control")
 }
 
 func (c *Context) GetBulb(rw web.ResponseWriter, req *web.Request) {
 	for _, bulb := range c.App.BulbList() {
 		if bulb.Address == req.PathParams["bulb_id"] {
-			state := bulb.bulb.GetState()
-			v := &BulbJSON{
-				Name:          bulb.Name,
-				Address:       bulb.Address,
-				Location:      bulb.Location,
-				Group:         bulb.Group,
-				Lux:           bulb.Lux,
-				LastSeen:      bulb.bulb.LastSeen(),
-				LastSeenSince: time.Since(bulb.bulb.LastSeen()).String(),
-				Hue:           int(state.Hue),
-				Saturation:    int(state.Saturation),
-				Brightness:    int(state.Brightness),
-				Kelvin:        int(state.Kelvin),
-				Dim:           int(state.Dim),
-				Power:         int(state.Power),
-			}
+			v := c.bulbJSON(bulb)
 			d, err := json.Marshal(v)
 			if err != nil {
 				panic(err)
@@ -224,37 +468,37 @@ func (c *Context) GetBulb(rw web.ResponseWriter, req *web.Request) {
 			return
 		}
 	}
-	http.Error(rw, "no such bulb", 404)
+	c.error(rw, 404, "no such bulb")
 }
 
 func (c *Context) ListCurves(rw web.ResponseWriter, req *web.Request) {
+	c.App.curvesMutex.RLock()
 	d, err := json.Marshal(c.App.curves)
+	etag := ""
+	if c.App.curves != nil {
+		etag = c.App.curves.ETag()
+	}
+	c.App.curvesMutex.RUnlock()
 	if err != nil {
 		panic(err)
 	}
+	if etag != "" {
+		rw.Header().Set("etag", etag)
+	}
 	rw.Header().Add("content-type", "application/json")
 	rw.Write(d)
 }
 
 func (c *Context) ListBulbs(rw web.ResponseWriter, req *web.Request) {
-	var v []*BulbJSON
-	for _, bulb := range c.App.BulbList() {
-		state := bulb.bulb.GetState()
-		v = append(v, &BulbJSON{
-			Name:          bulb.Name,
-			Address:       bulb.Address,
-			Location:      bulb.Location,
-			Group:         bulb.Group,
-			Lux:           bulb.Lux,
-			LastSeen:      bulb.bulb.LastSeen(),
-			LastSeenSince: time.Since(bulb.bulb.LastSeen()).String(),
-			Hue:           int(state.Hue),
-			Saturation:    int(state.Saturation),
-			Brightness:    int(state.Brightness),
-			Kelvin:        int(state.Kelvin),
-			Dim:           int(state.Dim),
-			Power:         int(state.Power),
-		})
+	bulbs, err := c.filter(filterExpr(req))
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	v := []*BulbJSON{}
+	for _, bulb := range bulbs {
+		v = append(v, c.bulbJSON(bulb))
 	}
 	d, err := json.Marshal(v)
 	if err != nil {
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gocraft/web"
+)
+
+// authorize authenticates the request and checks it has the scope its
+// method and path need, auditing anything which isn't a read
+func (c *Context) authorize(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	// the v2 middleware hasn't run yet, but errors here should match it
+	c.v2 = isV2(req.URL.Path)
+
+	scope := requiredScope(req.Method, req.URL.Path)
+	if scope == "" {
+		next(rw, req)
+		return
+	}
+
+	if c.App.auth == nil {
+		c.Principal = anonymous
+	} else {
+		c.Principal = c.App.auth.authenticate(req.Request)
+		if c.Principal == nil {
+			rw.Header().Add("www-authenticate", `Bearer realm="lifx"`)
+			rw.Header().Add("www-authenticate", `Basic realm="lifx"`)
+			c.error(rw, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if !c.Principal.Allows(scope) {
+			c.error(rw, http.StatusForbidden, fmt.Sprintf("%s scope required", scope))
+			return
+		}
+		// curves and scenes aren't per group, so a principal limited to
+		// some groups can't administer them
+		if scope == ScopeAdmin && len(c.Principal.Groups) > 0 {
+			c.error(rw, http.StatusForbidden, "admin requires access to every group")
+			return
+		}
+	}
+
+	if scope == ScopeRead {
+		next(rw, req)
+		return
+	}
+
+	c.control = true
+	body := &limitedBuffer{limit: auditBodyLimit}
+	if req.Body != nil {
+		req.Body = ioutil.NopCloser(io.TeeReader(req.Body, body))
+	}
+
+	next(rw, req)
+
+	status := rw.StatusCode()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	c.App.audit(&AuditEntry{
+		Time:      c.App.clock.Now(),
+		RequestID: c.RequestID,
+		Site:      c.App.site,
+		Principal: c.Principal.Name,
+		Auth:      c.Principal.Method,
+		Remote:    req.RemoteAddr,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Status:    status,
+		Body:      auditBody(body),
+	})
+}
+
+// permits reports whether the request may control bulbs in group
+func (c *Context) permits(group string) bool {
+	return c.Principal != nil && c.Principal.Permits(group)
+}
+
+// mayControl writes a 403 and returns false if the request can't control
+// bulbs in group
+func (c *Context) mayControl(rw web.ResponseWriter, group string) bool {
+	if c.permits(group) {
+		return true
+	}
+	c.error(rw, http.StatusForbidden, fmt.Sprintf("not permitted to control %q", group))
+	return false
+}
+
+// permitted drops the bulbs a controlling request isn't allowed to touch,
+// reads see everything
+func (c *Context) permitted(bulbs []*Bulb) []*Bulb {
+	if !c.control {
+		return bulbs
+	}
+	var bl []*Bulb
+	for _, bulb := range bulbs {
+		if c.permits(bulb.Group) {
+			bl = append(bl, bulb)
+		}
+	}
+	return bl
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+	log "github.com/sirupsen/logrus"
+)
+
+func (c *Context) curveError(rw web.ResponseWriter, err error) {
+	switch err {
+	case errCurveNotFound, errCurveHourNotFound:
+		c.error(rw, http.StatusNotFound, err.Error())
+	case errPreconditionFailed, errCurveExists:
+		c.error(rw, http.StatusPreconditionFailed, err.Error())
+	default:
+		c.error(rw, http.StatusBadRequest, err.Error())
+	}
+}
+
+func writeCurve(rw web.ResponseWriter, curve *Curve, status int) {
+	d, err := json.Marshal(curve)
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Set("etag", curve.ETag())
+	rw.Header().Add("content-type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(d)
+}
+
+// curveName returns the curve in the path, "default" for the default
+// curve's routes. The default curve can't be reached as a group curve.
+func (c *Context) curveName(rw web.ResponseWriter, req *web.Request) (string, bool) {
+	name, ok := req.PathParams["name"]
+	if !ok {
+		return "default", true
+	}
+	if name == "default" {
+		c.error(rw, http.StatusBadRequest, `"default" is not a group curve name, use /curves/default`)
+		return "", false
+	}
+	return name, true
+}
+
+// curveHour returns the hour in the path as curves key it, without leading
+// zeros
+func (c *Context) curveHour(rw web.ResponseWriter, req *web.Request) (string, bool) {
+	h, err := strconv.Atoi(req.PathParams["hour"])
+	if err != nil || h < 0 || h > 23 {
+		c.error(rw, http.StatusBadRequest, "invalid hour (must be 0-23)")
+		return "", false
+	}
+	return strconv.Itoa(h), true
+}
+
+func (c *Context) GetCurve(rw web.ResponseWriter, req *web.Request) {
+	name, ok := c.curveName(rw, req)
+	if !ok {
+		return
+	}
+	curve, err := c.App.getCurve(name)
+	if err != nil {
+		c.curveError(rw, err)
+		return
+	}
+
+	if inm := req.Header.Get("if-none-match"); inm != "" && inm == curve.ETag() {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeCurve(rw, curve, http.StatusOK)
+}
+
+func (c *Context) PutCurve(rw web.ResponseWriter, req *web.Request) {
+	name, ok := c.curveName(rw, req)
+	if !ok {
+		return
+	}
+
+	curve := &Curve{}
+	err := unmarshal_json_request(rw, req, curve)
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created, err := c.App.putCurve(name, curve, req.Header.Get("if-match"), req.Header.Get("if-none-match"))
+	if err != nil {
+		c.curveError(rw, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"curve":   name,
+		"groups":  curve.Groups,
+		"created": created,
+	}).Info("curve updated")
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeCurve(rw, curve, status)
+}
+
+func (c *Context) PatchCurveHour(rw web.ResponseWriter, req *web.Request) {
+	name, ok := c.curveName(rw, req)
+	if !ok {
+		return
+	}
+	hour, ok := c.curveHour(rw, req)
+	if !ok {
+		return
+	}
+
+	point := &CurveHour{}
+	err := unmarshal_json_request(rw, req, point)
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	curve, err := c.App.patchCurveHour(name, hour, point, req.Header.Get("if-match"))
+	if err != nil {
+		c.curveError(rw, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"curve": name,
+		"hour":  hour,
+	}).Info("curve point updated")
+
+	writeCurve(rw, curve, http.StatusOK)
+}
+
+func (c *Context) DeleteCurveHour(rw web.ResponseWriter, req *web.Request) {
+	name, ok := c.curveName(rw, req)
+	if !ok {
+		return
+	}
+	hour, ok := c.curveHour(rw, req)
+	if !ok {
+		return
+	}
+
+	curve, err := c.App.patchCurveHour(name, hour, nil, req.Header.Get("if-match"))
+	if err != nil {
+		c.curveError(rw, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"curve": name,
+		"hour":  hour,
+	}).Info("curve point removed")
+
+	writeCurve(rw, curve, http.StatusOK)
+}
+
+func (c *Context) DeleteCurve(rw web.ResponseWriter, req *web.Request) {
+	name, ok := c.curveName(rw, req)
+	if !ok {
+		return
+	}
+
+	err := c.App.deleteCurve(name, req.Header.Get("if-match"))
+	if err != nil {
+		c.curveError(rw, err)
+		return
+	}
+
+	log.WithField("curve", name).Info("curve deleted")
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// GetEffective explains where a bulb's curve values come from, now or at
+// the time in the at query parameter
+func (c *Context) GetEffective(rw web.ResponseWriter, req *web.Request) {
+	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
+	if bulb == nil {
+		c.error(rw, http.StatusNotFound, "no such bulb")
+		return
+	}
+
+	at := c.App.clock.Now()
+	if v := req.URL.Query().Get("at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.error(rw, http.StatusBadRequest, "can't parse at, use RFC 3339")
+			return
+		}
+		at = t.In(at.Location())
+	}
+
+	c.writeJSONStatus(rw, http.StatusOK, c.App.effective(bulb, at))
+}
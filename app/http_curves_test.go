@@ -0,0 +1,113 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func serveHeaders(a *App, method string, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	return rw
+}
+
+func testCurvesApp(t *testing.T) (*App, string) {
+	dir, err := ioutil.TempDir("", "curves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := testApp()
+	a.curvesDir = dir
+	return a, dir
+}
+
+func TestCurveETags(t *testing.T) {
+	a, dir := testCurvesApp(t)
+	defer os.RemoveAll(dir)
+
+	rw := serve(a, "GET", "/api/v2/curves/groups/kitchen", "")
+	etag := rw.Header().Get("etag")
+	if rw.Code != 200 || etag == "" {
+		t.Fatalf("expected the curve with an etag, got: %d %q", rw.Code, etag)
+	}
+	rw = serveHeaders(a, "GET", "/api/v2/curves/groups/kitchen", "", map[string]string{"if-none-match": etag})
+	if rw.Code != 304 {
+		t.Fatalf("expected %d, got: %d", 304, rw.Code)
+	}
+
+	// changes need the current etag
+	body := `{"groups":["Kitchen"],"hours":{"7":{"brightness":1000}}}`
+	expectAPIError(t, serveHeaders(a, "PUT", "/api/v2/curves/groups/kitchen", body, map[string]string{"if-match": `"stale"`}), 412)
+	rw = serveHeaders(a, "PUT", "/api/v2/curves/groups/kitchen", body, map[string]string{"if-match": etag})
+	if rw.Code != 200 || rw.Header().Get("etag") == etag {
+		t.Fatalf("expected a new etag, got: %d %q", rw.Code, rw.Header().Get("etag"))
+	}
+	expectAPIError(t, serveHeaders(a, "PATCH", "/api/v2/curves/groups/kitchen/hours/8", `{"kelvin":3000}`, map[string]string{"if-match": etag}), 412)
+	expectAPIError(t, serveHeaders(a, "DELETE", "/api/v2/curves/groups/kitchen", "", map[string]string{"if-match": etag}), 412)
+	expectAPIError(t, serveHeaders(a, "PUT", "/api/v2/curves/groups/kitchen", body, map[string]string{"if-none-match": "*"}), 412)
+
+	// creating needs nothing, and is saved
+	rw = serve(a, "PUT", "/api/v2/curves/groups/porch", `{"groups":["Outside"],"hours":{"20":{"brightness":0}}}`)
+	if rw.Code != 201 {
+		t.Fatalf("expected %d, got: %d %s", 201, rw.Code, rw.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "groups", "porch.json")); err != nil {
+		t.Fatal(err)
+	}
+	rw = serve(a, "DELETE", "/api/v2/curves/groups/porch", "")
+	if rw.Code != 204 {
+		t.Fatalf("expected %d, got: %d", 204, rw.Code)
+	}
+	expectAPIError(t, serve(a, "GET", "/api/v2/curves/groups/porch", ""), 404)
+}
+
+func TestCurveHours(t *testing.T) {
+	a, dir := testCurvesApp(t)
+	defer os.RemoveAll(dir)
+
+	rw := serve(a, "PATCH", "/api/v2/curves/default/hours/07", `{"brightness":2000,"kelvin":3000}`)
+	curve := &Curve{}
+	json.Unmarshal(rw.Body.Bytes(), curve)
+	if rw.Code != 200 || curve.Hours["7"].Brightness == nil || *curve.Hours["7"].Brightness != 2000 {
+		t.Fatalf("expected hour 7 to be set, got: %d %s", rw.Code, rw.Body.String())
+	}
+
+	// however the hour is written it's the same hour, and it's gone once
+	// removed
+	rw = serve(a, "DELETE", "/api/v2/curves/default/hours/007", "")
+	if rw.Code != 200 {
+		t.Fatalf("expected %d, got: %d %s", 200, rw.Code, rw.Body.String())
+	}
+	expectAPIError(t, serve(a, "DELETE", "/api/v2/curves/default/hours/7", ""), 404)
+	if c, _ := a.getCurve("default"); len(c.Hours) != 2 {
+		t.Fatalf("expected %d hours, got: %d", 2, len(c.Hours))
+	}
+	expectAPIError(t, serve(a, "DELETE", "/api/v2/curves/default/hours/24", ""), 400)
+	expectAPIError(t, serve(a, "PATCH", "/api/v2/curves/default/hours/x", `{"kelvin":3000}`), 400)
+	expectAPIError(t, serve(a, "PATCH", "/api/v2/curves/default/hours/8", `{"kelvin":100}`), 400)
+}
+
+func TestCurveDefaultNotAGroup(t *testing.T) {
+	a, dir := testCurvesApp(t)
+	defer os.RemoveAll(dir)
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		expectAPIError(t, serve(a, method, "/api/v2/curves/groups/default", `{"hours":{}}`), 400)
+	}
+	expectAPIError(t, serve(a, "PATCH", "/api/v2/curves/groups/default/hours/7", `{"kelvin":3000}`), 400)
+	if c, _ := a.getCurve("default"); len(c.Hours) != 2 {
+		t.Fatalf("expected the default curve untouched, got: %+v", c)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "default.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing written, got: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/filter"
+)
+
+// eventsKeepalive is how often an idle event stream is poked so proxies
+// don't time it out
+const eventsKeepalive = 15 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// subscribeEvents reads the filter, types and last-event-id parameters and
+// subscribes, writing an error and returning nil if they're bad
+func (c *Context) subscribeEvents(rw web.ResponseWriter, req *web.Request) (*eventSub, []*Event, bool) {
+	node, err := filter.Parse(req.URL.Query().Get("filter"))
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+
+	var types map[string]bool
+	if t := req.URL.Query().Get("types"); t != "" {
+		types = make(map[string]bool)
+		for _, eventType := range strings.Split(t, ",") {
+			types[eventType] = true
+		}
+	}
+
+	lastEventID := req.Header.Get("last-event-id")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("last-event-id")
+	}
+	var lastID eventID
+	if lastEventID != "" {
+		lastID, err = parseEventID(lastEventID)
+		if err != nil {
+			c.error(rw, http.StatusBadRequest, "bad last-event-id")
+			return nil, nil, false
+		}
+	}
+
+	// the filter is matched against the bulbs in the backlog
+	c.App.controlMutex.Lock()
+	defer c.App.controlMutex.Unlock()
+	return c.App.events.subscribe(lastID, node, types)
+}
+
+func writeSSE(rw web.ResponseWriter, e *Event) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	_, err = fmt.Fprintf(rw, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, d)
+	rw.Flush()
+	return err
+}
+
+// Events streams events as Server-Sent Events
+func (c *Context) Events(rw web.ResponseWriter, req *web.Request) {
+	sub, missed, gap := c.subscribeEvents(rw, req)
+	if sub == nil {
+		return
+	}
+	defer c.App.events.unsubscribe(sub)
+
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	if gap {
+		fmt.Fprintf(rw, "event: %s\ndata: {}\n\n", EventReset)
+	}
+	for _, e := range missed {
+		if writeSSE(rw, e) != nil {
+			return
+		}
+	}
+	rw.Flush()
+
+	keepalive := c.App.clock.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if writeSSE(rw, e) != nil {
+				return
+			}
+		case <-keepalive.C():
+			fmt.Fprint(rw, ": keepalive\n\n")
+			rw.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// EventsWebSocket streams events as JSON messages over a WebSocket
+func (c *Context) EventsWebSocket(rw web.ResponseWriter, req *web.Request) {
+	sub, missed, gap := c.subscribeEvents(rw, req)
+	if sub == nil {
+		return
+	}
+	defer c.App.events.unsubscribe(sub)
+
+	conn, err := upgrader.Upgrade(rw, req.Request, nil)
+	if err != nil {
+		// the upgrader has already responded
+		log.WithError(err).WithField("request-id", c.RequestID).Debug("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	// nothing is expected from the client, but reading notices it going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if gap {
+		if conn.WriteJSON(&Event{Type: EventReset, Time: c.App.clock.Now()}) != nil {
+			return
+		}
+	}
+	for _, e := range missed {
+		if conn.WriteJSON(e) != nil {
+			return
+		}
+	}
+
+	keepalive := c.App.clock.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if conn.WriteJSON(e) != nil {
+				return
+			}
+		case <-keepalive.C():
+			if conn.WriteMessage(websocket.PingMessage, nil) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -1,43 +1,69 @@
 package app
 
 import (
-	"errors"
-	"log"
-	"regexp"
-	"strings"
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/filter"
 )
 
-func (c *Context) filter(filter string) ([]*Bulb, error) {
-	log.Printf("filter is %s", filter)
-	filterRegexp := regexp.MustCompile("^([^!=<>~]+)(?:(!=|>|<|=|~)(.*))?$")
-
-	filterItems := strings.Split(filter, ",")
-	var group string
-	var location string
-	for _, filterItem := range filterItems {
-		filterItemParts := filterRegexp.FindStringSubmatch(filterItem)
-		if len(filterItemParts) == 0 {
-			return nil, errors.New("invalid filter expression (regexp does not match)")
+// Value returns the bulb's value of a filter field
+func (b *Bulb) Value(field string) interface{} {
+	switch field {
+	case "name":
+		return b.Name
+	case "address":
+		return b.Address
+	case "group":
+		return b.Group
+	case "location":
+		return b.Location
+	case "product":
+		if p := b.bulb.GetProduct(); p != nil {
+			return p.Name
 		}
-		if filterItemParts[2] != "=" {
-			return nil, errors.New("can't filter on anything but equals")
+	case "capability":
+		if p := b.bulb.GetProduct(); p != nil {
+			return p.Capabilities
 		}
-		if filterItemParts[1] == "group" {
-			group = filterItemParts[3]
-		} else if filterItemParts[1] == "location" {
-			location = filterItemParts[3]
-		} else {
-			return nil, errors.New("can only filter on group or location")
+	case "power":
+		return b.LastState.Power != powerOff
+	case "online":
+		return b.Online
+	case "controlled":
+		return b.Controlled
+	case "brightness":
+		return float64(b.LastState.Brightness)
+	case "saturation":
+		return float64(b.LastState.Saturation)
+	case "hue":
+		return float64(b.LastState.Hue)
+	case "kelvin":
+		return float64(b.LastState.Kelvin)
+	}
+	return nil
+}
+
+// FilterBulbs returns the bulbs matching a filter expression, see the filter
+// package for the syntax
+func (a *App) FilterBulbs(expr string) ([]*Bulb, error) {
+	node, err := filter.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var bl []*Bulb
+	for _, bulb := range a.BulbList() {
+		if node.Match(bulb) {
+			bl = append(bl, bulb)
 		}
 	}
+	return bl, nil
+}
 
-	if group != "" && location != "" {
-		return c.App.GetLocationGroupBulbs(location, group), nil
-	} else if group != "" {
-		return c.App.GetGroupBulbs(group), nil
-	} else if location != "" {
-		return c.App.GetLocationBulbs(location), nil
-	} else {
-		return c.App.GetBulbs(), nil
+func (c *Context) filter(expr string) ([]*Bulb, error) {
+	log.WithField("filter", expr).Debug("filtering bulbs")
+	bulbs, err := c.App.FilterBulbs(expr)
+	if err != nil {
+		return nil, err
 	}
+	return c.permitted(bulbs), nil
 }
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"testing"
+
+	"gitlab.adam.gs/home/lifx/filter"
+)
+
+func TestFilterBulbs(t *testing.T) {
+	a, _ := testApp()
+	b := report(a, 32768, 5000)
+	b.Online = true
+
+	tests := []struct {
+		filter  string
+		matches int
+	}{
+		{"", 1},
+		{"group=Kitchen", 1},
+		{"group=Lounge", 0},
+		{"name=La*,power=on,online", 1},
+		{"brightness=40%..60%,kelvin>4000", 1},
+		{"!controlled", 0},
+		{"capability=color", 0},
+	}
+	for _, test := range tests {
+		bulbs, err := a.FilterBulbs(test.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", test.filter, err)
+		}
+		if len(bulbs) != test.matches {
+			t.Fatalf("%s: expected %d, got: %d", test.filter, test.matches, len(bulbs))
+		}
+	}
+
+	// online is the offline-after status, not whether the bulb is visible
+	b.Online = false
+	bulbs, err := a.FilterBulbs("online")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bulbs) != 0 {
+		t.Fatalf("expected %d, got: %d", 0, len(bulbs))
+	}
+
+	_, err = a.FilterBulbs("group>Kitchen")
+	if _, ok := err.(*filter.Error); !ok {
+		t.Fatalf("expected a filter error, got: %v", err)
+	}
+}
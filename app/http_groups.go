@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/gocraft/web"
+)
+
+type GroupJSON struct {
+	Name            string           `json:"name"`
+	Bulbs           []string         `json:"bulbs"`
+	CurveBrightness uint16           `json:"curve-brightness"`
+	CurveKelvin     uint16           `json:"curve-kelvin"`
+	CurveSource     string           `json:"curve-source"`
+	Offset          *Offset          `json:"offset,omitempty"`
+	Occupancy       *Occupancy       `json:"occupancy"`
+	OccupancyPolicy *occupancyPolicy `json:"occupancy-policy,omitempty"`
+}
+
+type OccupancyRequest struct {
+	Occupied *bool `json:"occupied,omitempty"`
+}
+
+func (c *Context) groupJSON(group string) *GroupJSON {
+	now := c.App.clock.Now()
+	v := &GroupJSON{
+		Name:      group,
+		Bulbs:     []string{},
+		Occupancy: c.App.GetOccupancy(group),
+	}
+	for _, bulb := range c.App.GetGroupBulbs(group) {
+		v.Bulbs = append(v.Bulbs, bulb.Address)
+	}
+	v.CurveBrightness, v.CurveKelvin, v.CurveSource = c.App.curveTarget(group, now)
+	v.Offset = c.App.groupOffset(group)
+	p := c.App.occupancyPolicyFor(group)
+	if p.enabled() {
+		v.OccupancyPolicy = &p
+	}
+	return v
+}
+
+// occupied reads an OccupancyRequest, an empty body being activity
+func occupied(req *web.Request) (bool, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return false, err
+	}
+	if len(data) == 0 {
+		return true, nil
+	}
+	or := &OccupancyRequest{}
+	err = json.Unmarshal(data, or)
+	if err != nil {
+		return false, err
+	}
+	return or.Occupied == nil || *or.Occupied, nil
+}
+
+func (c *Context) trigger(group string, occupied bool) *Occupancy {
+	if occupied {
+		return c.App.Occupied(group)
+	}
+	return c.App.Vacated(group)
+}
+
+func (c *Context) ListGroups(rw web.ResponseWriter, req *web.Request) {
+	v := []*GroupJSON{}
+	for _, group := range c.App.Groups() {
+		v = append(v, c.groupJSON(group))
+	}
+	writeJSON(rw, v)
+}
+
+func (c *Context) GetGroup(rw web.ResponseWriter, req *web.Request) {
+	group := req.PathParams["name"]
+	v := c.groupJSON(group)
+	if len(v.Bulbs) == 0 && v.Occupancy.State == OccupancyUnknown {
+		c.error(rw, 404, "no such group")
+		return
+	}
+	writeJSON(rw, v)
+}
+
+func (c *Context) GroupOccupancy(rw web.ResponseWriter, req *web.Request) {
+	if !c.mayControl(rw, req.PathParams["name"]) {
+		return
+	}
+	o, err := occupied(req)
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+	writeJSON(rw, c.trigger(req.PathParams["name"], o))
+}
+
+// FilterOccupancy triggers every group with a bulb matching the filter
+func (c *Context) FilterOccupancy(rw web.ResponseWriter, req *web.Request) {
+	bulbs, err := c.filter(filterExpr(req))
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+	o, err := occupied(req)
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	seen := make(map[string]bool)
+	v := []*Occupancy{}
+	for _, bulb := range bulbs {
+		if bulb.Group == "" || seen[bulb.Group] {
+			continue
+		}
+		seen[bulb.Group] = true
+		v = append(v, c.trigger(bulb.Group, o))
+	}
+	writeJSON(rw, v)
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gocraft/web"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseOffset reads and validates an Offset
+func (c *Context) parseOffset(rw web.ResponseWriter, req *web.Request) *Offset {
+	offset := &Offset{}
+	err := unmarshal_json_request(rw, req, offset)
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	err = offset.validate()
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	return offset
+}
+
+func (c *Context) offsetError(rw web.ResponseWriter, err error) {
+	if err == errOffsetNotFound {
+		c.error(rw, http.StatusNotFound, err.Error())
+		return
+	}
+	c.error(rw, http.StatusInternalServerError, err.Error())
+}
+
+func (c *Context) ListOffsets(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, c.App.GetOffsets())
+}
+
+// offsetBulb returns the bulb in the path if the request may control it
+func (c *Context) offsetBulb(rw web.ResponseWriter, req *web.Request) *Bulb {
+	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
+	if bulb == nil {
+		c.error(rw, http.StatusNotFound, "no such bulb")
+		return nil
+	}
+	if !c.mayControl(rw, bulb.Group) {
+		return nil
+	}
+	return bulb
+}
+
+func (c *Context) PutBulbOffset(rw web.ResponseWriter, req *web.Request) {
+	bulb := c.offsetBulb(rw, req)
+	if bulb == nil {
+		return
+	}
+	offset := c.parseOffset(rw, req)
+	if offset == nil {
+		return
+	}
+
+	err := c.App.SetBulbOffset(bulb, offset)
+	if err != nil {
+		c.offsetError(rw, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"address":    bulb.Address,
+		"name":       bulb.Name,
+		"request-id": c.RequestID,
+	}).Info("set bulb offset")
+	c.writeJSONStatus(rw, http.StatusOK, c.bulbJSON(bulb))
+}
+
+func (c *Context) DeleteBulbOffset(rw web.ResponseWriter, req *web.Request) {
+	bulb := c.offsetBulb(rw, req)
+	if bulb == nil {
+		return
+	}
+
+	err := c.App.SetBulbOffset(bulb, nil)
+	if err != nil {
+		c.offsetError(rw, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"address":    bulb.Address,
+		"name":       bulb.Name,
+		"request-id": c.RequestID,
+	}).Info("removed bulb offset")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Context) PutGroupOffset(rw web.ResponseWriter, req *web.Request) {
+	group := req.PathParams["name"]
+	if !c.mayControl(rw, group) {
+		return
+	}
+	offset := c.parseOffset(rw, req)
+	if offset == nil {
+		return
+	}
+
+	err := c.App.SetGroupOffset(group, offset)
+	if err != nil {
+		c.offsetError(rw, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"group":      group,
+		"request-id": c.RequestID,
+	}).Info("set group offset")
+	c.writeJSONStatus(rw, http.StatusOK, c.groupJSON(group))
+}
+
+func (c *Context) DeleteGroupOffset(rw web.ResponseWriter, req *web.Request) {
+	group := req.PathParams["name"]
+	if !c.mayControl(rw, group) {
+		return
+	}
+
+	err := c.App.SetGroupOffset(group, nil)
+	if err != nil {
+		c.offsetError(rw, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"group":      group,
+		"request-id": c.RequestID,
+	}).Info("removed group offset")
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+type ActivateSceneRequest struct {
+	Transition *string    `json:"transition,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	Duration   *string    `json:"duration,omitempty"`
+}
+
+// ParseActivateSceneRequest returns the transition and, when the scene should
+// only be held for a limited time, when it ends
+func ParseActivateSceneRequest(ar *ActivateSceneRequest, now time.Time) (time.Duration, *time.Time, error) {
+	if ar.Until != nil && ar.Duration != nil {
+		return 0, nil, errors.New("don't set both until and duration")
+	}
+
+	var transition time.Duration
+	if ar.Transition != nil {
+		tv, err := time.ParseDuration(*ar.Transition)
+		if err != nil || tv < 0 {
+			return 0, nil, errors.New("can't parse transition")
+		}
+		transition = tv
+	}
+
+	var until *time.Time
+	if ar.Until != nil {
+		until = ar.Until
+	} else if ar.Duration != nil {
+		dv, err := time.ParseDuration(*ar.Duration)
+		if err != nil {
+			return 0, nil, errors.New("can't parse duration")
+		}
+		uv := now.Add(dv)
+		until = &uv
+	}
+
+	return transition, until, nil
+}
+
+func writeJSON(rw web.ResponseWriter, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Add("content-type", "application/json")
+	rw.Write(d)
+}
+
+func (c *Context) ListScenes(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, c.App.SceneList())
+}
+
+func (c *Context) GetScene(rw web.ResponseWriter, req *web.Request) {
+	scene := c.App.GetScene(req.PathParams["name"])
+	if scene == nil {
+		c.error(rw, 404, errSceneNotFound.Error())
+		return
+	}
+	writeJSON(rw, scene)
+}
+
+func (c *Context) CaptureScene(rw web.ResponseWriter, req *web.Request) {
+	bulbs := c.permitted(c.App.GetBulbs())
+	if filter := req.URL.Query().Get("filter"); filter != "" {
+		var err error
+		bulbs, err = c.filter(filter)
+		if err != nil {
+			c.error(rw, 400, err.Error())
+			return
+		}
+	}
+
+	scene, err := c.App.CaptureScene(req.PathParams["name"], bulbs)
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+	c.writeJSONStatus(rw, http.StatusCreated, scene)
+}
+
+func (c *Context) ActivateScene(rw web.ResponseWriter, req *web.Request) {
+	ar := &ActivateSceneRequest{}
+	if req.ContentLength != 0 {
+		err := unmarshal_json_request(rw, req, ar)
+		if err != nil {
+			c.error(rw, 400, err.Error())
+			return
+		}
+	}
+
+	transition, until, err := ParseActivateSceneRequest(ar, c.App.clock.Now())
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	if scene := c.App.GetScene(req.PathParams["name"]); scene != nil {
+		for address := range scene.Bulbs {
+			bulb := c.App.GetBulb(address)
+			if bulb != nil && !c.mayControl(rw, bulb.Group) {
+				return
+			}
+		}
+	}
+
+	bulbs, err := c.App.ActivateScene(req.PathParams["name"], transition, until)
+	if err == errSceneNotFound {
+		c.error(rw, 404, err.Error())
+		return
+	} else if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	activated := []string{}
+	for _, bulb := range bulbs {
+		activated = append(activated, bulb.Address)
+	}
+	writeJSON(rw, activated)
+}
+
+func (c *Context) DeleteScene(rw web.ResponseWriter, req *web.Request) {
+	err := c.App.DeleteScene(req.PathParams["name"])
+	if err == errSceneNotFound {
+		c.error(rw, 404, err.Error())
+		return
+	} else if err != nil {
+		c.error(rw, 500, err.Error())
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
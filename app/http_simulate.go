@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocraft/web"
+)
+
+// parseSimulationQuery reads the date (YYYY-MM-DD, default today) and step
+// (default 15m) query parameters
+func parseSimulationQuery(req *web.Request, now time.Time) (time.Time, time.Duration, error) {
+	date := now
+	if d := req.URL.Query().Get("date"); d != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", d, now.Location())
+		if err != nil {
+			return date, 0, err
+		}
+		date = parsed
+	}
+
+	step := 15 * time.Minute
+	if s := req.URL.Query().Get("step"); s != "" {
+		parsed, err := time.ParseDuration(s)
+		if err != nil {
+			return date, 0, err
+		}
+		step = parsed
+	}
+
+	return date, step, nil
+}
+
+func (c *Context) writeSimulation(rw web.ResponseWriter, req *web.Request, s *Simulation) {
+	switch req.URL.Query().Get("format") {
+	case "", "json":
+		d, err := json.Marshal(s)
+		if err != nil {
+			panic(err)
+		}
+		rw.Header().Add("content-type", "application/json")
+		rw.Write(d)
+	case "csv":
+		rw.Header().Add("content-type", "text/csv")
+		s.WriteCSV(rw)
+	case "svg":
+		rw.Header().Add("content-type", "image/svg+xml")
+		s.WriteSVG(rw)
+	default:
+		c.error(rw, 400, "format must be one of json, csv or svg")
+	}
+}
+
+func (c *Context) SimulateGroup(rw web.ResponseWriter, req *web.Request) {
+	date, step, err := parseSimulationQuery(req, c.App.clock.Now())
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	s, err := c.App.SimulateGroup(req.PathParams["group"], date, step)
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	c.writeSimulation(rw, req, s)
+}
+
+func (c *Context) SimulateBulb(rw web.ResponseWriter, req *web.Request) {
+	date, step, err := parseSimulationQuery(req, c.App.clock.Now())
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
+	if bulb == nil {
+		c.error(rw, 404, "no such bulb")
+		return
+	}
+
+	s, err := c.App.SimulateBulb(bulb, date, step)
+	if err != nil {
+		c.error(rw, 400, err.Error())
+		return
+	}
+
+	c.writeSimulation(rw, req, s)
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gocraft/web"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIError is the body of every v2 error response, inside an ErrorEnvelope
+type APIError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request-id"`
+}
+
+type ErrorEnvelope struct {
+	Error *APIError `json:"error"`
+}
+
+// OverrideJSON is a bulb's manual state
+type OverrideJSON struct {
+	Until      time.Time `json:"until"`
+	Source     string    `json:"source,omitempty"`
+	Brightness *uint16   `json:"brightness,omitempty"`
+	Kelvin     *uint16   `json:"kelvin,omitempty"`
+	Hue        *uint16   `json:"hue,omitempty"`
+	Saturation *uint16   `json:"saturation,omitempty"`
+	Power      *bool     `json:"power,omitempty"`
+	Transition *Duration `json:"transition,omitempty"`
+}
+
+// override returns the bulb's manual state, nil when there isn't one
+func (b *Bulb) override(now time.Time) *OverrideJSON {
+	if !b.ManualStateUntil.After(now) || !b.hasManualState() {
+		return nil
+	}
+	o := &OverrideJSON{
+		Until:      b.ManualStateUntil,
+		Source:     b.ManualStateSource,
+		Brightness: b.ManualStateBrightness,
+		Kelvin:     b.ManualStateKelvin,
+		Hue:        b.ManualStateHue,
+		Saturation: b.ManualStateSaturation,
+		Power:      b.ManualStatePower,
+	}
+	if b.ManualStateTransition != nil {
+		t := Duration(*b.ManualStateTransition)
+		o.Transition = &t
+	}
+	return o
+}
+
+// apiParam is a query, path or header parameter in the OpenAPI spec
+type apiParam struct {
+	Name        string
+	In          string
+	Description string
+}
+
+var (
+	filterParam      = apiParam{Name: "filter", In: "query", Description: "bulb filter, e.g. group=Kitchen,power=on"}
+	overridesParam   = apiParam{Name: "filter", In: "query", Description: "bulb filter, e.g. group=Kitchen,power=on, or all for every bulb. Required."}
+	ifMatchParam     = apiParam{Name: "If-Match", In: "header", Description: "ETag the curve must have"}
+	ifNoneMatchParam = apiParam{Name: "If-None-Match", In: "header", Description: "ETag to skip, or * to only create"}
+	dateParam        = apiParam{Name: "date", In: "query", Description: "YYYY-MM-DD, default today"}
+	stepParam        = apiParam{Name: "step", In: "query", Description: "duration between points, default 15m"}
+	formatParam      = apiParam{Name: "format", In: "query", Description: "json, csv or svg"}
+	typesParam       = apiParam{Name: "types", In: "query", Description: "comma separated event types, default all"}
+	atParam          = apiParam{Name: "at", In: "query", Description: "RFC 3339 time, default now"}
+	lastEventIDParam = apiParam{Name: "last-event-id", In: "query", Description: "resume after this event, also read from the Last-Event-ID header"}
+)
+
+// apiRoute is a v2 route, registered with the router and described in the
+// OpenAPI spec from the same table
+type apiRoute struct {
+	Method   string
+	Path     string
+	Handler  interface{}
+	Summary  string
+	Params   []apiParam
+	Request  interface{}
+	Optional bool // the request body may be left out
+	Status   []int
+	Response interface{}
+
+	// ContentType of the response, when it isn't application/json
+	ContentType string
+}
+
+func (r apiRoute) register(router *web.Router) {
+	switch r.Method {
+	case "GET":
+		router.Get(r.Path, r.Handler)
+	case "PUT":
+		router.Put(r.Path, r.Handler)
+	case "POST":
+		router.Post(r.Path, r.Handler)
+	case "PATCH":
+		router.Patch(r.Path, r.Handler)
+	case "DELETE":
+		router.Delete(r.Path, r.Handler)
+	default:
+		panic("unsupported method " + r.Method)
+	}
+}
+
+func apiRoutes() []apiRoute {
+	return []apiRoute{
+		{Method: "GET", Path: "/bulbs", Handler: (*Context).ListBulbs, Summary: "List bulbs",
+			Params: []apiParam{filterParam}, Status: []int{200}, Response: []*BulbJSON{}},
+		{Method: "GET", Path: "/bulbs/:bulb_id", Handler: (*Context).GetBulb, Summary: "Get a bulb",
+			Status: []int{200}, Response: &BulbJSON{}},
+		{Method: "GET", Path: "/bulbs/:bulb_id/effective", Handler: (*Context).GetEffective, Summary: "Explain where a bulb's curve values come from",
+			Params: []apiParam{atParam}, Status: []int{200}, Response: &EffectiveJSON{}},
+		{Method: "PUT", Path: "/bulbs/:bulb_id/override", Handler: (*Context).PutOverride, Summary: "Override a bulb's curve",
+			Request: &UpdateBulbRequest{}, Status: []int{201, 200}, Response: &BulbJSON{}},
+		{Method: "DELETE", Path: "/bulbs/:bulb_id/override", Handler: (*Context).DeleteOverride, Summary: "Return a bulb to its curve",
+			Status: []int{204}},
+		{Method: "POST", Path: "/overrides", Handler: (*Context).CreateOverrides, Summary: "Override every bulb matching a filter",
+			Params: []apiParam{overridesParam}, Request: &UpdateBulbRequest{}, Status: []int{201}, Response: []*BulbJSON{}},
+		{Method: "DELETE", Path: "/overrides", Handler: (*Context).DeleteOverrides, Summary: "Return every bulb matching a filter to its curve",
+			Params: []apiParam{overridesParam}, Status: []int{204}},
+
+		{Method: "GET", Path: "/offsets", Handler: (*Context).ListOffsets, Summary: "List bulb and group offsets",
+			Status: []int{200}, Response: &Offsets{}},
+		{Method: "PUT", Path: "/bulbs/:bulb_id/offset", Handler: (*Context).PutBulbOffset, Summary: "Adjust a bulb's curve values",
+			Request: &Offset{}, Status: []int{200}, Response: &BulbJSON{}},
+		{Method: "DELETE", Path: "/bulbs/:bulb_id/offset", Handler: (*Context).DeleteBulbOffset, Summary: "Remove a bulb's offset",
+			Status: []int{204}},
+		{Method: "PUT", Path: "/groups/:name/offset", Handler: (*Context).PutGroupOffset, Summary: "Adjust a group's curve values",
+			Request: &Offset{}, Status: []int{200}, Response: &GroupJSON{}},
+		{Method: "DELETE", Path: "/groups/:name/offset", Handler: (*Context).DeleteGroupOffset, Summary: "Remove a group's offset",
+			Status: []int{204}},
+
+		{Method: "GET", Path: "/curves", Handler: (*Context).ListCurves, Summary: "List curves",
+			Status: []int{200}, Response: &Curves{}},
+		{Method: "GET", Path: "/curves/default", Handler: (*Context).GetCurve, Summary: "Get the default curve",
+			Params: []apiParam{ifNoneMatchParam}, Status: []int{200, 304}, Response: &Curve{}},
+		{Method: "PUT", Path: "/curves/default", Handler: (*Context).PutCurve, Summary: "Replace the default curve",
+			Params: []apiParam{ifMatchParam, ifNoneMatchParam}, Request: &Curve{}, Status: []int{200, 201}, Response: &Curve{}},
+		{Method: "PATCH", Path: "/curves/default/hours/:hour", Handler: (*Context).PatchCurveHour, Summary: "Set an hour of the default curve",
+			Params: []apiParam{ifMatchParam}, Request: &CurveHour{}, Status: []int{200}, Response: &Curve{}},
+		{Method: "DELETE", Path: "/curves/default/hours/:hour", Handler: (*Context).DeleteCurveHour, Summary: "Remove an hour from the default curve",
+			Params: []apiParam{ifMatchParam}, Status: []int{200}, Response: &Curve{}},
+		{Method: "GET", Path: "/curves/groups/:name", Handler: (*Context).GetCurve, Summary: "Get a group curve",
+			Params: []apiParam{ifNoneMatchParam}, Status: []int{200, 304}, Response: &Curve{}},
+		{Method: "PUT", Path: "/curves/groups/:name", Handler: (*Context).PutCurve, Summary: "Create or replace a group curve",
+			Params: []apiParam{ifMatchParam, ifNoneMatchParam}, Request: &Curve{}, Status: []int{200, 201}, Response: &Curve{}},
+		{Method: "DELETE", Path: "/curves/groups/:name", Handler: (*Context).DeleteCurve, Summary: "Delete a group curve",
+			Params: []apiParam{ifMatchParam}, Status: []int{204}},
+		{Method: "PATCH", Path: "/curves/groups/:name/hours/:hour", Handler: (*Context).PatchCurveHour, Summary: "Set an hour of a group curve",
+			Params: []apiParam{ifMatchParam}, Request: &CurveHour{}, Status: []int{200}, Response: &Curve{}},
+		{Method: "DELETE", Path: "/curves/groups/:name/hours/:hour", Handler: (*Context).DeleteCurveHour, Summary: "Remove an hour from a group curve",
+			Params: []apiParam{ifMatchParam}, Status: []int{200}, Response: &Curve{}},
+
+		{Method: "GET", Path: "/scenes", Handler: (*Context).ListScenes, Summary: "List scenes",
+			Status: []int{200}, Response: []*Scene{}},
+		{Method: "GET", Path: "/scenes/:name", Handler: (*Context).GetScene, Summary: "Get a scene",
+			Status: []int{200}, Response: &Scene{}},
+		{Method: "DELETE", Path: "/scenes/:name", Handler: (*Context).DeleteScene, Summary: "Delete a scene",
+			Status: []int{204}},
+		{Method: "POST", Path: "/scenes/:name/capture", Handler: (*Context).CaptureScene, Summary: "Capture the bulbs matching a filter as a scene",
+			Params: []apiParam{filterParam}, Status: []int{201}, Response: &Scene{}},
+		{Method: "POST", Path: "/scenes/:name/activate", Handler: (*Context).ActivateScene, Summary: "Activate a scene",
+			Request: &ActivateSceneRequest{}, Optional: true, Status: []int{200}, Response: []string{}},
+
+		{Method: "GET", Path: "/groups", Handler: (*Context).ListGroups, Summary: "List groups",
+			Status: []int{200}, Response: []*GroupJSON{}},
+		{Method: "GET", Path: "/groups/:name", Handler: (*Context).GetGroup, Summary: "Get a group and its occupancy",
+			Status: []int{200}, Response: &GroupJSON{}},
+		{Method: "POST", Path: "/groups/:name/occupancy", Handler: (*Context).GroupOccupancy, Summary: "Signal activity or vacancy in a group",
+			Request: &OccupancyRequest{}, Optional: true, Status: []int{200}, Response: &Occupancy{}},
+		{Method: "POST", Path: "/occupancy", Handler: (*Context).FilterOccupancy, Summary: "Signal activity or vacancy in the groups of the bulbs matching a filter",
+			Params: []apiParam{filterParam}, Request: &OccupancyRequest{}, Optional: true, Status: []int{200}, Response: []*Occupancy{}},
+
+		{Method: "GET", Path: "/simulate/group/:group", Handler: (*Context).SimulateGroup, Summary: "Simulate a group's curve over a day",
+			Params: []apiParam{dateParam, stepParam, formatParam}, Status: []int{200}, Response: &Simulation{}},
+		{Method: "GET", Path: "/simulate/bulb/:bulb_id", Handler: (*Context).SimulateBulb, Summary: "Simulate a bulb over a day",
+			Params: []apiParam{dateParam, stepParam, formatParam}, Status: []int{200}, Response: &Simulation{}},
+
+		{Method: "GET", Path: "/events", Handler: (*Context).Events, Summary: "Stream events as Server-Sent Events",
+			Params: []apiParam{filterParam, typesParam, lastEventIDParam}, Status: []int{200}, Response: &Event{}, ContentType: "text/event-stream"},
+		{Method: "GET", Path: "/events/ws", Handler: (*Context).EventsWebSocket, Summary: "Stream events as WebSocket messages",
+			Params: []apiParam{filterParam, typesParam, lastEventIDParam}, Status: []int{101}, Response: &Event{}},
+
+		{Method: "GET", Path: "/openapi.json", Handler: (*Context).OpenAPI, Summary: "This document",
+			Status: []int{200}},
+	}
+}
+
+// filterExpr returns the filter from the path for v1 or the query for v2
+func filterExpr(req *web.Request) string {
+	if f, ok := req.PathParams["*"]; ok {
+		return f
+	}
+	return req.URL.Query().Get("filter")
+}
+
+func (c *Context) writeJSONStatus(rw web.ResponseWriter, status int, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(d)
+}
+
+// parseOverride reads and validates an UpdateBulbRequest
+func (c *Context) parseOverride(rw web.ResponseWriter, req *web.Request) *ManualState {
+	ur := &UpdateBulbRequest{}
+	err := unmarshal_json_request(rw, req, ur)
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	ms, err := ParseUpdateBulbRequest(ur, c.App.clock.Now())
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	return ms
+}
+
+func (c *Context) override(bulb *Bulb, ms *ManualState) {
+	bulb.setManualState(ms)
+	bulb.Controlled = true
+	log.WithFields(log.Fields{
+		"address":    bulb.Address,
+		"name":       bulb.Name,
+		"request-id": c.RequestID,
+	}).WithFields(ms.logFields()).Info("setting bulb to manual control")
+}
+
+func (c *Context) release(bulb *Bulb) {
+	bulb.releaseManualState()
+	bulb.Controlled = true
+	log.WithFields(log.Fields{
+		"address":    bulb.Address,
+		"name":       bulb.Name,
+		"request-id": c.RequestID,
+	}).Info("releasing bulb from manual control")
+}
+
+func (c *Context) PutOverride(rw web.ResponseWriter, req *web.Request) {
+	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
+	if bulb == nil {
+		c.error(rw, http.StatusNotFound, "no such bulb")
+		return
+	}
+	if !c.mayControl(rw, bulb.Group) {
+		return
+	}
+	ms := c.parseOverride(rw, req)
+	if ms == nil {
+		return
+	}
+
+	status := http.StatusCreated
+	if bulb.override(c.App.clock.Now()) != nil {
+		status = http.StatusOK
+	}
+	c.override(bulb, ms)
+	c.writeJSONStatus(rw, status, c.bulbJSON(bulb))
+}
+
+func (c *Context) DeleteOverride(rw web.ResponseWriter, req *web.Request) {
+	bulb := c.App.GetBulb(req.PathParams["bulb_id"])
+	if bulb == nil {
+		c.error(rw, http.StatusNotFound, "no such bulb")
+		return
+	}
+	if !c.mayControl(rw, bulb.Group) {
+		return
+	}
+	c.release(bulb)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// overridesBulbs returns the bulbs matching the request's filter, which
+// must be given so that every bulb is only changed when asked for with all
+func (c *Context) overridesBulbs(rw web.ResponseWriter, req *web.Request) ([]*Bulb, bool) {
+	expr := filterExpr(req)
+	switch expr {
+	case "":
+		c.error(rw, http.StatusBadRequest, "filter is required, use filter=all for every bulb")
+		return nil, false
+	case "all":
+		expr = ""
+	}
+	bulbs, err := c.filter(expr)
+	if err != nil {
+		c.error(rw, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return bulbs, true
+}
+
+func (c *Context) CreateOverrides(rw web.ResponseWriter, req *web.Request) {
+	bulbs, ok := c.overridesBulbs(rw, req)
+	if !ok {
+		return
+	}
+	ms := c.parseOverride(rw, req)
+	if ms == nil {
+		return
+	}
+
+	v := []*BulbJSON{}
+	for _, bulb := range bulbs {
+		c.override(bulb, ms)
+		v = append(v, c.bulbJSON(bulb))
+	}
+	c.writeJSONStatus(rw, http.StatusCreated, v)
+}
+
+func (c *Context) DeleteOverrides(rw web.ResponseWriter, req *web.Request) {
+	bulbs, ok := c.overridesBulbs(rw, req)
+	if !ok {
+		return
+	}
+	for _, bulb := range bulbs {
+		c.release(bulb)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Context) OpenAPI(rw web.ResponseWriter, req *web.Request) {
+	writeJSON(rw, OpenAPISpec())
+}
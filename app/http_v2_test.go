@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func serve(a *App, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	return rw
+}
+
+func expectAPIError(t *testing.T, rw *httptest.ResponseRecorder, status int) *APIError {
+	if rw.Code != status {
+		t.Fatalf("expected %d, got: %d %s", status, rw.Code, rw.Body.String())
+	}
+	e := &ErrorEnvelope{}
+	err := json.Unmarshal(rw.Body.Bytes(), e)
+	if err != nil || e.Error == nil {
+		t.Fatalf("expected an error envelope, got: %s", rw.Body.String())
+	}
+	if e.Error.Status != status || e.Error.RequestID == "" || e.Error.RequestID != rw.Header().Get("x-request-id") {
+		t.Fatalf("bad error envelope: %s", rw.Body.String())
+	}
+	return e.Error
+}
+
+func TestAPIv2Errors(t *testing.T) {
+	a, _ := testApp()
+	report(a, 32768, 5000)
+
+	expectAPIError(t, serve(a, "GET", "/api/v2/bulbs/nope", ""), 404)
+	expectAPIError(t, serve(a, "GET", "/api/v2/nothing", ""), 404)
+	expectAPIError(t, serve(a, "GET", "/api/v2/bulbs?filter=colour%3Dred", ""), 400)
+	expectAPIError(t, serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", "{"), 400)
+
+	e := expectAPIError(t, serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", `{"duration":"1h","brightness":70000}`), 400)
+	if e.Code != "bad_request" || !strings.Contains(e.Message, "brightness") {
+		t.Fatalf("unexpected error: %+v", e)
+	}
+	expectAPIError(t, serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", `{"duration":"1h","kelvin":100}`), 400)
+
+	// v1 keeps plain text errors, and stops at the first one
+	rw := serve(a, "POST", "/bulbs/group=Kitchen", "{")
+	if rw.Code != 400 || strings.HasPrefix(rw.Body.String(), "{") {
+		t.Fatalf("expected a plain 400, got: %d %s", rw.Code, rw.Body.String())
+	}
+	if a.GetBulb("d073d50035f7").hasManualState() {
+		t.Fatal("expected a bad request to leave the bulb alone")
+	}
+}
+
+func TestAPIv2Overrides(t *testing.T) {
+	a, _ := testApp()
+	report(a, 32768, 5000)
+
+	req := httptest.NewRequest("PUT", "/api/v2/bulbs/d073d50035f7/override", strings.NewReader(`{"duration":"1h","brightness":1000}`))
+	req.Header.Set("x-request-id", "test-request")
+	rw := httptest.NewRecorder()
+	newRouter(a).ServeHTTP(rw, req)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got: %d %s", http.StatusCreated, rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("x-request-id") != "test-request" {
+		t.Fatalf("expected the request id to be echoed, got: %s", rw.Header().Get("x-request-id"))
+	}
+	bj := &BulbJSON{}
+	json.Unmarshal(rw.Body.Bytes(), bj)
+	if bj.Override == nil || bj.Override.Brightness == nil || *bj.Override.Brightness != 1000 {
+		t.Fatalf("expected the override in the response, got: %s", rw.Body.String())
+	}
+
+	rw = serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/override", `{"duration":"1h","brightness":2000}`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d replacing an override, got: %d", http.StatusOK, rw.Code)
+	}
+
+	rw = serve(a, "POST", "/api/v2/overrides?filter=group%3DKitchen", `{"duration":"1h","power":false}`)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got: %d %s", http.StatusCreated, rw.Code, rw.Body.String())
+	}
+	var bulbs []*BulbJSON
+	json.Unmarshal(rw.Body.Bytes(), &bulbs)
+	if len(bulbs) != 1 || bulbs[0].Override == nil || bulbs[0].Override.Power == nil || *bulbs[0].Override.Power {
+		t.Fatalf("expected one bulb held off, got: %s", rw.Body.String())
+	}
+
+	rw = serve(a, "DELETE", "/api/v2/overrides?filter=group%3DKitchen", "")
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("expected %d, got: %d", http.StatusNoContent, rw.Code)
+	}
+	if a.GetBulb("d073d50035f7").hasManualState() {
+		t.Fatal("expected the override to be released")
+	}
+
+	// every bulb has to be asked for
+	expectAPIError(t, serve(a, "POST", "/api/v2/overrides", `{"duration":"1h","power":false}`), 400)
+	expectAPIError(t, serve(a, "DELETE", "/api/v2/overrides", ""), 400)
+	if a.GetBulb("d073d50035f7").hasManualState() {
+		t.Fatal("expected a missing filter to leave the bulb alone")
+	}
+	rw = serve(a, "POST", "/api/v2/overrides?filter=all", `{"duration":"1h","power":false}`)
+	if rw.Code != http.StatusCreated || !a.GetBulb("d073d50035f7").hasManualState() {
+		t.Fatalf("expected every bulb to be held, got: %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestAPIv2EmptyLists(t *testing.T) {
+	a, _ := testApp()
+
+	for _, path := range []string{"/api/v2/bulbs", "/api/v2/bulbs?filter=group%3DNowhere", "/api/v2/scenes", "/api/v2/groups"} {
+		rw := serve(a, "GET", path, "")
+		if rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != "[]" {
+			t.Fatalf("%s: expected an empty array, got: %d %s", path, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+// api/openapi.json is regenerated with "lifx openapi > api/openapi.json"
+func TestOpenAPISpecUpToDate(t *testing.T) {
+	data, err := ioutil.ReadFile("../api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var committed interface{}
+	err = json.Unmarshal(data, &committed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := json.Marshal(OpenAPISpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generated interface{}
+	json.Unmarshal(d, &generated)
+	if !reflect.DeepEqual(committed, generated) {
+		t.Fatal("api/openapi.json is out of date, regenerate it with lifx openapi")
+	}
+
+	// every route is served
+	// with the request already cancelled so streams return straight away
+	a, _ := testApp()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, route := range apiRoutes() {
+		path := "/api/v2" + pathParamRegexp.ReplaceAllString(route.Path, "x")
+		req := httptest.NewRequest(route.Method, path, nil).WithContext(ctx)
+		rw := httptest.NewRecorder()
+		newRouter(a).ServeHTTP(rw, req)
+		if rw.Code == http.StatusNotFound && bytes.Contains(rw.Body.Bytes(), []byte(`"message":"not found"`)) {
+			t.Fatalf("%s %s isn't routed", route.Method, route.Path)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -8,34 +9,100 @@ import (
 )
 
 type App struct {
-	client *lifx.Client
-	bulbs  map[string]*Bulb
-	curves *Curves
+	client      *lifx.Client
+	clock       lifx.Clock
+	config      *Config
+	site        string
+	sites       *Sites
+	bulbs       map[string]*Bulb
+	bulbsMutex  sync.RWMutex
+	curves      *Curves
+	curvesDir   string
+	curvesMutex sync.RWMutex
+	curvesError error
+	scenes      map[string]*Scene
+	scenesDir   string
+	scenesMutex sync.RWMutex
+
+	policies     *Policies
+	policiesPath string
+
+	auth     *AuthConfig
+	authPath string
+	auditLog *auditLog
+
+	mqtt     *MQTTConfig
+	mqttPath string
+
+	// controlMutex serialises everything reading or changing the bulbs'
+	// state. The client's updates, the control loops and the web and MQTT
+	// handlers each hold it while they run, and it's taken before any other
+	// mutex.
+	controlMutex sync.Mutex
+
+	gestures      *Gestures
+	gesturesPath  string
+	gesturesFired map[string]time.Time
+
+	occupancy         map[string]*Occupancy
+	occupancyPolicies *OccupancyPolicies
+	occupancyPath     string
+	occupancyMutex    sync.Mutex
+
+	events  *eventBus
+	metrics *Metrics
+
+	heartbeats      map[string]heartbeat
+	heartbeatsMutex sync.Mutex
+
+	offsets      *Offsets
+	offsetsPath  string
+	offsetsMutex sync.RWMutex
+
+	statePath      string
+	restoredState  map[string]*ControlState
+	lastSavedState []byte
+	stateMutex     sync.Mutex
 }
 
 func (a *App) watchOffline() {
-	for range time.Tick(time.Second) {
-		for _, bulb := range a.bulbs {
-			since := time.Since(bulb.bulb.LastSeen())
-			if since > time.Hour {
-				if bulb.Online {
-					bulb.Online = false
-					log.WithFields(log.Fields{
-						"name":   bulb.Name,
-						"addrss": bulb.Address,
-						"since":  since,
-					}).Info("bulb is now offline")
-				}
-			} else {
-				bulb.Online = true
+	a.heartbeat("offline", time.Second)
+	ticker := a.clock.NewTicker(time.Second)
+	for range ticker.C() {
+		a.checkOffline()
+		a.heartbeat("offline", time.Second)
+	}
+}
+
+func (a *App) checkOffline() {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
+	for _, bulb := range a.BulbList() {
+		since := a.clock.Since(bulb.bulb.LastSeen())
+		if since > time.Duration(a.config.OfflineAfter) {
+			if bulb.Online {
+				bulb.Online = false
+				log.WithFields(log.Fields{
+					"name":   bulb.Name,
+					"addrss": bulb.Address,
+					"since":  since,
+				}).Info("bulb is now offline")
 			}
+		} else {
+			bulb.Online = true
 		}
 	}
 }
 
 func (a *App) SetState(bulb *lifx.Bulb) {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
 	addr := bulb.GetLifxAddress()
+	a.bulbsMutex.RLock()
 	eb, ok := a.bulbs[addr]
+	a.bulbsMutex.RUnlock()
 	if !ok {
 		b := &Bulb{
 			bulb:       bulb,
@@ -47,14 +114,18 @@ func (a *App) SetState(bulb *lifx.Bulb) {
 		}
 		b.setState(bulb)
 		b.TargetState = bulb.GetState()
+		a.restoreState(b)
+		a.bulbsMutex.Lock()
 		a.bulbs[addr] = b
+		a.bulbsMutex.Unlock()
 		log.WithFields(log.Fields{
 			"address": addr,
 			"name":    b.Name,
 			"tags":    bulb.GetTags(),
 		}).Info("new bulb")
+		a.publish(EventBulbDiscovered, b, nil)
 	} else {
-		since := time.Since(eb.bulb.LastSeen())
+		since := a.clock.Since(eb.bulb.LastSeen())
 		changes, changed := eb.changed(bulb)
 		if changed {
 			log.WithFields(log.Fields{
@@ -63,47 +134,82 @@ func (a *App) SetState(bulb *lifx.Bulb) {
 				"name":       eb.Name,
 				"changes":    changes,
 			}).Info("state changed!")
-			eb.LastChange = time.Now()
+			eb.LastChange = a.clock.Now()
+			policy := a.policyFor(eb)
 			if eb.Controlled {
-				targetMismatch, targeted := eb.targetedChange(bulb)
+				targetMismatch, targeted := eb.targetedChange(bulb, policy)
 				if targeted {
 					eb.Controlled = true
 				} else {
-					log.WithFields(log.Fields{
-						"address":        addr,
-						"lastupdate":     since,
-						"name":           eb.Name,
-						"targetMismatch": targetMismatch,
-					}).Info("target mismatched, relinquishing control")
-					eb.Controlled = false
-					eb.ControlAfter = time.Now().Add(time.Hour)
+					eb.relinquishControl(policy, targetMismatch)
 				}
 			} else {
-				_, targeted := eb.targetedChange(bulb)
+				_, targeted := eb.targetedChange(bulb, policy)
 				if targeted {
 					log.WithFields(log.Fields{
 						"address":    addr,
 						"lastupdate": since,
 						"name":       eb.Name,
 					}).Info("target acquired, regaining control")
-					eb.Controlled = true
+					eb.regainControl("target-acquired")
+				} else if eb.suspendReason == RelinquishPowerCycle && powerCycled(eb.LastState, bulb.GetState()) {
+					log.WithFields(log.Fields{
+						"address":    addr,
+						"lastupdate": since,
+						"name":       eb.Name,
+					}).Info("bulb power cycled, regaining control")
+					eb.regainControl("power-cycled")
 				}
 			}
+		} else if !eb.Controlled && eb.suspendReason == RelinquishPowerCycle && powerCycled(eb.LastState, bulb.GetState()) {
+			// a bulb switched off at the wall drops off the network and comes
+			// back in the state it was in, without any reported change
+			log.WithFields(log.Fields{
+				"address":    addr,
+				"lastupdate": since,
+				"name":       eb.Name,
+			}).Info("bulb reappeared, regaining control")
+			eb.regainControl("power-cycled")
 		}
 		if eb.Online == false {
-			sinceLastUpdate := time.Since(eb.LastStateUpdate)
+			sinceLastUpdate := a.clock.Since(eb.LastStateUpdate)
 			log.WithFields(log.Fields{
 				"address": addr,
 				"offline": sinceLastUpdate,
 				"name":    eb.Name,
 			}).Debug("bulb is back online")
 		}
+		a.observeGesture(eb, bulb)
+		visible := eb.LastState.Visible
+		eb.bulb = bulb
 		eb.setState(bulb)
+		if changed {
+			a.publish(EventBulbChanged, eb, changes)
+		}
+		if visible && !eb.LastState.Visible {
+			a.publish(EventBulbOffline, eb, nil)
+		} else if !visible && eb.LastState.Visible {
+			a.publish(EventBulbOnline, eb, nil)
+		}
 	}
 }
 
+// powerCycled reports whether a bulb has been turned off and on again, either
+// through its reported power or by disappearing from the network and returning
+func powerCycled(was, is lifx.BulbState) bool {
+	if was.Power == powerOff && is.Power != powerOff {
+		return true
+	}
+	return !was.Visible && is.Visible
+}
+
+// BulbList returns a copy of the bulbs, safe to range over while bulbs are
+// being discovered
 func (a *App) BulbList() []*Bulb {
-	var l []*Bulb
+	a.bulbsMutex.RLock()
+	defer a.bulbsMutex.RUnlock()
+
+	l := make([]*Bulb, 0, len(a.bulbs))
 	for _, bulb := range a.bulbs {
 		l = append(l, bulb)
 	}
@@ -111,16 +217,20 @@ func (a *App) BulbList() []*Bulb {
 }
 
 func (a *App) GetBulbs() []*Bulb {
-	var l []*Bulb
-	for _, bulb := range a.bulbs {
-		l = append(l, bulb)
-	}
-	return l
+	return a.BulbList()
+}
+
+// bulbCount is how many bulbs have been discovered
+func (a *App) bulbCount() int {
+	a.bulbsMutex.RLock()
+	defer a.bulbsMutex.RUnlock()
+
+	return len(a.bulbs)
 }
 
 func (a *App) GetLocationBulbs(location string) []*Bulb {
 	var bl []*Bulb
-	for _, bulb := range a.bulbs {
+	for _, bulb := range a.BulbList() {
 		if bulb.Location == location {
 			bl = append(bl, bulb)
 		}
@@ -130,7 +240,7 @@ func (a *App) GetLocationBulbs(location string) []*Bulb {
 
 func (a *App) GetGroupBulbs(group string) []*Bulb {
 	var bl []*Bulb
-	for _, bulb := range a.bulbs {
+	for _, bulb := range a.BulbList() {
 		if bulb.Group == group {
 			bl = append(bl, bulb)
 		}
@@ -140,7 +250,7 @@ func (a *App) GetGroupBulbs(group string) []*Bulb {
 
 func (a *App) GetLocationGroupBulbs(location string, group string) []*Bulb {
 	var bl []*Bulb
-	for _, bulb := range a.bulbs {
+	for _, bulb := range a.BulbList() {
 		if bulb.Location == location && bulb.Group == group {
 			bl = append(bl, bulb)
 		}
@@ -149,62 +259,189 @@ func (a *App) GetLocationGroupBulbs(location string, group string) []*Bulb {
 }
 
 func (a *App) GetBulb(address string) *Bulb {
-	for _, bulb := range a.bulbs {
-		if bulb.Address == address {
-			return bulb
-		}
-	}
-	return nil
+	a.bulbsMutex.RLock()
+	defer a.bulbsMutex.RUnlock()
+
+	return a.bulbs[address]
 }
 
 func (a *App) regainControl() {
-	for _ = range time.Tick(time.Second) {
-		for _, bulb := range a.BulbList() {
-			if bulb.Controlled {
-				continue
-			}
-			if bulb.ControlAfter.Before(time.Now()) {
-				log.WithFields(log.Fields{
-					"address":       bulb.Address,
-					"name":          bulb.Name,
-					"after":         time.Since(bulb.ControlAfter),
-					"control-after": bulb.ControlAfter,
-				}).Info("regaining control of bulb")
-				bulb.Controlled = true
-				bulb.adjustState()
-			}
+	interval := time.Duration(a.config.ControlInterval)
+	a.heartbeat("regain-control", interval)
+	ticker := a.clock.NewTicker(interval)
+	for range ticker.C() {
+		a.checkRegainControl()
+		a.heartbeat("regain-control", interval)
+	}
+}
+
+func (a *App) checkRegainControl() {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
+	for _, bulb := range a.BulbList() {
+		if bulb.Controlled {
+			continue
+		}
+		if bulb.ControlAfter.Before(a.clock.Now()) {
+			log.WithFields(log.Fields{
+				"address":       bulb.Address,
+				"name":          bulb.Name,
+				"after":         a.clock.Since(bulb.ControlAfter),
+				"control-after": bulb.ControlAfter,
+			}).Info("regaining control of bulb")
+			bulb.regainControl("control-after")
+			bulb.adjustState()
 		}
 	}
 }
 
 func (a *App) watchAmbient() {
-	for _ = range time.Tick(time.Second * 30) {
+	ticker := a.clock.NewTicker(time.Second * 30)
+	for range ticker.C() {
 		for _, bulb := range a.BulbList() {
 			a.client.GetAmbientLight(bulb.bulb)
 		}
 	}
 }
+
 func (a *App) controlState() {
-	for _ = range time.Tick(time.Second) {
-		for _, bulb := range a.BulbList() {
-			if !bulb.Controlled {
-				continue
-			}
-			bulb.adjustState()
+	interval := time.Duration(a.config.ControlInterval)
+	a.heartbeat("control", interval)
+	ticker := a.clock.NewTicker(interval)
+	for range ticker.C() {
+		a.adjustControlled()
+		a.heartbeat("control", interval)
+	}
+}
+
+func (a *App) adjustControlled() {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
+	var controlled []*Bulb
+	for _, bulb := range a.BulbList() {
+		if bulb.Controlled {
+			controlled = append(controlled, bulb)
 		}
 	}
+	a.adjustTogether(controlled)
 }
 
-func NewApp(c *lifx.Client) (*App, error) {
-	a := App{
+// newApp builds an App with the default config taking its time from the
+// client's clock, without starting any of the background loops or the web
+// server
+func newApp(c *lifx.Client) *App {
+	// count the client's traffic if it was started with our metrics,
+	// otherwise it hasn't been shared with any goroutines yet
+	m, ok := c.Metrics.(*Metrics)
+	if !ok {
+		m = NewMetrics()
+		c.Metrics = m
+	}
+
+	a := &App{
 		bulbs:  make(map[string]*Bulb),
 		client: c,
+		clock:  c.Clock(),
+		scenes: make(map[string]*Scene),
+
+		policiesPath: "policies.json",
+		authPath:     "auth.json",
+		mqttPath:     "mqtt.json",
+
+		gesturesPath:  "gestures.json",
+		gesturesFired: make(map[string]time.Time),
+
+		occupancy:     make(map[string]*Occupancy),
+		occupancyPath: "occupancy.json",
+
+		events:  newEventBus(),
+		metrics: m,
+
+		heartbeats: make(map[string]heartbeat),
+
+		offsets: newOffsets(),
+
+		restoredState: make(map[string]*ControlState),
+	}
+	a.configure(DefaultConfig())
+	m.app = a
+	return a
+}
+
+func NewApp(c *lifx.Client, config *Config) (*App, error) {
+	a := newApp(c)
+	a.configure(config)
+
+	err := a.loadAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.start()
+	if err != nil {
+		return nil, err
+	}
+
+	err = RunWebServer(a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// start loads the app's config and state and starts its background loops
+func (a *App) start() error {
+	err := a.loadPolicies()
+	if err != nil {
+		return err
+	}
+
+	err = a.loadGestures()
+	if err != nil {
+		return err
+	}
+
+	err = a.loadOccupancyPolicies()
+	if err != nil {
+		return err
+	}
+
+	err = a.loadMQTT()
+	if err != nil {
+		return err
+	}
+
+	err = a.loadOffsets()
+	if err != nil {
+		return err
+	}
+
+	err = a.loadState()
+	if err != nil {
+		return err
 	}
 
 	go a.regainControl()
 	go a.controlState()
-	go a.loadCurves()
+	go a.persistState()
+	go a.watchOffline()
+	go a.watchGestures()
+	go a.watchOccupancy()
+	go func() {
+		err := a.loadCurves()
+		if err != nil {
+			log.WithError(err).Error("unable to load curves")
+		}
+	}()
+	err = a.loadScenes()
+	if err != nil {
+		return err
+	}
+	if a.mqtt != nil {
+		a.startMQTT()
+	}
 	//go a.watchAmbient()
-	RunWebServer(&a)
-	return &a, nil
+	return nil
 }
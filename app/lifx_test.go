@@ -0,0 +1,195 @@
+package app
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+var testAddr = [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x35, 0xf7}
+
+// testApp returns an app at 06:00 so the kitchen curve targets 32768/5000
+func testApp() (*App, *lifx.FakeClock) {
+	clock := lifx.NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	a := newApp(lifx.NewClientWithClock(clock))
+	a.curves = testCurves()
+	return a, clock
+}
+
+// withGateway gives the app's client somewhere to send commands, call the
+// returned func to close it
+func withGateway(t *testing.T, a *App) func() {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.client.AddGateway([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() { listener.Close() }
+}
+
+func report(a *App, brightness uint16, kelvin uint16) *Bulb {
+	a.SetState(lifx.NewBulbWithState(testAddr, "Lamp", "Kitchen", "Home", lifx.BulbState{
+		Brightness: brightness,
+		Kelvin:     kelvin,
+		Power:      65535,
+		Visible:    true,
+	}))
+	return a.GetBulb("d073d50035f7")
+}
+
+func TestControlStateMachine(t *testing.T) {
+	a, clock := testApp()
+
+	b := report(a, 1000, 2700)
+	if b == nil || !b.Controlled {
+		t.Fatal("expected new bulb to be controlled")
+	}
+
+	// the control loop notices the bulb is off-curve and sends a change,
+	// holding off control until the bulb confirms it
+	a.adjustControlled()
+	if b.Controlled {
+		t.Fatal("expected control to be suspended while the change is in flight")
+	}
+	if b.TargetState.Brightness != 32768 || b.TargetState.Kelvin != 5000 {
+		t.Fatalf("expected target 32768/5000, got: %d/%d", b.TargetState.Brightness, b.TargetState.Kelvin)
+	}
+
+	report(a, 32768, 5000)
+	if !b.Controlled {
+		t.Fatal("expected control once the bulb reached its target")
+	}
+
+	// somebody changes the bulb by hand
+	report(a, 10000, 5000)
+	if b.Controlled {
+		t.Fatal("expected control to be relinquished on a target mismatch")
+	}
+	expected := clock.Now().Add(time.Hour)
+	if !b.ControlAfter.Equal(expected) {
+		t.Fatalf("expected control after %s, got: %s", expected, b.ControlAfter)
+	}
+
+	a.adjustControlled()
+	if b.TargetState.Brightness != 32768 {
+		t.Fatalf("expected target to be left alone, got: %d", b.TargetState.Brightness)
+	}
+
+	clock.Advance(30 * time.Minute)
+	a.checkRegainControl()
+	if b.Controlled {
+		t.Fatal("expected control to stay relinquished before ControlAfter")
+	}
+
+	// after the hour is up control is regained and the curve re-applied
+	clock.Advance(31 * time.Minute)
+	a.checkRegainControl()
+	if b.Controlled {
+		t.Fatal("expected a change to be in flight after regaining control")
+	}
+	if !b.ControlAfter.Equal(clock.Now().Add(15 * time.Second)) {
+		t.Fatalf("expected a 15s grace, got control after: %s", b.ControlAfter)
+	}
+
+	report(a, b.TargetState.Brightness, b.TargetState.Kelvin)
+	if !b.Controlled {
+		t.Fatal("expected control once the bulb reached its target")
+	}
+}
+
+func TestManualOverrideExpiry(t *testing.T) {
+	a, clock := testApp()
+
+	b := report(a, 32768, 5000)
+	a.adjustControlled()
+	if !b.Controlled {
+		t.Fatal("expected bulb on its curve to stay controlled")
+	}
+
+	brightness := 5000
+	ms, err := ParseUpdateBulbRequest(&UpdateBulbRequest{
+		Duration:   stringp("30m"),
+		Brightness: &brightness,
+	}, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setManualState(ms)
+
+	a.adjustControlled()
+	if b.TargetState.Brightness != 5000 || b.TargetState.Kelvin != 5000 {
+		t.Fatalf("expected target 5000/5000, got: %d/%d", b.TargetState.Brightness, b.TargetState.Kelvin)
+	}
+	report(a, 5000, 5000)
+
+	clock.Advance(29 * time.Minute)
+	a.adjustControlled()
+	if b.TargetState.Brightness != 5000 {
+		t.Fatalf("expected override to still apply, got: %d", b.TargetState.Brightness)
+	}
+
+	clock.Advance(2 * time.Minute)
+	a.adjustControlled()
+	if b.TargetState.Brightness != 32768 {
+		t.Fatalf("expected curve after override expiry, got: %d", b.TargetState.Brightness)
+	}
+}
+
+func TestManualPowerOff(t *testing.T) {
+	a, clock := testApp()
+
+	b := report(a, 32768, 5000)
+
+	off := false
+	ms, err := ParseUpdateBulbRequest(&UpdateBulbRequest{
+		Duration:   stringp("30m"),
+		Power:      &off,
+		Transition: stringp("2s"),
+	}, clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.setManualState(ms)
+
+	a.adjustControlled()
+	if b.TargetState.Power != powerOff {
+		t.Fatalf("expected target power %d, got: %d", powerOff, b.TargetState.Power)
+	}
+	if !b.ControlAfter.Equal(clock.Now().Add(15 * time.Second)) {
+		t.Fatalf("expected a 15s grace, got control after: %s", b.ControlAfter)
+	}
+
+	// the bulb turning off is what was asked for, not a manual change
+	a.SetState(lifx.NewBulbWithState(testAddr, "Lamp", "Kitchen", "Home", lifx.BulbState{
+		Brightness: 32768,
+		Kelvin:     5000,
+		Power:      powerOff,
+		Visible:    true,
+	}))
+	if !b.Controlled {
+		t.Fatal("expected control once the bulb turned off")
+	}
+
+	clock.Advance(31 * time.Minute)
+	a.adjustControlled()
+	if b.TargetState.Power != powerOn {
+		t.Fatalf("expected the bulb to be turned back on, got target power: %d", b.TargetState.Power)
+	}
+	if b.hasManualState() {
+		t.Fatal("expected the manual state to be cleared on expiry")
+	}
+
+	_, err = ParseUpdateBulbRequest(&UpdateBulbRequest{Duration: stringp("1h")}, clock.Now())
+	if err == nil {
+		t.Fatal("expected an error when nothing is overridden")
+	}
+}
+
+func stringp(s string) *string {
+	return &s
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+// Metrics collects protocol and control loop metrics for /metrics, it is
+// also a lifx.Metrics so the client can count its traffic
+type Metrics struct {
+	registry *prometheus.Registry
+	app      *App
+
+	packetsSent     *prometheus.CounterVec
+	packetsReceived *prometheus.CounterVec
+	decodeErrors    prometheus.Counter
+	latency         *prometheus.HistogramVec
+	control         *prometheus.CounterVec
+	queueDepth      prometheus.Gauge
+	queueDelay      *prometheus.HistogramVec
+	coalesced       *prometheus.CounterVec
+	groupChanges    *prometheus.CounterVec
+	groupSpread     prometheus.Histogram
+}
+
+// NewMetrics builds the metrics registry, set it as the client's Metrics
+// before starting discovery and NewApp will use it
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		packetsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lifx_packets_sent_total",
+			Help: "Packets sent to gateways by packet type.",
+		}, []string{"type"}),
+		packetsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lifx_packets_received_total",
+			Help: "Packets received by packet type.",
+		}, []string{"type"}),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lifx_packet_decode_errors_total",
+			Help: "Packets received which couldn't be decoded.",
+		}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lifx_command_latency_seconds",
+			Help:    "Time from sending a request to a bulb to it answering, by request type.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"type"}),
+		control: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lifx_control_events_total",
+			Help: "Bulbs relinquished to or regained from manual control, by reason.",
+		}, []string{"event", "reason"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "lifx_command_queue_depth",
+			Help: "Commands waiting to be sent to bulbs.",
+		}),
+		queueDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lifx_command_queue_delay_seconds",
+			Help:    "Time commands waited to be sent, by packet type.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"type"}),
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lifx_commands_coalesced_total",
+			Help: "Commands replaced by a newer one for the same bulb before being sent, by packet type.",
+		}, []string{"type"}),
+		groupChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lifx_group_change_bulbs_total",
+			Help: "Bulbs sent their part of a group change, or whose part was superseded by a newer colour, by result.",
+		}, []string{"result"}),
+		groupSpread: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lifx_group_change_spread_seconds",
+			Help:    "Time from the first to the last bulb of a group change being sent.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5},
+		}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	m.registry.MustRegister(m.collectors()...)
+	return m
+}
+
+// collectors are the app's own metrics, leaving out the process's
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.packetsSent,
+		m.packetsReceived,
+		m.decodeErrors,
+		m.latency,
+		m.control,
+		m.queueDepth,
+		m.queueDelay,
+		m.coalesced,
+		m.groupChanges,
+		m.groupSpread,
+		&bulbCollector{m},
+	}
+}
+
+func (m *Metrics) PacketSent(packetType uint16) {
+	m.packetsSent.WithLabelValues(lifx.PacketName(packetType)).Inc()
+}
+
+func (m *Metrics) PacketReceived(packetType uint16) {
+	m.packetsReceived.WithLabelValues(lifx.PacketName(packetType)).Inc()
+}
+
+func (m *Metrics) DecodeError() {
+	m.decodeErrors.Inc()
+}
+
+func (m *Metrics) ResponseLatency(requestType uint16, latency time.Duration) {
+	m.latency.WithLabelValues(lifx.PacketName(requestType)).Observe(latency.Seconds())
+}
+
+func (m *Metrics) QueueDepth(depth int) {
+	m.queueDepth.Set(float64(depth))
+}
+
+func (m *Metrics) QueueDelay(packetType uint16, delay time.Duration) {
+	m.queueDelay.WithLabelValues(lifx.PacketName(packetType)).Observe(delay.Seconds())
+}
+
+func (m *Metrics) CommandCoalesced(packetType uint16) {
+	m.coalesced.WithLabelValues(lifx.PacketName(packetType)).Inc()
+}
+
+func (m *Metrics) groupChangeSent(result lifx.GroupResult) {
+	m.groupChanges.WithLabelValues(groupResultName(result)).Inc()
+}
+
+func (m *Metrics) groupChangeSpread(spread time.Duration) {
+	m.groupSpread.Observe(spread.Seconds())
+}
+
+func (m *Metrics) relinquished(policy string) {
+	m.control.WithLabelValues("relinquished", policy).Inc()
+}
+
+func (m *Metrics) regained(reason string) {
+	m.control.WithLabelValues("regained", reason).Inc()
+}
+
+var (
+	bulbLabels = []string{"bulb", "name", "group"}
+
+	bulbBrightnessDesc = prometheus.NewDesc("lifx_bulb_brightness_ratio", "Bulb brightness, 0 to 1.", bulbLabels, nil)
+	bulbKelvinDesc     = prometheus.NewDesc("lifx_bulb_kelvin", "Bulb colour temperature.", bulbLabels, nil)
+	bulbPowerDesc      = prometheus.NewDesc("lifx_bulb_power", "1 if the bulb is on.", bulbLabels, nil)
+	bulbLuxDesc        = prometheus.NewDesc("lifx_bulb_lux", "Ambient light at the bulb.", bulbLabels, nil)
+	bulbOnlineDesc     = prometheus.NewDesc("lifx_bulb_online", "1 if the bulb has been seen recently.", bulbLabels, nil)
+	bulbControlledDesc = prometheus.NewDesc("lifx_bulb_controlled", "1 if the bulb is following its curve or an override.", bulbLabels, nil)
+	bulbRSSIDesc       = prometheus.NewDesc("lifx_bulb_rssi_dbm", "Bulb wifi signal strength.", bulbLabels, nil)
+	bulbLastSeenDesc   = prometheus.NewDesc("lifx_bulb_last_seen_seconds", "Seconds since the bulb was last heard from.", bulbLabels, nil)
+)
+
+// bulbCollector reports the bulbs' current state when scraped
+type bulbCollector struct {
+	metrics *Metrics
+}
+
+func (bc *bulbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bulbBrightnessDesc
+	ch <- bulbKelvinDesc
+	ch <- bulbPowerDesc
+	ch <- bulbLuxDesc
+	ch <- bulbOnlineDesc
+	ch <- bulbControlledDesc
+	ch <- bulbRSSIDesc
+	ch <- bulbLastSeenDesc
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (bc *bulbCollector) Collect(ch chan<- prometheus.Metric) {
+	a := bc.metrics.app
+	if a == nil {
+		return
+	}
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+
+	now := a.clock.Now()
+	for _, b := range a.BulbList() {
+		labels := []string{b.Address, b.Name, b.Group}
+		gauge := func(desc *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+		}
+
+		gauge(bulbBrightnessDesc, float64(b.LastState.Brightness)/65535)
+		gauge(bulbKelvinDesc, float64(b.LastState.Kelvin))
+		gauge(bulbPowerDesc, boolGauge(b.LastState.Power > 0))
+		gauge(bulbLuxDesc, float64(b.Lux))
+		gauge(bulbOnlineDesc, boolGauge(b.Online))
+		gauge(bulbControlledDesc, boolGauge(b.Controlled))
+		if rssi, ok := b.bulb.GetRSSI(); ok {
+			gauge(bulbRSSIDesc, float64(rssi))
+		}
+		gauge(bulbLastSeenDesc, now.Sub(b.bulb.LastSeen()).Seconds())
+	}
+}
+
+// Metrics serves the registry in the prometheus exposition format
+func (c *Context) Metrics(rw web.ResponseWriter, req *web.Request) {
+	promhttp.HandlerFor(c.App.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(rw, req.Request)
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func TestMetrics(t *testing.T) {
+	a, _ := testApp()
+	report(a, 32768, 5000)
+	a.adjustControlled()
+	report(a, 10000, 5000)
+	a.metrics.PacketSent(lifx.PktGetLightState)
+	a.metrics.DecodeError()
+
+	rw := serve(a, "GET", "/metrics", "")
+	if rw.Code != 200 {
+		t.Fatalf("expected %d, got: %d", 200, rw.Code)
+	}
+	body := rw.Body.String()
+	for _, expected := range []string{
+		`lifx_bulb_kelvin{bulb="d073d50035f7",group="Kitchen",name="Lamp"} 5000`,
+		`lifx_bulb_controlled{bulb="d073d50035f7",group="Kitchen",name="Lamp"} 0`,
+		`lifx_control_events_total{event="relinquished",reason="duration"} 1`,
+		`lifx_packets_sent_total{type="GetLightState"} 1`,
+		`lifx_packet_decode_errors_total 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "lifx_bulb_rssi_dbm{") {
+		t.Fatal("expected no rssi before the bulb reports it")
+	}
+}
+
+func TestMetricsWhileDiscovering(t *testing.T) {
+	a, _ := testApp()
+	var bulbs []*lifx.Bulb
+	for i := 0; i < 50; i++ {
+		bulbs = append(bulbs, lifx.NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x01, byte(i)}, "Spot", "Kitchen", "Home", lifx.BulbState{Power: 65535, Visible: true}))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, bulb := range bulbs {
+			a.SetState(bulb)
+		}
+	}()
+	for scraping := true; scraping; {
+		select {
+		case <-done:
+			scraping = false
+		default:
+		}
+		if rw := serve(a, "GET", "/metrics", ""); rw.Code != 200 {
+			t.Fatalf("expected %d, got: %d", 200, rw.Code)
+		}
+		serve(a, "POST", "/api/v2/overrides?filter=all", `{"brightness":1000,"duration":"1h"}`)
+		a.checkOffline()
+	}
+
+	body := serve(a, "GET", "/metrics", "").Body.String()
+	if n := strings.Count(body, "lifx_bulb_online{"); n != len(bulbs) {
+		t.Fatalf("expected %d, got: %d", len(bulbs), n)
+	}
+}
@@ -0,0 +1,630 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/filter"
+)
+
+// MQTTConfig is the mqtt.json file, without it there's no bridge. Access
+// to the command topics is down to the broker's ACLs.
+type MQTTConfig struct {
+	Broker       string `json:"broker"`
+	ClientID     string `json:"client-id,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password-file,omitempty"`
+
+	// Prefix is the root of our own topics
+	Prefix string `json:"prefix,omitempty"`
+
+	// Discovery publishes Home Assistant discovery payloads under
+	// DiscoveryPrefix, on by default
+	Discovery       *bool  `json:"discovery,omitempty"`
+	DiscoveryPrefix string `json:"discovery-prefix,omitempty"`
+
+	// OverrideFor is how long a set command holds the bulb when it doesn't
+	// say, Home Assistant never does
+	OverrideFor *Duration `json:"override-for,omitempty"`
+}
+
+const (
+	mqttStatusOnline  = "online"
+	mqttStatusOffline = "offline"
+	mqttOn            = "ON"
+	mqttOff           = "OFF"
+	mqttPublishWait   = time.Second * 5
+	// mqttRefresh is how often everything is republished
+	mqttRefresh = time.Second * 10
+)
+
+func (mc *MQTTConfig) validate() error {
+	if mc.Broker == "" {
+		return errors.New("broker is required")
+	}
+	if mc.Password == "" && mc.PasswordFile != "" {
+		data, err := ioutil.ReadFile(mc.PasswordFile)
+		if err != nil {
+			return err
+		}
+		mc.Password = strings.TrimSpace(string(data))
+	}
+	if mc.ClientID == "" {
+		mc.ClientID = "lifx"
+	}
+	if mc.Prefix == "" {
+		mc.Prefix = "lifx"
+	}
+	if mc.DiscoveryPrefix == "" {
+		mc.DiscoveryPrefix = "homeassistant"
+	}
+	if mc.Discovery == nil {
+		discovery := true
+		mc.Discovery = &discovery
+	}
+	if mc.OverrideFor == nil {
+		d := Duration(time.Hour)
+		mc.OverrideFor = &d
+	} else if *mc.OverrideFor <= 0 {
+		return errors.New("override-for must be positive")
+	}
+	return nil
+}
+
+// loadMQTT reads the optional MQTT file
+func (a *App) loadMQTT() error {
+	data, err := ioutil.ReadFile(a.mqttPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	mc := &MQTTConfig{}
+	err = json.Unmarshal(data, mc)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.mqttPath, err)
+	}
+	err = mc.validate()
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.mqttPath, err)
+	}
+
+	a.mqtt = mc
+	log.WithFields(log.Fields{
+		"path":   a.mqttPath,
+		"broker": mc.Broker,
+		"prefix": mc.Prefix,
+	}).Info("loaded mqtt")
+
+	return nil
+}
+
+// mqttConn is the little of an MQTT client the bridge needs
+type mqttConn interface {
+	publish(topic string, retained bool, payload []byte) error
+	subscribe(topic string, handler func(topic string, payload []byte)) error
+}
+
+// pahoConn is an mqttConn on a real broker
+type pahoConn struct {
+	client mqtt.Client
+}
+
+func (pc *pahoConn) publish(topic string, retained bool, payload []byte) error {
+	t := pc.client.Publish(topic, 1, retained, payload)
+	if !t.WaitTimeout(mqttPublishWait) {
+		return fmt.Errorf("publish %s timed out", topic)
+	}
+	return t.Error()
+}
+
+func (pc *pahoConn) subscribe(topic string, handler func(topic string, payload []byte)) error {
+	t := pc.client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	})
+	if !t.WaitTimeout(mqttPublishWait) {
+		return fmt.Errorf("subscribe %s timed out", topic)
+	}
+	return t.Error()
+}
+
+// MQTTState is the retained state of a bulb, in the shape Home Assistant's
+// JSON light schema expects plus our own control fields
+type MQTTState struct {
+	State         string        `json:"state"`
+	Brightness    int           `json:"brightness"`
+	ColorMode     string        `json:"color_mode"`
+	ColorTemp     int           `json:"color_temp"`
+	Kelvin        int           `json:"kelvin"`
+	Controlled    bool          `json:"controlled"`
+	ControlReason string        `json:"control_reason"`
+	Override      *OverrideJSON `json:"override,omitempty"`
+}
+
+// MQTTCommand is a set command, brightness is 0-255 and color_temp is in
+// mireds as Home Assistant sends them. It's an override like
+// UpdateBulbRequest, lasting override-for unless until or duration is given.
+type MQTTCommand struct {
+	State      *string    `json:"state,omitempty"`
+	Brightness *int       `json:"brightness,omitempty"`
+	ColorTemp  *int       `json:"color_temp,omitempty"`
+	Kelvin     *int       `json:"kelvin,omitempty"`
+	Transition *float64   `json:"transition,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	Duration   *string    `json:"duration,omitempty"`
+}
+
+// updateBulbRequest converts the command to the API's units
+func (mc *MQTTCommand) updateBulbRequest(overrideFor time.Duration) (*UpdateBulbRequest, error) {
+	ur := &UpdateBulbRequest{
+		Until:    mc.Until,
+		Duration: mc.Duration,
+		Kelvin:   mc.Kelvin,
+	}
+	if ur.Until == nil && ur.Duration == nil {
+		d := overrideFor.String()
+		ur.Duration = &d
+	}
+	if mc.State != nil {
+		switch strings.ToUpper(*mc.State) {
+		case mqttOn:
+			ur.Power = boolPtr(true)
+		case mqttOff:
+			ur.Power = boolPtr(false)
+		default:
+			return nil, fmt.Errorf("state must be %s or %s", mqttOn, mqttOff)
+		}
+	}
+	if mc.Brightness != nil {
+		if *mc.Brightness < 0 || *mc.Brightness > 255 {
+			return nil, fmt.Errorf("brightness %d out of range (0-255)", *mc.Brightness)
+		}
+		b := int(math.Round(float64(*mc.Brightness) * 65535 / 255))
+		ur.Brightness = &b
+	}
+	if mc.ColorTemp != nil {
+		if *mc.ColorTemp <= 0 {
+			return nil, fmt.Errorf("color_temp %d out of range", *mc.ColorTemp)
+		}
+		k := mireds(*mc.ColorTemp)
+		ur.Kelvin = &k
+	}
+	if mc.Transition != nil {
+		if *mc.Transition < 0 {
+			return nil, errors.New("transition can't be negative")
+		}
+		t := time.Duration(*mc.Transition * float64(time.Second)).String()
+		ur.Transition = &t
+	}
+	return ur, nil
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+// mireds converts between kelvin and mireds, it's its own inverse
+func mireds(v int) int {
+	if v <= 0 {
+		return 0
+	}
+	return int(math.Round(1e6 / float64(v)))
+}
+
+// mqttSegment makes s safe to use as one level of a topic
+func mqttSegment(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// haID makes s safe for Home Assistant object ids
+func haID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, s)
+}
+
+// mqttBridge publishes bulb and occupancy state to a broker and acts on
+// commands from it
+type mqttBridge struct {
+	app    *App
+	config *MQTTConfig
+	conn   mqttConn
+
+	// published is the last retained payload on each topic, so state is
+	// only republished when it changes
+	mutex     sync.Mutex
+	published map[string]string
+}
+
+func newMQTTBridge(a *App, mc *MQTTConfig, conn mqttConn) *mqttBridge {
+	return &mqttBridge{
+		app:       a,
+		config:    mc,
+		conn:      conn,
+		published: make(map[string]string),
+	}
+}
+
+// startMQTT connects to the broker and runs the bridge, paho reconnects by
+// itself and every (re)connect republishes everything
+func (a *App) startMQTT() {
+	mc := a.mqtt
+	m := newMQTTBridge(a, mc, nil)
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(mc.Broker)
+	opts.SetClientID(mc.ClientID)
+	opts.SetUsername(mc.Username)
+	opts.SetPassword(mc.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetWill(m.topic("status"), mqttStatusOffline, 1, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.WithField("broker", mc.Broker).Info("mqtt connected")
+		m.connected()
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.WithError(err).WithField("broker", mc.Broker).Warn("mqtt connection lost")
+	})
+	client := mqtt.NewClient(opts)
+	m.conn = &pahoConn{client: client}
+
+	go func() {
+		for {
+			t := client.Connect()
+			t.Wait()
+			if t.Error() == nil {
+				break
+			}
+			log.WithError(t.Error()).WithField("broker", mc.Broker).Error("unable to connect to mqtt")
+			<-a.clock.After(time.Second * 10)
+		}
+	}()
+	go m.run()
+}
+
+func (m *mqttBridge) topic(levels ...string) string {
+	return m.config.Prefix + "/" + strings.Join(levels, "/")
+}
+
+func (m *mqttBridge) bulbTopic(b *Bulb, level string) string {
+	return m.topic("bulbs", mqttSegment(b.Address), level)
+}
+
+func (m *mqttBridge) groupTopic(group string, levels ...string) string {
+	return m.topic(append([]string{"groups", mqttSegment(group)}, levels...)...)
+}
+
+// connected announces us, subscribes to the command topics and publishes
+// everything afresh, as a new broker may not have our retained messages
+func (m *mqttBridge) connected() {
+	m.mutex.Lock()
+	m.published = make(map[string]string)
+	m.mutex.Unlock()
+
+	err := m.conn.publish(m.topic("status"), true, []byte(mqttStatusOnline))
+	if err != nil {
+		log.WithError(err).Error("unable to publish mqtt status")
+	}
+	for topic, handler := range map[string]func(string, []byte){
+		m.topic("bulbs", "+", "set"):               m.handleSet,
+		m.topic("bulbs", "+", "release"):           m.handleRelease,
+		m.topic("groups", "+", "occupancy", "set"): m.handleOccupancy,
+	} {
+		err := m.conn.subscribe(topic, handler)
+		if err != nil {
+			log.WithError(err).WithField("topic", topic).Error("unable to subscribe")
+		}
+	}
+	m.refresh()
+}
+
+// run republishes on events, and every so often for changes which aren't
+// events such as a bulb going offline
+func (m *mqttBridge) run() {
+	sub, _, _ := m.app.events.subscribe(eventID{}, filter.All{}, nil)
+	ticker := m.app.clock.NewTicker(mqttRefresh)
+	m.app.heartbeat("mqtt", mqttRefresh)
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				// dropped for being slow, catch up on everything
+				sub, _, _ = m.app.events.subscribe(eventID{}, filter.All{}, nil)
+				m.refresh()
+				continue
+			}
+			m.handleEvent(e)
+		case <-ticker.C():
+			m.refresh()
+			m.app.heartbeat("mqtt", mqttRefresh)
+		}
+	}
+}
+
+func (m *mqttBridge) handleEvent(e *Event) {
+	if e.bulb != nil {
+		m.publishBulb(e.bulb)
+	}
+	if e.Type == EventOccupancyChanged {
+		if o, ok := e.Data.(*Occupancy); ok {
+			m.publishOccupancy(o)
+		}
+	}
+}
+
+// refresh publishes every bulb and group, leaving out anything unchanged
+func (m *mqttBridge) refresh() {
+	for _, bulb := range m.app.BulbList() {
+		m.publishBulb(bulb)
+	}
+	m.app.controlMutex.Lock()
+	groups := m.app.Groups()
+	m.app.controlMutex.Unlock()
+	for _, group := range groups {
+		m.publishOccupancy(m.app.GetOccupancy(group))
+	}
+}
+
+// retain publishes a retained payload if it differs from the last one
+func (m *mqttBridge) retain(topic string, payload []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if last, ok := m.published[topic]; ok && last == string(payload) {
+		return
+	}
+	err := m.conn.publish(topic, true, payload)
+	if err != nil {
+		log.WithError(err).WithField("topic", topic).Error("unable to publish to mqtt")
+		return
+	}
+	m.published[topic] = string(payload)
+}
+
+func (m *mqttBridge) retainJSON(topic string, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	m.retain(topic, d)
+}
+
+func (m *mqttBridge) bulbState(b *Bulb) *MQTTState {
+	state := b.bulb.GetState()
+	s := &MQTTState{
+		State:         mqttOff,
+		Brightness:    int(math.Round(float64(state.Brightness) * 255 / 65535)),
+		ColorMode:     "color_temp",
+		ColorTemp:     mireds(int(state.Kelvin)),
+		Kelvin:        int(state.Kelvin),
+		Controlled:    b.Controlled,
+		ControlReason: b.ControlReason(),
+		Override:      b.override(m.app.clock.Now()),
+	}
+	if state.Power != powerOff {
+		s.State = mqttOn
+	}
+	return s
+}
+
+// publishBulb reads the bulb with controlMutex held but publishes without
+// it, so a slow broker doesn't hold up control
+func (m *mqttBridge) publishBulb(b *Bulb) {
+	m.app.controlMutex.Lock()
+	device := m.bulbDevice(b)
+	availability := mqttStatusOffline
+	if b.Online {
+		availability = mqttStatusOnline
+	}
+	state := m.bulbState(b)
+	m.app.controlMutex.Unlock()
+
+	if *m.config.Discovery {
+		m.publishBulbDiscovery(b, device)
+	}
+	m.retain(m.bulbTopic(b, "availability"), []byte(availability))
+	m.retainJSON(m.bulbTopic(b, "state"), state)
+}
+
+func (m *mqttBridge) publishOccupancy(o *Occupancy) {
+	if o.Group == "" {
+		return
+	}
+	if *m.config.Discovery {
+		m.publishOccupancyDiscovery(o.Group)
+	}
+	state := mqttOff
+	if o.State == OccupancyOccupied {
+		state = mqttOn
+	}
+	m.retain(m.groupTopic(o.Group, "occupancy"), []byte(state))
+}
+
+func (m *mqttBridge) discoveryTopic(component string, objectID string) string {
+	return strings.Join([]string{m.config.DiscoveryPrefix, component, objectID, "config"}, "/")
+}
+
+// bulbDevice describes the bulb as a Home Assistant device
+func (m *mqttBridge) bulbDevice(b *Bulb) map[string]interface{} {
+	device := map[string]interface{}{
+		"identifiers":  []string{"lifx_" + haID(b.Address)},
+		"name":         b.Name,
+		"manufacturer": "LIFX",
+	}
+	if p := b.bulb.GetProduct(); p != nil {
+		device["model"] = p.Name
+	}
+	if b.Group != "" {
+		device["suggested_area"] = b.Group
+	}
+	return device
+}
+
+// publishBulbDiscovery announces the bulb as a light with a button to hand
+// it back to its curve
+func (m *mqttBridge) publishBulbDiscovery(b *Bulb, device map[string]interface{}) {
+	id := "lifx_" + haID(b.Address)
+	availability := []map[string]string{
+		{"topic": m.topic("status")},
+		{"topic": m.bulbTopic(b, "availability")},
+	}
+
+	m.retainJSON(m.discoveryTopic("light", id), map[string]interface{}{
+		"name":                  nil,
+		"unique_id":             id,
+		"object_id":             id,
+		"schema":                "json",
+		"state_topic":           m.bulbTopic(b, "state"),
+		"command_topic":         m.bulbTopic(b, "set"),
+		"brightness":            true,
+		"supported_color_modes": []string{"color_temp"},
+		"min_mireds":            mireds(maxKelvin),
+		"max_mireds":            mireds(minKelvin),
+		"availability":          availability,
+		"availability_mode":     "all",
+		"device":                device,
+	})
+	m.retainJSON(m.discoveryTopic("button", id+"_release"), map[string]interface{}{
+		"name":              "Return to curve",
+		"unique_id":         id + "_release",
+		"command_topic":     m.bulbTopic(b, "release"),
+		"payload_press":     "release",
+		"availability":      availability,
+		"availability_mode": "all",
+		"device":            device,
+	})
+}
+
+// publishOccupancyDiscovery announces a group's occupancy as a switch
+func (m *mqttBridge) publishOccupancyDiscovery(group string) {
+	id := "lifx_occupancy_" + haID(group)
+	m.retainJSON(m.discoveryTopic("switch", id), map[string]interface{}{
+		"name":          group + " occupancy",
+		"unique_id":     id,
+		"object_id":     id,
+		"state_topic":   m.groupTopic(group, "occupancy"),
+		"command_topic": m.groupTopic(group, "occupancy", "set"),
+		"availability":  []map[string]string{{"topic": m.topic("status")}},
+		"icon":          "mdi:home-account",
+	})
+}
+
+// topicLevel returns the nth level of topic after our prefix
+func (m *mqttBridge) topicLevel(topic string, n int) string {
+	levels := strings.Split(strings.TrimPrefix(topic, m.config.Prefix+"/"), "/")
+	if n >= len(levels) {
+		return ""
+	}
+	return levels[n]
+}
+
+// command handles a command with controlMutex held, auditing it once it has
+// been handled
+func (m *mqttBridge) command(topic string, payload []byte, handle func() (int, error)) {
+	m.app.controlMutex.Lock()
+	status, err := handle()
+	m.app.controlMutex.Unlock()
+	le := log.WithField("topic", topic)
+	if err != nil {
+		le.WithError(err).Warn("mqtt command failed")
+	}
+
+	body := &limitedBuffer{limit: auditBodyLimit}
+	body.Write(payload)
+	m.app.audit(&AuditEntry{
+		Time:      m.app.clock.Now(),
+		Principal: "mqtt",
+		Auth:      "mqtt",
+		Remote:    m.config.Broker,
+		Method:    "MQTT",
+		Path:      topic,
+		Status:    status,
+		Body:      auditBody(body),
+	})
+}
+
+func (m *mqttBridge) handleSet(topic string, payload []byte) {
+	m.command(topic, payload, func() (int, error) {
+		bulb := m.app.GetBulb(m.topicLevel(topic, 1))
+		if bulb == nil {
+			return 404, errors.New("no such bulb")
+		}
+		mc := &MQTTCommand{}
+		err := json.Unmarshal(payload, mc)
+		if err != nil {
+			return 400, err
+		}
+		ur, err := mc.updateBulbRequest(time.Duration(*m.config.OverrideFor))
+		if err != nil {
+			return 400, err
+		}
+		ms, err := ParseUpdateBulbRequest(ur, m.app.clock.Now())
+		if err != nil {
+			return 400, err
+		}
+		bulb.setManualState(ms)
+		bulb.Controlled = true
+		log.WithFields(log.Fields{
+			"address": bulb.Address,
+			"name":    bulb.Name,
+		}).WithFields(ms.logFields()).Info("setting bulb to manual control from mqtt")
+		return 200, nil
+	})
+}
+
+func (m *mqttBridge) handleRelease(topic string, payload []byte) {
+	m.command(topic, payload, func() (int, error) {
+		bulb := m.app.GetBulb(m.topicLevel(topic, 1))
+		if bulb == nil {
+			return 404, errors.New("no such bulb")
+		}
+		bulb.releaseManualState()
+		bulb.Controlled = true
+		log.WithFields(log.Fields{
+			"address": bulb.Address,
+			"name":    bulb.Name,
+		}).Info("releasing bulb from manual control from mqtt")
+		return 200, nil
+	})
+}
+
+func (m *mqttBridge) handleOccupancy(topic string, payload []byte) {
+	m.command(topic, payload, func() (int, error) {
+		segment := m.topicLevel(topic, 1)
+		group := ""
+		for _, g := range m.app.Groups() {
+			if mqttSegment(g) == segment {
+				group = g
+			}
+		}
+		if group == "" {
+			return 404, errors.New("no such group")
+		}
+		switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+		case mqttOn:
+			m.app.Occupied(group)
+		case mqttOff:
+			m.app.Vacated(group)
+		default:
+			return 400, fmt.Errorf("payload must be %s or %s", mqttOn, mqttOff)
+		}
+		return 200, nil
+	})
+}
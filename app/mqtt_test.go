@@ -0,0 +1,192 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMQTT struct {
+	mutex     sync.Mutex
+	retained  map[string]string
+	publishes int
+	handlers  map[string]func(string, []byte)
+}
+
+func newFakeMQTT() *fakeMQTT {
+	return &fakeMQTT{
+		retained: make(map[string]string),
+		handlers: make(map[string]func(string, []byte)),
+	}
+}
+
+func (f *fakeMQTT) publish(topic string, retained bool, payload []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.publishes++
+	if retained {
+		f.retained[topic] = string(payload)
+	}
+	return nil
+}
+
+func (f *fakeMQTT) subscribe(topic string, handler func(string, []byte)) error {
+	f.handlers[topic] = handler
+	return nil
+}
+
+// send delivers payload to whichever subscription matches topic
+func (f *fakeMQTT) send(t *testing.T, topic string, payload string) {
+	levels := strings.Split(topic, "/")
+	for filter, handler := range f.handlers {
+		fl := strings.Split(filter, "/")
+		if len(fl) != len(levels) {
+			continue
+		}
+		match := true
+		for i := range fl {
+			if fl[i] != "+" && fl[i] != levels[i] {
+				match = false
+			}
+		}
+		if match {
+			handler(topic, []byte(payload))
+			return
+		}
+	}
+	t.Fatalf("no subscription for %s", topic)
+}
+
+func mqttApp(t *testing.T) (*App, *fakeMQTT, *mqttBridge, *Bulb) {
+	a, _ := testApp()
+	b := report(a, 32768, 5000)
+	b.Online = true
+	mc := &MQTTConfig{Broker: "tcp://localhost:1883"}
+	err := mc.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newFakeMQTT()
+	m := newMQTTBridge(a, mc, conn)
+	m.connected()
+	return a, conn, m, b
+}
+
+func TestMQTTPublish(t *testing.T) {
+	_, conn, m, b := mqttApp(t)
+
+	if conn.retained["lifx/status"] != "online" {
+		t.Fatalf("expected online status, got: %q", conn.retained["lifx/status"])
+	}
+	if conn.retained["lifx/bulbs/d073d50035f7/availability"] != "online" {
+		t.Fatalf("expected bulb online, got: %q", conn.retained["lifx/bulbs/d073d50035f7/availability"])
+	}
+
+	s := &MQTTState{}
+	err := json.Unmarshal([]byte(conn.retained["lifx/bulbs/d073d50035f7/state"]), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.State != "ON" || s.Brightness != 128 || s.ColorTemp != 200 || s.ControlReason != "curve" {
+		t.Fatalf("unexpected state: %+v", s)
+	}
+
+	light := map[string]interface{}{}
+	err = json.Unmarshal([]byte(conn.retained["homeassistant/light/lifx_d073d50035f7/config"]), &light)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if light["command_topic"] != "lifx/bulbs/d073d50035f7/set" {
+		t.Fatalf("expected command topic, got: %v", light["command_topic"])
+	}
+	if _, ok := conn.retained["homeassistant/button/lifx_d073d50035f7_release/config"]; !ok {
+		t.Fatal("expected a release button")
+	}
+	if _, ok := conn.retained["homeassistant/switch/lifx_occupancy_kitchen/config"]; !ok {
+		t.Fatal("expected an occupancy switch")
+	}
+
+	// nothing changed, nothing to publish
+	publishes := conn.publishes
+	m.refresh()
+	if conn.publishes != publishes {
+		t.Fatalf("expected no republishing, got: %d", conn.publishes-publishes)
+	}
+
+	b.Online = false
+	m.refresh()
+	if conn.retained["lifx/bulbs/d073d50035f7/availability"] != "offline" {
+		t.Fatalf("expected bulb offline, got: %q", conn.retained["lifx/bulbs/d073d50035f7/availability"])
+	}
+}
+
+func TestMQTTCommands(t *testing.T) {
+	a, conn, m, b := mqttApp(t)
+
+	conn.send(t, "lifx/bulbs/d073d50035f7/set", `{"state":"ON","brightness":255,"color_temp":370}`)
+	o := b.override(a.clock.Now())
+	if o == nil {
+		t.Fatal("expected an override")
+	}
+	if *o.Brightness != 65535 || *o.Kelvin != 2703 || !*o.Power {
+		t.Fatalf("expected 65535/2703/on, got: %d/%d/%v", *o.Brightness, *o.Kelvin, *o.Power)
+	}
+	if !o.Until.Equal(a.clock.Now().Add(time.Hour)) {
+		t.Fatalf("expected override-for an hour, got: %s", o.Until)
+	}
+
+	m.refresh()
+	s := &MQTTState{}
+	json.Unmarshal([]byte(conn.retained["lifx/bulbs/d073d50035f7/state"]), s)
+	if s.Override == nil || s.ControlReason != "manual-state" {
+		t.Fatalf("expected override in state, got: %+v", s)
+	}
+
+	// bad commands change nothing
+	conn.send(t, "lifx/bulbs/d073d50035f7/set", `{"brightness":300}`)
+	if *b.override(a.clock.Now()).Brightness != 65535 {
+		t.Fatal("expected out of range brightness to be rejected")
+	}
+
+	conn.send(t, "lifx/bulbs/d073d50035f7/release", "release")
+	if b.override(a.clock.Now()) != nil {
+		t.Fatal("expected release to end the override")
+	}
+
+	conn.send(t, "lifx/groups/Kitchen/occupancy/set", "ON")
+	if a.GetOccupancy("Kitchen").State != OccupancyOccupied {
+		t.Fatalf("expected occupied, got: %s", a.GetOccupancy("Kitchen").State)
+	}
+	m.refresh()
+	if conn.retained["lifx/groups/Kitchen/occupancy"] != "ON" {
+		t.Fatalf("expected occupancy ON, got: %q", conn.retained["lifx/groups/Kitchen/occupancy"])
+	}
+}
+
+func TestMQTTCommandConversion(t *testing.T) {
+	mc := &MQTTCommand{State: stringp("OFF"), Transition: new(float64)}
+	*mc.Transition = 1.5
+	ur, err := mc.updateBulbRequest(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ur.Power || *ur.Transition != "1.5s" || *ur.Duration != "1m0s" {
+		t.Fatalf("unexpected request: %v %s %s", *ur.Power, *ur.Transition, *ur.Duration)
+	}
+
+	for _, bad := range []*MQTTCommand{
+		{State: stringp("DIM")},
+		{Brightness: new(int)},
+		{ColorTemp: new(int)},
+	} {
+		if bad.Brightness != nil {
+			*bad.Brightness = -1
+		}
+		_, err := bad.updateBulbRequest(time.Minute)
+		if err == nil {
+			t.Fatalf("expected error for %+v", bad)
+		}
+	}
+}
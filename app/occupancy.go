@@ -0,0 +1,346 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Occupancy states of a group
+const (
+	// OccupancyUnknown is a group which hasn't had a trigger yet
+	OccupancyUnknown = "unknown"
+	// OccupancyOccupied is a group on its curve after recent activity
+	OccupancyOccupied = "occupied"
+	// OccupancyDimmed is a group dimmed for lack of activity
+	OccupancyDimmed = "dimmed"
+	// OccupancyVacant is a group turned off for lack of activity
+	OccupancyVacant = "vacant"
+)
+
+// occupancySource marks manual state set by the occupancy timers, which
+// activity releases. Anybody else's manual state is left alone.
+const occupancySource = "occupancy"
+
+// OccupancyPolicy says what happens to a group without activity. Unset
+// durations disable that step.
+type OccupancyPolicy struct {
+	DimAfter   *Duration `json:"dim-after,omitempty"`
+	DimTo      *int      `json:"dim-to,omitempty"`
+	OffAfter   *Duration `json:"off-after,omitempty"`
+	Transition *Duration `json:"transition,omitempty"`
+}
+
+// OccupancyPolicies is the occupancy.json file, groups override default
+type OccupancyPolicies struct {
+	Default *OccupancyPolicy            `json:"default,omitempty"`
+	Groups  map[string]*OccupancyPolicy `json:"groups,omitempty"`
+}
+
+// occupancyPolicy is an OccupancyPolicy with every field resolved, DimTo is a
+// percentage of the curve's brightness
+type occupancyPolicy struct {
+	DimAfter   time.Duration `json:"dim-after"`
+	DimTo      int           `json:"dim-to"`
+	OffAfter   time.Duration `json:"off-after"`
+	Transition time.Duration `json:"transition"`
+}
+
+var defaultOccupancyPolicy = occupancyPolicy{
+	DimTo:      30,
+	Transition: defaultTransition,
+}
+
+func (p *occupancyPolicy) apply(op *OccupancyPolicy) {
+	if op == nil {
+		return
+	}
+	if op.DimAfter != nil {
+		p.DimAfter = time.Duration(*op.DimAfter)
+	}
+	if op.DimTo != nil {
+		p.DimTo = *op.DimTo
+	}
+	if op.OffAfter != nil {
+		p.OffAfter = time.Duration(*op.OffAfter)
+	}
+	if op.Transition != nil {
+		p.Transition = time.Duration(*op.Transition)
+	}
+}
+
+func (p occupancyPolicy) enabled() bool {
+	return p.DimAfter > 0 || p.OffAfter > 0
+}
+
+func (op *OccupancyPolicy) validate() error {
+	if op == nil {
+		return nil
+	}
+	if op.DimTo != nil && (*op.DimTo < 0 || *op.DimTo > 100) {
+		return errors.New("dim-to is a percentage, 0-100")
+	}
+	if op.DimAfter != nil && *op.DimAfter < 0 {
+		return errors.New("dim-after can't be negative")
+	}
+	if op.OffAfter != nil && *op.OffAfter < 0 {
+		return errors.New("off-after can't be negative")
+	}
+	if op.DimAfter != nil && op.OffAfter != nil && *op.OffAfter > 0 && *op.DimAfter >= *op.OffAfter {
+		return errors.New("dim-after must be before off-after")
+	}
+	return nil
+}
+
+// Occupancy is the state machine of a group, unknown -> occupied on activity,
+// then dimmed after dim-after and vacant after off-after without any
+type Occupancy struct {
+	Group        string     `json:"group"`
+	State        string     `json:"state"`
+	LastActivity time.Time  `json:"last-activity,omitempty"`
+	DimAt        *time.Time `json:"dim-at,omitempty"`
+	OffAt        *time.Time `json:"off-at,omitempty"`
+}
+
+func (a *App) loadOccupancyPolicies() error {
+	data, err := ioutil.ReadFile(a.occupancyPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	policies := &OccupancyPolicies{}
+	err = json.Unmarshal(data, policies)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.occupancyPath, err)
+	}
+	err = policies.Default.validate()
+	if err != nil {
+		return fmt.Errorf("%s: default: %s", a.occupancyPath, err)
+	}
+	for group, op := range policies.Groups {
+		if err := op.validate(); err != nil {
+			return fmt.Errorf("%s: group %s: %s", a.occupancyPath, group, err)
+		}
+	}
+
+	a.occupancyPolicies = policies
+	log.WithField("path", a.occupancyPath).Info("loaded occupancy policies")
+
+	return nil
+}
+
+func (a *App) occupancyPolicyFor(group string) occupancyPolicy {
+	p := defaultOccupancyPolicy
+	p.Transition = time.Duration(a.config.Transition)
+	if a.occupancyPolicies == nil {
+		return p
+	}
+	p.apply(a.occupancyPolicies.Default)
+	p.apply(a.occupancyPolicies.Groups[group])
+	return p
+}
+
+// GetOccupancy returns a copy of the group's occupancy state
+func (a *App) GetOccupancy(group string) *Occupancy {
+	a.occupancyMutex.Lock()
+	defer a.occupancyMutex.Unlock()
+
+	o, ok := a.occupancy[group]
+	if !ok {
+		return &Occupancy{Group: group, State: OccupancyUnknown}
+	}
+	v := *o
+	return &v
+}
+
+// Occupied records activity in group, raising anything dimmed or turned off
+// by the timers back to the curve
+func (a *App) Occupied(group string) *Occupancy {
+	a.occupancyMutex.Lock()
+	defer a.occupancyMutex.Unlock()
+
+	now := a.clock.Now()
+	o := a.occupancyFor(group)
+	previous := o.State
+	o.State = OccupancyOccupied
+	o.LastActivity = now
+	a.scheduleOccupancy(o, a.occupancyPolicyFor(group), now)
+
+	if previous != OccupancyOccupied {
+		log.WithFields(log.Fields{
+			"group":    group,
+			"previous": previous,
+		}).Info("group occupied")
+		a.publishOccupancy(o)
+	}
+
+	var released []*Bulb
+	for _, bulb := range a.GetGroupBulbs(group) {
+		if bulb.ManualStateSource != occupancySource {
+			continue
+		}
+		bulb.releaseManualState()
+		bulb.Controlled = true
+		released = append(released, bulb)
+	}
+	a.adjustTogether(released)
+
+	v := *o
+	return &v
+}
+
+// Vacated records that group has been left, dimming it now and turning it
+// off once the rest of the policy's off-after has passed
+func (a *App) Vacated(group string) *Occupancy {
+	a.occupancyMutex.Lock()
+	defer a.occupancyMutex.Unlock()
+
+	now := a.clock.Now()
+	p := a.occupancyPolicyFor(group)
+	o := a.occupancyFor(group)
+	if o.State == OccupancyUnknown {
+		o.State = OccupancyOccupied
+	}
+	o.LastActivity = now.Add(-p.DimAfter)
+	a.scheduleOccupancy(o, p, o.LastActivity)
+
+	log.WithField("group", group).Info("group vacated")
+	a.stepOccupancy(o, p, now)
+
+	v := *o
+	return &v
+}
+
+func (a *App) occupancyFor(group string) *Occupancy {
+	o, ok := a.occupancy[group]
+	if !ok {
+		o = &Occupancy{Group: group, State: OccupancyUnknown}
+		a.occupancy[group] = o
+	}
+	return o
+}
+
+func (a *App) scheduleOccupancy(o *Occupancy, p occupancyPolicy, from time.Time) {
+	o.DimAt = nil
+	o.OffAt = nil
+	if p.DimAfter > 0 {
+		dimAt := from.Add(p.DimAfter)
+		o.DimAt = &dimAt
+	}
+	if p.OffAfter > 0 {
+		offAt := from.Add(p.OffAfter)
+		o.OffAt = &offAt
+	}
+}
+
+func (a *App) watchOccupancy() {
+	a.heartbeat("occupancy", time.Second)
+	ticker := a.clock.NewTicker(time.Second)
+	for range ticker.C() {
+		a.checkOccupancy()
+		a.heartbeat("occupancy", time.Second)
+	}
+}
+
+func (a *App) checkOccupancy() {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	a.occupancyMutex.Lock()
+	defer a.occupancyMutex.Unlock()
+
+	now := a.clock.Now()
+	for group, o := range a.occupancy {
+		a.stepOccupancy(o, a.occupancyPolicyFor(group), now)
+	}
+}
+
+// stepOccupancy moves o along once its timers have passed
+func (a *App) stepOccupancy(o *Occupancy, p occupancyPolicy, now time.Time) {
+	if o.OffAt != nil && !now.Before(*o.OffAt) && (o.State == OccupancyOccupied || o.State == OccupancyDimmed) {
+		log.WithFields(log.Fields{
+			"group":         o.Group,
+			"last-activity": o.LastActivity,
+		}).Info("no activity, turning group off")
+		o.State = OccupancyVacant
+		a.occupancyOff(o.Group, p)
+		a.publishOccupancy(o)
+	} else if o.DimAt != nil && !now.Before(*o.DimAt) && o.State == OccupancyOccupied {
+		log.WithFields(log.Fields{
+			"group":         o.Group,
+			"last-activity": o.LastActivity,
+			"dim-to":        p.DimTo,
+		}).Info("no activity, dimming group")
+		o.State = OccupancyDimmed
+		a.occupancyDim(o.Group, p, now)
+		a.publishOccupancy(o)
+	}
+}
+
+// occupancyBulbs returns the bulbs in group the timers may change, bulbs
+// somebody else is controlling are left alone
+func (a *App) occupancyBulbs(group string) []*Bulb {
+	var bl []*Bulb
+	for _, bulb := range a.GetGroupBulbs(group) {
+		if bulb.ManualStateSource == occupancySource {
+			bl = append(bl, bulb)
+		} else if bulb.Controlled && !bulb.hasManualState() {
+			bl = append(bl, bulb)
+		}
+	}
+	return bl
+}
+
+func (a *App) occupancyDim(group string, p occupancyPolicy, now time.Time) {
+	brightness, _, _ := a.curveTarget(group, now)
+	brightness = uint16(int(brightness) * p.DimTo / 100)
+	transition := p.Transition
+	bulbs := a.occupancyBulbs(group)
+	for _, bulb := range bulbs {
+		bulb.setManualState(&ManualState{
+			Until:      manualStateForever,
+			Brightness: &brightness,
+			Transition: &transition,
+			Source:     occupancySource,
+		})
+		bulb.Controlled = true
+	}
+	a.adjustTogether(bulbs)
+}
+
+func (a *App) occupancyOff(group string, p occupancyPolicy) {
+	power := false
+	transition := p.Transition
+	for _, bulb := range a.occupancyBulbs(group) {
+		bulb.setManualState(&ManualState{
+			Until:      manualStateForever,
+			Power:      &power,
+			Transition: &transition,
+			Source:     occupancySource,
+		})
+		bulb.Controlled = true
+		bulb.adjustState()
+	}
+}
+
+// Groups returns the names of every group with a bulb in it
+func (a *App) Groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, bulb := range a.BulbList() {
+		if bulb.Group == "" || seen[bulb.Group] {
+			continue
+		}
+		seen[bulb.Group] = true
+		groups = append(groups, bulb.Group)
+	}
+	sort.Strings(groups)
+	return groups
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func occupancyApp() (*App, func(time.Duration), *Bulb) {
+	a, clock := testApp()
+	dimTo := 50
+	a.occupancyPolicies = &OccupancyPolicies{
+		Groups: map[string]*OccupancyPolicy{
+			"Kitchen": {
+				DimAfter: durationp(10 * time.Minute),
+				DimTo:    &dimTo,
+				OffAfter: durationp(20 * time.Minute),
+			},
+		},
+	}
+	b := report(a, 32768, 5000)
+	a.adjustControlled()
+	advance := func(d time.Duration) {
+		clock.Advance(d)
+		a.checkOccupancy()
+	}
+	return a, advance, b
+}
+
+func TestOccupancyTimers(t *testing.T) {
+	a, advance, b := occupancyApp()
+
+	if s := a.GetOccupancy("Kitchen").State; s != OccupancyUnknown {
+		t.Fatalf("expected %s, got: %s", OccupancyUnknown, s)
+	}
+	a.Occupied("Kitchen")
+
+	advance(9 * time.Minute)
+	if s := a.GetOccupancy("Kitchen").State; s != OccupancyOccupied {
+		t.Fatalf("expected %s, got: %s", OccupancyOccupied, s)
+	}
+
+	advance(time.Minute)
+	if s := a.GetOccupancy("Kitchen").State; s != OccupancyDimmed {
+		t.Fatalf("expected %s, got: %s", OccupancyDimmed, s)
+	}
+	if b.ManualStateBrightness == nil || *b.ManualStateBrightness != 16384 {
+		t.Fatal("expected the bulb dimmed to half the curve")
+	}
+	report(a, 16384, 5000)
+	if b.ControlReason() != occupancySource {
+		t.Fatalf("expected control reason %s, got: %s", occupancySource, b.ControlReason())
+	}
+
+	advance(10 * time.Minute)
+	if s := a.GetOccupancy("Kitchen").State; s != OccupancyVacant {
+		t.Fatalf("expected %s, got: %s", OccupancyVacant, s)
+	}
+	if b.ManualStatePower == nil || *b.ManualStatePower || b.TargetState.Power != powerOff {
+		t.Fatal("expected the bulb held off")
+	}
+
+	o := a.Occupied("Kitchen")
+	if o.State != OccupancyOccupied {
+		t.Fatalf("expected %s, got: %s", OccupancyOccupied, o.State)
+	}
+	if b.hasManualState() || b.TargetState.Power != powerOn {
+		t.Fatal("expected activity to turn the bulb back on")
+	}
+}
+
+func TestOccupancyLeavesManualState(t *testing.T) {
+	a, advance, b := occupancyApp()
+
+	brightness := uint16(1000)
+	b.setManualState(&ManualState{Until: a.clock.Now().Add(time.Hour), Brightness: &brightness})
+	a.Occupied("Kitchen")
+	advance(20 * time.Minute)
+	if b.ManualStatePower != nil || *b.ManualStateBrightness != 1000 {
+		t.Fatal("expected somebody else's manual state to be left alone")
+	}
+}
+
+func TestVacated(t *testing.T) {
+	a, advance, b := occupancyApp()
+
+	o := a.Vacated("Kitchen")
+	if o.State != OccupancyDimmed {
+		t.Fatalf("expected %s, got: %s", OccupancyDimmed, o.State)
+	}
+	if b.ManualStateBrightness == nil {
+		t.Fatal("expected vacancy to dim straight away")
+	}
+	advance(10 * time.Minute)
+	if s := a.GetOccupancy("Kitchen").State; s != OccupancyVacant {
+		t.Fatalf("expected %s, got: %s", OccupancyVacant, s)
+	}
+}
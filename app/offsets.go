@@ -0,0 +1,276 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errOffsetNotFound = errors.New("no such offset")
+
+// Offset adjusts the curve values for a bulb or group instead of replacing
+// them, so somebody who likes their room dimmer still follows the curves
+// through the day
+type Offset struct {
+	// BrightnessPercent scales the curve's brightness, -20 is 20% dimmer
+	BrightnessPercent *float64 `json:"brightness-percent,omitempty"`
+	// Brightness is added to the curve's brightness after scaling
+	Brightness *int `json:"brightness,omitempty"`
+	// Kelvin is added to the curve's kelvin, negative is warmer
+	Kelvin *int `json:"kelvin,omitempty"`
+}
+
+// Offsets are the offsets set for bulbs, by address, and groups
+type Offsets struct {
+	Bulbs  map[string]*Offset `json:"bulbs"`
+	Groups map[string]*Offset `json:"groups"`
+}
+
+func newOffsets() *Offsets {
+	return &Offsets{
+		Bulbs:  make(map[string]*Offset),
+		Groups: make(map[string]*Offset),
+	}
+}
+
+func (o *Offset) validate() error {
+	if o.BrightnessPercent == nil && o.Brightness == nil && o.Kelvin == nil {
+		return errors.New("must set one of brightness-percent, brightness or kelvin")
+	}
+	if o.BrightnessPercent != nil && (*o.BrightnessPercent < -100 || *o.BrightnessPercent > 100) {
+		return fmt.Errorf("brightness-percent %g out of range (-100 to 100)", *o.BrightnessPercent)
+	}
+	if o.Brightness != nil && (*o.Brightness < -65535 || *o.Brightness > 65535) {
+		return fmt.Errorf("brightness %d out of range (-65535 to 65535)", *o.Brightness)
+	}
+	maxKelvinOffset := maxKelvin - minKelvin
+	if o.Kelvin != nil && (*o.Kelvin < -maxKelvinOffset || *o.Kelvin > maxKelvinOffset) {
+		return fmt.Errorf("kelvin %d out of range (%d to %d)", *o.Kelvin, -maxKelvinOffset, maxKelvinOffset)
+	}
+	return nil
+}
+
+// merge returns o with whatever it leaves unset taken from under, either
+// may be nil
+func (o *Offset) merge(under *Offset) *Offset {
+	if o == nil {
+		return under
+	}
+	if under == nil {
+		return o
+	}
+	m := *o
+	if m.BrightnessPercent == nil {
+		m.BrightnessPercent = under.BrightnessPercent
+	}
+	if m.Brightness == nil {
+		m.Brightness = under.Brightness
+	}
+	if m.Kelvin == nil {
+		m.Kelvin = under.Kelvin
+	}
+	return &m
+}
+
+// apply adjusts curve values by the offset, keeping them in range
+func (o *Offset) apply(brightness uint16, kelvin uint16) (uint16, uint16) {
+	if o == nil {
+		return brightness, kelvin
+	}
+
+	b := float64(brightness)
+	if o.BrightnessPercent != nil {
+		b += b * *o.BrightnessPercent / 100
+	}
+	if o.Brightness != nil {
+		b += float64(*o.Brightness)
+	}
+	if b < 0 {
+		b = 0
+	} else if b > 65535 {
+		b = 65535
+	}
+
+	k := int(kelvin)
+	if o.Kelvin != nil {
+		k += *o.Kelvin
+	}
+	if k < minKelvin {
+		k = minKelvin
+	} else if k > maxKelvin {
+		k = maxKelvin
+	}
+
+	return uint16(b + 0.5), uint16(k)
+}
+
+// offsetFor is the bulb's offset merged over its group's, nil when neither
+// has one
+func (o *Offsets) offsetFor(address string, group string) *Offset {
+	if o == nil {
+		return nil
+	}
+	return o.Bulbs[address].merge(o.Groups[group])
+}
+
+// loadOffsets reads the offsets saved by the API, if there are any
+func (a *App) loadOffsets() error {
+	data, err := ioutil.ReadFile(a.offsetsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	offsets := newOffsets()
+	err = json.Unmarshal(data, offsets)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.offsetsPath, err)
+	}
+	if offsets.Bulbs == nil {
+		offsets.Bulbs = make(map[string]*Offset)
+	}
+	if offsets.Groups == nil {
+		offsets.Groups = make(map[string]*Offset)
+	}
+
+	a.offsetsMutex.Lock()
+	a.offsets = offsets
+	a.offsetsMutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"path":   a.offsetsPath,
+		"bulbs":  len(offsets.Bulbs),
+		"groups": len(offsets.Groups),
+	}).Info("loaded offsets")
+
+	return nil
+}
+
+// saveOffsets writes the offsets, it is called with offsetsMutex held
+func (a *App) saveOffsets() error {
+	d, err := json.MarshalIndent(a.offsets, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(a.offsetsPath, append(d, '\n'))
+}
+
+// GetOffsets returns a copy of every bulb's and group's offset
+func (a *App) GetOffsets() *Offsets {
+	a.offsetsMutex.RLock()
+	defer a.offsetsMutex.RUnlock()
+
+	o := newOffsets()
+	for address, offset := range a.offsets.Bulbs {
+		o.Bulbs[address] = offset
+	}
+	for group, offset := range a.offsets.Groups {
+		o.Groups[group] = offset
+	}
+	return o
+}
+
+// SetBulbOffset sets the bulb's offset, replacing any it had. A nil offset
+// removes it, errOffsetNotFound if there isn't one.
+func (a *App) SetBulbOffset(b *Bulb, offset *Offset) error {
+	err := a.setOffset(func(o *Offsets) map[string]*Offset { return o.Bulbs }, b.Address, offset)
+	if err != nil {
+		return err
+	}
+	if offset == nil {
+		a.publish(EventOffsetRemoved, b, nil)
+	} else {
+		a.publish(EventOffsetSet, b, offset)
+	}
+	return nil
+}
+
+// SetGroupOffset sets the group's offset, replacing any it had. A nil offset
+// removes it, errOffsetNotFound if there isn't one.
+func (a *App) SetGroupOffset(group string, offset *Offset) error {
+	if group == "" {
+		return errors.New("group must not be empty")
+	}
+	err := a.setOffset(func(o *Offsets) map[string]*Offset { return o.Groups }, group, offset)
+	if err != nil {
+		return err
+	}
+	eventType := EventOffsetSet
+	if offset == nil {
+		eventType = EventOffsetRemoved
+	}
+	a.events.publish(&Event{
+		Type:  eventType,
+		Time:  a.clock.Now(),
+		Group: group,
+		Data:  offset,
+	})
+	return nil
+}
+
+// setOffset sets or removes key's offset in the bulb or group offsets
+// chosen by which, saving them
+func (a *App) setOffset(which func(*Offsets) map[string]*Offset, key string, offset *Offset) error {
+	if offset != nil {
+		err := offset.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	a.offsetsMutex.Lock()
+	defer a.offsetsMutex.Unlock()
+
+	offsets := which(a.offsets)
+	previous, had := offsets[key]
+	if offset == nil && !had {
+		return errOffsetNotFound
+	}
+	if offset == nil {
+		delete(offsets, key)
+	} else {
+		offsets[key] = offset
+	}
+
+	err := a.saveOffsets()
+	if err != nil {
+		// keep what's in memory matching what's on disk
+		if had {
+			offsets[key] = previous
+		} else {
+			delete(offsets, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// groupOffset is the offset set for the group itself, nil if none
+func (a *App) groupOffset(group string) *Offset {
+	a.offsetsMutex.RLock()
+	defer a.offsetsMutex.RUnlock()
+
+	return a.offsets.Groups[group]
+}
+
+// bulbOffset is the offset which applies to the bulb
+func (a *App) bulbOffset(b *Bulb) *Offset {
+	a.offsetsMutex.RLock()
+	defer a.offsetsMutex.RUnlock()
+
+	return a.offsets.offsetFor(b.Address, b.Group)
+}
+
+// bulbTarget is the brightness and kelvin the bulb's curves and offsets
+// target at t, and the most specific curve source
+func (a *App) bulbTarget(b *Bulb, t time.Time) (uint16, uint16, string) {
+	brightness, kelvin, source := a.bulbCurveTarget(b, t)
+	brightness, kelvin = a.bulbOffset(b).apply(brightness, kelvin)
+	return brightness, kelvin, source
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func float64p(f float64) *float64 {
+	return &f
+}
+
+func intp(i int) *int {
+	return &i
+}
+
+func TestOffsetApply(t *testing.T) {
+	for _, test := range []struct {
+		offset     *Offset
+		brightness uint16
+		kelvin     uint16
+	}{
+		{nil, 32768, 4000},
+		{&Offset{BrightnessPercent: float64p(-20)}, 26214, 4000},
+		{&Offset{BrightnessPercent: float64p(-20), Brightness: intp(1000)}, 27214, 4000},
+		{&Offset{Brightness: intp(40000)}, 65535, 4000},
+		{&Offset{BrightnessPercent: float64p(-100), Kelvin: intp(500)}, 0, 4500},
+		{&Offset{Kelvin: intp(-3000)}, 32768, 1500},
+	} {
+		brightness, kelvin := test.offset.apply(32768, 4000)
+		if brightness != test.brightness || kelvin != test.kelvin {
+			t.Fatalf("%+v: expected %d/%d, got: %d/%d", test.offset, test.brightness, test.kelvin, brightness, kelvin)
+		}
+	}
+
+	for _, bad := range []*Offset{
+		{},
+		{BrightnessPercent: float64p(-150)},
+		{Brightness: intp(70000)},
+		{Kelvin: intp(8000)},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, _ := testApp()
+	a.offsetsPath = filepath.Join(dir, "offsets.json")
+	b := report(a, 32768, 5000)
+
+	err = a.SetGroupOffset("Kitchen", &Offset{BrightnessPercent: float64p(-20), Kelvin: intp(-1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetBulbOffset(b, &Offset{Kelvin: intp(-500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// brightness from the group's offset, kelvin from the bulb's
+	a.adjustControlled()
+	if b.TargetState.Brightness != 26214 || b.TargetState.Kelvin != 4500 {
+		t.Fatalf("expected 26214/4500, got: %d/%d", b.TargetState.Brightness, b.TargetState.Kelvin)
+	}
+
+	// offsets survive a restart
+	restarted := newApp(a.client)
+	restarted.offsetsPath = a.offsetsPath
+	err = restarted.loadOffsets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := restarted.offsets.offsetFor(b.Address, "Kitchen")
+	if o == nil || *o.BrightnessPercent != -20 || *o.Kelvin != -500 {
+		t.Fatalf("unexpected offset: %+v", o)
+	}
+
+	err = a.SetBulbOffset(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := a.bulbOffset(b); o == nil || *o.Kelvin != -1000 {
+		t.Fatalf("expected the group's offset, got: %+v", o)
+	}
+}
+
+func TestOffsetEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, _ := testApp()
+	a.offsetsPath = filepath.Join(dir, "offsets.json")
+	report(a, 32768, 5000)
+
+	rw := serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/offset", `{"brightness-percent":-50}`)
+	bj := &BulbJSON{}
+	json.Unmarshal(rw.Body.Bytes(), bj)
+	if rw.Code != 200 || bj.Offset == nil || *bj.Offset.BrightnessPercent != -50 {
+		t.Fatalf("expected the offset in the response, got: %d %s", rw.Code, rw.Body.String())
+	}
+	expectAPIError(t, serve(a, "PUT", "/api/v2/bulbs/d073d50035f7/offset", `{}`), 400)
+	expectAPIError(t, serve(a, "PUT", "/api/v2/bulbs/nope/offset", `{"kelvin":100}`), 404)
+
+	rw = serve(a, "PUT", "/api/v2/groups/Kitchen/offset", `{"kelvin":500}`)
+	gj := &GroupJSON{}
+	json.Unmarshal(rw.Body.Bytes(), gj)
+	if rw.Code != 200 || gj.Offset == nil || *gj.Offset.Kelvin != 500 {
+		t.Fatalf("expected the offset in the response, got: %d %s", rw.Code, rw.Body.String())
+	}
+
+	offsets := &Offsets{}
+	json.Unmarshal(serve(a, "GET", "/api/v2/offsets", "").Body.Bytes(), offsets)
+	if len(offsets.Bulbs) != 1 || len(offsets.Groups) != 1 {
+		t.Fatalf("unexpected offsets: %+v", offsets)
+	}
+
+	e := &EffectiveJSON{}
+	json.Unmarshal(serve(a, "GET", "/api/v2/bulbs/d073d50035f7/effective", "").Body.Bytes(), e)
+	if e.Brightness.Value != 32768 || e.TargetBrightness != 16384 || e.TargetKelvin != e.Kelvin.Value+500 {
+		t.Fatalf("unexpected effective values: %+v", e)
+	}
+
+	for _, path := range []string{"/api/v2/bulbs/d073d50035f7/offset", "/api/v2/groups/Kitchen/offset"} {
+		rw = serve(a, "DELETE", path, "")
+		if rw.Code != 204 {
+			t.Fatalf("expected %d, got: %d", 204, rw.Code)
+		}
+	}
+	if o := a.GetOffsets(); len(o.Bulbs) != 0 || len(o.Groups) != 0 {
+		t.Fatalf("expected no offsets, got: %+v", o)
+	}
+	expectAPIError(t, serve(a, "DELETE", "/api/v2/groups/Kitchen/offset", ""), 404)
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISchemas builds OpenAPI schemas for Go types, named struct types are
+// added to components and referenced
+type openAPISchemas map[string]interface{}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(Duration(0))
+)
+
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "string", "example": "1h30m"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Uint16:
+		return map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 65535}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := s[name]; !ok {
+			s[name] = nil // break cycles
+			s[name] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (s openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.schema(f.Type)
+		omitempty := false
+		for _, p := range parts[1:] {
+			if p == "omitempty" {
+				omitempty = true
+			}
+		}
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+var pathParamRegexp = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+// OpenAPISpec describes the v2 API, generated from the routes it serves
+func OpenAPISpec() map[string]interface{} {
+	schemas := openAPISchemas{}
+	errorResponse := map[string]interface{}{
+		"description": "error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(ErrorEnvelope{}))},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, route := range apiRoutes() {
+		path := pathParamRegexp.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+
+		parameters := []interface{}{}
+		for _, m := range pathParamRegexp.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range route.Params {
+			parameters = append(parameters, map[string]interface{}{
+				"name": p.Name, "in": p.In, "description": p.Description,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		responses := map[string]interface{}{"default": errorResponse}
+		for _, status := range route.Status {
+			response := map[string]interface{}{"description": http.StatusText(status)}
+			if route.Response != nil && status != http.StatusNoContent && status != http.StatusNotModified {
+				contentType := route.ContentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				response["content"] = map[string]interface{}{
+					contentType: map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.Response))},
+				}
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+
+		operation := map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": responses,
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": !route.Optional,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.Request))},
+				},
+			}
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "lifx",
+			"version": "2",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v2"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}(schemas),
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basic":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+		// only enforced when auth.json exists, client certificates also work
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"basic": []string{}},
+		},
+	}
+}
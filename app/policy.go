@@ -0,0 +1,187 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+// What happens when somebody changes a controlled bulb
+const (
+	// RelinquishDuration gives up control for RelinquishFor
+	RelinquishDuration = "duration"
+	// RelinquishNextCurvePoint gives up control until the curve next changes
+	RelinquishNextCurvePoint = "next-curve-point"
+	// RelinquishPowerCycle gives up control until the bulb is turned off and on again
+	RelinquishPowerCycle = "power-cycle"
+	// RelinquishNever puts the bulb straight back
+	RelinquishNever = "never"
+)
+
+// ControlPolicy controls how manual changes to a bulb are detected and
+// handled. Unset fields are inherited, bulb from group from default.
+type ControlPolicy struct {
+	Relinquish          *string   `json:"relinquish,omitempty"`
+	RelinquishFor       *Duration `json:"relinquish-for,omitempty"`
+	Grace               *Duration `json:"grace,omitempty"`
+	BrightnessTolerance *uint16   `json:"brightness-tolerance,omitempty"`
+	KelvinTolerance     *uint16   `json:"kelvin-tolerance,omitempty"`
+	PowerOffIsOverride  *bool     `json:"power-off-is-override,omitempty"`
+}
+
+// Policies is the policies.json file, groups and bulbs (by address) override default
+type Policies struct {
+	Default *ControlPolicy            `json:"default,omitempty"`
+	Groups  map[string]*ControlPolicy `json:"groups,omitempty"`
+	Bulbs   map[string]*ControlPolicy `json:"bulbs,omitempty"`
+}
+
+// policy is a ControlPolicy with every field resolved
+type policy struct {
+	Relinquish          string        `json:"relinquish"`
+	RelinquishFor       time.Duration `json:"relinquish-for"`
+	Grace               time.Duration `json:"grace"`
+	BrightnessTolerance uint16        `json:"brightness-tolerance"`
+	KelvinTolerance     uint16        `json:"kelvin-tolerance"`
+	PowerOffIsOverride  bool          `json:"power-off-is-override"`
+}
+
+var defaultPolicy = policy{
+	Relinquish:         RelinquishDuration,
+	RelinquishFor:      time.Hour,
+	Grace:              time.Second * 15,
+	PowerOffIsOverride: true,
+}
+
+func (p *policy) apply(cp *ControlPolicy) {
+	if cp == nil {
+		return
+	}
+	if cp.Relinquish != nil {
+		p.Relinquish = *cp.Relinquish
+	}
+	if cp.RelinquishFor != nil {
+		p.RelinquishFor = time.Duration(*cp.RelinquishFor)
+	}
+	if cp.Grace != nil {
+		p.Grace = time.Duration(*cp.Grace)
+	}
+	if cp.BrightnessTolerance != nil {
+		p.BrightnessTolerance = *cp.BrightnessTolerance
+	}
+	if cp.KelvinTolerance != nil {
+		p.KelvinTolerance = *cp.KelvinTolerance
+	}
+	if cp.PowerOffIsOverride != nil {
+		p.PowerOffIsOverride = *cp.PowerOffIsOverride
+	}
+}
+
+func (cp *ControlPolicy) validate() error {
+	if cp == nil || cp.Relinquish == nil {
+		return nil
+	}
+	switch *cp.Relinquish {
+	case RelinquishDuration, RelinquishNextCurvePoint, RelinquishPowerCycle, RelinquishNever:
+		return nil
+	}
+	return fmt.Errorf("unknown relinquish policy %q", *cp.Relinquish)
+}
+
+func (p *Policies) validate() error {
+	err := p.Default.validate()
+	if err != nil {
+		return fmt.Errorf("default: %s", err)
+	}
+	for group, cp := range p.Groups {
+		if err := cp.validate(); err != nil {
+			return fmt.Errorf("group %s: %s", group, err)
+		}
+	}
+	for address, cp := range p.Bulbs {
+		if err := cp.validate(); err != nil {
+			return fmt.Errorf("bulb %s: %s", address, err)
+		}
+	}
+	return nil
+}
+
+// loadPolicies reads the optional policies file
+func (a *App) loadPolicies() error {
+	data, err := ioutil.ReadFile(a.policiesPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	policies := &Policies{}
+	err = json.Unmarshal(data, policies)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.policiesPath, err)
+	}
+	err = policies.validate()
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.policiesPath, err)
+	}
+
+	a.policies = policies
+	log.WithField("path", a.policiesPath).Info("loaded control policies")
+
+	return nil
+}
+
+func (a *App) policyFor(b *Bulb) policy {
+	p := defaultPolicy
+	p.Grace = time.Duration(a.config.Grace)
+	p.RelinquishFor = time.Duration(a.config.RelinquishFor)
+	if a.policies == nil {
+		return p
+	}
+	p.apply(a.policies.Default)
+	p.apply(a.policies.Groups[b.Group])
+	p.apply(a.policies.Bulbs[b.Address])
+	return p
+}
+
+// nextCurvePoint returns the start of the next hour in which the bulb's
+// curves target something other than they do at now
+func (a *App) nextCurvePoint(bulb *Bulb, now time.Time) time.Time {
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	brightness, kelvin, _ := a.bulbCurveTarget(bulb, now)
+	for i := 1; i <= 24; i++ {
+		t := hour.Add(time.Duration(i) * time.Hour)
+		b, k, _ := a.bulbCurveTarget(bulb, t)
+		if b != brightness || k != kelvin {
+			return t
+		}
+	}
+	return hour.Add(24 * time.Hour)
+}
+
+func withinTolerance(left uint16, right uint16, tolerance uint16) bool {
+	if left > right {
+		return left-right <= tolerance
+	}
+	return right-left <= tolerance
+}
+
+// targetMismatch compares a reported state against the target, allowing for
+// the policy's tolerances and whether power is considered at all
+func targetMismatch(target lifx.BulbState, state lifx.BulbState, p policy) ([]string, bool) {
+	if withinTolerance(target.Brightness, state.Brightness, p.BrightnessTolerance) {
+		state.Brightness = target.Brightness
+	}
+	if withinTolerance(target.Kelvin, state.Kelvin, p.KelvinTolerance) {
+		state.Kelvin = target.Kelvin
+	}
+	if !p.PowerOffIsOverride {
+		state.Power = target.Power
+	}
+	return bulbDiff(target, state)
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func policyApp(cp *ControlPolicy) (*App, *lifx.FakeClock, *Bulb) {
+	a, clock := testApp()
+	a.policies = &Policies{Groups: map[string]*ControlPolicy{"Kitchen": cp}}
+	b := report(a, 32768, 5000)
+	a.adjustControlled()
+	return a, clock, b
+}
+
+func reportPower(a *App, brightness uint16, power uint16) {
+	a.SetState(lifx.NewBulbWithState(testAddr, "Lamp", "Kitchen", "Home", lifx.BulbState{
+		Brightness: brightness,
+		Kelvin:     5000,
+		Power:      power,
+		Visible:    true,
+	}))
+}
+
+func TestPolicyTolerance(t *testing.T) {
+	tolerance := uint16(100)
+	a, _, b := policyApp(&ControlPolicy{BrightnessTolerance: &tolerance})
+
+	// firmware rounding isn't a manual change
+	report(a, 32700, 5000)
+	if !b.Controlled {
+		t.Fatal("expected a change within tolerance to keep control")
+	}
+	a.adjustControlled()
+	if !b.Controlled {
+		t.Fatal("expected no correction within tolerance")
+	}
+
+	report(a, 30000, 5000)
+	if b.Controlled {
+		t.Fatal("expected a change outside tolerance to relinquish control")
+	}
+	if b.ControlReason() != "relinquished:duration" {
+		t.Fatalf("unexpected control reason %q", b.ControlReason())
+	}
+}
+
+func TestPolicyNever(t *testing.T) {
+	never := RelinquishNever
+	a, _, b := policyApp(&ControlPolicy{Relinquish: &never})
+
+	report(a, 10000, 5000)
+	if !b.Controlled {
+		t.Fatal("expected control to be kept")
+	}
+	a.adjustControlled()
+	if b.ControlReason() != "adjusting" {
+		t.Fatalf("expected the bulb to be put back, got: %q", b.ControlReason())
+	}
+}
+
+func TestPolicyNextCurvePoint(t *testing.T) {
+	next := RelinquishNextCurvePoint
+	a, clock, b := policyApp(&ControlPolicy{Relinquish: &next})
+
+	clock.Advance(20 * time.Minute)
+	report(a, 10000, 5000)
+	expected := time.Date(2020, 1, 1, 7, 0, 0, 0, time.UTC)
+	if b.Controlled || !b.ControlAfter.Equal(expected) {
+		t.Fatalf("expected control after %s, got: %s", expected, b.ControlAfter)
+	}
+}
+
+func TestPolicyPowerCycle(t *testing.T) {
+	cycle := RelinquishPowerCycle
+	a, _, b := policyApp(&ControlPolicy{Relinquish: &cycle})
+
+	report(a, 10000, 5000)
+	if b.Controlled {
+		t.Fatal("expected control to be relinquished")
+	}
+
+	reportPower(a, 10000, powerOff)
+	if b.Controlled {
+		t.Fatal("expected control to stay relinquished while off")
+	}
+	reportPower(a, 10000, powerOn)
+	if !b.Controlled {
+		t.Fatal("expected control to be regained after a power cycle")
+	}
+}
+
+func TestPolicyPowerCycleAtWall(t *testing.T) {
+	cycle := RelinquishPowerCycle
+	a, _, b := policyApp(&ControlPolicy{Relinquish: &cycle})
+
+	report(a, 10000, 5000)
+	if b.Controlled {
+		t.Fatal("expected control to be relinquished")
+	}
+
+	// switched off at the wall: the bulb drops off the network and comes
+	// back with the same state
+	a.SetState(lifx.NewBulbWithState(testAddr, "Lamp", "Kitchen", "Home", lifx.BulbState{
+		Brightness: 10000,
+		Kelvin:     5000,
+		Power:      powerOn,
+		Visible:    false,
+	}))
+	if b.Controlled {
+		t.Fatal("expected control to stay relinquished while invisible")
+	}
+	report(a, 10000, 5000)
+	if !b.Controlled {
+		t.Fatal("expected control to be regained when the bulb reappears")
+	}
+}
+
+func TestPolicyPowerOffIsOverride(t *testing.T) {
+	off := false
+	a, _, b := policyApp(&ControlPolicy{PowerOffIsOverride: &off})
+
+	reportPower(a, 32768, powerOff)
+	if !b.Controlled {
+		t.Fatal("expected turning the bulb off not to count as an override")
+	}
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+var (
+	errSceneNotFound = errors.New("no such scene")
+
+	// manualStateForever holds a manual state until it is explicitly released
+	manualStateForever = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Scene is a named snapshot of the state of a set of bulbs
+type Scene struct {
+	Name     string                `json:"name"`
+	Captured time.Time             `json:"captured"`
+	Bulbs    map[string]*SceneBulb `json:"bulbs"`
+}
+
+// SceneBulb is the captured state of a single bulb, keyed by address in Scene.Bulbs
+type SceneBulb struct {
+	Name       string `json:"name"`
+	Group      string `json:"group,omitempty"`
+	Location   string `json:"location,omitempty"`
+	Power      bool   `json:"power"`
+	Hue        uint16 `json:"hue"`
+	Saturation uint16 `json:"saturation"`
+	Brightness uint16 `json:"brightness"`
+	Kelvin     uint16 `json:"kelvin"`
+	// Zones are the colours of a multizone bulb's zones, first to last
+	Zones []lifx.HSBK `json:"zones,omitempty"`
+}
+
+func (a *App) sceneFile(name string) string {
+	return filepath.Join(a.scenesDir, name+".json")
+}
+
+func (a *App) loadScenes() error {
+	files, err := filepath.Glob(filepath.Join(a.scenesDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	scenes := make(map[string]*Scene)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		scene := &Scene{}
+		err = json.Unmarshal(data, scene)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		scene.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		scenes[scene.Name] = scene
+	}
+
+	a.scenesMutex.Lock()
+	a.scenes = scenes
+	a.scenesMutex.Unlock()
+
+	return nil
+}
+
+// SceneList returns every known scene sorted by name
+func (a *App) SceneList() []*Scene {
+	a.scenesMutex.RLock()
+	defer a.scenesMutex.RUnlock()
+
+	l := []*Scene{}
+	for _, scene := range a.scenes {
+		l = append(l, scene)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
+	})
+	return l
+}
+
+// GetScene returns the named scene or nil
+func (a *App) GetScene(name string) *Scene {
+	a.scenesMutex.RLock()
+	defer a.scenesMutex.RUnlock()
+
+	return a.scenes[name]
+}
+
+// CaptureScene snapshots the current state of bulbs as name, replacing any
+// existing scene of that name
+func (a *App) CaptureScene(name string, bulbs []*Bulb) (*Scene, error) {
+	if !nameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid scene name %q", name)
+	}
+	if len(bulbs) == 0 {
+		return nil, errors.New("no bulbs to capture")
+	}
+
+	scene := &Scene{
+		Name:     name,
+		Captured: a.clock.Now(),
+		Bulbs:    make(map[string]*SceneBulb),
+	}
+	for _, bulb := range bulbs {
+		state := bulb.bulb.GetState()
+		scene.Bulbs[bulb.Address] = &SceneBulb{
+			Name:       bulb.Name,
+			Group:      bulb.Group,
+			Location:   bulb.Location,
+			Power:      state.Power != 0,
+			Hue:        state.Hue,
+			Saturation: state.Saturation,
+			Brightness: state.Brightness,
+			Kelvin:     state.Kelvin,
+			Zones:      bulb.bulb.GetZones(),
+		}
+	}
+
+	d, err := json.MarshalIndent(scene, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileSync(a.sceneFile(name), append(d, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	a.scenesMutex.Lock()
+	a.scenes[name] = scene
+	a.scenesMutex.Unlock()
+
+	return scene, nil
+}
+
+// DeleteScene forgets a scene and removes it from disk
+func (a *App) DeleteScene(name string) error {
+	a.scenesMutex.Lock()
+	defer a.scenesMutex.Unlock()
+
+	if _, ok := a.scenes[name]; !ok {
+		return errSceneNotFound
+	}
+
+	err := os.Remove(a.sceneFile(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(a.scenes, name)
+
+	return nil
+}
+
+// ActivateScene transitions every bulb in the scene which is currently known
+// to its captured state, holding it there as a manual state until the given
+// time (or until released when until is nil). It returns the bulbs changed.
+func (a *App) ActivateScene(name string, transition time.Duration, until *time.Time) ([]*Bulb, error) {
+	scene := a.GetScene(name)
+	if scene == nil {
+		return nil, errSceneNotFound
+	}
+
+	now := a.clock.Now()
+	hold := manualStateForever
+	if until != nil {
+		hold = *until
+	}
+
+	var activated []*Bulb
+	for address, sb := range scene.Bulbs {
+		bulb := a.GetBulb(address)
+		if bulb == nil {
+			log.WithFields(log.Fields{
+				"scene":   name,
+				"address": address,
+				"name":    sb.Name,
+			}).Warn("scene bulb not found")
+			continue
+		}
+
+		hue := sb.Hue
+		saturation := sb.Saturation
+		brightness := sb.Brightness
+		kelvin := sb.Kelvin
+		power := sb.Power
+		bulb.setManualState(&ManualState{
+			Until:      hold,
+			Hue:        &hue,
+			Saturation: &saturation,
+			Brightness: &brightness,
+			Kelvin:     &kelvin,
+			Power:      &power,
+			Transition: &transition,
+		})
+
+		// let the transition finish before expecting the bulb to match
+		bulb.Controlled = false
+		bulb.ControlAfter = now.Add(transition + time.Second*15)
+		bulb.suspendReason = "adjusting"
+		bulb.TargetState.Hue = sb.Hue
+		bulb.TargetState.Saturation = sb.Saturation
+		bulb.TargetState.Brightness = sb.Brightness
+		bulb.TargetState.Kelvin = sb.Kelvin
+
+		if len(sb.Zones) > 0 {
+			a.client.SetZones(bulb.bulb, lifx.PriorityUser, sb.Zones, uint32(transition/time.Millisecond))
+		} else {
+			a.client.SetColour(bulb.bulb, lifx.PriorityUser, sb.Hue, sb.Saturation, sb.Brightness, sb.Kelvin, uint32(transition/time.Millisecond))
+		}
+		if sb.Power {
+			bulb.TargetState.Power = powerOn
+		} else {
+			bulb.TargetState.Power = powerOff
+		}
+		a.client.SetPower(bulb.bulb, lifx.PriorityUser, sb.Power)
+
+		log.WithFields(log.Fields{
+			"scene":      name,
+			"address":    address,
+			"name":       bulb.Name,
+			"until":      hold,
+			"transition": transition,
+		}).Info("activating scene")
+		activated = append(activated, bulb)
+	}
+
+	return activated, nil
+}
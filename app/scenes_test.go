@@ -0,0 +1,127 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func TestSceneCaptureActivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, clock := testApp()
+	a.scenesDir = dir
+
+	b := report(a, 1000, 2700)
+
+	_, err = a.CaptureScene("evening", a.GetBulbs())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// scenes survive a reload from disk
+	a.scenes = make(map[string]*Scene)
+	err = a.loadScenes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scene := a.GetScene("evening")
+	if scene == nil {
+		t.Fatal("expected scene to be loaded from disk")
+	}
+	if sb := scene.Bulbs[b.Address]; sb == nil || sb.Brightness != 1000 || sb.Kelvin != 2700 || !sb.Power {
+		t.Fatalf("unexpected captured state %+v", sb)
+	}
+
+	report(a, 32768, 5000)
+	until := clock.Now().Add(30 * time.Minute)
+	activated, err := a.ActivateScene("evening", 2*time.Second, &until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activated) != 1 {
+		t.Fatalf("expected %d, got: %d", 1, len(activated))
+	}
+
+	a.adjustControlled()
+	if b.TargetState.Brightness != 1000 || b.TargetState.Kelvin != 2700 {
+		t.Fatalf("expected target 1000/2700, got: %d/%d", b.TargetState.Brightness, b.TargetState.Kelvin)
+	}
+
+	report(a, 1000, 2700)
+	if !b.Controlled {
+		t.Fatal("expected control once the bulb reached the scene")
+	}
+
+	clock.Advance(31 * time.Minute)
+	a.adjustControlled()
+	if b.TargetState.Brightness != 32768 {
+		t.Fatalf("expected curve once the scene expired, got: %d", b.TargetState.Brightness)
+	}
+
+	_, err = a.ActivateScene("missing", 0, nil)
+	if err != errSceneNotFound {
+		t.Fatalf("expected %v, got: %v", errSceneNotFound, err)
+	}
+}
+
+func TestSceneZones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scenes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, _ := testApp()
+	defer withGateway(t, a)()
+	a.scenesDir = dir
+
+	zones := []lifx.HSBK{
+		{Hue: 0, Saturation: 65535, Brightness: 32768, Kelvin: 3500},
+		{Hue: 0, Saturation: 65535, Brightness: 32768, Kelvin: 3500},
+		{Hue: 43690, Saturation: 65535, Brightness: 16384, Kelvin: 3500},
+	}
+	a.SetState(lifx.NewMultizoneBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Strip", "Kitchen", "Home", lifx.BulbState{
+		Saturation: 65535,
+		Brightness: 32768,
+		Kelvin:     3500,
+		Power:      65535,
+		Visible:    true,
+	}, zones))
+
+	_, err = a.CaptureScene("party", a.GetBulbs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.scenes = make(map[string]*Scene)
+	err = a.loadScenes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := a.GetScene("party").Bulbs["d073d5000001"]
+	if sb == nil || !reflect.DeepEqual(sb.Zones, zones) {
+		t.Fatalf("expected the zones to be captured, got: %+v", sb)
+	}
+
+	// the zones are restored rather than one colour for the whole strip
+	_, err = a.ActivateScene("party", time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := serve(a, "GET", "/metrics", "").Body.String()
+	if !strings.Contains(body, `lifx_command_queue_delay_seconds_count{type="SetColorZones"} 1`) {
+		t.Fatalf("expected the zones to be sent in:\n%s", body)
+	}
+	if strings.Contains(body, `type="SetLightColour"`) {
+		t.Fatalf("expected no single colour to be sent in:\n%s", body)
+	}
+}
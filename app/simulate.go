@@ -0,0 +1,202 @@
+package app
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"time"
+)
+
+// SimulationPoint is the effective state of a bulb at a point in time
+type SimulationPoint struct {
+	Time       time.Time `json:"time"`
+	Brightness uint16    `json:"brightness"`
+	Kelvin     uint16    `json:"kelvin"`
+	Source     string    `json:"source"`
+}
+
+// Simulation is the effective brightness/kelvin timeline for a group or bulb over a day
+type Simulation struct {
+	Group  string            `json:"group"`
+	Bulb   string            `json:"bulb,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Date   string            `json:"date"`
+	Step   string            `json:"step"`
+	Points []SimulationPoint `json:"points"`
+}
+
+// Simulate renders the curve timeline for group on the day containing date,
+// sampled every step.
+func (c *Curves) Simulate(group string, date time.Time, step time.Duration) (*Simulation, error) {
+	return c.simulate(curveSubject{group: group}, date, step)
+}
+
+// simulate renders the curve timeline for a bulb or group
+func (c *Curves) simulate(subject curveSubject, date time.Time, step time.Duration) (*Simulation, error) {
+	if step < time.Minute {
+		return nil, errors.New("step must be at least one minute")
+	}
+
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 0, 1)
+
+	s := &Simulation{
+		Group: subject.group,
+		Date:  start.Format("2006-01-02"),
+		Step:  step.String(),
+	}
+
+	for t := start; t.Before(end); t = t.Add(step) {
+		brightness, kelvin, source := c.targetFor(subject, t)
+		s.Points = append(s.Points, SimulationPoint{
+			Time:       t,
+			Brightness: brightness,
+			Kelvin:     kelvin,
+			Source:     source,
+		})
+	}
+
+	return s, nil
+}
+
+// SimulateGroup renders the timeline for a group from the active curves
+func (a *App) SimulateGroup(group string, date time.Time, step time.Duration) (*Simulation, error) {
+	a.curvesMutex.RLock()
+	defer a.curvesMutex.RUnlock()
+
+	return a.curves.Simulate(group, date, step)
+}
+
+// SimulateBulb renders the timeline for a single bulb, including its offset
+// and any manual override which is currently scheduled.
+func (a *App) SimulateBulb(b *Bulb, date time.Time, step time.Duration) (*Simulation, error) {
+	a.curvesMutex.RLock()
+	s, err := a.curves.simulate(b.curveSubject(), date, step)
+	a.curvesMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	s.Bulb = b.Address
+	s.Name = b.Name
+
+	offset := a.bulbOffset(b)
+	now := a.clock.Now()
+	for i := range s.Points {
+		p := &s.Points[i]
+		p.Brightness, p.Kelvin = offset.apply(p.Brightness, p.Kelvin)
+		if p.Time.Before(now) || !p.Time.Before(b.ManualStateUntil) {
+			continue
+		}
+		if b.ManualStateBrightness != nil {
+			p.Brightness = *b.ManualStateBrightness
+			p.Source = "manual"
+		}
+		if b.ManualStateKelvin != nil {
+			p.Kelvin = *b.ManualStateKelvin
+			p.Source = "manual"
+		}
+		if b.ManualStatePower != nil && !*b.ManualStatePower {
+			p.Brightness = 0
+			p.Source = "manual"
+		}
+	}
+
+	return s, nil
+}
+
+// WriteCSV writes the timeline as time,brightness,kelvin,source rows
+func (s *Simulation) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"time", "brightness", "kelvin", "source"})
+	if err != nil {
+		return err
+	}
+	for _, p := range s.Points {
+		err = cw.Write([]string{
+			p.Time.Format(time.RFC3339),
+			strconv.Itoa(int(p.Brightness)),
+			strconv.Itoa(int(p.Kelvin)),
+			p.Source,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+const (
+	svgWidth     = 960
+	svgHeight    = 320
+	svgMargin    = 40
+	svgMinKelvin = minKelvin
+	svgMaxKelvin = maxKelvin
+)
+
+// WriteSVG draws the timeline as a step chart, brightness against the left
+// axis (0-100%) and kelvin against the right axis (1500-9000K)
+func (s *Simulation) WriteSVG(w io.Writer) error {
+	plotWidth := float64(svgWidth - 2*svgMargin)
+	plotHeight := float64(svgHeight - 2*svgMargin)
+
+	x := func(i int) float64 {
+		return svgMargin + plotWidth*float64(i)/float64(len(s.Points))
+	}
+	brightnessY := func(v uint16) float64 {
+		return svgMargin + plotHeight*(1-float64(v)/65535)
+	}
+	kelvinY := func(v uint16) float64 {
+		k := float64(v)
+		if k < svgMinKelvin {
+			k = svgMinKelvin
+		}
+		if k > svgMaxKelvin {
+			k = svgMaxKelvin
+		}
+		return svgMargin + plotHeight*(1-(k-svgMinKelvin)/(svgMaxKelvin-svgMinKelvin))
+	}
+
+	title := s.Group
+	if s.Name != "" {
+		title = s.Name
+	}
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`+"\n", svgWidth, svgHeight)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, `<text x="%d" y="20" font-size="14">%s %s</text>`+"\n", svgMargin, html.EscapeString(title), s.Date)
+	fmt.Fprintf(w, `<rect x="%d" y="%d" width="%.0f" height="%.0f" fill="none" stroke="#ccc"/>`+"\n", svgMargin, svgMargin, plotWidth, plotHeight)
+
+	for hour := 0; hour <= 24; hour += 3 {
+		hx := svgMargin + plotWidth*float64(hour)/24
+		fmt.Fprintf(w, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#eee"/>`+"\n", hx, svgMargin, hx, svgHeight-svgMargin)
+		fmt.Fprintf(w, `<text x="%.1f" y="%d" text-anchor="middle">%02d:00</text>`+"\n", hx, svgHeight-svgMargin+15, hour)
+	}
+	fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end" fill="#d08000">100%%</text>`+"\n", svgMargin-4, svgMargin+4)
+	fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end" fill="#d08000">0%%</text>`+"\n", svgMargin-4, svgHeight-svgMargin)
+	fmt.Fprintf(w, `<text x="%d" y="%d" fill="#3060c0">%dK</text>`+"\n", svgWidth-svgMargin+4, svgMargin+4, svgMaxKelvin)
+	fmt.Fprintf(w, `<text x="%d" y="%d" fill="#3060c0">%dK</text>`+"\n", svgWidth-svgMargin+4, svgHeight-svgMargin, svgMinKelvin)
+
+	writePath := func(colour string, y func(SimulationPoint) float64) {
+		fmt.Fprintf(w, `<path fill="none" stroke-width="2" stroke="%s" d="`, colour)
+		for i, p := range s.Points {
+			if i == 0 {
+				fmt.Fprintf(w, "M%.1f %.1f", x(i), y(p))
+			} else {
+				fmt.Fprintf(w, " V%.1f", y(p))
+			}
+			fmt.Fprintf(w, " H%.1f", x(i+1))
+		}
+		fmt.Fprint(w, `"/>`+"\n")
+	}
+	writePath("#d08000", func(p SimulationPoint) float64 { return brightnessY(p.Brightness) })
+	writePath("#3060c0", func(p SimulationPoint) float64 { return kelvinY(p.Kelvin) })
+
+	_, err = fmt.Fprint(w, "</svg>\n")
+	return err
+}
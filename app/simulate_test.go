@@ -0,0 +1,93 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uint16p(v uint16) *uint16 {
+	return &v
+}
+
+func testCurves() *Curves {
+	c := &Curves{
+		Default: &Curve{
+			Hours: map[string]CurveHour{
+				"6":  {Brightness: uint16p(16384), Kelvin: uint16p(5000)},
+				"20": {Brightness: uint16p(4096), Kelvin: uint16p(2500)},
+			},
+		},
+		Named: map[string]*Curve{
+			"kitchen": {
+				Groups: []string{"Kitchen"},
+				Hours: map[string]CurveHour{
+					"6": {Brightness: uint16p(32768)},
+				},
+			},
+		},
+	}
+	c.rebuildBindings()
+	return c
+}
+
+func TestCurvesTarget(t *testing.T) {
+	c := testCurves()
+	at := func(hour int) time.Time {
+		return time.Date(2020, 1, 1, hour, 30, 0, 0, time.UTC)
+	}
+
+	brightness, kelvin, source := c.Target("Kitchen", at(6))
+	if brightness != 32768 || kelvin != 5000 || source != "group" {
+		t.Fatalf("expected 32768/5000/group, got: %d/%d/%s", brightness, kelvin, source)
+	}
+
+	brightness, kelvin, source = c.Target("Office", at(20))
+	if brightness != 4096 || kelvin != 2500 || source != "default" {
+		t.Fatalf("expected 4096/2500/default, got: %d/%d/%s", brightness, kelvin, source)
+	}
+
+	brightness, kelvin, source = c.Target("Office", at(3))
+	if brightness != 65535 || kelvin != 4000 || source != "builtin" {
+		t.Fatalf("expected 65535/4000/builtin, got: %d/%d/%s", brightness, kelvin, source)
+	}
+}
+
+func TestCurvesSimulate(t *testing.T) {
+	c := testCurves()
+	date := time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)
+
+	s, err := c.Simulate("Kitchen", date, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Points) != 24 {
+		t.Fatalf("expected %d, got: %d", 24, len(s.Points))
+	}
+	if !s.Points[0].Time.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected simulation to start at midnight, got: %s", s.Points[0].Time)
+	}
+	if s.Points[6].Brightness != 32768 {
+		t.Fatalf("expected %d, got: %d", 32768, s.Points[6].Brightness)
+	}
+
+	buf := new(bytes.Buffer)
+	err = s.WriteCSV(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 25 {
+		t.Fatalf("expected %d, got: %d", 25, len(lines))
+	}
+	if lines[7] != "2020-01-01T06:00:00Z,32768,5000,group" {
+		t.Fatalf("unexpected csv row %q", lines[7])
+	}
+
+	_, err = c.Simulate("Kitchen", date, time.Second)
+	if err == nil {
+		t.Fatal("expected an error for a sub-minute step")
+	}
+}
@@ -0,0 +1,328 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+// SiteConfig is one home when the daemon runs several, each on its own
+// network with its own bulbs, curves and state
+type SiteConfig struct {
+	Name string `yaml:"name"`
+
+	// Interface is the network interface to discover the site's bulbs on,
+	// or Bind and Broadcast give the addresses directly. With neither
+	// discovery uses every interface.
+	Interface string `yaml:"interface,omitempty"`
+	Bind      string `yaml:"bind,omitempty"`
+	Broadcast string `yaml:"broadcast,omitempty"`
+
+	// Timezone is the IANA time zone the site's curves are in, by default
+	// the daemon's
+	Timezone string `yaml:"timezone,omitempty"`
+
+	// Dir holds the site's policies.json, gestures.json, occupancy.json and
+	// mqtt.json, by default a directory named after the site
+	Dir string `yaml:"dir,omitempty"`
+	// CurvesDir is by default curves under Dir, and StateDir a directory
+	// named after the site under the daemon's state-dir
+	CurvesDir string `yaml:"curves-dir,omitempty"`
+	StateDir  string `yaml:"state-dir,omitempty"`
+
+	timezone *time.Location
+}
+
+func (s *SiteConfig) validate() error {
+	if !nameRegexp.MatchString(s.Name) {
+		return fmt.Errorf("invalid site name %q", s.Name)
+	}
+	if s.Interface != "" && (s.Bind != "" || s.Broadcast != "") {
+		return errors.New("set interface or bind and broadcast, not both")
+	}
+	for _, address := range []struct {
+		name  string
+		value string
+	}{{"bind", s.Bind}, {"broadcast", s.Broadcast}} {
+		if address.value != "" && net.ParseIP(address.value).To4() == nil {
+			return fmt.Errorf("%s %q isn't an IPv4 address", address.name, address.value)
+		}
+	}
+	if s.Timezone != "" {
+		tz, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return err
+		}
+		s.timezone = tz
+	}
+	return nil
+}
+
+// discoveryAddress is what the site's discovery listens on, empty when it
+// listens on every interface
+func (s *SiteConfig) discoveryAddress() string {
+	if s.Interface != "" {
+		return "interface " + s.Interface
+	}
+	if ip := net.ParseIP(s.Bind); ip != nil && !ip.IsUnspecified() {
+		return ip.String()
+	}
+	return ""
+}
+
+func (s *SiteConfig) dir() string {
+	if s.Dir != "" {
+		return s.Dir
+	}
+	return s.Name
+}
+
+// Discovery returns the addresses to discover the site's bulbs with, for
+// the client's ListenIP and BroadcastIP. Either may be nil for the default.
+func (s *SiteConfig) Discovery() (listen net.IP, broadcast net.IP, err error) {
+	if s.Interface == "" {
+		return net.ParseIP(s.Bind), net.ParseIP(s.Broadcast), nil
+	}
+
+	iface, err := net.InterfaceByName(s.Interface)
+	if err != nil {
+		return nil, nil, fmt.Errorf("site %s: %s", s.Name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("site %s: %s", s.Name, err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		ip := ipnet.IP.To4()
+		mask := net.IP(ipnet.Mask).To4()
+		broadcast := make(net.IP, len(ip))
+		for i := range ip {
+			broadcast[i] = ip[i] | ^mask[i]
+		}
+		return ip, broadcast, nil
+	}
+	return nil, nil, fmt.Errorf("site %s: interface %s has no IPv4 address", s.Name, s.Interface)
+}
+
+// forSite is the config for one site's App
+func (c *Config) forSite(s *SiteConfig) *Config {
+	sc := *c
+	sc.Sites = nil
+	sc.site = s
+	sc.CurvesDir = s.CurvesDir
+	if sc.CurvesDir == "" {
+		sc.CurvesDir = filepath.Join(s.dir(), "curves")
+	}
+	sc.StateDir = s.StateDir
+	if sc.StateDir == "" {
+		sc.StateDir = filepath.Join(c.StateDir, s.Name)
+	}
+	return &sc
+}
+
+// timezoneClock gives a site's App the time in the site's time zone, so
+// curve hours are local to the site
+type timezoneClock struct {
+	lifx.Clock
+	timezone *time.Location
+}
+
+func (tc timezoneClock) Now() time.Time {
+	return tc.Clock.Now().In(tc.timezone)
+}
+
+// Sites runs an App for each site in one process, serving them all from
+// one web server. Each site's API is under /sites/{site}, and the first
+// site's is also at the top level so single-site clients keep working.
+// /healthz, /readyz and /metrics at the top level cover every site.
+type Sites struct {
+	names   []string
+	apps    map[string]*App
+	routers map[string]*web.Router
+
+	// registry has every site's metrics, labelled with the site
+	registry *prometheus.Registry
+}
+
+// NewSites starts an App for each of the config's sites, each with the
+// client discovering its bulbs, and serves them
+func NewSites(clients map[string]*lifx.Client, config *Config) (*Sites, error) {
+	s, err := newSites(clients, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range s.names {
+		err := s.apps[name].start()
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %s", name, err)
+		}
+	}
+
+	err = listen(config.Listen, s.apps[s.names[0]].auth, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newSites builds the sites' Apps, sharing the auth config between them,
+// without starting them
+func newSites(clients map[string]*lifx.Client, config *Config) (*Sites, error) {
+	if len(config.Sites) == 0 {
+		return nil, errors.New("no sites configured")
+	}
+	s := &Sites{
+		apps:     make(map[string]*App),
+		routers:  make(map[string]*web.Router),
+		registry: prometheus.NewRegistry(),
+	}
+	s.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	for _, site := range config.Sites {
+		c, ok := clients[site.Name]
+		if !ok {
+			return nil, fmt.Errorf("no client for site %s", site.Name)
+		}
+		a := newApp(c)
+		a.configure(config.forSite(site))
+		a.sites = s
+
+		if len(s.names) == 0 {
+			err := a.loadAuth()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			first := s.apps[s.names[0]]
+			a.auth = first.auth
+			a.auditLog = first.auditLog
+		}
+
+		s.names = append(s.names, site.Name)
+		s.apps[site.Name] = a
+		s.routers[site.Name] = newRouter(a)
+		prometheus.WrapRegistererWith(prometheus.Labels{"site": site.Name}, s.registry).MustRegister(a.metrics.collectors()...)
+	}
+	return s, nil
+}
+
+// App returns the named site's App
+func (s *Sites) App(name string) *App {
+	return s.apps[name]
+}
+
+func (s *Sites) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+
+	if strings.HasPrefix(path, "/sites/") {
+		rest := strings.TrimPrefix(path, "/sites/")
+		name := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name = rest[:i]
+			rest = rest[i:]
+		} else {
+			rest = "/"
+		}
+		if router, ok := s.routers[name]; ok {
+			r := new(http.Request)
+			*r = *req
+			u := *req.URL
+			u.Path = rest
+			u.RawPath = ""
+			r.URL = &u
+			router.ServeHTTP(rw, r)
+			return
+		}
+	}
+
+	if path == "/healthz" || path == "/readyz" {
+		s.writeHealth(rw, path == "/readyz")
+		return
+	}
+	if path == "/metrics" {
+		promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}).ServeHTTP(rw, req)
+		return
+	}
+
+	// everything else is the first site's, unknown sites end up at its
+	// not found
+	s.routers[s.names[0]].ServeHTTP(rw, req)
+}
+
+// health combines every site's health or readiness, each check prefixed
+// with its site
+func (s *Sites) health(ready bool) *HealthJSON {
+	h := newHealthJSON()
+	for _, name := range s.names {
+		a := s.apps[name]
+		var sh *HealthJSON
+		if ready {
+			sh = a.checkReady(a.client.Health())
+		} else {
+			sh = a.checkHealth(a.client.Health())
+		}
+		for _, check := range sh.Checks {
+			h.add(name+":"+check.Name, check.OK, check.Detail)
+		}
+	}
+	return h
+}
+
+func (s *Sites) writeHealth(rw http.ResponseWriter, ready bool) {
+	h := s.health(ready)
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	d, err := json.Marshal(h)
+	if err != nil {
+		panic(err)
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(d)
+}
+
+// SiteJSON is a site in /sites
+type SiteJSON struct {
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+	Bulbs    int    `json:"bulbs"`
+	Path     string `json:"path"`
+}
+
+// ListSites lists the sites when the daemon runs several, and nothing
+// otherwise
+func (c *Context) ListSites(rw web.ResponseWriter, req *web.Request) {
+	l := []*SiteJSON{}
+	if s := c.App.sites; s != nil {
+		for _, name := range s.names {
+			a := s.apps[name]
+			l = append(l, &SiteJSON{
+				Name:     name,
+				Timezone: a.clock.Now().Location().String(),
+				Bulbs:    a.bulbCount(),
+				Path:     "/sites/" + name,
+			})
+		}
+	}
+	c.writeJSONStatus(rw, http.StatusOK, l)
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lifx "gitlab.adam.gs/home/lifx/lib"
+)
+
+func TestSiteConfig(t *testing.T) {
+	for _, bad := range []*SiteConfig{
+		{Name: "my house"},
+		{Name: "home", Interface: "eth0", Bind: "10.0.0.2"},
+		{Name: "home", Broadcast: "10.0.0"},
+		{Name: "home", Bind: "fe80::1"},
+		{Name: "home", Timezone: "Mars/Olympus_Mons"},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("expected an error for %+v", bad)
+		}
+	}
+
+	c := DefaultConfig()
+	c.Sites = []*SiteConfig{{Name: "home"}, {Name: "home"}}
+	if c.validate() == nil {
+		t.Fatal("expected duplicate sites to be an error")
+	}
+
+	// several sites can't share the LIFX port
+	for _, sites := range [][]*SiteConfig{
+		{{Name: "home"}, {Name: "cabin", Interface: "eth0.20"}},
+		{{Name: "home", Bind: "0.0.0.0"}, {Name: "cabin", Interface: "eth0.20"}},
+		{{Name: "home", Bind: "10.0.10.2"}, {Name: "cabin", Bind: "10.0.10.2"}},
+		{{Name: "home", Interface: "eth0.10"}, {Name: "cabin", Interface: "eth0.10"}},
+	} {
+		c.Sites = sites
+		if c.validate() == nil {
+			t.Fatalf("expected an error for %+v and %+v", sites[0], sites[1])
+		}
+	}
+	for _, sites := range [][]*SiteConfig{
+		{{Name: "home"}},
+		{{Name: "home", Interface: "eth0.10"}, {Name: "cabin", Bind: "10.0.20.2"}},
+	} {
+		c.Sites = sites
+		if err := c.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &SiteConfig{Name: "cabin", Bind: "10.0.20.2", Broadcast: "10.0.20.255"}
+	listen, broadcast, err := s.Discovery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listen.String() != "10.0.20.2" || broadcast.String() != "10.0.20.255" {
+		t.Fatalf("expected 10.0.20.2 and 10.0.20.255, got: %s and %s", listen, broadcast)
+	}
+
+	sc := c.forSite(s)
+	if sc.CurvesDir != "cabin/curves" || sc.StateDir != "state/cabin" || sc.Sites != nil {
+		t.Fatalf("unexpected site config: %+v", sc)
+	}
+}
+
+func testSites(t *testing.T) (*Sites, *lifx.FakeClock) {
+	clock := lifx.NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	config := DefaultConfig()
+	config.Sites = []*SiteConfig{
+		{Name: "home", Bind: "10.0.10.2"},
+		{Name: "cabin", Bind: "10.0.20.2", Timezone: "America/New_York"},
+	}
+	err := config.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSites(map[string]*lifx.Client{
+		"home":  lifx.NewClientWithClock(clock),
+		"cabin": lifx.NewClientWithClock(clock),
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range s.apps {
+		a.curves = testCurves()
+	}
+	return s, clock
+}
+
+func serveSites(s *Sites, method string, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSitesRouting(t *testing.T) {
+	s, _ := testSites(t)
+	home, cabin := s.App("home"), s.App("cabin")
+
+	report(home, 1000, 2700)
+	cabin.SetState(lifx.NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Porch", "Outside", "Cabin", lifx.BulbState{
+		Power:   65535,
+		Visible: true,
+	}))
+
+	for path, expected := range map[string]string{
+		"/bulbs":              "Lamp",
+		"/sites/home/bulbs":   "Lamp",
+		"/sites/cabin/bulbs":  "Porch",
+		"/sites/cabin/bulbs/": "Porch",
+	} {
+		rw := serveSites(s, "GET", path)
+		var bulbs []*BulbJSON
+		err := json.Unmarshal(rw.Body.Bytes(), &bulbs)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if len(bulbs) != 1 || bulbs[0].Name != expected {
+			t.Fatalf("%s: expected %s, got: %s", path, expected, rw.Body.String())
+		}
+	}
+
+	expectAPIError(t, serveSites(s, "GET", "/sites/cabin/api/v2/bulbs/d073d50035f7"), 404)
+	expectAPIError(t, serveSites(s, "GET", "/sites/nowhere/api/v2/bulbs"), 404)
+
+	var sites []*SiteJSON
+	json.Unmarshal(serveSites(s, "GET", "/sites").Body.Bytes(), &sites)
+	if len(sites) != 2 || sites[0].Name != "home" || sites[1].Timezone != "America/New_York" || sites[1].Bulbs != 1 {
+		t.Fatalf("unexpected sites: %s", serveSites(s, "GET", "/sites").Body.String())
+	}
+
+	// the top level probes cover every site
+	h := &HealthJSON{}
+	json.Unmarshal(serveSites(s, "GET", "/readyz").Body.Bytes(), h)
+	if len(h.Checks) != 4 || h.Checks[0].Name != "home:discovered" || h.Checks[2].Name != "cabin:discovered" {
+		t.Fatalf("unexpected checks: %+v", h.Checks)
+	}
+	json.Unmarshal(serveSites(s, "GET", "/sites/cabin/readyz").Body.Bytes(), h)
+	if !strings.HasPrefix(h.Checks[0].Name, "discovered") {
+		t.Fatalf("expected the site's own checks, got: %+v", h.Checks)
+	}
+
+	// as do the top level metrics, each site's labelled with it
+	body := serveSites(s, "GET", "/metrics").Body.String()
+	for _, expected := range []string{
+		`lifx_bulb_kelvin{bulb="d073d50035f7",group="Kitchen",name="Lamp",site="home"} 2700`,
+		`lifx_bulb_kelvin{bulb="d073d5000001",group="Outside",name="Porch",site="cabin"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, body)
+		}
+	}
+	body = serveSites(s, "GET", "/sites/cabin/metrics").Body.String()
+	if strings.Contains(body, `name="Lamp"`) || !strings.Contains(body, `name="Porch"`) {
+		t.Fatalf("expected only the cabin's bulbs in:\n%s", body)
+	}
+}
+
+func TestSiteAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, _ := testSites(t)
+	al, err := openAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range s.apps {
+		a.auditLog = al
+	}
+	cabin := s.App("cabin")
+	cabin.SetState(lifx.NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Porch", "Outside", "Cabin", lifx.BulbState{
+		Power:   65535,
+		Visible: true,
+	}))
+
+	req := httptest.NewRequest("PUT", "/sites/cabin/api/v2/bulbs/d073d5000001/override", strings.NewReader(`{"brightness": 1000, "duration": "1h"}`))
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != 201 {
+		t.Fatalf("expected %d, got: %d %s", 201, rw.Code, rw.Body.String())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &AuditEntry{}
+	err = json.Unmarshal(data, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Site != "cabin" || e.Path != "/api/v2/bulbs/d073d5000001/override" {
+		t.Fatalf("unexpected audit entry: %s", data)
+	}
+}
+
+func TestSiteTimezone(t *testing.T) {
+	s, _ := testSites(t)
+
+	// 6am UTC is 1am in New York, each site follows its curves' hours
+	// locally
+	if hour := s.App("home").clock.Now().Hour(); hour != 6 {
+		t.Fatalf("expected %d, got: %d", 6, hour)
+	}
+	if hour := s.App("cabin").clock.Now().Hour(); hour != 1 {
+		t.Fatalf("expected %d, got: %d", 1, hour)
+	}
+	brightness, _ := s.App("home").GetDefaultCurve()
+	if brightness == nil || *brightness != 16384 {
+		t.Fatal("expected the home site at its 6am point")
+	}
+	brightness, _ = s.App("cabin").GetDefaultCurve()
+	if brightness != nil {
+		t.Fatalf("expected no point at 1am, got: %d", *brightness)
+	}
+
+	if s.App("cabin").policiesPath != "cabin/policies.json" || s.App("cabin").statePath != "state/cabin/control.json" {
+		t.Fatalf("unexpected paths: %s %s", s.App("cabin").policiesPath, s.App("cabin").statePath)
+	}
+}
@@ -0,0 +1,204 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ControlState is the part of a Bulb which survives restarts
+type ControlState struct {
+	Controlled            bool           `json:"controlled"`
+	ControlAfter          time.Time      `json:"control-after,omitempty"`
+	ControlReason         string         `json:"control-reason,omitempty"`
+	ManualStateUntil      time.Time      `json:"manual-state-until,omitempty"`
+	ManualStateBrightness *uint16        `json:"manual-state-brightness,omitempty"`
+	ManualStateKelvin     *uint16        `json:"manual-state-kelvin,omitempty"`
+	ManualStateHue        *uint16        `json:"manual-state-hue,omitempty"`
+	ManualStateSaturation *uint16        `json:"manual-state-saturation,omitempty"`
+	ManualStatePower      *bool          `json:"manual-state-power,omitempty"`
+	ManualStateTransition *time.Duration `json:"manual-state-transition,omitempty"`
+	ManualStateSource     string         `json:"manual-state-source,omitempty"`
+}
+
+func (b *Bulb) controlState() *ControlState {
+	return &ControlState{
+		Controlled:            b.Controlled,
+		ControlAfter:          b.ControlAfter,
+		ControlReason:         b.suspendReason,
+		ManualStateUntil:      b.ManualStateUntil,
+		ManualStateBrightness: b.ManualStateBrightness,
+		ManualStateKelvin:     b.ManualStateKelvin,
+		ManualStateHue:        b.ManualStateHue,
+		ManualStateSaturation: b.ManualStateSaturation,
+		ManualStatePower:      b.ManualStatePower,
+		ManualStateTransition: b.ManualStateTransition,
+		ManualStateSource:     b.ManualStateSource,
+	}
+}
+
+func (b *Bulb) restoreControlState(cs *ControlState) {
+	b.Controlled = cs.Controlled
+	b.ControlAfter = cs.ControlAfter
+	b.suspendReason = cs.ControlReason
+	b.ManualStateUntil = cs.ManualStateUntil
+	b.ManualStateBrightness = cs.ManualStateBrightness
+	b.ManualStateKelvin = cs.ManualStateKelvin
+	b.ManualStateHue = cs.ManualStateHue
+	b.ManualStateSaturation = cs.ManualStateSaturation
+	b.ManualStatePower = cs.ManualStatePower
+	b.ManualStateTransition = cs.ManualStateTransition
+	b.ManualStateSource = cs.ManualStateSource
+}
+
+// prune drops whatever has expired by now, returning nil when nothing is left
+// which differs from a freshly discovered bulb
+func (cs *ControlState) prune(now time.Time) *ControlState {
+	p := *cs
+	if !p.ManualStateUntil.After(now) {
+		p.ManualStateUntil = time.Time{}
+		p.ManualStateBrightness = nil
+		p.ManualStateKelvin = nil
+		p.ManualStateHue = nil
+		p.ManualStateSaturation = nil
+		p.ManualStateTransition = nil
+		// a bulb held off still needs turning back on when it reappears
+		if p.ManualStatePower != nil && *p.ManualStatePower {
+			p.ManualStatePower = nil
+		}
+		if p.ManualStatePower == nil {
+			p.ManualStateSource = ""
+		}
+	}
+	if !p.Controlled && !p.ControlAfter.After(now) {
+		p.Controlled = true
+	}
+	if p.Controlled {
+		p.ControlAfter = time.Time{}
+		p.ControlReason = ""
+	}
+	if p.Controlled && p.ManualStateUntil.IsZero() && p.ManualStatePower == nil {
+		return nil
+	}
+	return &p
+}
+
+// loadState reads the persisted control state, which is applied to bulbs as
+// they're discovered
+func (a *App) loadState() error {
+	data, err := ioutil.ReadFile(a.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	states := make(map[string]*ControlState)
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return err
+	}
+
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	now := a.clock.Now()
+	for address, cs := range states {
+		cs = cs.prune(now)
+		if cs == nil {
+			continue
+		}
+		a.restoredState[address] = cs
+	}
+	a.lastSavedState = data
+
+	log.WithFields(log.Fields{
+		"path":  a.statePath,
+		"bulbs": len(a.restoredState),
+	}).Info("loaded control state")
+
+	return nil
+}
+
+// restoreState applies any persisted control state to a newly discovered bulb
+func (a *App) restoreState(b *Bulb) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	cs, ok := a.restoredState[b.Address]
+	if !ok {
+		return
+	}
+	delete(a.restoredState, b.Address)
+
+	cs = cs.prune(a.clock.Now())
+	if cs == nil {
+		return
+	}
+	b.restoreControlState(cs)
+
+	log.WithFields(log.Fields{
+		"address":            b.Address,
+		"name":               b.Name,
+		"controlled":         b.Controlled,
+		"control-after":      b.ControlAfter,
+		"manual-state-until": b.ManualStateUntil,
+	}).Info("restored control state")
+}
+
+func (a *App) persistState() {
+	a.heartbeat("persist-state", time.Second)
+	ticker := a.clock.NewTicker(time.Second)
+	for range ticker.C() {
+		err := a.saveState()
+		if err != nil {
+			log.WithError(err).Error("unable to persist control state")
+		}
+		a.heartbeat("persist-state", time.Second)
+	}
+}
+
+// saveState writes the control state of every bulb which isn't simply under
+// curve control, including restored state for bulbs not yet rediscovered. The
+// file is only rewritten when its content changes.
+func (a *App) saveState() error {
+	a.controlMutex.Lock()
+	defer a.controlMutex.Unlock()
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	now := a.clock.Now()
+	states := make(map[string]*ControlState)
+	for address, cs := range a.restoredState {
+		if cs = cs.prune(now); cs != nil {
+			states[address] = cs
+		}
+	}
+	for _, bulb := range a.BulbList() {
+		if cs := bulb.controlState().prune(now); cs != nil {
+			states[bulb.Address] = cs
+		} else {
+			delete(states, bulb.Address)
+		}
+	}
+
+	data, err := json.MarshalIndent(states, "", "    ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, a.lastSavedState) {
+		return nil
+	}
+
+	err = writeFileSync(a.statePath, data)
+	if err != nil {
+		return err
+	}
+	a.lastSavedState = data
+
+	return nil
+}
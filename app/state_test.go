@@ -0,0 +1,62 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, clock := testApp()
+	a.statePath = filepath.Join(dir, "control.json")
+
+	b := report(a, 32768, 5000)
+	kelvin := uint16(2700)
+	b.setManualState(&ManualState{
+		Until:  clock.Now().Add(2 * time.Hour),
+		Kelvin: &kelvin,
+	})
+
+	err = a.saveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart an hour later restores the override when the bulb reappears
+	clock.Advance(time.Hour)
+	restarted := newApp(a.client)
+	restarted.statePath = a.statePath
+	restarted.curves = a.curves
+	err = restarted.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb := report(restarted, 32768, 5000)
+	if rb.ManualStateKelvin == nil || *rb.ManualStateKelvin != 2700 {
+		t.Fatal("expected the manual kelvin to be restored")
+	}
+	if !rb.ManualStateUntil.Equal(b.ManualStateUntil) {
+		t.Fatalf("expected %s, got: %s", b.ManualStateUntil, rb.ManualStateUntil)
+	}
+
+	// once expired the entry is pruned rather than restored
+	clock.Advance(2 * time.Hour)
+	restarted = newApp(a.client)
+	restarted.statePath = a.statePath
+	err = restarted.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.restoredState) != 0 {
+		t.Fatalf("expected %d, got: %d", 0, len(restarted.restoredState))
+	}
+}
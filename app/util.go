@@ -3,6 +3,7 @@ package app
 import (
 	"encoding/json"
 	"io/ioutil"
+	"time"
 
 	"github.com/gocraft/web"
 )
@@ -14,7 +15,7 @@ func unmarshal_json_request(rw web.ResponseWriter, req *web.Request, models ...i
 	}
 
 	for _, model := range models {
-		err = json.Unmarshal(data, &model)
+		err = json.Unmarshal(data, model)
 		if err != nil {
 			return err
 		}
@@ -22,3 +23,43 @@ func unmarshal_json_request(rw web.ResponseWriter, req *web.Request, models ...i
 
 	return nil
 }
+
+// Duration is a time.Duration which is written as a string such as "1h30m"
+// in JSON and YAML
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
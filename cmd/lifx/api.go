@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+// defaultServer is the daemon the API commands talk to, LIFX_SERVER or
+// the daemon's own port on this host, at LIFX_SITE's API when the daemon
+// runs several sites
+func defaultServer() string {
+	server := os.Getenv("LIFX_SERVER")
+	if server == "" {
+		server = "http://localhost:8089"
+	}
+	if site := os.Getenv("LIFX_SITE"); site != "" {
+		server = strings.TrimSuffix(server, "/") + "/sites/" + site
+	}
+	return server
+}
+
+// newDaemonRequest builds a request to the daemon, authenticated with
+// LIFX_TOKEN when it is set
+func newDaemonRequest(server string, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if token := os.Getenv("LIFX_TOKEN"); token != "" {
+		req.Header.Set("authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// doDaemonRequest sends req, turning error responses into errors
+func doDaemonRequest(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	ee := &app.ErrorEnvelope{}
+	if json.Unmarshal(msg, ee) == nil && ee.Error != nil {
+		msg = []byte(ee.Error.Message)
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+}
+
+func marshalBody(body interface{}) (io.Reader, error) {
+	if body == nil {
+		return nil, nil
+	}
+	d, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(d), nil
+}
+
+// daemonJSON sends body as JSON to the daemon and decodes the response into v
+func daemonJSON(server string, method string, path string, body interface{}, v interface{}) error {
+	r, err := marshalBody(body)
+	if err != nil {
+		return err
+	}
+	req, err := newDaemonRequest(server, method, path, r)
+	if err != nil {
+		return err
+	}
+	resp, err := doDaemonRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// daemonRequest sends body as JSON to the daemon and copies the response to stdout
+func daemonRequest(server string, method string, path string, body interface{}) error {
+	r, err := marshalBody(body)
+	if err != nil {
+		return err
+	}
+	req, err := newDaemonRequest(server, method, path, r)
+	if err != nil {
+		return err
+	}
+	resp, err := doDaemonRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/lib"
+)
+
+func bulbsUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %s <discover|get|on|off|color|watch> [target] [flags]
+
+talks to bulbs directly, without the daemon. A target is a bulb's address,
+label, group or location, optionally prefixed with address:, label:, group:
+or location: to be specific, or all.
+
+  discover                                   list bulbs
+  get TARGET                                 show bulbs' state
+  on TARGET                                  turn bulbs on
+  off TARGET                                 turn bulbs off
+  color TARGET [-hue 0-360] [-saturation 0-100] [-brightness 0-100]
+        [-kelvin 1500-9000] [-duration 1s]   change bulbs' colour, unset
+                                             flags keep the current value
+  watch [TARGET]                             print bulbs' state as it changes
+
+  -wait 2s    how long to listen for bulbs before acting
+  -json       print JSON instead of a table
+`, os.Args[0])
+}
+
+// bulbInfo is a bulb as the CLI prints it, in people's units
+type bulbInfo struct {
+	Address  string `json:"address"`
+	Label    string `json:"label"`
+	Group    string `json:"group,omitempty"`
+	Location string `json:"location,omitempty"`
+	Product  string `json:"product,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	IP       string `json:"ip,omitempty"`
+
+	Visible    bool    `json:"visible"`
+	Power      bool    `json:"power"`
+	Hue        float64 `json:"hue"`
+	Saturation float64 `json:"saturation"`
+	Brightness float64 `json:"brightness"`
+	Kelvin     int     `json:"kelvin"`
+}
+
+func newBulbInfo(b *lifx.Bulb) bulbInfo {
+	state := b.GetState()
+	bi := bulbInfo{
+		Address:    b.GetLifxAddress(),
+		Label:      b.GetLabel(),
+		Group:      b.GetGroup(),
+		Location:   b.GetLocation(),
+		Firmware:   b.GetFirmware(),
+		IP:         b.GetIP(),
+		Visible:    state.Visible,
+		Power:      state.Power != 0,
+		Hue:        round1(float64(state.Hue) * 360 / 65536),
+		Saturation: round1(float64(state.Saturation) * 100 / 65535),
+		Brightness: round1(float64(state.Brightness) * 100 / 65535),
+		Kelvin:     int(state.Kelvin),
+	}
+	if p := b.GetProduct(); p != nil {
+		bi.Product = p.Name
+	}
+	return bi
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// bulbCommand is the flags shared by the commands which talk to bulbs
+type bulbCommand struct {
+	fs     *flag.FlagSet
+	wait   *time.Duration
+	json   *bool
+	target string
+}
+
+func newBulbCommand(name string) *bulbCommand {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = bulbsUsage
+	return &bulbCommand{
+		fs:   fs,
+		wait: fs.Duration("wait", 2*time.Second, "how long to listen for bulbs before acting"),
+		json: fs.Bool("json", false, "print JSON instead of a table"),
+	}
+}
+
+// parse reads the flags, which may come before or after the target
+func (bc *bulbCommand) parse(args []string) {
+	positional := parseInterspersed(bc.fs, args)
+	if len(positional) > 0 {
+		bc.target = positional[0]
+	}
+}
+
+// client starts listening for bulbs, the broadcast port can only be used
+// by one process on a host
+func (bc *bulbCommand) client() *lifx.Client {
+	// the client logs the gateways it finds
+	log.SetLevel(log.WarnLevel)
+
+	c := lifx.NewClient()
+	err := c.StartDiscovery()
+	if err != nil {
+		log.WithError(err).Fatal("can't listen for bulbs, is the daemon running on this host?")
+	}
+	return c
+}
+
+// discover listens for bulbs for -wait and returns those matching the target
+func (bc *bulbCommand) discover() (*lifx.Client, []*lifx.Bulb) {
+	c := bc.client()
+	time.Sleep(*bc.wait)
+
+	var bulbs []*lifx.Bulb
+	for _, b := range c.GetBulbs() {
+		if b.HasState() && matchTarget(b, bc.target) {
+			bulbs = append(bulbs, b)
+		}
+	}
+	sort.Slice(bulbs, func(i, j int) bool {
+		return bulbs[i].GetLabel() < bulbs[j].GetLabel()
+	})
+	return c, bulbs
+}
+
+// targets is discover for commands which need at least one bulb
+func (bc *bulbCommand) targets() (*lifx.Client, []*lifx.Bulb) {
+	if bc.target == "" {
+		bulbsUsage()
+		os.Exit(2)
+	}
+	c, bulbs := bc.discover()
+	if len(bulbs) == 0 {
+		log.WithField("target", bc.target).Fatal("no bulbs found")
+	}
+	return c, bulbs
+}
+
+// matchTarget reports whether the bulb is addressed by target
+func matchTarget(b *lifx.Bulb, target string) bool {
+	if target == "" || target == "all" {
+		return true
+	}
+	field := ""
+	if i := strings.Index(target, ":"); i > 0 {
+		switch target[:i] {
+		case "address", "label", "group", "location":
+			field = target[:i]
+			target = target[i+1:]
+		}
+	}
+
+	address := strings.ToLower(strings.Replace(target, ":", "", -1))
+	switch field {
+	case "address":
+		return b.GetLifxAddress() == address
+	case "label":
+		return strings.EqualFold(b.GetLabel(), target)
+	case "group":
+		return strings.EqualFold(b.GetGroup(), target)
+	case "location":
+		return strings.EqualFold(b.GetLocation(), target)
+	}
+	return b.GetLifxAddress() == address ||
+		strings.EqualFold(b.GetLabel(), target) ||
+		strings.EqualFold(b.GetGroup(), target) ||
+		strings.EqualFold(b.GetLocation(), target)
+}
+
+func printJSON(v interface{}) {
+	d, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(d))
+}
+
+func infos(bulbs []*lifx.Bulb) []bulbInfo {
+	l := []bulbInfo{}
+	for _, b := range bulbs {
+		l = append(l, newBulbInfo(b))
+	}
+	return l
+}
+
+func runDiscover(args []string) {
+	bc := newBulbCommand("discover")
+	bc.parse(args)
+	_, bulbs := bc.discover()
+
+	if *bc.json {
+		printJSON(infos(bulbs))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tLABEL\tGROUP\tLOCATION\tPRODUCT\tFIRMWARE\tIP")
+	for _, bi := range infos(bulbs) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			bi.Address, bi.Label, bi.Group, bi.Location, bi.Product, bi.Firmware, bi.IP)
+	}
+	tw.Flush()
+}
+
+func runGet(args []string) {
+	bc := newBulbCommand("get")
+	bc.parse(args)
+	_, bulbs := bc.targets()
+
+	if *bc.json {
+		printJSON(infos(bulbs))
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tLABEL\tPOWER\tHUE\tSATURATION\tBRIGHTNESS\tKELVIN")
+	for _, bi := range infos(bulbs) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%.1f%%\t%.1f%%\t%d\n",
+			bi.Address, bi.Label, onOff(bi.Power), bi.Hue, bi.Saturation, bi.Brightness, bi.Kelvin)
+	}
+	tw.Flush()
+}
+
+func runPower(on bool, args []string) {
+	bc := newBulbCommand(onOff(on))
+	bc.parse(args)
+	c, bulbs := bc.targets()
+
+	for _, b := range bulbs {
+		var err error
+		if on {
+			err = c.LightOn(b)
+		} else {
+			err = c.LightOff(b)
+		}
+		if err != nil {
+			log.WithError(err).WithField("bulb", b.GetLabel()).Error("can't change power")
+		}
+	}
+}
+
+func runColor(args []string) {
+	bc := newBulbCommand("color")
+	hue := bc.fs.Float64("hue", 0, "hue in degrees, 0-360")
+	saturation := bc.fs.Float64("saturation", 0, "saturation in percent")
+	bc.fs.Float64Var(saturation, "sat", 0, "short for -saturation")
+	brightness := bc.fs.Float64("brightness", 0, "brightness in percent")
+	kelvin := bc.fs.Int("kelvin", 0, "colour temperature, 1500-9000")
+	duration := bc.fs.Duration("duration", 0, "transition time")
+	bc.parse(args)
+
+	set := make(map[string]bool)
+	bc.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["sat"] {
+		set["saturation"] = true
+	}
+	switch {
+	case *hue < 0 || *hue > 360:
+		log.Fatal("hue must be 0-360")
+	case *saturation < 0 || *saturation > 100:
+		log.Fatal("saturation must be 0-100")
+	case *brightness < 0 || *brightness > 100:
+		log.Fatal("brightness must be 0-100")
+	case set["kelvin"] && (*kelvin < 1500 || *kelvin > 9000):
+		log.Fatal("kelvin must be 1500-9000")
+	case *duration < 0:
+		log.Fatal("duration can't be negative")
+	}
+
+	c, bulbs := bc.targets()
+	for _, b := range bulbs {
+		state := b.GetState()
+		h, s, l, k := state.Hue, state.Saturation, state.Brightness, state.Kelvin
+		if set["hue"] {
+			h = uint16(math.Round(*hue / 360 * 65535))
+		}
+		if set["saturation"] {
+			s = uint16(math.Round(*saturation / 100 * 65535))
+		}
+		if set["brightness"] {
+			l = uint16(math.Round(*brightness / 100 * 65535))
+		}
+		if set["kelvin"] {
+			k = uint16(*kelvin)
+		}
+		err := c.LightColour(b, h, s, l, k, uint32(*duration/time.Millisecond))
+		if err != nil {
+			log.WithError(err).WithField("bulb", b.GetLabel()).Error("can't change colour")
+		}
+	}
+}
+
+// runWatch prints a line each time a bulb's state changes, until interrupted
+func runWatch(args []string) {
+	bc := newBulbCommand("watch")
+	bc.parse(args)
+	c := bc.client()
+	sub := c.Subscribe()
+
+	last := make(map[string]bulbInfo)
+	for event := range sub.Events {
+		b, ok := event.(*lifx.Bulb)
+		if !ok || !b.HasState() || !matchTarget(b, bc.target) {
+			continue
+		}
+		bi := newBulbInfo(b)
+		if previous, ok := last[bi.Address]; ok && previous == bi {
+			continue
+		}
+		last[bi.Address] = bi
+
+		now := time.Now()
+		if *bc.json {
+			d, err := json.Marshal(struct {
+				Time time.Time `json:"time"`
+				bulbInfo
+			}{now, bi})
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println(string(d))
+			continue
+		}
+		if !bi.Visible {
+			fmt.Printf("%s %s (%s) offline\n", now.Format("15:04:05"), bi.Label, bi.Address)
+			continue
+		}
+		fmt.Printf("%s %s (%s) %s hue=%.1f saturation=%.1f%% brightness=%.1f%% kelvin=%d\n",
+			now.Format("15:04:05"), bi.Label, bi.Address, onOff(bi.Power),
+			bi.Hue, bi.Saturation, bi.Brightness, bi.Kelvin)
+	}
+}
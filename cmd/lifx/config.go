@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+// runConfig prints the daemon's config as it would be given the same
+// file, environment and flags
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Fprintf(os.Stderr, "usage: %s config show [daemon flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	config, err := app.ParseConfig(fs, args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(config.YAML())
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+func ctlUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %s ctl <command> [flags] [args]
+
+talks to the daemon's HTTP API, at -server or LIFX_SERVER, with LIFX_TOKEN as
+a bearer token when it is set. LIFX_SITE picks a site when the daemon runs
+several. FILTER is the filter syntax, e.g. group=Kitchen, override and
+release take all for every bulb.
+
+  bulbs [FILTER] [-json]                list bulbs and who is controlling them
+  override FILTER [-brightness 30%%] [-kelvin 2700] [-hue 0-360]
+        [-saturation 50%%] [-power on|off] [-transition 2s]
+        [-for 2h | -until 2006-01-02T15:04:05Z]
+                                        hold bulbs off their curves
+  release FILTER                        return bulbs to their curves
+  offsets                               print every bulb and group offset
+  offset bulb ADDRESS | group NAME [-brightness -20%%] [-kelvin -500]
+                                        adjust curve values, a percentage
+                                        scales brightness
+  offset bulb ADDRESS | group NAME -clear
+                                        remove an offset
+  curves                                print every curve
+  curve show NAME                       print a curve, NAME is default or a group curve
+  curve edit NAME                       edit a curve in $EDITOR
+  curve set NAME FILE                   replace a curve from FILE, - for stdin
+  curve delete NAME                     delete a group curve
+  events [-filter FILTER] [-types a,b] [-json]
+                                        follow the event stream
+`, os.Args[0])
+}
+
+// parseInterspersed parses flags which may come before, after or between
+// positional arguments, returning the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// runCtl manages the daemon through its HTTP API
+func runCtl(args []string) {
+	if len(args) == 0 {
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("ctl "+args[0], flag.ExitOnError)
+	fs.Usage = ctlUsage
+	server := fs.String("server", defaultServer(), "daemon URL")
+
+	var err error
+	switch args[0] {
+	case "bulbs":
+		err = ctlBulbs(fs, server, args[1:])
+	case "override":
+		err = ctlOverride(fs, server, args[1:])
+	case "release":
+		err = ctlRelease(fs, server, args[1:])
+	case "offsets":
+		parseInterspersed(fs, args[1:])
+		err = daemonRequest(*server, "GET", "/api/v2/offsets", nil)
+	case "offset":
+		err = ctlOffset(fs, server, args[1:])
+	case "curves":
+		parseInterspersed(fs, args[1:])
+		err = daemonRequest(*server, "GET", "/api/v2/curves", nil)
+	case "curve":
+		err = ctlCurve(fs, server, args[1:])
+	case "events":
+		err = ctlEvents(fs, server, args[1:])
+	default:
+		ctlUsage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func filterQuery(filter string) string {
+	if filter == "" {
+		return ""
+	}
+	return "?" + url.Values{"filter": {filter}}.Encode()
+}
+
+func ctlBulbs(fs *flag.FlagSet, server *string, args []string) error {
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	filter := strings.Join(parseInterspersed(fs, args), ",")
+
+	var bulbs []*app.BulbJSON
+	err := daemonJSON(*server, "GET", "/api/v2/bulbs"+filterQuery(filter), nil, &bulbs)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		printJSON(bulbs)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tNAME\tGROUP\tPOWER\tBRIGHTNESS\tKELVIN\tCONTROL\tUNTIL")
+	for _, b := range bulbs {
+		until := ""
+		if b.Override != nil {
+			until = b.Override.Until.Local().Format("Jan 2 15:04")
+		} else if b.ControlAfter != nil {
+			until = b.ControlAfter.Local().Format("Jan 2 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.0f%%\t%d\t%s\t%s\n",
+			b.Address, b.Name, b.Group, onOff(b.Power != 0),
+			float64(b.Brightness)*100/65535, b.Kelvin, b.ControlReason, until)
+	}
+	return tw.Flush()
+}
+
+// parseLevel reads a 0-65535 level given either raw or as a percentage
+func parseLevel(name string, s string) (*int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var v int
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("%s: %q isn't a percentage", name, s)
+		}
+		v = int(math.Round(pct / 100 * 65535))
+	} else {
+		raw, err := strconv.Atoi(s)
+		if err != nil || raw < 0 || raw > 65535 {
+			return nil, fmt.Errorf("%s: %q isn't a percentage or 0-65535", name, s)
+		}
+		v = raw
+	}
+	return &v, nil
+}
+
+func ctlOverride(fs *flag.FlagSet, server *string, args []string) error {
+	brightness := fs.String("brightness", "", "brightness as a percentage, or 0-65535")
+	saturation := fs.String("saturation", "", "saturation as a percentage, or 0-65535")
+	hue := fs.Float64("hue", -1, "hue in degrees, 0-360")
+	kelvin := fs.Int("kelvin", 0, "colour temperature")
+	power := fs.String("power", "", "on or off")
+	transition := fs.Duration("transition", 0, "transition time")
+	duration := fs.Duration("for", 0, "how long to hold the bulbs")
+	until := fs.String("until", "", "when to return the bulbs to their curves, RFC 3339")
+	filter := strings.Join(parseInterspersed(fs, args), ",")
+	if filter == "" {
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	ur := &app.UpdateBulbRequest{}
+	var err error
+	ur.Brightness, err = parseLevel("brightness", *brightness)
+	if err != nil {
+		return err
+	}
+	ur.Saturation, err = parseLevel("saturation", *saturation)
+	if err != nil {
+		return err
+	}
+	if *hue >= 0 {
+		if *hue > 360 {
+			return fmt.Errorf("hue: %g isn't 0-360", *hue)
+		}
+		h := int(math.Round(*hue / 360 * 65535))
+		ur.Hue = &h
+	}
+	if *kelvin != 0 {
+		ur.Kelvin = kelvin
+	}
+	switch *power {
+	case "":
+	case "on", "off":
+		on := *power == "on"
+		ur.Power = &on
+	default:
+		return fmt.Errorf("power: %q isn't on or off", *power)
+	}
+	if *transition != 0 {
+		t := transition.String()
+		ur.Transition = &t
+	}
+	switch {
+	case *until != "" && *duration != 0:
+		return fmt.Errorf("don't set both -for and -until")
+	case *until != "":
+		t, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return fmt.Errorf("until: %s", err)
+		}
+		ur.Until = &t
+	case *duration != 0:
+		d := duration.String()
+		ur.Duration = &d
+	default:
+		return fmt.Errorf("set -for or -until")
+	}
+
+	var bulbs []*app.BulbJSON
+	err = daemonJSON(*server, "POST", "/api/v2/overrides"+filterQuery(filter), ur, &bulbs)
+	if err != nil {
+		return err
+	}
+	if len(bulbs) == 0 {
+		return fmt.Errorf("no bulbs match %s", filter)
+	}
+	for _, b := range bulbs {
+		fmt.Printf("%s (%s) held until %s\n", b.Name, b.Address, b.Override.Until.Local().Format(time.RFC1123))
+	}
+	return nil
+}
+
+func ctlRelease(fs *flag.FlagSet, server *string, args []string) error {
+	filter := strings.Join(parseInterspersed(fs, args), ",")
+	if filter == "" {
+		ctlUsage()
+		os.Exit(2)
+	}
+	return daemonJSON(*server, "DELETE", "/api/v2/overrides"+filterQuery(filter), nil, nil)
+}
+
+func ctlOffset(fs *flag.FlagSet, server *string, args []string) error {
+	brightness := fs.String("brightness", "", "brightness change as a percentage, or -65535-65535")
+	kelvin := fs.Int("kelvin", 0, "colour temperature change, negative is warmer")
+	remove := fs.Bool("clear", false, "remove the offset")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 2 || (positional[0] != "bulb" && positional[0] != "group") {
+		ctlUsage()
+		os.Exit(2)
+	}
+	path := "/api/v2/bulbs/" + url.PathEscape(positional[1]) + "/offset"
+	if positional[0] == "group" {
+		path = "/api/v2/groups/" + url.PathEscape(positional[1]) + "/offset"
+	}
+
+	if *remove {
+		return daemonJSON(*server, "DELETE", path, nil, nil)
+	}
+
+	offset := &app.Offset{}
+	if strings.HasSuffix(*brightness, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(*brightness, "%"), 64)
+		if err != nil {
+			return fmt.Errorf("brightness: %q isn't a percentage", *brightness)
+		}
+		offset.BrightnessPercent = &pct
+	} else if *brightness != "" {
+		raw, err := strconv.Atoi(*brightness)
+		if err != nil {
+			return fmt.Errorf("brightness: %q isn't a percentage or a number", *brightness)
+		}
+		offset.Brightness = &raw
+	}
+	if *kelvin != 0 {
+		offset.Kelvin = kelvin
+	}
+	return daemonRequest(*server, "PUT", path, offset)
+}
+
+func curvePath(name string) string {
+	if name == "default" {
+		return "/api/v2/curves/default"
+	}
+	return "/api/v2/curves/groups/" + url.PathEscape(name)
+}
+
+func ctlCurve(fs *flag.FlagSet, server *string, args []string) error {
+	positional := parseInterspersed(fs, args)
+	if len(positional) < 2 {
+		ctlUsage()
+		os.Exit(2)
+	}
+	name := positional[1]
+	path := curvePath(name)
+
+	switch positional[0] {
+	case "show":
+		return daemonRequest(*server, "GET", path, nil)
+	case "delete":
+		return daemonJSON(*server, "DELETE", path, nil, nil)
+	case "set":
+		if len(positional) < 3 {
+			ctlUsage()
+			os.Exit(2)
+		}
+		var data []byte
+		var err error
+		if positional[2] == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(positional[2])
+		}
+		if err != nil {
+			return err
+		}
+		_, err = putCurve(*server, path, data, "")
+		return err
+	case "edit":
+		return editCurve(*server, path)
+	}
+	ctlUsage()
+	os.Exit(2)
+	return nil
+}
+
+// putCurve replaces a curve, only if it is still etag when that's set
+func putCurve(server string, path string, data []byte, etag string) (*http.Response, error) {
+	req, err := newDaemonRequest(server, "PUT", path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("if-match", etag)
+	}
+	resp, err := doDaemonRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// editCurve opens the curve in $EDITOR and saves it if it changed, failing
+// rather than overwriting if somebody else changed it in the meantime
+func editCurve(server string, path string) error {
+	req, err := newDaemonRequest(server, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := doDaemonRequest(req)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	etag := resp.Header.Get("etag")
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, data, "", "  ") == nil {
+		data = append(indented.Bytes(), '\n')
+	}
+
+	f, err := ioutil.TempFile("", "curve-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// EDITOR may have arguments of its own
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, data) {
+		fmt.Fprintln(os.Stderr, "no changes")
+		return nil
+	}
+	_, err = putCurve(server, path, edited, etag)
+	return err
+}
+
+// ctlEvents follows the event stream, resuming where it left off if the
+// connection drops
+func ctlEvents(fs *flag.FlagSet, server *string, args []string) error {
+	filter := fs.String("filter", "", "only events about bulbs matching this filter")
+	types := fs.String("types", "", "only these event types, comma separated")
+	asJSON := fs.Bool("json", false, "print each event as a line of JSON")
+	parseInterspersed(fs, args)
+
+	q := url.Values{}
+	if *filter != "" {
+		q.Set("filter", *filter)
+	}
+	if *types != "" {
+		q.Set("types", *types)
+	}
+	path := "/api/v2/events?" + q.Encode()
+
+	lastID := ""
+	for {
+		req, err := newDaemonRequest(*server, "GET", path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("accept", "text/event-stream")
+		if lastID != "" {
+			req.Header.Set("last-event-id", lastID)
+		}
+		resp, err := doDaemonRequest(req)
+		if err != nil {
+			return err
+		}
+		lastID, err = readEvents(resp.Body, lastID, *asJSON)
+		resp.Body.Close()
+		log.WithError(err).Warn("event stream ended, reconnecting")
+		time.Sleep(time.Second)
+	}
+}
+
+// readEvents prints events from a Server-Sent Events stream until it ends,
+// returning the last event id
+func readEvents(r io.Reader, lastID string, asJSON bool) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var id, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			if id != "" {
+				lastID = id
+			}
+			printEvent(data, asJSON)
+			id, data = "", ""
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return lastID, err
+}
+
+func printEvent(data string, asJSON bool) {
+	if asJSON {
+		fmt.Println(data)
+		return
+	}
+	e := &app.Event{}
+	if json.Unmarshal([]byte(data), e) != nil || e.Type == "" {
+		fmt.Println(data)
+		return
+	}
+
+	about := ""
+	switch {
+	case e.Bulb != nil:
+		about = fmt.Sprintf("%s (%s)", e.Bulb.Name, e.Bulb.Address)
+	case e.Group != "":
+		about = e.Group
+	case e.Curve != "":
+		about = e.Curve
+	}
+	detail := ""
+	if e.Data != nil {
+		d, err := json.Marshal(e.Data)
+		if err != nil {
+			panic(err)
+		}
+		detail = string(d)
+	}
+	fmt.Println(strings.TrimSpace(fmt.Sprintf("%s %-20s %s %s",
+		e.Time.Local().Format("15:04:05"), e.Type, about, detail)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+	"gitlab.adam.gs/home/lifx/lib"
+)
+
+func runDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	config, err := app.ParseConfig(fs, args, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.SetupLogging()
+
+	if len(config.Sites) > 0 {
+		runSites(config)
+		return
+	}
+
+	c := startClient(config, nil, nil)
+
+	a, err := app.NewApp(c, config)
+	if err != nil {
+		panic(err)
+	}
+
+	forwardEvents(c, a)
+}
+
+// runSites runs an App for each site, each discovering bulbs with its own
+// client
+func runSites(config *app.Config) {
+	clients := make(map[string]*lifx.Client)
+	for _, site := range config.Sites {
+		listen, broadcast, err := site.Discovery()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{
+			"site":      site.Name,
+			"listen":    listen,
+			"broadcast": broadcast,
+		}).Info("discovering bulbs")
+		clients[site.Name] = startClient(config, listen, broadcast)
+	}
+
+	sites, err := app.NewSites(clients, config)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, site := range config.Sites {
+		go forwardEvents(clients[site.Name], sites.App(site.Name))
+	}
+	select {}
+}
+
+func startClient(config *app.Config, listen net.IP, broadcast net.IP) *lifx.Client {
+	c := lifx.NewClient()
+	c.Metrics = app.NewMetrics()
+	c.TraceWire = config.LogLevel == "trace"
+	c.Rate = config.Rate
+	c.DeviceRate = config.DeviceRate
+	c.DiscoveryInterval = time.Duration(config.DiscoveryInterval)
+	c.VisibilityTimeout = time.Duration(config.VisibilityTimeout)
+	c.ListenIP = listen
+	c.BroadcastIP = broadcast
+
+	err := c.StartDiscovery()
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// forwardEvents tells the app about bulbs as the client hears from them
+func forwardEvents(c *lifx.Client, a *app.App) {
+	sub := c.Subscribe()
+
+	for {
+		event := <-sub.Events
+
+		switch event := event.(type) {
+		case *lifx.Gateway:
+			//log.Printf("Gateway Update %+v", event)
+		case *lifx.Bulb:
+			//log.Printf("Bulb Update %+v", event.GetState())
+			a.SetState(event)
+		case *lifx.LightSensorState:
+			//log.Printf("Light Sensor Update %s %f", event.GetLifxAddress(), event.Lux)
+		default:
+			log.Printf("Event %+v", event)
+		}
+
+	}
+}
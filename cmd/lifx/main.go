@@ -1,44 +1,74 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	log "github.com/sirupsen/logrus"
-	"gitlab.adam.gs/home/lifx/app"
-	"gitlab.adam.gs/home/lifx/lib"
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [command] [flags]
+
+commands:
+  daemon     discover and control bulbs, serving the HTTP API (default)
+  config     show the daemon's config after the file, environment and flags
+  discover   list bulbs on the network, without the daemon
+  get        show bulbs' state
+  on, off    turn bulbs on or off
+  color      change bulbs' colour
+  watch      print bulbs' state as it changes
+  simulate   render the effective curve timeline for a group or bulb
+  ctl        list bulbs, set overrides, edit curves and follow events on the daemon
+  scene      capture, list and activate scenes on the daemon
+  openapi    print the OpenAPI spec of the v2 HTTP API
+  passwd     hash a password for a basic auth user in auth.json
+`, os.Args[0])
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
 	})
 
-	c := lifx.NewClient()
-
-	err := c.StartDiscovery()
-	if err != nil {
-		panic(err)
+	command := "daemon"
+	args := []string{}
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+		args = os.Args[2:]
 	}
 
-	a, err := app.NewApp(c)
-	if err != nil {
-		panic(err)
-	}
-
-	sub := c.Subscribe()
-
-	for {
-		event := <-sub.Events
-
-		switch event := event.(type) {
-		case *lifx.Gateway:
-			//log.Printf("Gateway Update %+v", event)
-		case *lifx.Bulb:
-			//log.Printf("Bulb Update %+v", event.GetState())
-			a.SetState(event)
-		case *lifx.LightSensorState:
-			//log.Printf("Light Sensor Update %s %f", event.GetLifxAddress(), event.Lux)
-		default:
-			log.Printf("Event %+v", event)
-		}
-
+	switch command {
+	case "daemon":
+		runDaemon(args)
+	case "config":
+		runConfig(args)
+	case "discover":
+		runDiscover(args)
+	case "get":
+		runGet(args)
+	case "on":
+		runPower(true, args)
+	case "off":
+		runPower(false, args)
+	case "color", "colour":
+		runColor(args)
+	case "watch":
+		runWatch(args)
+	case "simulate":
+		runSimulate(args)
+	case "ctl":
+		runCtl(args)
+	case "scene":
+		runScene(args)
+	case "openapi":
+		runOpenAPI(args)
+	case "passwd":
+		runPasswd(args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
 	}
 }
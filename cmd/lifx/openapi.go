@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+// runOpenAPI prints the spec, api/openapi.json is regenerated with it
+func runOpenAPI(args []string) {
+	d, err := json.MarshalIndent(app.OpenAPISpec(), "", "  ")
+	if err != nil {
+		log.WithError(err).Fatal("can't marshal spec")
+	}
+	os.Stdout.Write(append(d, '\n'))
+}
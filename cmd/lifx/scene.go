@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+func sceneUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %s scene <list|show|capture|activate|delete> [flags] [name]
+
+  list                                     list scenes
+  show NAME                                show a scene
+  capture [-filter group=Kitchen] NAME     snapshot bulbs as a scene
+  activate [-transition 2s] [-for 1h] NAME recall a scene
+  delete NAME                              delete a scene
+`, os.Args[0])
+}
+
+// runScene manages scenes through the daemon's HTTP API
+func runScene(args []string) {
+	if len(args) == 0 {
+		sceneUsage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("scene "+args[0], flag.ExitOnError)
+	server := fs.String("server", defaultServer(), "daemon URL")
+	filter := fs.String("filter", "", "bulb filter for capture, e.g. group=Kitchen")
+	transition := fs.Duration("transition", 0, "transition time for activate")
+	duration := fs.Duration("for", 0, "how long to hold the scene before curves resume (default until released)")
+	fs.Parse(args[1:])
+
+	name := fs.Arg(0)
+	if args[0] != "list" && name == "" {
+		sceneUsage()
+		os.Exit(2)
+	}
+	path := "/scenes/" + url.PathEscape(name)
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = daemonRequest(*server, "GET", "/scenes", nil)
+	case "show":
+		err = daemonRequest(*server, "GET", path, nil)
+	case "capture":
+		q := url.Values{}
+		if *filter != "" {
+			q.Set("filter", *filter)
+		}
+		err = daemonRequest(*server, "POST", path+"/capture?"+q.Encode(), nil)
+	case "activate":
+		ar := &app.ActivateSceneRequest{}
+		if *transition != 0 {
+			t := transition.String()
+			ar.Transition = &t
+		}
+		if *duration != 0 {
+			d := duration.String()
+			ar.Duration = &d
+		}
+		err = daemonRequest(*server, "POST", path+"/activate", ar)
+	case "delete":
+		err = daemonRequest(*server, "DELETE", path, nil)
+	default:
+		sceneUsage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
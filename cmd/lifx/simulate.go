@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.adam.gs/home/lifx/app"
+)
+
+// runSimulate renders a curve timeline. Without -server it reads the curve
+// files directly; with -server it asks the daemon, which also knows about
+// bulbs and their scheduled manual overrides.
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	curvesDir := fs.String("curves", "curves", "curves directory (offline mode)")
+	server := fs.String("server", "", "daemon URL, e.g. http://localhost:8089")
+	group := fs.String("group", "", "group to simulate")
+	bulb := fs.String("bulb", "", "bulb address to simulate (requires -server)")
+	date := fs.String("date", time.Now().Format("2006-01-02"), "date to simulate (YYYY-MM-DD)")
+	step := fs.Duration("step", 15*time.Minute, "sample interval")
+	format := fs.String("format", "csv", "output format: json, csv or svg")
+	fs.Parse(args)
+
+	if *server != "" {
+		err := simulateRemote(*server, *group, *bulb, *date, *step, *format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *bulb != "" {
+		log.Fatal("-bulb requires -server")
+	}
+
+	d, err := time.ParseInLocation("2006-01-02", *date, time.Local)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	curves, err := app.LoadCurves(*curvesDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := curves.Simulate(*group, d, *step)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *format {
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(s)
+	case "csv":
+		err = s.WriteCSV(os.Stdout)
+	case "svg":
+		err = s.WriteSVG(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func simulateRemote(server, group, bulb, date string, step time.Duration, format string) error {
+	var path string
+	if bulb != "" {
+		path = "/simulate/bulb/" + url.PathEscape(bulb)
+	} else {
+		path = "/simulate/group/" + url.PathEscape(group)
+	}
+
+	q := url.Values{}
+	q.Set("date", date)
+	q.Set("step", step.String())
+	q.Set("format", format)
+
+	resp, err := http.Get(server + path + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
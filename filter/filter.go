@@ -0,0 +1,276 @@
+// Package filter parses and evaluates bulb filter expressions such as
+//
+//	group=Kitchen,power=on
+//	(group=Kitchen|group=Lounge),!controlled
+//	name~^Desk,brightness=20%..60%
+//
+// Terms are ANDed with "," and ORed with "|", "," binding tighter. "!"
+// negates a term or a parenthesised expression and a bare boolean field is
+// true when set.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Kind is the type of a field
+type Kind int
+
+// Field kinds
+const (
+	String Kind = iota
+	Number
+	Bool
+	Set
+)
+
+func (k Kind) String() string {
+	switch k {
+	case String:
+		return "string"
+	case Number:
+		return "number"
+	case Bool:
+		return "boolean"
+	case Set:
+		return "set"
+	}
+	return "unknown"
+}
+
+// Field describes something a filter can match on. Percent, when set, is
+// what 100% means for a number field.
+type Field struct {
+	Kind    Kind
+	Percent float64
+}
+
+// BulbFields are the fields of a bulb
+var BulbFields = map[string]Field{
+	"name":       {Kind: String},
+	"address":    {Kind: String},
+	"group":      {Kind: String},
+	"location":   {Kind: String},
+	"product":    {Kind: String},
+	"capability": {Kind: Set},
+	"power":      {Kind: Bool},
+	"online":     {Kind: Bool},
+	"controlled": {Kind: Bool},
+	"brightness": {Kind: Number, Percent: 65535},
+	"saturation": {Kind: Number, Percent: 65535},
+	"hue":        {Kind: Number},
+	"kelvin":     {Kind: Number},
+}
+
+// Fields is something a filter can be matched against. Values are string,
+// float64, bool or []string depending on the field's kind, nil when unknown.
+type Fields interface {
+	Value(field string) interface{}
+}
+
+// Node is a parsed filter expression
+type Node interface {
+	Match(f Fields) bool
+	String() string
+}
+
+// All matches everything, it's what an empty filter parses to
+type All struct{}
+
+func (All) Match(f Fields) bool { return true }
+func (All) String() string      { return "" }
+
+// And matches when all of its nodes do
+type And []Node
+
+func (n And) Match(f Fields) bool {
+	for _, node := range n {
+		if !node.Match(f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n And) String() string {
+	parts := make([]string, len(n))
+	for i, node := range n {
+		parts[i] = node.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Or matches when any of its nodes do
+type Or []Node
+
+func (n Or) Match(f Fields) bool {
+	for _, node := range n {
+		if node.Match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Or) String() string {
+	parts := make([]string, len(n))
+	for i, node := range n {
+		parts[i] = node.String()
+	}
+	return "(" + strings.Join(parts, "|") + ")"
+}
+
+// Not inverts its node
+type Not struct {
+	Node Node
+}
+
+func (n Not) Match(f Fields) bool {
+	return !n.Node.Match(f)
+}
+
+func (n Not) String() string {
+	return "!" + n.Node.String()
+}
+
+// Operators
+const (
+	OpEqual        = "="
+	OpNotEqual     = "!="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpMatch        = "~"
+	OpNotMatch     = "!~"
+)
+
+// operators in the order they're tried when parsing, longest first
+var operators = []string{OpNotEqual, OpNotMatch, OpLessEqual, OpGreaterEqual, OpEqual, OpLess, OpGreater, OpMatch}
+
+// Compare matches a field against a value
+type Compare struct {
+	Field string
+	Kind  Kind
+	Op    string
+	Value string
+
+	// parsed forms of Value
+	number float64
+	high   float64
+	ranged bool
+	truth  bool
+	glob   bool
+	regexp *regexp.Regexp
+}
+
+func (c *Compare) String() string {
+	if c.Kind == Bool && c.Op == OpEqual && c.truth && c.Value == "" {
+		return c.Field
+	}
+	return c.Field + c.Op + quote(c.Value)
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, ",|()\"\\") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func (c *Compare) Match(f Fields) bool {
+	v := f.Value(c.Field)
+	if v == nil {
+		// nothing is known, only a negative comparison can be true
+		return c.Op == OpNotEqual || c.Op == OpNotMatch
+	}
+
+	switch c.Kind {
+	case String:
+		s, _ := v.(string)
+		return c.matchString(s)
+	case Set:
+		set, _ := v.([]string)
+		found := false
+		for _, s := range set {
+			if c.matchString(s) {
+				found = true
+				break
+			}
+		}
+		if c.Op == OpNotEqual || c.Op == OpNotMatch {
+			// "not any member matches" rather than "any member doesn't"
+			found = true
+			for _, s := range set {
+				if !c.matchString(s) {
+					found = false
+					break
+				}
+			}
+		}
+		return found
+	case Bool:
+		b, _ := v.(bool)
+		if c.Op == OpNotEqual {
+			return b != c.truth
+		}
+		return b == c.truth
+	case Number:
+		n, _ := v.(float64)
+		return c.matchNumber(n)
+	}
+	return false
+}
+
+func (c *Compare) matchString(s string) bool {
+	switch c.Op {
+	case OpEqual:
+		if c.glob {
+			ok, _ := path.Match(c.Value, s)
+			return ok
+		}
+		return s == c.Value
+	case OpNotEqual:
+		if c.glob {
+			ok, _ := path.Match(c.Value, s)
+			return !ok
+		}
+		return s != c.Value
+	case OpMatch:
+		return c.regexp.MatchString(s)
+	case OpNotMatch:
+		return !c.regexp.MatchString(s)
+	}
+	return false
+}
+
+func (c *Compare) matchNumber(n float64) bool {
+	switch c.Op {
+	case OpEqual:
+		if c.ranged {
+			return n >= c.number && n <= c.high
+		}
+		return n == c.number
+	case OpNotEqual:
+		if c.ranged {
+			return n < c.number || n > c.high
+		}
+		return n != c.number
+	case OpLess:
+		return n < c.number
+	case OpLessEqual:
+		return n <= c.number
+	case OpGreater:
+		return n > c.number
+	case OpGreaterEqual:
+		return n >= c.number
+	}
+	return false
+}
+
+func pathMatch(pattern string) (bool, error) {
+	return path.Match(pattern, "")
+}
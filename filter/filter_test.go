@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"testing"
+)
+
+type testBulb map[string]interface{}
+
+func (b testBulb) Value(field string) interface{} {
+	return b[field]
+}
+
+var kitchen = testBulb{
+	"name":       "Kitchen Ceiling",
+	"address":    "d073d50035f7",
+	"group":      "Kitchen",
+	"location":   "Home",
+	"product":    "LIFX A19",
+	"capability": []string{"color", "temperature"},
+	"power":      true,
+	"online":     true,
+	"controlled": false,
+	"brightness": float64(32768),
+	"kelvin":     float64(2700),
+}
+
+var lounge = testBulb{
+	"name":       "Lounge Lamp",
+	"address":    "d073d5001234",
+	"group":      "Lounge",
+	"location":   "Home",
+	"capability": []string{},
+	"power":      false,
+	"online":     true,
+	"controlled": true,
+	"brightness": float64(65535),
+	"kelvin":     float64(4000),
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter  string
+		kitchen bool
+		lounge  bool
+	}{
+		{"", true, true},
+		{"group=Kitchen", true, false},
+		{"group!=Kitchen", false, true},
+		{"location=Home,group=Lounge", false, true},
+		{"group=Kitchen|group=Lounge", true, true},
+		{"(group=Kitchen|group=Lounge),power=on", true, false},
+		{"!controlled", true, false},
+		{"controlled", false, true},
+		{"!(group=Kitchen,power)", false, true},
+		{"name=Kitchen*", true, false},
+		{"name~lamp$", false, false},
+		{"name~(?i)lamp$", false, true},
+		{"name!~^Kitchen", false, true},
+		{"brightness>=60%", false, true},
+		{"brightness<40000", true, false},
+		{"brightness=40%..60%", true, false},
+		{"kelvin=2500..3000", true, false},
+		{"kelvin!=2500..3000", false, true},
+		{"capability=color", true, false},
+		{"capability!=color", false, true},
+		{"product=LIFX*", true, false},
+		{"product!=LIFX*", false, true},
+		{`name="Kitchen Ceiling"`, true, false},
+		{"group = Kitchen , power = on", true, false},
+	}
+
+	for _, test := range tests {
+		node, err := Parse(test.filter)
+		if err != nil {
+			t.Fatalf("%s: %s", test.filter, err)
+		}
+		if got := node.Match(kitchen); got != test.kitchen {
+			t.Fatalf("%s: expected kitchen %t, got: %t", test.filter, test.kitchen, got)
+		}
+		if got := node.Match(lounge); got != test.lounge {
+			t.Fatalf("%s: expected lounge %t, got: %t", test.filter, test.lounge, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		pos    int
+	}{
+		{"colour=red", 0},
+		{"group", 5},
+		{"group>Kitchen", 6},
+		{"power=maybe", 6},
+		{"kelvin=50%", 7},
+		{"brightness=lots", 11},
+		{"kelvin=4000..2700", 7},
+		{"name~(", 5},
+		{"(group=Kitchen", 14},
+		{"group=Kitchen)", 13},
+		{"group=Kitchen,", 14},
+		{`name="Kitchen`, 5},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.filter)
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.filter)
+		}
+		fe, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: expected *Error, got: %T", test.filter, err)
+		}
+		if fe.Pos != test.pos {
+			t.Fatalf("%s: expected position %d, got: %d (%s)", test.filter, test.pos, fe.Pos, err)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	node, err := Parse("(group=Kitchen|group=Lounge),!controlled,name=\"a,b\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `(group=Kitchen|group=Lounge),!controlled,name="a,b"`
+	if node.String() != expected {
+		t.Fatalf("expected %s, got: %s", expected, node.String())
+	}
+}
@@ -0,0 +1,319 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error is a filter which can't be parsed, Pos is the byte offset of the problem
+type Error struct {
+	Filter string
+	Pos    int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Pos, e.Msg)
+}
+
+// Parse parses a bulb filter, an empty filter matches everything
+func Parse(filter string) (Node, error) {
+	return ParseFields(filter, BulbFields)
+}
+
+// ParseFields parses a filter over the given fields
+func ParseFields(filter string, fields map[string]Field) (Node, error) {
+	p := &parser{s: filter, fields: fields}
+	p.skipSpace()
+	if p.eof() {
+		return All{}, nil
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	return node, nil
+}
+
+type parser struct {
+	s      string
+	pos    int
+	fields map[string]Field
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &Error{Filter: p.s, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) peek(c byte) bool {
+	return !p.eof() && p.s[p.pos] == c
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) parseOr() (Node, error) {
+	var nodes Or
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		p.skipSpace()
+		if !p.peek('|') {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *parser) parseAnd() (Node, error) {
+	var nodes And
+	for {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		p.skipSpace()
+		if !p.peek(',') {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.errorf("expected a term")
+	}
+	switch p.s[p.pos] {
+	case '!':
+		p.pos++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Node: node}, nil
+	case '(':
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.peek(')') {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return node, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	start := p.pos
+	for !p.eof() && isFieldByte(p.s[p.pos]) {
+		p.pos++
+	}
+	name := p.s[start:p.pos]
+	if name == "" {
+		return nil, p.errorf("expected a field name")
+	}
+	field, ok := p.fields[name]
+	if !ok {
+		p.pos = start
+		return nil, p.errorf("unknown field %q", name)
+	}
+
+	c := &Compare{Field: name, Kind: field.Kind}
+	p.skipSpace()
+	for _, op := range operators {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			c.Op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if c.Op == "" {
+		// a bare field is shorthand for field=true
+		if field.Kind != Bool {
+			return nil, p.errorf("%s is a %s field and needs an operator", name, field.Kind)
+		}
+		c.Op = OpEqual
+		c.truth = true
+		return c, nil
+	}
+
+	p.skipSpace()
+	valuePos := p.pos
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	c.Value = value
+
+	err = c.compile(field)
+	if err != nil {
+		return nil, &Error{Filter: p.s, Pos: valuePos, Msg: err.Error()}
+	}
+	return c, nil
+}
+
+func isFieldByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseValue reads a quoted string, or everything up to the next , | or )
+// which isn't inside brackets opened in the value, so regexps mostly need no quoting
+func (p *parser) parseValue() (string, error) {
+	if p.peek('"') {
+		start := p.pos
+		p.pos++
+		for !p.eof() && p.s[p.pos] != '"' {
+			if p.s[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.eof() {
+			p.pos = start
+			return "", p.errorf("unterminated quote")
+		}
+		p.pos++
+		v, err := strconv.Unquote(p.s[start:p.pos])
+		if err != nil {
+			p.pos = start
+			return "", p.errorf("bad quoted value")
+		}
+		return v, nil
+	}
+
+	var b strings.Builder
+	depth := 0
+	for !p.eof() {
+		c := p.s[p.pos]
+		if depth == 0 && (c == ',' || c == '|' || c == ')') {
+			break
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+		}
+		if c == '\\' && p.pos+1 < len(p.s) {
+			p.pos++
+			c = p.s[p.pos]
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return strings.TrimRight(b.String(), " "), nil
+}
+
+// compile checks the operator suits the field and parses the value
+func (c *Compare) compile(field Field) error {
+	switch field.Kind {
+	case String, Set:
+		switch c.Op {
+		case OpEqual, OpNotEqual:
+			if strings.ContainsAny(c.Value, "*?[") {
+				if _, err := pathMatch(c.Value); err != nil {
+					return fmt.Errorf("bad glob %q", c.Value)
+				}
+				c.glob = true
+			}
+		case OpMatch, OpNotMatch:
+			re, err := regexp.Compile(c.Value)
+			if err != nil {
+				return fmt.Errorf("bad regexp: %s", err)
+			}
+			c.regexp = re
+		default:
+			return fmt.Errorf("%s can't be compared with %s", c.Field, c.Op)
+		}
+	case Bool:
+		if c.Op != OpEqual && c.Op != OpNotEqual {
+			return fmt.Errorf("%s can't be compared with %s", c.Field, c.Op)
+		}
+		switch strings.ToLower(c.Value) {
+		case "on", "true", "yes", "1":
+			c.truth = true
+		case "off", "false", "no", "0":
+			c.truth = false
+		default:
+			return fmt.Errorf("%s is on or off, not %q", c.Field, c.Value)
+		}
+	case Number:
+		if c.Op == OpMatch || c.Op == OpNotMatch {
+			return fmt.Errorf("%s can't be compared with %s", c.Field, c.Op)
+		}
+		if i := strings.Index(c.Value, ".."); i >= 0 {
+			if c.Op != OpEqual && c.Op != OpNotEqual {
+				return fmt.Errorf("ranges only work with = and !=")
+			}
+			low, err := parseNumber(c.Value[:i], field)
+			if err != nil {
+				return err
+			}
+			high, err := parseNumber(c.Value[i+2:], field)
+			if err != nil {
+				return err
+			}
+			if low > high {
+				return fmt.Errorf("range %s is backwards", c.Value)
+			}
+			c.number, c.high, c.ranged = low, high, true
+			return nil
+		}
+		n, err := parseNumber(c.Value, field)
+		if err != nil {
+			return err
+		}
+		c.number = n
+	}
+	return nil
+}
+
+func parseNumber(s string, field Field) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		if field.Percent == 0 {
+			return 0, fmt.Errorf("percentages don't make sense here")
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad percentage %q", s)
+		}
+		return math.Round(n / 100 * field.Percent), nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", s)
+	}
+	return n, nil
+}
@@ -4,6 +4,13 @@ go 1.13
 
 require (
 	github.com/davecgh/go-spew v1.1.1
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/gocraft/web v0.0.0-20190207150652-9707327fb69b
+	github.com/gorilla/websocket v1.2.0
+	github.com/prometheus/client_golang v1.7.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
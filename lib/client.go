@@ -2,13 +2,13 @@ package lifx
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"reflect"
 	"sync"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -22,6 +22,10 @@ const (
 	bulbOn  uint16 = 1
 )
 
+// ErrNoGateway is returned for commands which no gateway found by discovery
+// can carry, they aren't sent
+var ErrNoGateway = errors.New("no gateway to send through")
+
 var emptyAddr = [6]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
 
 // StateHandler this is called when there is a change in the state of a bulb
@@ -39,6 +43,15 @@ type Bulb struct {
 	location string
 	group    string
 	lux      float32
+	vendor   uint32
+	product  uint32
+	signal   float32
+	firmware uint32
+	ip       string
+
+	// the colours of a multizone bulb's zones, and which it has told us
+	zones     []HSBK
+	zonesSeen []bool
 }
 
 func (b *Bulb) GetLocation() string {
@@ -53,14 +66,65 @@ func (b *Bulb) GetLux() float32 {
 	return b.lux
 }
 
+// GetProduct returns what kind of bulb this is, once it has told us
+func (b *Bulb) GetProduct() *Product {
+	return LookupProduct(b.vendor, b.product)
+}
+
+// GetRSSI returns the bulb's wifi signal strength in dBm, once it has told us
+func (b *Bulb) GetRSSI() (int, bool) {
+	if b.signal <= 0 {
+		return 0, false
+	}
+	return int(math.Floor(10*math.Log10(float64(b.signal)) + 0.5)), true
+}
+
+// GetFirmware returns the bulb's firmware version as major.minor, once it
+// has told us
+func (b *Bulb) GetFirmware() string {
+	if b.firmware == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", b.firmware>>16, b.firmware&0xffff)
+}
+
+// GetIP returns the address the bulb's state last came from
+func (b *Bulb) GetIP() string {
+	return b.ip
+}
+
+// HasState reports whether the bulb has reported its state yet, GetState
+// can't be used until it has
+func (b *Bulb) HasState() bool {
+	return b.bulbState != nil
+}
+
 func (b *Bulb) LastSeen() time.Time {
 	return b.lastSeen
 }
 
+// SetLastSeen sets when a bulb built with NewBulbWithState was last heard
+// from
+func (b *Bulb) SetLastSeen(t time.Time) {
+	b.lastSeen = t
+}
+
 func newBulb(lifxAddress [6]byte) *Bulb {
 	return &Bulb{LifxAddress: lifxAddress}
 }
 
+// NewBulbWithState builds a Bulb which isn't attached to the network, for
+// simulators and tests which need a bulb in a known state
+func NewBulbWithState(lifxAddress [6]byte, label string, group string, location string, state BulbState) *Bulb {
+	b := newBulb(lifxAddress)
+	b.lastLightState = &lightStateCommand{}
+	copy(b.lastLightState.Payload.BulbLabel[:], label)
+	b.bulbState = &state
+	b.group = group
+	b.location = location
+	return b
+}
+
 // GetState Get a *snapshot* of the state for the bulb
 func (b *Bulb) GetState() BulbState {
 	return *b.bulbState
@@ -93,7 +157,6 @@ func (b *Bulb) String() string {
 
 // SetStateHandler add a handler which is invoked each time a state change comes through
 func (b *Bulb) SetStateHandler(handler StateHandler) {
-	//log.Printf("bulb %s", b)
 	b.stateHandler = handler
 }
 
@@ -171,8 +234,6 @@ func (g *Gateway) GetSite() string {
 }
 
 func newGateway(client *Client, lifxAddress [6]byte, hostAddress string, port uint16, site [6]byte) *Gateway {
-	buf := make([]byte, 1024)
-
 	// can we connect to the gw
 	addr, err := net.ResolveUDPAddr("udp4", hostAddress)
 
@@ -187,50 +248,54 @@ func newGateway(client *Client, lifxAddress [6]byte, hostAddress string, port ui
 		return nil
 	}
 
-	go func() {
-		for {
-			n, addr, err := socket.ReadFrom(buf)
-
-			if err != nil {
-				log.Fatalf("Woops %s", err)
-			}
-
-			//log.Printf("Received buffer from %+v of %x", addr, buf[:n])
+	g := &Gateway{
+		client:      client,
+		lifxAddress: lifxAddress,
+		hostAddress: hostAddress,
+		Port:        port,
+		Site:        site,
+		Socket:      socket,
+	}
+	go g.read()
+	return g
+}
 
-			cmd, err := decodeCommand(buf[:n])
+// read dispatches the packets the gateway sends until its socket fails,
+// when the gateway is dropped to be found again by discovery
+func (g *Gateway) read() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := g.Socket.ReadFrom(buf)
 
-			if err != nil {
-				//log.Printf("Error processing command: %v", err)
-				continue
-			}
-			//log.Printf("Recieved command: %s", reflect.TypeOf(cmd))
+		if err != nil {
+			g.Socket.Close()
+			g.client.error(fmt.Errorf("gateway %s: %s", g.hostAddress, err))
+			g.client.commandCh <- &cmdEvent{nil, &gatewayClosed{g}}
+			return
+		}
 
-			// dispatch a cmdEvent
-			client.commandCh <- &cmdEvent{
-				addr,
-				cmd,
-			}
+		cmd := g.client.decode(buf[:n])
 
+		if cmd == nil {
+			continue
 		}
-	}()
 
-	return &Gateway{
-		lifxAddress: lifxAddress,
-		hostAddress: hostAddress,
-		Port:        port,
-		Site:        site,
-		Socket:      socket,
+		// dispatch a cmdEvent
+		g.client.commandCh <- &cmdEvent{
+			addr,
+			cmd,
+		}
 	}
 }
 
 func (g *Gateway) sendTo(cmd command) error {
-	_, err := cmd.WriteTo(g.Socket)
+	err := cmd.encode(g.Socket)
 
 	if err != nil {
 		return err
 	}
-
-	//log.Printf("Sent command to gateway %s: %s", g.hostAddress, reflect.TypeOf(cmd))
+	g.client.Metrics.PacketSent(cmd.header().PacketType)
+	g.client.traceWire("sent packet", cmd, "gateway", g.hostAddress)
 
 	return nil
 }
@@ -264,50 +329,123 @@ type cmdEvent struct {
 	cmd  interface{}
 }
 
+// gatewayClosed is dispatched when a gateway's socket fails
+type gatewayClosed struct {
+	gateway *Gateway
+}
+
 // Client holds all the state and connections for the lifx client.
 type Client struct {
-	gateways      []*Gateway
-	bulbs         []*Bulb
-	intervalID    int
-	DiscoInterval int
+	gateways   []*Gateway
+	bulbs      []*Bulb
+	intervalID int
+
+	// DiscoveryInterval is how often discovery is broadcast, each gateway
+	// that answers is asked for its bulbs' state so it's also how often
+	// bulbs are seen
+	DiscoveryInterval time.Duration
+
+	// VisibilityTimeout is how long a bulb can go unseen before it is
+	// reported to subscribers as no longer visible, it should be a few
+	// DiscoveryIntervals
+	VisibilityTimeout time.Duration
+
+	// ListenIP is the local address discovery listens on, by default every
+	// interface. Set it and BroadcastIP to discover bulbs on one network
+	// when the host is on several.
+	ListenIP net.IP
+
+	// BroadcastIP is where discovery is broadcast, by default
+	// 255.255.255.255
+	BroadcastIP net.IP
+
+	// Rate is the most packets a second sent to bulbs, and DeviceRate the
+	// most commands a second sent to any one bulb. Commands beyond them wait
+	// their turn, zero is unlimited.
+	Rate       float64
+	DeviceRate float64
+
+	// Metrics is told about packets sent and received, by default nothing
+	Metrics Metrics
+
+	// Logger is where the client logs, by default the standard logrus
+	// logger
+	Logger Logger
+
+	// TraceWire logs every packet sent and received with its payload, at
+	// trace level if the Logger has one and debug otherwise
+	TraceWire bool
+
+	// OnError is called with errors from the client's goroutines, such as
+	// a socket failing, which have nowhere to be returned. By default
+	// they're logged.
+	OnError func(err error)
 
 	peerSocket  net.Conn
 	bcastSocket *net.UDPConn
-	discoTicker *time.Ticker
+	discoTicker Ticker
+	clock       Clock
 	commandCh   chan *cmdEvent
 	subs        []*Sub
+	pending     pendingRequests
+	health      health
+	scheduler   *scheduler
 
 	tags      map[uint64][]byte // the tags known to the client
 	tagsMutex sync.RWMutex      // mutex for locking the tags map
+
+	gatewaysMutex sync.RWMutex // guards gateways, which discovery adds to
 }
 
 // NewClient make a new lifx client
 func NewClient() *Client {
-	return &Client{commandCh: make(chan *cmdEvent)}
+	return NewClientWithClock(RealClock)
+}
+
+// NewClientWithClock make a new lifx client which takes its time from clock
+func NewClientWithClock(clock Clock) *Client {
+	c := &Client{
+		commandCh:         make(chan *cmdEvent),
+		clock:             clock,
+		DiscoveryInterval: 3 * time.Second,
+		VisibilityTimeout: 10 * time.Second,
+		Rate:              DefaultRate,
+		DeviceRate:        DefaultDeviceRate,
+		Metrics:           nopMetrics{},
+		Logger:            defaultLogger(),
+	}
+	c.scheduler = newScheduler(c)
+	return c
+}
+
+// Clock returns the clock the client is using
+func (c *Client) Clock() Clock {
+	return c.clock
 }
 
 // StartDiscovery Begin searching for lifx globes on the local LAN
 func (c *Client) StartDiscovery() (err error) {
-	//log.Printf("Listening for bcast :%d", BroadcastPort)
-
 	// this socket will recieve broadcast packets on this socket
-	c.bcastSocket, err = net.ListenUDP("udp4", &net.UDPAddr{Port: BroadcastPort})
+	c.bcastSocket, err = net.ListenUDP("udp4", &net.UDPAddr{IP: c.ListenIP, Port: BroadcastPort})
 
 	if err != nil {
 		return
 	}
 
-	c.discoTicker = time.NewTicker(time.Second * 3)
+	c.health.set(func(h *health) { h.listening = true })
+
+	c.discoTicker = c.clock.NewTicker(c.DiscoveryInterval)
 
 	// once you pop you can't stop
 	go c.startMainEventLoop()
+	go c.scheduler.run()
 
 	// once you pop you can't stop
 	go func() {
 
-		c.sendDiscovery(time.Now())
+		c.sendDiscovery(c.clock.Now())
 
-		for t := range c.discoTicker.C {
+		for t := range c.discoTicker.C() {
 			c.sendDiscovery(t)
 		}
 
@@ -338,23 +476,37 @@ func (c *Client) LightsColour(hue uint16, sat uint16, lum uint16, kelvin uint16,
 
 // LightOn turn on a bulb
 func (c *Client) LightOn(bulb *Bulb) error {
-	cmd := newSetPowerStateCommand(bulbOn)
-
-	return c.sendTo(bulb, cmd)
+	return c.SetPower(bulb, PriorityNormal, true)
 }
 
 // LightOff turn off a bulb
 func (c *Client) LightOff(bulb *Bulb) error {
-	cmd := newSetPowerStateCommand(bulbOff)
-
-	return c.sendTo(bulb, cmd)
+	return c.SetPower(bulb, PriorityNormal, false)
 }
 
 // LightColour change the color of a bulb
 func (c *Client) LightColour(bulb *Bulb, hue uint16, sat uint16, lum uint16, kelvin uint16, timing uint32) error {
+	return c.SetColour(bulb, PriorityNormal, hue, sat, lum, kelvin, timing)
+}
+
+// SetPower turns a bulb on or off, sent ahead of anything less urgent
+// waiting to be sent
+func (c *Client) SetPower(bulb *Bulb, p Priority, on bool) error {
+	onoff := bulbOff
+	if on {
+		onoff = bulbOn
+	}
+	cmd := newSetPowerStateCommand(onoff)
+
+	return c.send(bulb, cmd, p)
+}
+
+// SetColour changes the colour of a bulb, sent ahead of anything less
+// urgent waiting to be sent
+func (c *Client) SetColour(bulb *Bulb, p Priority, hue uint16, sat uint16, lum uint16, kelvin uint16, timing uint32) error {
 	cmd := newSetLightColour(hue, sat, lum, kelvin, timing)
 
-	return c.sendTo(bulb, cmd)
+	return c.send(bulb, cmd, p)
 }
 
 // GetBulbs get a list of the bulbs found by the client
@@ -362,30 +514,49 @@ func (c *Client) GetBulbs() []*Bulb {
 	return c.bulbs
 }
 
-// GetBulbState send a notification to the bulb to emit it's current state
+// GetBulbState send a notification to the bulb to emit it's current state,
+// and a multizone bulb the colours of its zones
 func (c *Client) GetBulbState(bulb *Bulb) error {
-	log.Printf("GetBulbState sent to %s", bulb.GetLifxAddress())
 	cmd := newGetLightStateCommandFromBulb(bulb.LifxAddress)
-	return c.sendTo(bulb, cmd)
+	err := c.sendTo(bulb, cmd)
+	if err != nil || !bulb.isMultizone() {
+		return err
+	}
+	return c.GetColorZones(bulb)
 }
 
 // GetLocation send a notification to the bulb to emit the current location
 func (c *Client) GetLocation(bulb *Bulb) error {
-	log.Printf("GetLocation sent to %s", bulb.GetLifxAddress())
 	cmd := newGetLocationCommandFromBulb(bulb.LifxAddress)
 	return c.sendTo(bulb, cmd)
 }
 
 // GetGroup send a notification to the bulb to emit the current group
 func (c *Client) GetGroup(bulb *Bulb) error {
-	log.Printf("GetGroup sent to %s", bulb.GetLifxAddress())
 	cmd := newGetGroupCommandFromBulb(bulb.LifxAddress)
 	return c.sendTo(bulb, cmd)
 }
 
+// GetVersion send a notification to the bulb to emit its vendor and product
+func (c *Client) GetVersion(bulb *Bulb) error {
+	cmd := newGetVersionCommandFromBulb(bulb.LifxAddress)
+	return c.sendTo(bulb, cmd)
+}
+
+// GetWifiInfo send a notification to the bulb to emit its wifi signal strength
+func (c *Client) GetWifiInfo(bulb *Bulb) error {
+	cmd := newGetWifiInfoCommandFromBulb(bulb.LifxAddress)
+	return c.sendTo(bulb, cmd)
+}
+
+// GetHostFirmware send a notification to the bulb to emit its firmware version
+func (c *Client) GetHostFirmware(bulb *Bulb) error {
+	cmd := newGetHostFirmwareCommandFromBulb(bulb.LifxAddress)
+	return c.sendTo(bulb, cmd)
+}
+
 // GetAmbientLight send a notification to the bulb to emit the current ambient light
 func (c *Client) GetAmbientLight(bulb *Bulb) error {
-	log.Printf("GetAmbientLight sent to %s", bulb.GetLifxAddress())
 	cmd := newGetAmbientLightCommandFromBulb(bulb.LifxAddress)
 	return c.sendTo(bulb, cmd)
 }
@@ -419,34 +590,66 @@ func (c *Client) Tags() map[uint64][]byte {
 	return tags
 }
 
+// sendTo queues a request for the bulb's state behind any changes
 func (c *Client) sendTo(bulb *Bulb, cmd command) error {
-	log.WithFields(log.Fields{
-		"bulb": bulb,
-		"cmd":  cmd,
-	}).Debug("sending command")
+	return c.send(bulb, cmd, PriorityBackground)
+}
+
+// send queues cmd for the bulb, it goes out as soon as the rates allow.
+// ErrNoGateway is returned when nothing could carry it, errors writing it
+// are reported to OnError.
+func (c *Client) send(bulb *Bulb, cmd command, p Priority) error {
+	if len(c.gatewaysFor(bulb.LifxAddress)) == 0 {
+		return ErrNoGateway
+	}
 	cmd.SetLifxAddr(bulb.LifxAddress) // ensure the message is addressed to the correct bulb
+	c.scheduler.schedule(bulb.LifxAddress, cmd, p)
+	return nil
+}
+
+func (c *Client) sendToAll(cmd command) error {
+	if len(c.gatewaysFor(broadcastTarget)) == 0 {
+		return ErrNoGateway
+	}
+	c.scheduler.schedule(broadcastTarget, cmd, PriorityNormal)
+	return nil
+}
+
+// transmit writes a queued command through the gateways which reach its
+// target, returning how many packets were written
+func (c *Client) transmit(q *queuedCommand) int {
+	cmd := q.cmd
+	packetType := cmd.header().PacketType
+	if q.target != broadcastTarget {
+		c.Logger.Debug("sending command", "bulb", fmt.Sprintf("%x", q.target), "packet", PacketName(packetType))
+		c.pending.sent(q.target, packetType, c.clock.Now(), c.VisibilityTimeout)
+	}
 
-	for _, gw := range c.gateways {
-		//log.Printf("sending command to %s", gw.hostAddress)
+	gateways := c.gatewaysFor(q.target)
+	for _, gw := range gateways {
 		cmd.SetSiteAddr(gw.Site) // update the site address for each gateway
 		err := gw.sendTo(cmd)
 		if err != nil {
-			return err
+			c.error(fmt.Errorf("gateway %s: %s", gw.hostAddress, err))
 		}
 	}
-	return nil
+	return len(gateways)
 }
 
-func (c *Client) sendToAll(cmd command) error {
-	for _, gw := range c.gateways {
-		//log.Printf("sending command to %s", gw.hostAddress)
-		cmd.SetSiteAddr(gw.Site) // update the site address so all globes change
-		err := gw.sendTo(cmd)
-		if err != nil {
-			return err
+// gatewaysFor returns the target's own gateway when it is one, as every
+// bulb speaking the current protocol is, and otherwise every gateway
+func (c *Client) gatewaysFor(target [6]byte) []*Gateway {
+	c.gatewaysMutex.RLock()
+	defer c.gatewaysMutex.RUnlock()
+
+	if target != broadcastTarget {
+		for _, gw := range c.gateways {
+			if gw.lifxAddress == target {
+				return []*Gateway{gw}
+			}
 		}
 	}
-	return nil
+	return append([]*Gateway(nil), c.gateways...)
 }
 
 // This function handles all response messages and dispatches events subscribers
@@ -459,18 +662,18 @@ func (c *Client) startMainEventLoop() {
 		n, addr, err := c.bcastSocket.ReadFrom(buf)
 
 		if err != nil {
-			log.Fatalf("Woops %s", err)
+			// without the broadcast socket nothing new will be found,
+			// Health shows it's no longer listening
+			c.health.set(func(h *health) { h.listening = false })
+			c.error(fmt.Errorf("broadcast socket: %s", err))
+			return
 		}
 
-		//log.Printf("Received buffer from %+v of %x", addr, buf[:n])
-
-		cmd, err := decodeCommand(buf[:n])
+		cmd := c.decode(buf[:n])
 
-		if err != nil {
-			//log.Printf("Error processing command: %v", err)
+		if cmd == nil {
 			continue
 		}
-		//log.Printf("Recieved command: %s", reflect.TypeOf(cmd))
 
 		// dispatch a cmdEvent
 		c.commandCh <- &cmdEvent{
@@ -481,17 +684,46 @@ func (c *Client) startMainEventLoop() {
 	}
 }
 
+// decode decodes a packet, telling Metrics about it and about the request
+// it answers, returns nil for packets we can't or don't handle
+func (c *Client) decode(buf []byte) command {
+	cmd, err := decodeCommand(buf)
+
+	if err != nil {
+		if unknown, ok := err.(*unknownPacketError); ok {
+			c.Metrics.PacketReceived(unknown.PacketType)
+		} else {
+			c.Metrics.DecodeError()
+			c.Logger.Debug("can't decode packet", "error", err)
+		}
+		return nil
+	}
+	c.traceWire("received packet", cmd)
+
+	now := c.clock.Now()
+	c.health.set(func(h *health) { h.lastPacket = now })
+
+	h := cmd.header()
+	c.Metrics.PacketReceived(h.PacketType)
+	if r, ok := c.pending.received(h.TargetMacAddress, h.PacketType); ok {
+		c.Metrics.ResponseLatency(r.requestType, c.clock.Since(r.sent))
+	}
+	return cmd
+}
+
 func (c *Client) readCommands() {
 	for {
 		select {
 		case cmde := <-c.commandCh:
 			c.processCommandEvent(cmde)
 			c.checkExpired()
-		case <-time.After(10 * time.Second):
+		case <-c.clock.After(c.VisibilityTimeout):
 			// the read from command channel has timed out
 			// this happens if all gateway(s) are offline
 			c.checkExpired()
 		}
+		now := c.clock.Now()
+		c.health.set(func(h *health) { h.lastTick = now })
 
 	}
 
@@ -512,6 +744,10 @@ func (c *Client) processCommandEvent(cmde *cmdEvent) {
 		// found a bulb
 		bulb := c.GetBulb(cmd.Header.TargetMacAddress)
 		bulb.lastLightState = cmd
+		bulb.lastSeen = c.clock.Now()
+		if addr, ok := cmde.addr.(*net.UDPAddr); ok {
+			bulb.ip = addr.IP.String()
+		}
 
 		bulb.bulbState = newBulbState(cmd.Payload.Hue, cmd.Payload.Saturation, cmd.Payload.Brightness, cmd.Payload.Kelvin, cmd.Payload.Dim, cmd.Payload.Power, true)
 
@@ -527,6 +763,21 @@ func (c *Client) processCommandEvent(cmde *cmdEvent) {
 	case *groupCommand:
 		c.updateGroup(cmd.Header.TargetMacAddress, cmd.Payload.Label)
 
+	case *versionCommand:
+		c.updateVersion(cmd.Header.TargetMacAddress, cmd.Payload.Vendor, cmd.Payload.Product)
+
+	case *wifiInfoCommand:
+		c.updateWifiInfo(cmd.Header.TargetMacAddress, cmd.Payload.Signal)
+
+	case *hostFirmwareCommand:
+		c.updateHostFirmware(cmd.Header.TargetMacAddress, cmd.Payload.Version)
+
+	case *stateZoneCommand:
+		c.updateZones(cmd.Header.TargetMacAddress, cmd.Payload.Count, cmd.Payload.Index, []HSBK{cmd.Payload.Colour})
+
+	case *stateMultiZoneCommand:
+		c.updateZones(cmd.Header.TargetMacAddress, cmd.Payload.Count, cmd.Payload.Index, cmd.Payload.Colours[:])
+
 	case *ambientStateCommand:
 		c.updateAmbientLightState(cmd.Header.TargetMacAddress, cmd.Payload.Lux)
 
@@ -536,22 +787,26 @@ func (c *Client) processCommandEvent(cmde *cmdEvent) {
 	case *tagLabelsCommand:
 		c.updateTagLabels(cmd.Payload.Tags, cmd.Payload.Label)
 
+	case *gatewayClosed:
+		c.removeGateway(cmd.gateway)
+
 	default:
-		log.Printf("Recieved command: %s", reflect.TypeOf(cmd))
+		c.Logger.Debug("unhandled packet", "type", reflect.TypeOf(cmd).String())
 	}
 }
 
 func (c *Client) checkExpired() {
-	// /log.Printf("Check expired devices")
-
 	for _, bulb := range c.bulbs {
-		if time.Now().Sub(bulb.lastSeen) > 10*time.Second {
+		if bulb.bulbState == nil {
+			continue
+		}
+		if c.clock.Since(bulb.lastSeen) > c.VisibilityTimeout {
 			if bulb.GetState().Visible {
-				//log.Printf("notifying bulb %s offline", bulb.GetLifxAddress())
 				bulb.bulbState.Visible = false
 				if bulb.stateHandler != nil {
 					bulb.stateHandler(bulb.bulbState)
 				}
+				go c.notifySubsBulbNew(bulb)
 			}
 		}
 	}
@@ -559,27 +814,38 @@ func (c *Client) checkExpired() {
 }
 
 func (c *Client) sendDiscovery(t time.Time) {
-	//log.Println("Discovery packet sent at", t)
-
 	remoteAddr := &net.UDPAddr{
 		IP:   net.IPv4(255, 255, 255, 255),
 		Port: BroadcastPort,
 	}
+	if c.BroadcastIP != nil {
+		remoteAddr.IP = c.BroadcastIP
+	}
 
 	p := newPacketHeader(PktGetPANgateway)
-	_, _ = p.EncodeToUDP(c.bcastSocket, remoteAddr)
-
-	//log.Printf("Bcast sent %d", n)
-
-	//log.Printf("gateways %v", c.gateways)
-	//log.Printf("bulbs %v", c.bulbs)
+	_, err := p.EncodeToUDP(c.bcastSocket, remoteAddr)
+	if err == nil {
+		c.Metrics.PacketSent(PktGetPANgateway)
+		c.health.set(func(h *health) { h.lastDiscovery = t })
+	}
+}
 
+// AddGateway adds a gateway which discovery can't find, such as a bulb on a
+// network broadcasts don't reach, at hostAddress
+func (c *Client) AddGateway(lifxAddress [6]byte, hostAddress string) error {
+	gw := newGateway(c, lifxAddress, hostAddress, PeerPort, [6]byte{})
+	if gw == nil {
+		return fmt.Errorf("can't reach a gateway at %s", hostAddress)
+	}
+	c.addGateway(gw)
+	return nil
 }
 
 func (c *Client) addGateway(gw *Gateway) {
+	c.gatewaysMutex.Lock()
 	if !gatewayInSlice(gw, c.gateways) {
-		log.Printf("Added gw %v", gw)
-		gw.lastSeen = time.Now()
+		c.Logger.Info("found gateway", "address", gw.hostAddress, "site", gw.GetSite())
+		gw.lastSeen = c.clock.Now()
 		c.gateways = append(c.gateways, gw)
 
 		// notify subscribers
@@ -588,22 +854,34 @@ func (c *Client) addGateway(gw *Gateway) {
 	} else {
 		for _, lgw := range c.gateways {
 			if gw.lifxAddress == lgw.lifxAddress && gw.Port == lgw.Port && gw.hostAddress == lgw.hostAddress {
-				gw.lastSeen = time.Now()
-				//log.Printf("update last seen for %v %s", gw.hostAddress, gw.lastSeen)
+				gw.lastSeen = c.clock.Now()
 			}
 		}
 	}
+	c.gatewaysMutex.Unlock()
 
 	gw.findBulbs()
 }
 
+// removeGateway forgets a gateway whose socket has failed
+func (c *Client) removeGateway(gw *Gateway) {
+	c.gatewaysMutex.Lock()
+	defer c.gatewaysMutex.Unlock()
+
+	for i, lgw := range c.gateways {
+		if lgw == gw {
+			c.gateways = append(c.gateways[:i], c.gateways[i+1:]...)
+			c.Logger.Warn("lost gateway", "address", gw.hostAddress, "site", gw.GetSite())
+			return
+		}
+	}
+}
+
 func (c *Client) addBulb(bulb *Bulb) {
 	if !bulbInSlice(bulb, c.bulbs) {
-		bulb.lastSeen = time.Now()
+		bulb.lastSeen = c.clock.Now()
 		c.bulbs = append(c.bulbs, bulb)
 
-		// log.Printf("Added bulb %x state %v", bulb.LifxAddress, bulb.bulbState)
-
 		// notify subscribers
 	}
 	go c.notifySubsBulbNew(bulb)
@@ -617,9 +895,9 @@ func (c *Client) addBulb(bulb *Bulb) {
 func (c *Client) updateBulbPowerState(lifxAddress [6]byte, onoff uint16) {
 	for _, b := range c.bulbs {
 		// this needs further investigation
-		if lifxAddress == b.LifxAddress {
+		if lifxAddress == b.LifxAddress && b.bulbState != nil {
 			b.bulbState.Power = onoff
-			// log.Printf("Updated bulb %v", b)
+			b.lastSeen = c.clock.Now()
 
 			// notify subscribers
 			go c.notifySubsBulbNew(b)
@@ -639,6 +917,9 @@ func (c *Client) GetBulb(lifxAddress [6]byte) *Bulb {
 	c.GetGroup(bulb)
 	c.GetLocation(bulb)
 	c.GetAmbientLight(bulb)
+	c.GetVersion(bulb)
+	c.GetWifiInfo(bulb)
+	c.GetHostFirmware(bulb)
 
 	c.addBulb(bulb)
 
@@ -655,6 +936,25 @@ func (c *Client) updateGroup(lifxAddress [6]byte, group [32]byte) {
 	b.group = string(bytes.Trim(group[:], "\x00"))
 }
 
+func (c *Client) updateVersion(lifxAddress [6]byte, vendor uint32, product uint32) {
+	b := c.GetBulb(lifxAddress)
+	b.vendor = vendor
+	b.product = product
+	if b.isMultizone() {
+		c.GetColorZones(b)
+	}
+}
+
+func (c *Client) updateWifiInfo(lifxAddress [6]byte, signal float32) {
+	b := c.GetBulb(lifxAddress)
+	b.signal = signal
+}
+
+func (c *Client) updateHostFirmware(lifxAddress [6]byte, version uint32) {
+	b := c.GetBulb(lifxAddress)
+	b.firmware = version
+}
+
 func (c *Client) updateAmbientLightState(lifxAddress [6]byte, lux float32) {
 	b := c.GetBulb(lifxAddress)
 	b.lux = lux
@@ -0,0 +1,155 @@
+package lifx
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the client, swapping it for a FakeClock
+// makes timeouts and expiry deterministic under test
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, see time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is a Clock backed by the time package
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock is a Clock which only moves when told to
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock    *FakeClock
+	when     time.Time
+	interval time.Duration // zero for one-shot After channels
+	ch       chan time.Time
+}
+
+// NewFakeClock returns a FakeClock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake current time
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Since returns the fake time elapsed since t
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After returns a channel which receives once the clock has been advanced by d
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	w := &fakeWaiter{clock: f, when: f.now.Add(d), ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return w.ch
+}
+
+// NewTicker returns a Ticker which ticks each time the clock passes a multiple of d
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	w := &fakeWaiter{clock: f, when: f.now.Add(d), interval: d, ch: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+// Advance moves the clock forward by d, firing any timers and tickers which
+// fall due in order. Like time.Ticker, ticks are dropped for slow receivers.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool {
+			return f.waiters[i].when.Before(f.waiters[j].when)
+		})
+		if len(f.waiters) == 0 || f.waiters[0].when.After(end) {
+			break
+		}
+
+		w := f.waiters[0]
+		f.now = w.when
+		select {
+		case w.ch <- w.when:
+		default:
+		}
+
+		if w.interval > 0 {
+			w.when = w.when.Add(w.interval)
+		} else {
+			f.waiters = f.waiters[1:]
+		}
+	}
+	f.now = end
+}
+
+// Set jumps the clock to t, firing anything which falls due on the way
+func (f *FakeClock) Set(t time.Time) {
+	f.Advance(t.Sub(f.Now()))
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *fakeWaiter) Stop() {
+	f := w.clock
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, o := range f.waiters {
+		if o == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
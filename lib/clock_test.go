@@ -0,0 +1,50 @@
+package lifx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	ticker := c.NewTicker(time.Second)
+	after := c.After(1500 * time.Millisecond)
+
+	c.Advance(time.Second)
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(start.Add(time.Second)) {
+			t.Fatalf("expected %s, got: %s", start.Add(time.Second), tick)
+		}
+	default:
+		t.Fatal("expected a tick")
+	}
+
+	select {
+	case <-after:
+		t.Fatal("expected After not to have fired yet")
+	default:
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-after:
+	default:
+		t.Fatal("expected After to have fired")
+	}
+
+	ticker.Stop()
+	<-ticker.C()
+	c.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("expected no ticks after Stop")
+	default:
+	}
+
+	if !c.Now().Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("expected %s, got: %s", start.Add(3*time.Second), c.Now())
+	}
+}
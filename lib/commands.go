@@ -5,14 +5,23 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	//"log"
-	//"github.com/davecgh/go-spew/spew"
 )
 
 type command interface {
 	SetSiteAddr(site [6]byte)
 	SetLifxAddr(addr [6]byte)
-	WriteTo(wr io.Writer) (int, error)
+	encode(wr io.Writer) error
+	header() *packetHeader
+}
+
+// unknownPacketError is returned for packets which decoded fine but which
+// we don't handle
+type unknownPacketError struct {
+	PacketType uint16
+}
+
+func (e *unknownPacketError) Error() string {
+	return fmt.Sprintf("Unrecognised type 0x%x", e.PacketType)
 }
 
 func decodeCommand(buf []byte) (command, error) {
@@ -40,9 +49,19 @@ func decodeCommand(buf []byte) (command, error) {
 		return decodeGroupCommand(ph, buf[HeaderLen:])
 	case PktLocation:
 		return decodeLocationCommand(ph, buf[HeaderLen:])
+	case PktStateVersion:
+		return decodeVersionCommand(ph, buf[HeaderLen:])
+	case PktWifiInfo:
+		return decodeWifiInfoCommand(ph, buf[HeaderLen:])
+	case PktHostFirmware:
+		return decodeHostFirmwareCommand(ph, buf[HeaderLen:])
+	case PktStateZone:
+		return decodeStateZoneCommand(ph, buf[HeaderLen:])
+	case PktStateMultiZone:
+		return decodeStateMultiZoneCommand(ph, buf[HeaderLen:])
 	}
 
-	return nil, fmt.Errorf("Unrecognised type 0x%x", ph.PacketType)
+	return nil, &unknownPacketError{ph.PacketType}
 }
 
 type commandPacket struct {
@@ -57,8 +76,13 @@ func (c *commandPacket) SetLifxAddr(addr [6]byte) {
 	c.Header.TargetMacAddress = addr
 }
 
-func (c *commandPacket) WriteTo(wr io.Writer) (int, error) {
-	return writeHeaderOnly(c.Header, wr)
+func (c *commandPacket) encode(wr io.Writer) error {
+	_, err := writeHeaderOnly(c.Header, wr)
+	return err
+}
+
+func (c *commandPacket) header() *packetHeader {
+	return c.Header
 }
 
 // GetPANGatewayCommand 0x02
@@ -86,11 +110,8 @@ func decodePANGatewayCommand(ph *packetHeader, payload []byte) (*panGatewayComma
 	cmd.Header = ph
 
 	// decode payload
-	// log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -139,11 +160,8 @@ func decodeLightStateCommand(ph *packetHeader, payload []byte) (*lightStateComma
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -185,11 +203,8 @@ func decodeAmbientStateCommand(ph *packetHeader, payload []byte) (*ambientStateC
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -224,16 +239,17 @@ func newSetLightColour(hue uint16, sat uint16, lum uint16, kelvin uint16, timing
 	return cmd
 }
 
-func (c *setLightColour) WriteTo(wr io.Writer) (int, error) {
+func (c *setLightColour) encode(wr io.Writer) error {
 	buf := new(bytes.Buffer)
 
 	err := binary.Write(buf, binary.LittleEndian, &c.Payload)
 
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return writeHeaderAndPayload(c.Header, buf.Bytes(), wr)
+	_, err = writeHeaderAndPayload(c.Header, buf.Bytes(), wr)
+	return err
 }
 
 // GetPowerStateCommand 0x14
@@ -273,12 +289,13 @@ func newSetPowerStateCommand(onoff uint16) *setPowerStateCommand {
 	return cmd
 }
 
-func (c *setPowerStateCommand) WriteTo(wr io.Writer) (int, error) {
+func (c *setPowerStateCommand) encode(wr io.Writer) error {
 	buf := []byte{0x0, 0x0}
 
 	binary.BigEndian.PutUint16(buf, c.Payload.OnOff)
 
-	return writeHeaderAndPayload(c.Header, buf, wr)
+	_, err := writeHeaderAndPayload(c.Header, buf, wr)
+	return err
 }
 
 // PowerStateCommand 0x16
@@ -294,11 +311,8 @@ func decodePowerStateCommand(ph *packetHeader, payload []byte) (*powerStateComma
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -329,11 +343,8 @@ func decodeTagsCommand(ph *packetHeader, payload []byte) (*tagsCommand, error) {
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -371,11 +382,8 @@ func decodeTagLabelsCommand(ph *packetHeader, payload []byte) (*tagLabelsCommand
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -420,11 +428,8 @@ func decodeLocationCommand(ph *packetHeader, payload []byte) (*locationCommand,
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
-
 	return cmd, nil
 }
 
@@ -471,10 +476,111 @@ func decodeGroupCommand(ph *packetHeader, payload []byte) (*groupCommand, error)
 	cmd.Header = ph
 
 	// decode payload
-	//log.Printf("payload len : %d", len(payload))
 	decodePayload(payload, &cmd.Payload)
 
-	//log.Printf("Command: \n %s", spew.Sdump(cmd))
+	return cmd, nil
+}
+
+// getVersionCommand 0x20
+type getVersionCommand struct {
+	commandPacket
+}
+
+func newGetVersionCommandFromBulb(lifxAddress [6]byte) *getVersionCommand {
+	ph := newPacketHeader(PktGetVersion)
+	ph.Protocol = 0x1400
+	ph.TargetMacAddress = lifxAddress
+
+	cmd := &getVersionCommand{}
+	cmd.Header = ph
+	return cmd
+}
+
+// versionCommand 0x21
+type versionCommand struct {
+	commandPacket
+	Payload struct {
+		Vendor  uint32
+		Product uint32
+		Version uint32
+	}
+}
+
+func decodeVersionCommand(ph *packetHeader, payload []byte) (*versionCommand, error) {
+	cmd := &versionCommand{}
+	cmd.Header = ph
+
+	decodePayload(payload, &cmd.Payload)
+
+	return cmd, nil
+}
+
+// getWifiInfoCommand 0x10
+type getWifiInfoCommand struct {
+	commandPacket
+}
+
+func newGetWifiInfoCommandFromBulb(lifxAddress [6]byte) *getWifiInfoCommand {
+	ph := newPacketHeader(PktGetWifiInfo)
+	ph.Protocol = 0x1400
+	ph.TargetMacAddress = lifxAddress
+
+	cmd := &getWifiInfoCommand{}
+	cmd.Header = ph
+	return cmd
+}
+
+// wifiInfoCommand 0x11
+type wifiInfoCommand struct {
+	commandPacket
+	Payload struct {
+		Signal   float32
+		Tx       uint32
+		Rx       uint32
+		Reserved int16
+	}
+}
+
+func decodeWifiInfoCommand(ph *packetHeader, payload []byte) (*wifiInfoCommand, error) {
+	cmd := &wifiInfoCommand{}
+	cmd.Header = ph
+
+	decodePayload(payload, &cmd.Payload)
+
+	return cmd, nil
+}
+
+// getHostFirmwareCommand 0x0e
+type getHostFirmwareCommand struct {
+	commandPacket
+}
+
+func newGetHostFirmwareCommandFromBulb(lifxAddress [6]byte) *getHostFirmwareCommand {
+	ph := newPacketHeader(PktGetHostFirmware)
+	ph.Protocol = 0x1400
+	ph.TargetMacAddress = lifxAddress
+
+	cmd := &getHostFirmwareCommand{}
+	cmd.Header = ph
+	return cmd
+}
+
+// hostFirmwareCommand 0x0f, Version is the major version in the high 16
+// bits and the minor in the low
+type hostFirmwareCommand struct {
+	commandPacket
+	Payload struct {
+		Build    uint64
+		Reserved uint64
+		Version  uint32
+	}
+}
+
+func decodeHostFirmwareCommand(ph *packetHeader, payload []byte) (*hostFirmwareCommand, error) {
+	cmd := &hostFirmwareCommand{}
+	cmd.Header = ph
+
+	decodePayload(payload, &cmd.Payload)
 
 	return cmd, nil
 }
@@ -11,13 +11,13 @@ func TestGetPANGatewayCommandWrite(t *testing.T) {
 
 	c := newGetPANGatewayCommand()
 
-	n, err := c.WriteTo(buf)
+	err := c.encode(buf)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if n != HeaderLen {
+	if n := buf.Len(); n != HeaderLen {
 		t.Fatalf("expected %d, got: %d", 36, n)
 	}
 	expBuf := getPANgatewayMsg()
@@ -63,13 +63,13 @@ func TestSetPowerStateCommandWrite(t *testing.T) {
 	//c.SetLifxAddr(addr)
 	c.SetSiteAddr(addr)
 
-	n, err := c.WriteTo(buf)
+	err := c.encode(buf)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if n != 38 {
+	if n := buf.Len(); n != 38 {
 		t.Fatalf("expected %d, got: %d", 38, n)
 	}
 	expBuf := setPowerStateMsg()
@@ -103,3 +103,46 @@ func TestPowerStateCommandDecode(t *testing.T) {
 		t.Fatal("expected panGatewayCommand")
 	}
 }
+
+func TestVersionCommandDecode(t *testing.T) {
+	cmd, err := decodeCommand(stateVersionMsg())
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	switch cmd := cmd.(type) {
+	case *versionCommand:
+		p := LookupProduct(cmd.Payload.Vendor, cmd.Payload.Product)
+		if p == nil || p.ID != 27 {
+			t.Fatalf("expected product %d, got: %v", 27, p)
+		}
+		if !p.HasCapability(CapabilityColor) {
+			t.Fatal("expected a colour bulb")
+		}
+	default:
+		t.Fatal("expected versionCommand")
+	}
+}
+
+func TestHostFirmwareCommandDecode(t *testing.T) {
+	cmd, err := decodeCommand(hostFirmwareMsg())
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	switch cmd := cmd.(type) {
+	case *hostFirmwareCommand:
+		b := newBulb(cmd.Header.TargetMacAddress)
+		if b.GetFirmware() != "" {
+			t.Fatalf("expected no firmware yet, got: %s", b.GetFirmware())
+		}
+		b.firmware = cmd.Payload.Version
+		if b.GetFirmware() != "3.70" {
+			t.Fatalf("expected %s, got: %s", "3.70", b.GetFirmware())
+		}
+	default:
+		t.Fatal("expected hostFirmwareCommand")
+	}
+}
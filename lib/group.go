@@ -0,0 +1,230 @@
+package lifx
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// taggedProtocol marks a packet as for every bulb that hears it
+const taggedProtocol = 0x3400
+
+// GroupColour is the colour one bulb in a group change becomes
+type GroupColour struct {
+	Bulb       *Bulb
+	Hue        uint16
+	Saturation uint16
+	Brightness uint16
+	Kelvin     uint16
+}
+
+// GroupResult is how sending a bulb its part of a group change went
+type GroupResult struct {
+	Bulb *Bulb
+	// Sent is when the bulb's packet was written
+	Sent time.Time
+	// Broadcast is set when a change for every bulb went out as one
+	// broadcast packet rather than one sent to each
+	Broadcast bool
+	// Superseded is set when a newer colour for the bulb was asked for
+	// before its part was sent, so nothing was sent to it
+	Superseded bool
+	Err        error
+}
+
+// groupChange is a colour change for several bulbs which is sent to all of
+// them together, leaving out any bulb whose part has been superseded. all
+// is set when it's for every bulb, found or not, so it can be broadcast.
+type groupChange struct {
+	all        bool
+	colours    []GroupColour
+	timing     uint32
+	commands   []*setLightColour
+	superseded []bool
+	results    chan []GroupResult
+}
+
+// stagedPacket is a bulb's part of a group change encoded ready to write
+type stagedPacket struct {
+	index int
+	gw    *Gateway
+	data  []byte
+}
+
+// SetGroupColour changes the colour of several bulbs over the same
+// transition, so that they change together rather than one after another.
+// Their commands wait until every bulb can take one and are then written
+// back to back. How each bulb's went is sent on the returned channel once
+// they have been written.
+func (c *Client) SetGroupColour(p Priority, timing uint32, colours []GroupColour) <-chan []GroupResult {
+	return c.setGroupColour(p, timing, colours, false)
+}
+
+// SetAllColour changes every bulb on the network to the same colour, those
+// discovery hasn't found included, as one broadcast packet. Without a
+// broadcast socket, or once a newer colour has been asked for any bulb, it
+// is sent to each bulb the client knows like SetGroupColour. The results
+// are for the bulbs the client knows.
+func (c *Client) SetAllColour(p Priority, timing uint32, hue uint16, sat uint16, lum uint16, kelvin uint16) <-chan []GroupResult {
+	var colours []GroupColour
+	for _, bulb := range c.GetBulbs() {
+		colours = append(colours, GroupColour{Bulb: bulb, Hue: hue, Saturation: sat, Brightness: lum, Kelvin: kelvin})
+	}
+	return c.setGroupColour(p, timing, colours, true)
+}
+
+func (c *Client) setGroupColour(p Priority, timing uint32, colours []GroupColour, all bool) <-chan []GroupResult {
+	results := make(chan []GroupResult, 1)
+	if len(colours) == 0 {
+		results <- nil
+		return results
+	}
+
+	g := &groupChange{
+		all:        all,
+		colours:    colours,
+		timing:     timing,
+		superseded: make([]bool, len(colours)),
+		results:    results,
+	}
+	for _, colour := range colours {
+		cmd := newSetLightColour(colour.Hue, colour.Saturation, colour.Brightness, colour.Kelvin, timing)
+		cmd.SetLifxAddr(colour.Bulb.LifxAddress)
+		g.commands = append(g.commands, cmd)
+	}
+	c.scheduler.scheduleGroup(g, p)
+
+	return results
+}
+
+// supersede drops the bulb's part of the change, a newer colour for it
+// having been asked for, reporting whether it had one
+func (g *groupChange) supersede(target [6]byte) bool {
+	found := false
+	for i, colour := range g.colours {
+		if colour.Bulb.LifxAddress == target && !g.superseded[i] {
+			g.superseded[i] = true
+			found = true
+		}
+	}
+	return found
+}
+
+// canBroadcast is whether the change can go out as a single broadcast,
+// which reaches every bulb so only a change meant for all of them can.
+// Once any bulb's part has been superseded a broadcast would undo its newer
+// colour.
+func (c *Client) canBroadcast(g *groupChange) bool {
+	if !g.all || c.bcastSocket == nil {
+		return false
+	}
+	for _, superseded := range g.superseded {
+		if superseded {
+			return false
+		}
+	}
+	return true
+}
+
+// transmitGroup writes a group change and sends how it went to its results,
+// returning how many packets were written
+func (c *Client) transmitGroup(g *groupChange) int {
+	if c.canBroadcast(g) {
+		return c.broadcastGroup(g)
+	}
+
+	results := make([]GroupResult, len(g.colours))
+
+	// encode everything first so nothing slows the writes down
+	var staged []stagedPacket
+	for i, colour := range g.colours {
+		results[i].Bulb = colour.Bulb
+		if g.superseded[i] {
+			results[i].Superseded = true
+			continue
+		}
+		cmd := g.commands[i]
+		for _, gw := range c.gatewaysFor(colour.Bulb.LifxAddress) {
+			cmd.SetSiteAddr(gw.Site)
+			buf := new(bytes.Buffer)
+			err := cmd.encode(buf)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			staged = append(staged, stagedPacket{i, gw, buf.Bytes()})
+		}
+		if len(staged) == 0 || staged[len(staged)-1].index != i {
+			if results[i].Err == nil {
+				results[i].Err = fmt.Errorf("no gateway for %x", colour.Bulb.LifxAddress)
+			}
+		}
+	}
+
+	for _, s := range staged {
+		_, err := s.gw.Socket.Write(s.data)
+		results[s.index].Sent = c.clock.Now()
+		if err != nil {
+			results[s.index].Err = fmt.Errorf("gateway %s: %s", s.gw.hostAddress, err)
+		}
+	}
+
+	for _, s := range staged {
+		cmd := g.commands[s.index]
+		if results[s.index].Err != nil {
+			c.error(results[s.index].Err)
+			continue
+		}
+		c.Logger.Debug("sending command", "bulb", fmt.Sprintf("%x", g.colours[s.index].Bulb.LifxAddress), "packet", PacketName(PktSetLightColour))
+		c.pending.sent(g.colours[s.index].Bulb.LifxAddress, PktSetLightColour, results[s.index].Sent, c.VisibilityTimeout)
+		c.Metrics.PacketSent(PktSetLightColour)
+		c.traceWire("sent packet", cmd, "gateway", s.gw.hostAddress)
+	}
+
+	g.results <- results
+	return len(staged)
+}
+
+// broadcastGroup writes a change for every bulb as one tagged packet to the
+// broadcast address
+func (c *Client) broadcastGroup(g *groupChange) int {
+	first := g.colours[0]
+	cmd := newSetLightColour(first.Hue, first.Saturation, first.Brightness, first.Kelvin, g.timing)
+	cmd.Header.Protocol = taggedProtocol
+
+	remoteAddr := &net.UDPAddr{
+		IP:   net.IPv4(255, 255, 255, 255),
+		Port: BroadcastPort,
+	}
+	if c.BroadcastIP != nil {
+		remoteAddr.IP = c.BroadcastIP
+	}
+	err := cmd.encode(&broadcastWriter{c.bcastSocket, remoteAddr})
+	sent := c.clock.Now()
+	if err != nil {
+		err = fmt.Errorf("broadcast: %s", err)
+		c.error(err)
+	} else {
+		c.Logger.Debug("broadcasting command", "bulbs", len(g.colours), "packet", PacketName(PktSetLightColour))
+		c.Metrics.PacketSent(PktSetLightColour)
+		c.traceWire("sent packet", cmd, "broadcast", remoteAddr.String())
+	}
+
+	results := make([]GroupResult, len(g.colours))
+	for i, colour := range g.colours {
+		results[i] = GroupResult{Bulb: colour.Bulb, Sent: sent, Broadcast: true, Err: err}
+	}
+	g.results <- results
+	return 1
+}
+
+// broadcastWriter writes each packet to addr through socket
+type broadcastWriter struct {
+	socket *net.UDPConn
+	addr   *net.UDPAddr
+}
+
+func (w *broadcastWriter) Write(b []byte) (int, error) {
+	return w.socket.WriteToUDP(b, w.addr)
+}
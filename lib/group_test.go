@@ -0,0 +1,216 @@
+package lifx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readBrightness reads n SetLightColour packets from listener, returning the
+// brightness each bulb was last sent
+func readBrightness(t *testing.T, listener *net.UDPConn, n int) map[[6]byte]uint16 {
+	brightness := make(map[[6]byte]uint16)
+	buf := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < n; i++ {
+		size, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ph, err := decodePacketHeader(buf[:size])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := &setLightColour{}
+		binary.Read(bytes.NewReader(buf[HeaderLen:size]), binary.LittleEndian, &cmd.Payload)
+		brightness[ph.TargetMacAddress] = cmd.Payload.Brightness
+	}
+	return brightness
+}
+
+func TestSetGroupColour(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	l := &recordingLogger{}
+	c.Logger = l
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.Rate = 0
+	c.gateways = append(c.gateways, newGateway(c, [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String(), PeerPort, [6]byte{}))
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	spot := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Spot", "Kitchen", "Home", BulbState{})
+	porch := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x03}, "Porch", "Outside", "Home", BulbState{})
+
+	// the lamp can't take another for 50ms, its waiting change is replaced
+	// by the group's
+	c.LightColour(lamp, 0, 0, 1000, 2700, 0)
+	c.LightColour(lamp, 0, 0, 2000, 2700, 0)
+	results := c.SetGroupColour(PriorityNormal, 10000, []GroupColour{
+		{Bulb: lamp, Brightness: 3000, Kelvin: 2700},
+		{Bulb: spot, Brightness: 4000, Kelvin: 2700},
+	})
+	c.GetBulbState(porch)
+	if m.coalesced[PktSetLightColour] != 1 || m.depth != 1 {
+		t.Fatalf("expected one coalesced and one waiting, got: %d and %d", m.coalesced[PktSetLightColour], m.depth)
+	}
+
+	// the spot waits for the lamp rather than going on ahead
+	select {
+	case r := <-results:
+		t.Fatalf("expected nothing sent yet, got: %+v", r)
+	default:
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	c.scheduler.drain(clock.Now())
+	expected := []string{
+		"d073d5000001 SetLightColour",
+		"d073d5000003 GetLightState",
+		"d073d5000001 SetLightColour",
+		"d073d5000002 SetLightColour",
+	}
+	sent := sentTo(l)
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got: %v", expected, sent)
+	}
+
+	r := <-results
+	if len(r) != 2 || r[0].Bulb != lamp || r[1].Bulb != spot {
+		t.Fatalf("expected a result for each bulb, got: %+v", r)
+	}
+	for _, result := range r {
+		if result.Err != nil || result.Broadcast || !result.Sent.Equal(clock.Now()) {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+	if m.delays[PktSetLightColour] != 50*time.Millisecond {
+		t.Fatalf("expected %s, got: %s", 50*time.Millisecond, m.delays[PktSetLightColour])
+	}
+}
+
+func TestSetGroupColourBroadcast(t *testing.T) {
+	bcast, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bcast.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	c.Logger = &recordingLogger{}
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.bcastSocket = bcast
+	c.BroadcastIP = net.IPv4(127, 0, 0, 1)
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	spot := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Spot", "Kitchen", "Home", BulbState{})
+	c.bulbs = []*Bulb{lamp, spot}
+
+	// a group change is never broadcast, even when it covers every bulb
+	// the client knows, as a broadcast also reaches bulbs it doesn't
+	r := <-c.SetGroupColour(PriorityNormal, 0, []GroupColour{
+		{Bulb: lamp, Brightness: 3000, Kelvin: 2700},
+		{Bulb: spot, Brightness: 3000, Kelvin: 2700},
+	})
+	if r[0].Broadcast || r[0].Err == nil {
+		t.Fatalf("expected no gateway to send through, got: %+v", r[0])
+	}
+
+	clock.Advance(time.Second)
+	r = <-c.SetAllColour(PriorityNormal, 0, 0, 0, 3000, 2700)
+	if len(r) != 2 || !r[0].Broadcast || r[0].Err != nil || r[1].Err != nil {
+		t.Fatalf("expected one broadcast, got: %+v", r)
+	}
+	if m.sent[PktSetLightColour] != 1 {
+		t.Fatalf("expected %d packet, got: %d", 1, m.sent[PktSetLightColour])
+	}
+}
+
+func TestSetGroupColourSuperseded(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	l := &recordingLogger{}
+	c.Logger = l
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.Rate = 0
+	c.gateways = append(c.gateways, newGateway(c, [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String(), PeerPort, [6]byte{}))
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	spot := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Spot", "Kitchen", "Home", BulbState{})
+
+	// the group change waits for the lamp, until somebody asks for the lamp
+	// to be something else and the spot no longer needs to wait
+	c.LightColour(lamp, 0, 0, 1000, 2700, 0)
+	results := c.SetGroupColour(PriorityNormal, 10000, []GroupColour{
+		{Bulb: lamp, Brightness: 3000, Kelvin: 2700},
+		{Bulb: spot, Brightness: 3000, Kelvin: 2700},
+	})
+	c.SetColour(lamp, PriorityUser, 0, 0, 5000, 2700, 0)
+	if m.coalesced[PktSetLightColour] != 1 || m.depth != 1 {
+		t.Fatalf("expected one coalesced and one waiting, got: %d and %d", m.coalesced[PktSetLightColour], m.depth)
+	}
+	r := <-results
+	if len(r) != 2 || !r[0].Superseded || r[1].Superseded || r[1].Err != nil {
+		t.Fatalf("expected only the spot sent its part, got: %+v", r)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	c.scheduler.drain(clock.Now())
+	expected := []string{
+		"d073d5000001 SetLightColour",
+		"d073d5000002 SetLightColour",
+		"d073d5000001 SetLightColour",
+	}
+	if sent := sentTo(l); strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got: %v", expected, sent)
+	}
+	brightness := readBrightness(t, listener, len(expected))
+	if brightness[lamp.LifxAddress] != 5000 || brightness[spot.LifxAddress] != 3000 {
+		t.Fatalf("expected the lamp at 5000 and the spot at 3000, got: %v", brightness)
+	}
+
+	// a change superseded for every bulb is dropped, and a newer group
+	// change supersedes an older one
+	results = c.SetGroupColour(PriorityNormal, 10000, []GroupColour{
+		{Bulb: lamp, Brightness: 6000, Kelvin: 2700},
+		{Bulb: spot, Brightness: 6000, Kelvin: 2700},
+	})
+	newer := c.SetGroupColour(PriorityNormal, 10000, []GroupColour{
+		{Bulb: lamp, Brightness: 7000, Kelvin: 2700},
+		{Bulb: spot, Brightness: 7000, Kelvin: 2700},
+	})
+	r = <-results
+	if len(r) != 2 || !r[0].Superseded || !r[1].Superseded {
+		t.Fatalf("expected both superseded, got: %+v", r)
+	}
+	if m.depth != 1 {
+		t.Fatalf("expected %d waiting, got: %d", 1, m.depth)
+	}
+	clock.Advance(50 * time.Millisecond)
+	c.scheduler.drain(clock.Now())
+	if r = <-newer; r[0].Superseded || r[0].Err != nil {
+		t.Fatalf("expected the newer change sent, got: %+v", r)
+	}
+	brightness = readBrightness(t, listener, 2)
+	if brightness[lamp.LifxAddress] != 7000 || brightness[spot.LifxAddress] != 7000 {
+		t.Fatalf("expected both at 7000, got: %v", brightness)
+	}
+}
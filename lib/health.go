@@ -0,0 +1,60 @@
+package lifx
+
+import (
+	"sync"
+	"time"
+)
+
+// Health is a snapshot of how the client's discovery and event loops are
+// doing
+type Health struct {
+	// Listening is whether the broadcast socket is open
+	Listening bool
+
+	// LastTick is when the event loop last ran, it runs at least every
+	// ten seconds even with nothing to read
+	LastTick time.Time
+
+	// LastDiscovery is when discovery was last broadcast
+	LastDiscovery time.Time
+
+	// LastPacket is when a packet was last received
+	LastPacket time.Time
+
+	Gateways int
+	Bulbs    int
+}
+
+// health is updated by the client's goroutines and read by Health
+type health struct {
+	mutex         sync.Mutex
+	listening     bool
+	lastTick      time.Time
+	lastDiscovery time.Time
+	lastPacket    time.Time
+}
+
+func (h *health) set(update func(h *health)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	update(h)
+}
+
+// Health returns a snapshot of the client's health
+func (c *Client) Health() Health {
+	c.gatewaysMutex.RLock()
+	gateways := len(c.gateways)
+	c.gatewaysMutex.RUnlock()
+
+	c.health.mutex.Lock()
+	defer c.health.mutex.Unlock()
+
+	return Health{
+		Listening:     c.health.listening,
+		LastTick:      c.health.lastTick,
+		LastDiscovery: c.health.lastDiscovery,
+		LastPacket:    c.health.lastPacket,
+		Gateways:      gateways,
+		Bulbs:         len(c.bulbs),
+	}
+}
@@ -0,0 +1,103 @@
+package lifx
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is where the client logs. Each method takes a message followed by
+// alternating keys and values, the same as log/slog, so a *slog.Logger can
+// be used as is
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// tracer is implemented by loggers with a level below debug, wire logging
+// goes there when it's available
+type tracer interface {
+	Trace(msg string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// NopLogger discards everything logged to it
+var NopLogger Logger = nopLogger{}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// LogrusLogger logs to a logrus entry, with the keys and values as fields
+func LogrusLogger(entry *logrus.Entry) Logger {
+	return &logrusLogger{entry}
+}
+
+func (l *logrusLogger) with(args []interface{}) *logrus.Entry {
+	if len(args) == 0 {
+		return l.entry
+	}
+	fields := logrus.Fields{}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			// like slog, a value without a key
+			fields["!BADKEY"] = args[i]
+			break
+		}
+		fields[fmt.Sprint(args[i])] = args[i+1]
+	}
+	return l.entry.WithFields(fields)
+}
+
+func (l *logrusLogger) Trace(msg string, args ...interface{}) { l.with(args).Trace(msg) }
+func (l *logrusLogger) Debug(msg string, args ...interface{}) { l.with(args).Debug(msg) }
+func (l *logrusLogger) Info(msg string, args ...interface{})  { l.with(args).Info(msg) }
+func (l *logrusLogger) Warn(msg string, args ...interface{})  { l.with(args).Warn(msg) }
+func (l *logrusLogger) Error(msg string, args ...interface{}) { l.with(args).Error(msg) }
+
+// traceWire logs a packet sent or received when TraceWire is set, with its
+// payload decoded
+func (c *Client) traceWire(msg string, cmd command, args ...interface{}) {
+	if !c.TraceWire {
+		return
+	}
+	h := cmd.header()
+	args = append(args,
+		"packet", PacketName(h.PacketType),
+		"target", fmt.Sprintf("%x", h.TargetMacAddress),
+		"site", fmt.Sprintf("%x", h.Site),
+	)
+	if payload := reflect.ValueOf(cmd).Elem().FieldByName("Payload"); payload.IsValid() {
+		args = append(args, "payload", fmt.Sprintf("%+v", payload.Interface()))
+	}
+
+	if t, ok := c.Logger.(tracer); ok {
+		t.Trace(msg, args...)
+	} else {
+		c.Logger.Debug(msg, args...)
+	}
+}
+
+// error reports an error from one of the client's goroutines to OnError,
+// or logs it if there's no OnError
+func (c *Client) error(err error) {
+	if c.OnError != nil {
+		c.OnError(err)
+		return
+	}
+	c.Logger.Error("lifx client error", "error", err)
+}
+
+// defaultLogger is the standard logrus logger
+func defaultLogger() Logger {
+	return LogrusLogger(logrus.NewEntry(logrus.StandardLogger()))
+}
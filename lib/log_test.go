@@ -0,0 +1,107 @@
+package lifx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) record(level string, msg string, args []interface{}) {
+	l.lines = append(l.lines, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (l *recordingLogger) Trace(msg string, args ...interface{}) { l.record("trace", msg, args) }
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+
+func TestLogrusLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := logrus.New()
+	l.Out = out
+	l.Formatter = &logrus.JSONFormatter{}
+
+	LogrusLogger(logrus.NewEntry(l)).Info("found gateway", "address", "10.0.0.2:56700", "port", 56700, "odd")
+
+	fields := map[string]interface{}{}
+	err := json.Unmarshal(out.Bytes(), &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields["msg"] != "found gateway" || fields["address"] != "10.0.0.2:56700" || fields["port"] != float64(56700) {
+		t.Fatalf("unexpected fields: %v", fields)
+	}
+	if fields["!BADKEY"] != "odd" {
+		t.Fatalf("expected %q, got: %v", "odd", fields["!BADKEY"])
+	}
+}
+
+func TestTraceWire(t *testing.T) {
+	c := NewClient()
+	l := &recordingLogger{}
+	c.Logger = l
+
+	c.decode(wifiInfoMsg())
+	if len(l.lines) != 0 {
+		t.Fatalf("expected nothing logged, got: %v", l.lines)
+	}
+
+	c.TraceWire = true
+	c.decode(wifiInfoMsg())
+	if len(l.lines) != 1 {
+		t.Fatalf("expected %d, got: %d", 1, len(l.lines))
+	}
+	line := l.lines[0]
+	if !strings.HasPrefix(line, "trace received packet") || !strings.Contains(line, "WifiInfo") || !strings.Contains(line, "Signal:") {
+		t.Fatalf("expected a decoded wifi info packet, got: %s", line)
+	}
+}
+
+func TestGatewaySocketError(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := NewClient()
+	c.Logger = NopLogger
+	errs := make(chan error, 1)
+	c.OnError = func(err error) { errs <- err }
+
+	gw := newGateway(c, [6]byte{}, listener.LocalAddr().String(), PeerPort, [6]byte{})
+	c.gateways = append(c.gateways, gw)
+
+	// a failing socket is reported rather than exiting, and the gateway is
+	// dropped to be found again by discovery
+	gw.Socket.Close()
+	event := <-c.commandCh
+	c.processCommandEvent(event)
+
+	err = <-errs
+	if !strings.Contains(err.Error(), listener.LocalAddr().String()) {
+		t.Fatalf("expected the gateway in the error, got: %s", err)
+	}
+	if len(c.gateways) != 0 {
+		t.Fatalf("expected %d, got: %d", 0, len(c.gateways))
+	}
+
+	c.OnError = nil
+	l := &recordingLogger{}
+	c.Logger = l
+	c.error(errors.New("broken"))
+	if len(l.lines) != 1 || !strings.HasPrefix(l.lines[0], "error ") {
+		t.Fatalf("expected the error to be logged, got: %v", l.lines)
+	}
+}
@@ -0,0 +1,110 @@
+package lifx
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics is told about protocol traffic as it happens, set Client.Metrics
+// before starting discovery to collect it
+type Metrics interface {
+	// PacketSent is called for every packet written to a gateway
+	PacketSent(packetType uint16)
+
+	// PacketReceived is called for every packet read which has a valid
+	// header, whether or not we handle it
+	PacketReceived(packetType uint16)
+
+	// DecodeError is called for packets which couldn't be decoded
+	DecodeError()
+
+	// ResponseLatency is called when a bulb answers a request, with the
+	// request's packet type and how long the answer took
+	ResponseLatency(requestType uint16, latency time.Duration)
+
+	// QueueDepth is called with how many commands are waiting to be sent
+	// whenever the scheduler has sent what it can
+	QueueDepth(depth int)
+
+	// QueueDelay is called as a command is sent, with how long it waited
+	QueueDelay(packetType uint16, delay time.Duration)
+
+	// CommandCoalesced is called when a command replaces one of the same
+	// type still waiting to be sent to the same bulb
+	CommandCoalesced(packetType uint16)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) PacketSent(packetType uint16)                              {}
+func (nopMetrics) PacketReceived(packetType uint16)                          {}
+func (nopMetrics) DecodeError()                                              {}
+func (nopMetrics) ResponseLatency(requestType uint16, latency time.Duration) {}
+func (nopMetrics) QueueDepth(depth int)                                      {}
+func (nopMetrics) QueueDelay(packetType uint16, delay time.Duration)         {}
+func (nopMetrics) CommandCoalesced(packetType uint16)                        {}
+
+// responseTypes maps requests to the packet a bulb answers them with
+var responseTypes = map[uint16]uint16{
+	PktGetLightState:   PktLightState,
+	PktSetLightColour:  PktLightState,
+	PktGetPowerState:   PktPowerState,
+	PktSetPowerState:   PktPowerState,
+	PktGetAmbientLight: PktAmbientLightState,
+	PktGetVersion:      PktStateVersion,
+	PktGetWifiInfo:     PktWifiInfo,
+	PktGetHostFirmware: PktHostFirmware,
+	PktGetLocation:     PktLocation,
+	PktGetGroup:        PktGroup,
+}
+
+type pendingKey struct {
+	lifxAddress  [6]byte
+	responseType uint16
+}
+
+type pendingRequest struct {
+	requestType uint16
+	sent        time.Time
+}
+
+// pendingRequests remembers when requests were sent to bulbs so the
+// response latency can be measured
+type pendingRequests struct {
+	mutex    sync.Mutex
+	requests map[pendingKey]pendingRequest
+}
+
+// sent records a request, keeping an earlier unanswered one unless it has
+// been outstanding for longer than expire
+func (p *pendingRequests) sent(lifxAddress [6]byte, requestType uint16, now time.Time, expire time.Duration) {
+	responseType, ok := responseTypes[requestType]
+	if !ok {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.requests == nil {
+		p.requests = make(map[pendingKey]pendingRequest)
+	}
+	key := pendingKey{lifxAddress, responseType}
+	if r, ok := p.requests[key]; ok && now.Sub(r.sent) < expire {
+		return
+	}
+	p.requests[key] = pendingRequest{requestType, now}
+}
+
+// received matches a response to its request
+func (p *pendingRequests) received(lifxAddress [6]byte, responseType uint16) (pendingRequest, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := pendingKey{lifxAddress, responseType}
+	r, ok := p.requests[key]
+	if ok {
+		delete(p.requests, key)
+	}
+	return r, ok
+}
@@ -0,0 +1,99 @@
+package lifx
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	sent      map[uint16]int
+	received  map[uint16]int
+	errors    int
+	latencies map[uint16]time.Duration
+	depth     int
+	delays    map[uint16]time.Duration
+	coalesced map[uint16]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		sent:      make(map[uint16]int),
+		received:  make(map[uint16]int),
+		latencies: make(map[uint16]time.Duration),
+		delays:    make(map[uint16]time.Duration),
+		coalesced: make(map[uint16]int),
+	}
+}
+
+func (m *recordingMetrics) PacketSent(packetType uint16)     { m.sent[packetType]++ }
+func (m *recordingMetrics) PacketReceived(packetType uint16) { m.received[packetType]++ }
+func (m *recordingMetrics) DecodeError()                     { m.errors++ }
+func (m *recordingMetrics) ResponseLatency(requestType uint16, latency time.Duration) {
+	m.latencies[requestType] = latency
+}
+func (m *recordingMetrics) QueueDepth(depth int) { m.depth = depth }
+func (m *recordingMetrics) QueueDelay(packetType uint16, delay time.Duration) {
+	m.delays[packetType] = delay
+}
+func (m *recordingMetrics) CommandCoalesced(packetType uint16) { m.coalesced[packetType]++ }
+
+func TestDecodeMetrics(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.gateways = append(c.gateways, newGateway(c, [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String(), PeerPort, [6]byte{}))
+
+	bulb := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x35, 0xf7}, "Lamp", "Kitchen", "Home", BulbState{})
+	c.sendTo(bulb, newGetWifiInfoCommandFromBulb(bulb.LifxAddress))
+	clock.Advance(30 * time.Millisecond)
+
+	cmd := c.decode(wifiInfoMsg())
+	if cmd == nil {
+		t.Fatal("expected wifi info to decode")
+	}
+	if m.received[PktWifiInfo] != 1 {
+		t.Fatalf("expected %d, got: %d", 1, m.received[PktWifiInfo])
+	}
+	if m.latencies[PktGetWifiInfo] != 30*time.Millisecond {
+		t.Fatalf("expected %s, got: %s", 30*time.Millisecond, m.latencies[PktGetWifiInfo])
+	}
+
+	// the second answer wasn't asked for
+	m.latencies = make(map[uint16]time.Duration)
+	c.decode(wifiInfoMsg())
+	if len(m.latencies) != 0 {
+		t.Fatalf("expected no latency, got: %v", m.latencies)
+	}
+
+	if c.decode(getLightStatusMsg()) != nil || m.received[PktGetLightState] != 1 || m.errors != 0 {
+		t.Fatal("expected an unhandled packet to be counted but not as an error")
+	}
+	if c.decode([]byte{0x24, 0x00}) != nil || m.errors != 1 {
+		t.Fatalf("expected %d, got: %d", 1, m.errors)
+	}
+}
+
+func TestWifiInfoDecode(t *testing.T) {
+	cmd, err := decodeCommand(wifiInfoMsg())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBulb([6]byte{})
+	if _, ok := b.GetRSSI(); ok {
+		t.Fatal("expected no rssi before wifi info")
+	}
+	b.signal = cmd.(*wifiInfoCommand).Payload.Signal
+	rssi, ok := b.GetRSSI()
+	if !ok || rssi != -50 {
+		t.Fatalf("expected %d, got: %d", -50, rssi)
+	}
+}
@@ -3,8 +3,8 @@ package lifx
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
 	"net"
 )
 
@@ -14,6 +14,12 @@ const (
 	PktGetPANgateway uint16 = 0x0002
 	PktPANgateway    uint16 = 0x0003
 
+	PktGetHostFirmware uint16 = 0x000e
+	PktHostFirmware    uint16 = 0x000f
+
+	PktGetWifiInfo uint16 = 0x0010
+	PktWifiInfo    uint16 = 0x0011
+
 	PktGetTime   uint16 = 0x0004
 	PktSetTime   uint16 = 0x0005
 	PktTimeState uint16 = 0x0006
@@ -37,13 +43,67 @@ const (
 	PktSetTagLabels uint16 = 0x001e
 	PktTagLabels    uint16 = 0x001f
 
+	PktGetVersion   uint16 = 32
+	PktStateVersion uint16 = 33
+
 	PktGetLocation uint16 = 48
 	PktLocation    uint16 = 50
 
 	PktGetGroup uint16 = 51
 	PktGroup    uint16 = 53
+
+	PktSetColorZones  uint16 = 501
+	PktGetColorZones  uint16 = 502
+	PktStateZone      uint16 = 503
+	PktStateMultiZone uint16 = 506
 )
 
+var packetNames = map[uint16]string{
+	PktGetPANgateway:     "GetPANgateway",
+	PktPANgateway:        "PANgateway",
+	PktGetHostFirmware:   "GetHostFirmware",
+	PktHostFirmware:      "HostFirmware",
+	PktGetWifiInfo:       "GetWifiInfo",
+	PktWifiInfo:          "WifiInfo",
+	PktGetTime:           "GetTime",
+	PktSetTime:           "SetTime",
+	PktTimeState:         "TimeState",
+	PktGetPowerState:     "GetPowerState",
+	PktSetPowerState:     "SetPowerState",
+	PktPowerState:        "PowerState",
+	PktGetLightState:     "GetLightState",
+	PktSetLightColour:    "SetLightColour",
+	PktLightState:        "LightState",
+	PktGetAmbientLight:   "GetAmbientLight",
+	PktAmbientLightState: "AmbientLightState",
+	PktGetTags:           "GetTags",
+	PktSetTags:           "SetTags",
+	PktTags:              "Tags",
+	PktGetTagLabels:      "GetTagLabels",
+	PktSetTagLabels:      "SetTagLabels",
+	PktTagLabels:         "TagLabels",
+	PktGetVersion:        "GetVersion",
+	PktStateVersion:      "StateVersion",
+	PktGetLocation:       "GetLocation",
+	PktLocation:          "Location",
+	PktGetGroup:          "GetGroup",
+	PktGroup:             "Group",
+	PktSetColorZones:     "SetColorZones",
+	PktGetColorZones:     "GetColorZones",
+	PktStateZone:         "StateZone",
+	PktStateMultiZone:    "StateMultiZone",
+}
+
+// PacketName returns a readable name for a packet type, or its number in
+// hex if we don't know it
+func PacketName(packetType uint16) string {
+	name, ok := packetNames[packetType]
+	if !ok {
+		return fmt.Sprintf("0x%x", packetType)
+	}
+	return name
+}
+
 type packetHeader struct {
 	Size             uint16
 	Protocol         uint16
@@ -87,11 +147,9 @@ func (p *packetHeader) Encode(wr io.Writer) (int, error) {
 	err := binary.Write(buf, binary.LittleEndian, p)
 
 	if err != nil {
-		log.Fatalf("Woops %s", err)
+		return 0, err
 	}
 
-	//log.Printf("encode % x", buf.Bytes())
-
 	return wr.Write(buf.Bytes())
 }
 
@@ -101,11 +159,9 @@ func (p *packetHeader) EncodeToUDP(wr *net.UDPConn, addr *net.UDPAddr) (int, err
 	err := binary.Write(buf, binary.LittleEndian, p)
 
 	if err != nil {
-		log.Fatalf("Woops %s", err)
+		return 0, err
 	}
 
-	//log.Printf("encode % x", buf.Bytes())
-
 	return wr.WriteToUDP(buf.Bytes(), addr)
 }
 
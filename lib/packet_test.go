@@ -83,3 +83,21 @@ func powerStateMsg() []byte {
 	buf, _ := hex.DecodeString("2600005400000000d073d50035f70000d073d50035f70000000000000000000016000000ffff")
 	return buf
 }
+
+// state version, LIFX A19
+func stateVersionMsg() []byte {
+	buf, _ := hex.DecodeString("3000005400000000d073d50035f70000d073d50035f70000000000000000000021000000010000001b00000000000000")
+	return buf
+}
+
+// host firmware, 3.70
+func hostFirmwareMsg() []byte {
+	buf, _ := hex.DecodeString("3800005400000000d073d50035f70000d073d50035f7000000000000000000000f0000000000000000000000000000000000000046000300")
+	return buf
+}
+
+// wifi info, -50dBm
+func wifiInfoMsg() []byte {
+	buf, _ := hex.DecodeString("3200005400000000d073d50035f70000d073d50035f70000000000000000000011000000acc5273700000000000000000000")
+	return buf
+}
@@ -0,0 +1,110 @@
+package lifx
+
+import "fmt"
+
+// Capabilities a product may have
+const (
+	CapabilityColor       = "color"
+	CapabilityTemperature = "temperature"
+	CapabilityInfrared    = "infrared"
+	CapabilityMultizone   = "multizone"
+	CapabilityMatrix      = "matrix"
+	CapabilityChain       = "chain"
+	CapabilityHEV         = "hev"
+)
+
+// VendorLIFX is the vendor id reported by LIFX bulbs
+const VendorLIFX = 1
+
+// Product describes a model of bulb, as reported by StateVersion
+type Product struct {
+	Vendor       uint32   `json:"vendor"`
+	ID           uint32   `json:"id"`
+	Name         string   `json:"name"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// HasCapability reports whether the product has capability
+func (p *Product) HasCapability(capability string) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	capsWhite     = []string{}
+	capsVariable  = []string{CapabilityTemperature}
+	capsColor     = []string{CapabilityColor, CapabilityTemperature}
+	capsInfrared  = []string{CapabilityColor, CapabilityTemperature, CapabilityInfrared}
+	capsMultizone = []string{CapabilityColor, CapabilityTemperature, CapabilityMultizone}
+	capsTile      = []string{CapabilityColor, CapabilityTemperature, CapabilityMatrix, CapabilityChain}
+	capsCandle    = []string{CapabilityColor, CapabilityTemperature, CapabilityMatrix}
+	capsClean     = []string{CapabilityColor, CapabilityTemperature, CapabilityHEV}
+)
+
+var products = map[uint32]*Product{
+	1:  {Vendor: VendorLIFX, ID: 1, Name: "LIFX Original 1000", Capabilities: capsColor},
+	3:  {Vendor: VendorLIFX, ID: 3, Name: "LIFX Color 650", Capabilities: capsColor},
+	10: {Vendor: VendorLIFX, ID: 10, Name: "LIFX White 800 (Low Voltage)", Capabilities: capsVariable},
+	11: {Vendor: VendorLIFX, ID: 11, Name: "LIFX White 800 (High Voltage)", Capabilities: capsVariable},
+	18: {Vendor: VendorLIFX, ID: 18, Name: "LIFX White 900 BR30 (Low Voltage)", Capabilities: capsVariable},
+	20: {Vendor: VendorLIFX, ID: 20, Name: "LIFX Color 1000 BR30", Capabilities: capsColor},
+	22: {Vendor: VendorLIFX, ID: 22, Name: "LIFX Color 1000", Capabilities: capsColor},
+	27: {Vendor: VendorLIFX, ID: 27, Name: "LIFX A19", Capabilities: capsColor},
+	28: {Vendor: VendorLIFX, ID: 28, Name: "LIFX BR30", Capabilities: capsColor},
+	29: {Vendor: VendorLIFX, ID: 29, Name: "LIFX A19 Night Vision", Capabilities: capsInfrared},
+	30: {Vendor: VendorLIFX, ID: 30, Name: "LIFX BR30 Night Vision", Capabilities: capsInfrared},
+	31: {Vendor: VendorLIFX, ID: 31, Name: "LIFX Z", Capabilities: capsMultizone},
+	32: {Vendor: VendorLIFX, ID: 32, Name: "LIFX Z", Capabilities: capsMultizone},
+	36: {Vendor: VendorLIFX, ID: 36, Name: "LIFX Downlight", Capabilities: capsColor},
+	37: {Vendor: VendorLIFX, ID: 37, Name: "LIFX Downlight", Capabilities: capsColor},
+	38: {Vendor: VendorLIFX, ID: 38, Name: "LIFX Beam", Capabilities: capsMultizone},
+	43: {Vendor: VendorLIFX, ID: 43, Name: "LIFX A19", Capabilities: capsColor},
+	44: {Vendor: VendorLIFX, ID: 44, Name: "LIFX BR30", Capabilities: capsColor},
+	45: {Vendor: VendorLIFX, ID: 45, Name: "LIFX A19 Night Vision", Capabilities: capsInfrared},
+	46: {Vendor: VendorLIFX, ID: 46, Name: "LIFX BR30 Night Vision", Capabilities: capsInfrared},
+	49: {Vendor: VendorLIFX, ID: 49, Name: "LIFX Mini Color", Capabilities: capsColor},
+	50: {Vendor: VendorLIFX, ID: 50, Name: "LIFX Mini White to Warm", Capabilities: capsVariable},
+	51: {Vendor: VendorLIFX, ID: 51, Name: "LIFX Mini White", Capabilities: capsWhite},
+	52: {Vendor: VendorLIFX, ID: 52, Name: "LIFX GU10", Capabilities: capsColor},
+	55: {Vendor: VendorLIFX, ID: 55, Name: "LIFX Tile", Capabilities: capsTile},
+	57: {Vendor: VendorLIFX, ID: 57, Name: "LIFX Candle", Capabilities: capsCandle},
+	59: {Vendor: VendorLIFX, ID: 59, Name: "LIFX Mini Color", Capabilities: capsColor},
+	60: {Vendor: VendorLIFX, ID: 60, Name: "LIFX Mini White to Warm", Capabilities: capsVariable},
+	61: {Vendor: VendorLIFX, ID: 61, Name: "LIFX Mini White", Capabilities: capsWhite},
+	62: {Vendor: VendorLIFX, ID: 62, Name: "LIFX A19", Capabilities: capsColor},
+	63: {Vendor: VendorLIFX, ID: 63, Name: "LIFX BR30", Capabilities: capsColor},
+	64: {Vendor: VendorLIFX, ID: 64, Name: "LIFX A19 Night Vision", Capabilities: capsInfrared},
+	65: {Vendor: VendorLIFX, ID: 65, Name: "LIFX BR30 Night Vision", Capabilities: capsInfrared},
+	66: {Vendor: VendorLIFX, ID: 66, Name: "LIFX Mini White", Capabilities: capsWhite},
+	68: {Vendor: VendorLIFX, ID: 68, Name: "LIFX Candle", Capabilities: capsCandle},
+	90: {Vendor: VendorLIFX, ID: 90, Name: "LIFX Clean", Capabilities: capsClean},
+	91: {Vendor: VendorLIFX, ID: 91, Name: "LIFX Color", Capabilities: capsColor},
+	92: {Vendor: VendorLIFX, ID: 92, Name: "LIFX Color", Capabilities: capsColor},
+	97: {Vendor: VendorLIFX, ID: 97, Name: "LIFX A19", Capabilities: capsColor},
+	98: {Vendor: VendorLIFX, ID: 98, Name: "LIFX BR30", Capabilities: capsColor},
+	99: {Vendor: VendorLIFX, ID: 99, Name: "LIFX Clean", Capabilities: capsClean},
+}
+
+// LookupProduct returns the product for a StateVersion, or nil when the
+// bulb hasn't reported one yet. Products missing from the table are named
+// by id and assumed to have no capabilities.
+func LookupProduct(vendor uint32, product uint32) *Product {
+	if vendor == 0 && product == 0 {
+		return nil
+	}
+	if vendor == VendorLIFX {
+		if p, ok := products[product]; ok {
+			return p
+		}
+	}
+	return &Product{
+		Vendor:       vendor,
+		ID:           product,
+		Name:         fmt.Sprintf("unknown product %d:%d", vendor, product),
+		Capabilities: []string{},
+	}
+}
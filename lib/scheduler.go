@@ -0,0 +1,294 @@
+package lifx
+
+import (
+	"sync"
+	"time"
+)
+
+// Priority orders commands waiting to be sent, higher first
+type Priority int
+
+const (
+	// PriorityBackground is for polling bulbs for their state
+	PriorityBackground Priority = iota
+	// PriorityNormal is for changes nobody is waiting on, such as
+	// following a curve
+	PriorityNormal
+	// PriorityUser is for changes somebody has just asked for
+	PriorityUser
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityNormal:
+		return "normal"
+	case PriorityUser:
+		return "user"
+	}
+	return "unknown"
+}
+
+const (
+	// DefaultDeviceRate is the most messages a second LIFX recommend
+	// sending one device
+	DefaultDeviceRate = 20
+	// DefaultRate is the most packets a second the client sends in all
+	DefaultRate = 100
+)
+
+// broadcastTarget is the target of commands sent to every bulb
+var broadcastTarget [6]byte
+
+// queuedCommand is a command waiting to be sent to target, or to every
+// bulb when target is broadcastTarget. A group change is sent to every bulb
+// in it whose part hasn't been superseded at once, cmd is only its first
+// bulb's.
+type queuedCommand struct {
+	target   [6]byte
+	cmd      command
+	group    *groupChange
+	priority Priority
+	seq      uint64
+	queued   time.Time
+}
+
+// targets are the bulbs the command is for
+func (q *queuedCommand) targets() [][6]byte {
+	if q.group == nil {
+		return [][6]byte{q.target}
+	}
+	var targets [][6]byte
+	for i, colour := range q.group.colours {
+		if !q.group.superseded[i] {
+			targets = append(targets, colour.Bulb.LifxAddress)
+		}
+	}
+	return targets
+}
+
+// scheduler sends commands no faster than the client's rates allow, most
+// urgent first. A command for a bulb replaces one of the same type still
+// waiting for it, whatever was asked for last is what's wanted, and a colour
+// replaces the bulb's part of any group change still waiting.
+type scheduler struct {
+	client *Client
+
+	mutex      sync.Mutex
+	queue      []*queuedCommand
+	seq        uint64
+	nextSend   time.Time
+	nextDevice map[[6]byte]time.Time
+	wake       chan struct{}
+}
+
+func newScheduler(c *Client) *scheduler {
+	return &scheduler{
+		client:     c,
+		nextDevice: make(map[[6]byte]time.Time),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func interval(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// schedule queues cmd for target and sends whatever the rates allow now,
+// which when nothing else is waiting is cmd itself
+func (s *scheduler) schedule(target [6]byte, cmd command, p Priority) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.client.clock.Now()
+	packetType := cmd.header().PacketType
+	coalesced := false
+	for _, q := range s.queue {
+		if q.group == nil && q.target == target && q.cmd.header().PacketType == packetType {
+			q.cmd = cmd
+			if p > q.priority {
+				q.priority = p
+			}
+			coalesced = true
+			s.client.Metrics.CommandCoalesced(packetType)
+			break
+		}
+	}
+	if !coalesced {
+		s.seq++
+		s.queue = append(s.queue, &queuedCommand{
+			target:   target,
+			cmd:      cmd,
+			priority: p,
+			seq:      s.seq,
+			queued:   now,
+		})
+	}
+	if packetType == PktSetLightColour && target != broadcastTarget {
+		s.supersedeGroups(map[[6]byte]bool{target: true})
+	}
+
+	s.drain(now)
+	s.poke()
+}
+
+// scheduleGroup queues a group change, replacing colour changes still
+// waiting for any of its bulbs, and sends whatever the rates allow now
+func (s *scheduler) scheduleGroup(g *groupChange, p Priority) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.client.clock.Now()
+	targets := make(map[[6]byte]bool)
+	for _, colour := range g.colours {
+		targets[colour.Bulb.LifxAddress] = true
+	}
+	queue := s.queue[:0]
+	for _, q := range s.queue {
+		if q.group == nil && targets[q.target] && q.cmd.header().PacketType == PktSetLightColour {
+			if q.priority > p {
+				p = q.priority
+			}
+			s.client.Metrics.CommandCoalesced(PktSetLightColour)
+			continue
+		}
+		queue = append(queue, q)
+	}
+	s.queue = queue
+	s.supersedeGroups(targets)
+
+	s.seq++
+	s.queue = append(s.queue, &queuedCommand{
+		target:   g.colours[0].Bulb.LifxAddress,
+		cmd:      g.commands[0],
+		group:    g,
+		priority: p,
+		seq:      s.seq,
+		queued:   now,
+	})
+
+	s.drain(now)
+	s.poke()
+}
+
+// supersedeGroups drops the targets' parts of group changes still waiting,
+// newer colours for them having been asked for, it is called with mutex
+// held. The rest of each change still goes, to each bulb as it can no
+// longer be broadcast, and a change left with nothing to send is dropped.
+func (s *scheduler) supersedeGroups(targets map[[6]byte]bool) {
+	queue := s.queue[:0]
+	for _, q := range s.queue {
+		if q.group != nil {
+			for target := range targets {
+				if q.group.supersede(target) {
+					s.client.Metrics.CommandCoalesced(PktSetLightColour)
+				}
+			}
+			if len(q.targets()) == 0 {
+				// nothing is written, but its results are still wanted
+				s.client.transmitGroup(q.group)
+				continue
+			}
+		}
+		queue = append(queue, q)
+	}
+	s.queue = queue
+}
+
+// poke wakes run to send whatever drain left waiting
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// readyAt is when every bulb the command is for can take another
+func (s *scheduler) readyAt(q *queuedCommand) time.Time {
+	var ready time.Time
+	for _, target := range q.targets() {
+		if t := s.nextDevice[target]; t.After(ready) {
+			ready = t
+		}
+	}
+	return ready
+}
+
+// drain sends every command the rates allow at now, it is called with mutex
+// held. It returns how long until the next can be sent, zero when nothing is
+// waiting.
+func (s *scheduler) drain(now time.Time) time.Duration {
+	defer func() { s.client.Metrics.QueueDepth(len(s.queue)) }()
+
+	for len(s.queue) > 0 {
+		if now.Before(s.nextSend) {
+			return s.nextSend.Sub(now)
+		}
+
+		// the most urgent command whose bulbs can take another, oldest
+		// first
+		next := -1
+		var wait time.Duration
+		for i, q := range s.queue {
+			if ready := s.readyAt(q); now.Before(ready) {
+				if w := ready.Sub(now); wait == 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+			if next < 0 || q.priority > s.queue[next].priority ||
+				(q.priority == s.queue[next].priority && q.seq < s.queue[next].seq) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return wait
+		}
+
+		q := s.queue[next]
+		s.queue = append(s.queue[:next], s.queue[next+1:]...)
+
+		var packets int
+		if q.group != nil {
+			packets = s.client.transmitGroup(q.group)
+		} else {
+			packets = s.client.transmit(q)
+		}
+		s.client.Metrics.QueueDelay(q.cmd.header().PacketType, now.Sub(q.queued))
+		s.nextSend = now.Add(time.Duration(packets) * interval(s.client.Rate))
+		for _, target := range q.targets() {
+			s.nextDevice[target] = now.Add(interval(s.client.DeviceRate))
+		}
+	}
+	return 0
+}
+
+// run sends queued commands as the rates allow
+func (s *scheduler) run() {
+	for {
+		s.mutex.Lock()
+		wait := s.drain(s.client.clock.Now())
+		s.mutex.Unlock()
+
+		if wait == 0 {
+			<-s.wake
+			continue
+		}
+		select {
+		case <-s.wake:
+		case <-s.client.clock.After(wait):
+		}
+	}
+}
+
+// depth is how many commands are waiting
+func (s *scheduler) depth() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.queue)
+}
@@ -0,0 +1,128 @@
+package lifx
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sentTo(l *recordingLogger) []string {
+	var sent []string
+	for _, line := range l.lines {
+		if !strings.HasPrefix(line, "debug sending command") {
+			continue
+		}
+		fields := strings.Fields(strings.Trim(strings.TrimPrefix(line, "debug sending command "), "[]"))
+		sent = append(sent, fields[1]+" "+fields[3])
+	}
+	return sent
+}
+
+func TestSchedulerDeviceRate(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	l := &recordingLogger{}
+	c.Logger = l
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.Rate = 0
+	c.gateways = append(c.gateways, newGateway(c, [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String(), PeerPort, [6]byte{}))
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	porch := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Porch", "Outside", "Home", BulbState{})
+
+	// the first goes straight out, the lamp can't take the next for 50ms
+	c.LightColour(lamp, 0, 0, 1000, 2700, 0)
+	c.LightColour(lamp, 0, 0, 2000, 2700, 0)
+	c.LightColour(lamp, 0, 0, 3000, 2700, 0)
+	if m.coalesced[PktSetLightColour] != 1 || m.depth != 1 {
+		t.Fatalf("expected one coalesced and one waiting, got: %d and %d", m.coalesced[PktSetLightColour], m.depth)
+	}
+	if b := c.scheduler.queue[0].cmd.(*setLightColour).Payload.Brightness; b != 3000 {
+		t.Fatalf("expected the latest colour to be waiting, got: %d", b)
+	}
+
+	// another bulb isn't held up
+	c.GetBulbState(porch)
+	if sent := sentTo(l); len(sent) != 2 || sent[1] != "d073d5000002 GetLightState" {
+		t.Fatalf("unexpected sends: %v", sent)
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	if wait := c.scheduler.drain(clock.Now()); wait != 0 || c.scheduler.depth() != 0 {
+		t.Fatalf("expected the queue to drain, %d left", c.scheduler.depth())
+	}
+	if m.delays[PktSetLightColour] != 50*time.Millisecond {
+		t.Fatalf("expected %s, got: %s", 50*time.Millisecond, m.delays[PktSetLightColour])
+	}
+}
+
+func TestSendWithoutGateway(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	m := newRecordingMetrics()
+	c.Metrics = m
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	if err := c.LightColour(lamp, 0, 0, 1000, 2700, 0); err != ErrNoGateway {
+		t.Fatalf("expected %s, got: %v", ErrNoGateway, err)
+	}
+	if err := c.LightsOff(); err != ErrNoGateway {
+		t.Fatalf("expected %s, got: %v", ErrNoGateway, err)
+	}
+	if c.scheduler.depth() != 0 || len(m.sent) != 0 {
+		t.Fatalf("expected nothing queued or sent, got: %d queued %v sent", c.scheduler.depth(), m.sent)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC))
+	c := NewClientWithClock(clock)
+	l := &recordingLogger{}
+	c.Logger = l
+	m := newRecordingMetrics()
+	c.Metrics = m
+	c.Rate = 10
+	c.DeviceRate = 0
+	c.gateways = append(c.gateways, newGateway(c, [6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0xff}, listener.LocalAddr().String(), PeerPort, [6]byte{}))
+
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Lamp", "Kitchen", "Home", BulbState{})
+	porch := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x02}, "Porch", "Outside", "Home", BulbState{})
+
+	c.GetBulbState(lamp)
+	c.GetBulbState(porch)
+	c.LightColour(porch, 0, 0, 1000, 2700, 0)
+	c.SetPower(lamp, PriorityUser, false)
+
+	// one packet every 100ms, most urgent first
+	for i := 0; i < 3; i++ {
+		clock.Advance(100 * time.Millisecond)
+		c.scheduler.drain(clock.Now())
+	}
+	expected := []string{
+		"d073d5000001 GetLightState",
+		"d073d5000001 SetPowerState",
+		"d073d5000002 SetLightColour",
+		"d073d5000002 GetLightState",
+	}
+	sent := sentTo(l)
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got: %v", expected, sent)
+	}
+	if m.sent[PktGetLightState] != 2 || m.sent[PktSetPowerState] != 1 {
+		t.Fatalf("unexpected packets: %v", m.sent)
+	}
+}
@@ -0,0 +1,217 @@
+package lifx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// HSBK is the colour of a bulb or one of its zones
+type HSBK struct {
+	Hue        uint16 `json:"hue"`
+	Saturation uint16 `json:"saturation"`
+	Brightness uint16 `json:"brightness"`
+	Kelvin     uint16 `json:"kelvin"`
+}
+
+// how a SetColorZones applies its colours
+const (
+	zonesNoApply uint8 = 0
+	zonesApply   uint8 = 1
+)
+
+// zonesPerStateMultiZone is how many zones a StateMultiZone carries
+const zonesPerStateMultiZone = 8
+
+// getColorZonesCommand 0x1f6
+type getColorZonesCommand struct {
+	commandPacket
+	Payload struct {
+		StartIndex uint8
+		EndIndex   uint8
+	}
+}
+
+func newGetColorZonesCommandFromBulb(lifxAddress [6]byte) *getColorZonesCommand {
+	ph := newPacketHeader(PktGetColorZones)
+	ph.Protocol = 0x1400
+	ph.Size = HeaderLen + 2
+	ph.TargetMacAddress = lifxAddress
+
+	cmd := &getColorZonesCommand{}
+	cmd.Header = ph
+	cmd.Payload.StartIndex = 0
+	cmd.Payload.EndIndex = 255
+	return cmd
+}
+
+func (c *getColorZonesCommand) encode(wr io.Writer) error {
+	_, err := writeHeaderAndPayload(c.Header, []byte{c.Payload.StartIndex, c.Payload.EndIndex}, wr)
+	return err
+}
+
+// zoneRange is a run of zones set to the same colour
+type zoneRange struct {
+	StartIndex uint8
+	EndIndex   uint8
+	Colour     HSBK
+	Duration   uint32
+	Apply      uint8
+}
+
+// setColorZonesCommand 0x1f5, a bulb's zones are set with one SetColorZones
+// packet for each run of zones with the same colour, only the last applying
+// them so they all change together. They're one command so a newer set of
+// zones replaces the whole of one still waiting to be sent.
+type setColorZonesCommand struct {
+	commandPacket
+	Ranges []zoneRange
+}
+
+func newSetColorZonesCommand(zones []HSBK, timing uint32) *setColorZonesCommand {
+	ph := newPacketHeader(PktSetColorZones)
+	ph.Protocol = 0x1400
+	ph.Size = HeaderLen + 15
+
+	cmd := &setColorZonesCommand{}
+	cmd.Header = ph
+	for i, zone := range zones {
+		if n := len(cmd.Ranges); n > 0 && cmd.Ranges[n-1].Colour == zone {
+			cmd.Ranges[n-1].EndIndex = uint8(i)
+			continue
+		}
+		cmd.Ranges = append(cmd.Ranges, zoneRange{
+			StartIndex: uint8(i),
+			EndIndex:   uint8(i),
+			Colour:     zone,
+			Duration:   timing,
+			Apply:      zonesNoApply,
+		})
+	}
+	if n := len(cmd.Ranges); n > 0 {
+		cmd.Ranges[n-1].Apply = zonesApply
+	}
+	return cmd
+}
+
+func (c *setColorZonesCommand) encode(wr io.Writer) error {
+	for _, r := range c.Ranges {
+		buf := new(bytes.Buffer)
+		err := binary.Write(buf, binary.LittleEndian, &r)
+		if err != nil {
+			return err
+		}
+		_, err = writeHeaderAndPayload(c.Header, buf.Bytes(), wr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateZoneCommand 0x1f7
+type stateZoneCommand struct {
+	commandPacket
+	Payload struct {
+		Count  uint8
+		Index  uint8
+		Colour HSBK
+	}
+}
+
+func decodeStateZoneCommand(ph *packetHeader, payload []byte) (*stateZoneCommand, error) {
+	cmd := &stateZoneCommand{}
+	cmd.Header = ph
+
+	decodePayload(payload, &cmd.Payload)
+
+	return cmd, nil
+}
+
+// stateMultiZoneCommand 0x1fa
+type stateMultiZoneCommand struct {
+	commandPacket
+	Payload struct {
+		Count   uint8
+		Index   uint8
+		Colours [zonesPerStateMultiZone]HSBK
+	}
+}
+
+func decodeStateMultiZoneCommand(ph *packetHeader, payload []byte) (*stateMultiZoneCommand, error) {
+	cmd := &stateMultiZoneCommand{}
+	cmd.Header = ph
+
+	decodePayload(payload, &cmd.Payload)
+
+	return cmd, nil
+}
+
+// GetZones returns the colours of a multizone bulb's zones, nil until it
+// has told us all of them
+func (b *Bulb) GetZones() []HSBK {
+	if len(b.zones) == 0 {
+		return nil
+	}
+	for _, seen := range b.zonesSeen {
+		if !seen {
+			return nil
+		}
+	}
+	return append([]HSBK(nil), b.zones...)
+}
+
+// updateZones records the colours of zones from index onwards, count is how
+// many zones the bulb has
+func (b *Bulb) updateZones(count uint8, index uint8, colours []HSBK) {
+	if len(b.zones) != int(count) {
+		b.zones = make([]HSBK, count)
+		b.zonesSeen = make([]bool, count)
+	}
+	for i, colour := range colours {
+		z := int(index) + i
+		if z >= len(b.zones) {
+			break
+		}
+		b.zones[z] = colour
+		b.zonesSeen[z] = true
+	}
+}
+
+// isMultizone is whether the bulb is a product with zones
+func (b *Bulb) isMultizone() bool {
+	p := b.GetProduct()
+	return p != nil && p.HasCapability(CapabilityMultizone)
+}
+
+// NewMultizoneBulbWithState builds a LIFX Z which isn't attached to the
+// network with its zones set, for simulators and tests
+func NewMultizoneBulbWithState(lifxAddress [6]byte, label string, group string, location string, state BulbState, zones []HSBK) *Bulb {
+	b := NewBulbWithState(lifxAddress, label, group, location, state)
+	b.vendor = VendorLIFX
+	b.product = 32
+	b.updateZones(uint8(len(zones)), 0, zones)
+	return b
+}
+
+// GetColorZones asks a multizone bulb for the colours of its zones
+func (c *Client) GetColorZones(bulb *Bulb) error {
+	cmd := newGetColorZonesCommandFromBulb(bulb.LifxAddress)
+	return c.sendTo(bulb, cmd)
+}
+
+// SetZones changes the colours of a multizone bulb's zones, starting from
+// the first, sent ahead of anything less urgent waiting to be sent
+func (c *Client) SetZones(bulb *Bulb, p Priority, zones []HSBK, timing uint32) error {
+	if len(zones) == 0 {
+		return nil
+	}
+	cmd := newSetColorZonesCommand(zones, timing)
+
+	return c.send(bulb, cmd, p)
+}
+
+func (c *Client) updateZones(lifxAddress [6]byte, count uint8, index uint8, colours []HSBK) {
+	b := c.GetBulb(lifxAddress)
+	b.updateZones(count, index, colours)
+}
@@ -0,0 +1,84 @@
+package lifx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestSetColorZonesCommandWrite(t *testing.T) {
+	red := HSBK{Hue: 0, Saturation: 65535, Brightness: 65535, Kelvin: 3500}
+	blue := HSBK{Hue: 43690, Saturation: 65535, Brightness: 32768, Kelvin: 3500}
+
+	buf := new(bytes.Buffer)
+	c := newSetColorZonesCommand([]HSBK{red, red, red, blue, blue}, 1000)
+	err := c.encode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one packet for each run of colour, the last applying them
+	if n := buf.Len(); n != 2*(HeaderLen+15) {
+		t.Fatalf("expected %d, got: %d", 2*(HeaderLen+15), n)
+	}
+	data := buf.Bytes()
+	for i, expected := range []zoneRange{
+		{StartIndex: 0, EndIndex: 2, Colour: red, Duration: 1000, Apply: zonesNoApply},
+		{StartIndex: 3, EndIndex: 4, Colour: blue, Duration: 1000, Apply: zonesApply},
+	} {
+		packet := data[i*(HeaderLen+15) : (i+1)*(HeaderLen+15)]
+		ph, err := decodePacketHeader(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ph.PacketType != PktSetColorZones || int(ph.Size) != len(packet) {
+			t.Fatalf("unexpected header: %+v", ph)
+		}
+		r := zoneRange{}
+		binary.Read(bytes.NewReader(packet[HeaderLen:]), binary.LittleEndian, &r)
+		if r != expected {
+			t.Fatalf("expected %+v, got: %+v", expected, r)
+		}
+	}
+}
+
+func TestStateMultiZoneDecode(t *testing.T) {
+	lamp := NewBulbWithState([6]byte{0xd0, 0x73, 0xd5, 0x00, 0x00, 0x01}, "Strip", "Kitchen", "Home", BulbState{})
+
+	// a strip of ten zones reports them eight at a time
+	zones := make([]HSBK, 10)
+	for i := range zones {
+		zones[i] = HSBK{Hue: uint16(i * 1000), Saturation: 65535, Brightness: 32768, Kelvin: 3500}
+	}
+	for _, index := range []int{0, 8} {
+		payload := new(bytes.Buffer)
+		payload.Write([]byte{10, uint8(index)})
+		var colours [zonesPerStateMultiZone]HSBK
+		copy(colours[:], zones[index:])
+		binary.Write(payload, binary.LittleEndian, colours)
+
+		ph := newPacketHeader(PktStateMultiZone)
+		ph.Size = uint16(HeaderLen + payload.Len())
+		buf := new(bytes.Buffer)
+		ph.Encode(buf)
+		buf.Write(payload.Bytes())
+
+		cmd, err := decodeCommand(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, ok := cmd.(*stateMultiZoneCommand)
+		if !ok {
+			t.Fatalf("expected a StateMultiZone, got: %T", cmd)
+		}
+		if lamp.GetZones() != nil {
+			t.Fatal("expected no zones until all have been reported")
+		}
+		lamp.updateZones(state.Payload.Count, state.Payload.Index, state.Payload.Colours[:])
+	}
+
+	if got := lamp.GetZones(); !reflect.DeepEqual(got, zones) {
+		t.Fatalf("expected %v, got: %v", zones, got)
+	}
+}